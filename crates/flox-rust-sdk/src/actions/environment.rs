@@ -11,7 +11,8 @@ use thiserror::Error;
 use {fs_extra, nix_editor, tempfile};
 
 use crate::flox::{Flox, FloxNixApi};
-use crate::prelude::flox_package::FloxPackage;
+use crate::models::flox_nix::{self, ValidateFloxNixError};
+use crate::prelude::flox_package::{FloxPackage, PackageRequest};
 use crate::utils::errors::IoError;
 
 static FLOX_NIX: &str = "flox.nix";
@@ -42,6 +43,8 @@ pub enum EnvironmentError {
     Io(#[from] IoError),
     #[error("Failed to write modifications to {} file: {0}", FLOX_NIX)]
     ModifyFloxNix(nix_editor::write::WriteError),
+    #[error(transparent)]
+    InvalidFloxNix(ValidateFloxNixError),
     #[error("Environment directory should be a subdirectory of a flake, e.g. `pkgs/my-pkg`, but it was {dir}")]
     TooShortDirectory { dir: PathBuf },
     #[error("floxEnv directory cannot end in ..")]
@@ -156,7 +159,7 @@ impl<'flox> Environment<'flox> {
 
     pub async fn install<Nix: FloxNixApi>(
         &self,
-        packages: &[FloxPackage],
+        packages: &[PackageRequest],
     ) -> Result<(), EnvironmentInstallError<Nix>>
     where
         Build: Run<Nix>,
@@ -169,15 +172,18 @@ impl<'flox> Environment<'flox> {
              package|
              -> Result<(String, i32), EnvironmentError> {
                 // reference to packages.<package>
-                let query = format!("packages.{}", package);
+                let query = format!("packages.{}", package.package);
 
-                let new_content = nix_editor::write::write(&flox_nix_contents, &query, "{}")
-                    .map_err(EnvironmentError::ModifyFloxNix)?;
+                let new_content =
+                    nix_editor::write::write(&flox_nix_contents, &query, &package.flox_nix_value())
+                        .map_err(EnvironmentError::ModifyFloxNix)?;
                 Ok((new_content, n_installed + 1))
             },
         )?;
 
         if n_new > 0 {
+            flox_nix::validate(&edited).map_err(EnvironmentError::InvalidFloxNix)?;
+
             let built_environment = self.build(&edited).await?;
             self.write_environment(&edited, &built_environment)?;
         }
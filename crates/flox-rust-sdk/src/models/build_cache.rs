@@ -0,0 +1,124 @@
+//! Cache of the results of `flox build`
+//!
+//! Builds are keyed by their inputs, e.g. the flox version, the installable
+//! and the locked `narHash`es of the project and its dependencies.
+//! A cached build is only reused while all of its outputs are still in the store.
+
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::PathBuf;
+
+use serde::{Deserialize, Serialize};
+use thiserror::Error;
+
+use crate::utils::errors::IoError;
+use crate::utils::stable_hash;
+
+pub struct BuildCache {
+    dir: PathBuf,
+}
+
+/// Output paths of a build by output name, e.g. `out` or `dev`
+pub type BuildOutputs = BTreeMap<String, PathBuf>;
+
+#[derive(Serialize, Deserialize)]
+struct CacheEntry {
+    inputs: Vec<String>,
+    /// Outputs of each built installable
+    outputs: Vec<BuildOutputs>,
+}
+
+#[derive(Error, Debug)]
+pub enum BuildCacheError {
+    #[error(transparent)]
+    Io(#[from] IoError),
+    #[error("Failed to serialize build outputs: {0}")]
+    Serialize(serde_json::Error),
+}
+
+impl BuildCache {
+    pub fn new(dir: impl Into<PathBuf>) -> Self {
+        BuildCache { dir: dir.into() }
+    }
+
+    /// File caching the build of `inputs`
+    fn entry_path(&self, inputs: &[String]) -> PathBuf {
+        self.dir.join(format!("{:016x}.json", stable_hash(inputs)))
+    }
+
+    /// Record the `outputs` of a successful build of `inputs`
+    pub fn store(
+        &self,
+        inputs: &[String],
+        outputs: &[BuildOutputs],
+    ) -> Result<(), BuildCacheError> {
+        fs::create_dir_all(&self.dir).map_err(|err| IoError::Write {
+            file: self.dir.clone(),
+            err,
+        })?;
+
+        let entry = CacheEntry {
+            inputs: inputs.to_vec(),
+            outputs: outputs.to_vec(),
+        };
+        let file = self.entry_path(inputs);
+        let contents = serde_json::to_string(&entry).map_err(BuildCacheError::Serialize)?;
+        fs::write(&file, contents).map_err(|err| IoError::Write { file, err })?;
+
+        Ok(())
+    }
+
+    /// Outputs of a previous build of `inputs`
+    ///
+    /// Unreadable entries and builds with outputs that have since been
+    /// garbage collected are treated as missing.
+    pub fn load(&self, inputs: &[String]) -> Option<Vec<BuildOutputs>> {
+        let contents = fs::read_to_string(self.entry_path(inputs)).ok()?;
+        let entry: CacheEntry = serde_json::from_str(&contents).ok()?;
+        // guard against hash collisions
+        if entry.inputs != inputs {
+            return None;
+        }
+
+        let available = entry
+            .outputs
+            .iter()
+            .flat_map(BTreeMap::values)
+            .all(|path| path.exists());
+        if !available {
+            return None;
+        }
+
+        Some(entry.outputs)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn reuse_cached_build() {
+        let dir = tempfile::tempdir().unwrap();
+        let out = dir.path().join("out");
+        fs::write(&out, "").unwrap();
+
+        let cache = BuildCache::new(dir.path().join("builds"));
+        let inputs = vec!["flox 0.1.0".to_string(), "sha256-abc".to_string()];
+        let outputs = vec![BTreeMap::from([("out".to_string(), out.clone())])];
+
+        assert!(cache.load(&inputs).is_none());
+
+        cache.store(&inputs, &outputs).unwrap();
+        assert_eq!(cache.load(&inputs), Some(outputs));
+
+        // changed inputs are not served from the cache
+        assert!(cache
+            .load(&["flox 0.2.0".to_string(), "sha256-abc".to_string()])
+            .is_none());
+
+        // neither are builds whose outputs were removed
+        fs::remove_file(out).unwrap();
+        assert!(cache.load(&inputs).is_none());
+    }
+}
@@ -0,0 +1,125 @@
+//! Files provided by more than one package of an environment
+//!
+//! Nix refuses to build an environment if two packages of the same priority
+//! provide the same file, but only names the store paths of the files.
+//! [FileCollision] names the packages and explains how to resolve the collision.
+
+use std::fmt::Display;
+
+use once_cell::sync::Lazy;
+use regex::Regex;
+
+use super::root::environment::parse_store_path_name;
+
+/// `nix profile` and `buildEnv`, e.g.
+/// error: files '/nix/store/<hash>-a/bin/foo' and '/nix/store/<hash>-b/bin/foo' have the same priority 5; ...
+static SAME_PRIORITY: Lazy<Regex> = Lazy::new(|| {
+    Regex::new(concat!(
+        r"files '(\S+?/[0-9a-z]{32}-[^/']+)/([^']+)' and ",
+        r"'(\S+?/[0-9a-z]{32}-[^/']+)/[^']+' have the same priority (\d+)"
+    ))
+    .unwrap()
+});
+
+/// `buildEnv` of older versions of nixpkgs, e.g.
+/// collision between `/nix/store/<hash>-a/bin/foo' and `/nix/store/<hash>-b/bin/foo'
+static COLLISION_BETWEEN: Lazy<Regex> = Lazy::new(|| {
+    Regex::new(concat!(
+        r"collision between `(\S+?/[0-9a-z]{32}-[^/']+)/([^']+)' and ",
+        r"`(\S+?/[0-9a-z]{32}-[^/']+)/[^']+'"
+    ))
+    .unwrap()
+});
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct FileCollision {
+    /// Path of the file within the packages, e.g. `bin/foo`
+    pub file: String,
+    /// Store paths of the colliding packages
+    pub store_paths: [String; 2],
+    /// Priority shared by both packages, if reported
+    pub priority: Option<i64>,
+}
+
+impl FileCollision {
+    /// The collisions reported in the output of a failed build
+    pub fn parse_nix_errors(stderr: &str) -> Vec<FileCollision> {
+        let mut collisions = Vec::new();
+        for captures in SAME_PRIORITY
+            .captures_iter(stderr)
+            .chain(COLLISION_BETWEEN.captures_iter(stderr))
+        {
+            let collision = FileCollision {
+                file: captures[2].to_string(),
+                store_paths: [captures[1].to_string(), captures[3].to_string()],
+                priority: captures
+                    .get(4)
+                    .and_then(|priority| priority.as_str().parse().ok()),
+            };
+            if !collisions.contains(&collision) {
+                collisions.push(collision);
+            }
+        }
+        collisions
+    }
+
+    /// Names of the colliding packages, derived from their store paths
+    pub fn package_names(&self) -> [&str; 2] {
+        fn name(store_path: &str) -> &str {
+            parse_store_path_name(store_path).map_or(store_path, |(name, _)| name)
+        }
+        [name(&self.store_paths[0]), name(&self.store_paths[1])]
+    }
+}
+
+impl Display for FileCollision {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let [first, second] = self.package_names();
+        write!(
+            f,
+            "Packages '{first}' and '{second}' both provide '{}'",
+            self.file
+        )?;
+        match self.priority {
+            Some(priority) => writeln!(f, " with priority {priority}:")?,
+            None => writeln!(f, ":")?,
+        }
+        for store_path in &self.store_paths {
+            writeln!(f, "  {store_path}/{}", self.file)?;
+        }
+
+        write!(
+            f,
+            "Remove '{first}' or '{second}' from the environment to resolve the collision."
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parse_collisions() {
+        let stderr = "\
+error: builder for '/nix/store/00000000000000000000000000000000-profile.drv' failed with exit code 1;
+       last 1 log lines:
+       > error: files '/nix/store/11111111111111111111111111111111-vim-9.0/share/man/man1/vim.1' and '/nix/store/22222222222222222222222222222222-neovim-0.8.3/share/man/man1/vim.1' have the same priority 5; use 'nix-env --set-flag priority NUMBER INSTALLED_PKGNAME' or type 'nix profile install --help' if using 'nix profile' to find out how to change the priority of one of the conflicting packages (0 being the highest priority)
+       For full logs, run 'nix log /nix/store/00000000000000000000000000000000-profile.drv'.
+collision between `/nix/store/33333333333333333333333333333333-busybox-1.36.0/bin/vi' and `/nix/store/11111111111111111111111111111111-vim-9.0/bin/vi'
+";
+
+        let collisions = FileCollision::parse_nix_errors(stderr);
+        assert_eq!(collisions.len(), 2);
+        assert_eq!(collisions[0].file, "share/man/man1/vim.1");
+        assert_eq!(collisions[0].package_names(), ["vim", "neovim"]);
+        assert_eq!(collisions[0].priority, Some(5));
+        assert_eq!(collisions[1].file, "bin/vi");
+        assert_eq!(collisions[1].package_names(), ["busybox", "vim"]);
+        assert_eq!(collisions[1].priority, None);
+
+        assert!(collisions[0]
+            .to_string()
+            .ends_with("Remove 'vim' or 'neovim' from the environment to resolve the collision."));
+    }
+}
@@ -0,0 +1,203 @@
+//! Configuration of the images built by `flox containerize`
+//!
+//! Defaults are read from the `containerize` attribute of an environment's `flox.nix`
+//! and can be overridden on the command line.
+
+use std::collections::BTreeMap;
+
+use serde::Deserialize;
+use serde_json::{json, Value};
+use thiserror::Error;
+
+use super::flox_nix;
+
+#[derive(Debug, Clone, Default, PartialEq, Eq, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct ContainerConfig {
+    pub entrypoint: Option<Vec<String>>,
+    pub cmd: Option<Vec<String>>,
+    /// Ports as `<port>[/tcp|/udp]`
+    #[serde(default)]
+    pub exposed_ports: Vec<String>,
+    /// Default values of environment variables
+    #[serde(default)]
+    pub environment: BTreeMap<String, String>,
+    pub working_dir: Option<String>,
+    #[serde(default)]
+    pub labels: BTreeMap<String, String>,
+}
+
+#[derive(Error, Debug)]
+pub enum ContainerConfigError {
+    #[error("Failed parsing flox.nix: {0}")]
+    Parse(#[from] rnix::parser::ParseError),
+    #[error("Invalid `containerize` attribute in flox.nix: {0}")]
+    Invalid(serde_json::Error),
+    #[error("Invalid port '{0}', expected <port>[/tcp|/udp]")]
+    Port(String),
+}
+
+impl ContainerConfig {
+    /// The `containerize` attribute of the `flox.nix` with `contents`
+    ///
+    /// Only literal values are read, see [flox_nix::literal_attr].
+    pub fn from_flox_nix(contents: &str) -> Result<Self, ContainerConfigError> {
+        match flox_nix::literal_attr(contents, "containerize")? {
+            Value::Null => Ok(Default::default()),
+            value => serde_json::from_value(value).map_err(ContainerConfigError::Invalid),
+        }
+    }
+
+    /// Whether applying this configuration leaves an image unchanged
+    pub fn is_empty(&self) -> bool {
+        self == &ContainerConfig::default()
+    }
+
+    /// Combine with `overrides` which take precedence over the values of `self`
+    ///
+    /// Ports are added, environment variables and labels of the same name are replaced.
+    pub fn merge(mut self, overrides: ContainerConfig) -> Self {
+        if overrides.entrypoint.is_some() {
+            self.entrypoint = overrides.entrypoint;
+        }
+        if overrides.cmd.is_some() {
+            self.cmd = overrides.cmd;
+        }
+        for port in overrides.exposed_ports {
+            if !self.exposed_ports.contains(&port) {
+                self.exposed_ports.push(port);
+            }
+        }
+        self.environment.extend(overrides.environment);
+        if overrides.working_dir.is_some() {
+            self.working_dir = overrides.working_dir;
+        }
+        self.labels.extend(overrides.labels);
+        self
+    }
+
+    /// Nix expression overriding the `config` of `image`, a `streamLayeredImage` expression
+    ///
+    /// Like `ENTRYPOINT` in a Dockerfile, setting an entrypoint without a command
+    /// drops the command of the image.
+    pub fn override_image(&self, image: &str) -> Result<String, ContainerConfigError> {
+        let overrides = json!({
+            "entrypoint": self.entrypoint,
+            "cmd": self.cmd,
+            "exposedPorts": self
+                .exposed_ports
+                .iter()
+                .map(|port| normalize_port(port))
+                .collect::<Result<Vec<_>, _>>()?,
+            "environment": self.environment,
+            "workingDir": self.working_dir,
+            "labels": self.labels,
+        });
+
+        Ok(format!(
+            "({OVERRIDE_IMAGE}) ({image}) {}",
+            flox_nix::to_nix(&overrides)
+        ))
+    }
+}
+
+/// Nix function applying the overrides of [ContainerConfig::override_image]
+/// to the `config` argument of a `streamLayeredImage` image
+const OVERRIDE_IMAGE: &str = r#"image: overrides:
+  image.override (args:
+    let
+      config = args.config or { };
+      variable = entry: builtins.head (builtins.split "=" entry);
+      env = builtins.filter (entry: !(builtins.hasAttr (variable entry) overrides.environment))
+        (config.Env or [ ])
+        ++ builtins.attrValues
+          (builtins.mapAttrs (name: value: "${name}=${value}") overrides.environment);
+      ports = builtins.listToAttrs
+        (map (port: { name = port; value = { }; }) overrides.exposedPorts);
+      optional = condition: attrs: if condition then attrs else { };
+    in {
+      config = builtins.removeAttrs config
+          (if overrides.entrypoint != null && overrides.cmd == null then [ "Cmd" ] else [ ])
+        // optional (overrides.entrypoint != null) { Entrypoint = overrides.entrypoint; }
+        // optional (overrides.cmd != null) { Cmd = overrides.cmd; }
+        // optional (overrides.environment != { }) { Env = env; }
+        // optional (overrides.exposedPorts != [ ])
+          { ExposedPorts = (config.ExposedPorts or { }) // ports; }
+        // optional (overrides.workingDir != null) { WorkingDir = overrides.workingDir; }
+        // optional (overrides.labels != { })
+          { Labels = (config.Labels or { }) // overrides.labels; };
+    })"#;
+
+/// `<port>[/<protocol>]` as `<port>/<protocol>`, defaulting to tcp
+fn normalize_port(port: &str) -> Result<String, ContainerConfigError> {
+    let (number, protocol) = port.split_once('/').unwrap_or((port, "tcp"));
+    match (number.parse::<u16>(), protocol) {
+        (Ok(number), "tcp" | "udp") if number > 0 => Ok(format!("{number}/{protocol}")),
+        _ => Err(ContainerConfigError::Port(port.to_string())),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn read_flox_nix() {
+        let config = ContainerConfig::from_flox_nix(
+            r#"{
+              packages.nixpkgs-flox.hello = {};
+              containerize.entrypoint = [ "hello" ];
+              containerize = {
+                exposedPorts = [ "8080" ];
+                labels."org.opencontainers.image.title" = "hello";
+              };
+            }"#,
+        )
+        .unwrap();
+
+        assert_eq!(config.entrypoint, Some(vec!["hello".to_string()]));
+        assert_eq!(config.exposed_ports, vec!["8080"]);
+        assert_eq!(
+            config.labels.get("org.opencontainers.image.title"),
+            Some(&"hello".to_string())
+        );
+
+        assert!(ContainerConfig::from_flox_nix("{ }").unwrap().is_empty());
+    }
+
+    #[test]
+    fn override_image() {
+        let defaults = ContainerConfig {
+            entrypoint: Some(vec!["hello".to_string()]),
+            environment: BTreeMap::from([("PORT".to_string(), "8080".to_string())]),
+            ..Default::default()
+        };
+        let overrides = ContainerConfig {
+            exposed_ports: vec!["9090".to_string()],
+            environment: BTreeMap::from([("PORT".to_string(), "9090".to_string())]),
+            ..Default::default()
+        };
+
+        let expression = defaults.merge(overrides).override_image("image").unwrap();
+        assert_eq!(
+            expression,
+            format!(
+                "({OVERRIDE_IMAGE}) (image) {{ cmd = null; entrypoint = [ \"hello\" ]; \
+                 environment = {{ PORT = \"9090\"; }}; exposedPorts = [ \"9090/tcp\" ]; \
+                 labels = {{}}; workingDir = null; }}"
+            )
+        );
+    }
+
+    #[test]
+    fn invalid_port() {
+        let config = ContainerConfig {
+            exposed_ports: vec!["http".to_string()],
+            ..Default::default()
+        };
+        assert!(matches!(
+            config.override_image("image"),
+            Err(ContainerConfigError::Port(_))
+        ));
+    }
+}
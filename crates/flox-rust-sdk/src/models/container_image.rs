@@ -0,0 +1,404 @@
+//! Multi-platform images built by `flox containerize --platform`
+//!
+//! The image of each platform is streamed as docker-archive by `streamLayeredImage`.
+//! The archives are combined into a single OCI image layout,
+//! whose image index references the image of each platform.
+
+use std::collections::HashMap;
+use std::fs::{self, File};
+use std::io::{self, Read, Write};
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+use serde::Deserialize;
+use serde_json::{json, Value};
+use sha2::{Digest, Sha256};
+use thiserror::Error;
+
+const OCI_MANIFEST: &str = "application/vnd.oci.image.manifest.v1+json";
+const OCI_INDEX: &str = "application/vnd.oci.image.index.v1+json";
+const OCI_CONFIG: &str = "application/vnd.oci.image.config.v1+json";
+const OCI_LAYER: &str = "application/vnd.oci.image.layer.v1.tar";
+
+/// Platforms images can be built for, as `<os>/<architecture>` and nix system
+const PLATFORMS: [(&str, &str); 2] = [
+    ("linux/amd64", "x86_64-linux"),
+    ("linux/arm64", "aarch64-linux"),
+];
+
+/// A platform of a container image, e.g. `linux/arm64`
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Platform {
+    pub os: String,
+    pub architecture: String,
+    /// The nix system packages for this platform are built for
+    pub system: String,
+}
+
+#[derive(Error, Debug)]
+pub enum ContainerImageError {
+    #[error("Unsupported platform '{0}', supported platforms are: linux/amd64, linux/arm64")]
+    UnknownPlatform(String),
+    #[error("Could not write the OCI image: {0}")]
+    Io(#[from] io::Error),
+    #[error("Invalid image archive {}: {1}", .0.display())]
+    InvalidArchive(PathBuf, String),
+}
+
+impl FromStr for Platform {
+    type Err = ContainerImageError;
+
+    /// Parse `<os>/<architecture>`, `linux/arm64/v8` is accepted for `linux/arm64`
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let name = s.trim().trim_end_matches("/v8");
+        let (_, system) = PLATFORMS
+            .iter()
+            .find(|(platform, _)| *platform == name)
+            .ok_or_else(|| ContainerImageError::UnknownPlatform(s.trim().to_string()))?;
+        let (os, architecture) = name.split_once('/').expect("platforms contain a '/'");
+
+        Ok(Platform {
+            os: os.to_string(),
+            architecture: architecture.to_string(),
+            system: system.to_string(),
+        })
+    }
+}
+
+impl std::fmt::Display for Platform {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}/{}", self.os, self.architecture)
+    }
+}
+
+/// Parse a comma separated list of platforms, e.g. `linux/amd64,linux/arm64`
+pub fn parse_platforms(platforms: &str) -> Result<Vec<Platform>, ContainerImageError> {
+    let mut parsed: Vec<Platform> = Vec::new();
+    for platform in platforms
+        .split(',')
+        .filter(|platform| !platform.trim().is_empty())
+    {
+        let platform: Platform = platform.parse()?;
+        if !parsed.contains(&platform) {
+            parsed.push(platform);
+        }
+    }
+    Ok(parsed)
+}
+
+/// A content addressed file of an OCI image layout
+#[derive(Debug, Clone)]
+struct Blob {
+    digest: String,
+    size: u64,
+}
+
+impl Blob {
+    fn descriptor(&self, media_type: &str) -> Value {
+        json!({
+            "mediaType": media_type,
+            "digest": self.digest,
+            "size": self.size,
+        })
+    }
+}
+
+/// Writer computing the digest of a blob while it is written
+struct BlobWriter<W> {
+    inner: W,
+    hasher: Sha256,
+    size: u64,
+}
+
+impl<W: Write> Write for BlobWriter<W> {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let written = self.inner.write(buf)?;
+        self.hasher.update(&buf[..written]);
+        self.size += written as u64;
+        Ok(written)
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.inner.flush()
+    }
+}
+
+/// The blobs of an OCI image layout in `<dir>/blobs/sha256`
+struct BlobStore {
+    dir: PathBuf,
+}
+
+impl BlobStore {
+    fn new(layout: &Path) -> io::Result<Self> {
+        let dir = layout.join("blobs").join("sha256");
+        fs::create_dir_all(&dir)?;
+        Ok(BlobStore { dir })
+    }
+
+    /// Copy `reader` into the store
+    fn add(&self, mut reader: impl Read) -> io::Result<Blob> {
+        let partial = self.dir.join("partial");
+        let mut writer = BlobWriter {
+            inner: File::create(&partial)?,
+            hasher: Sha256::new(),
+            size: 0,
+        };
+        io::copy(&mut reader, &mut writer)?;
+        writer.flush()?;
+
+        let hash = format!("{:x}", writer.hasher.finalize());
+        fs::rename(&partial, self.dir.join(&hash))?;
+        Ok(Blob {
+            digest: format!("sha256:{hash}"),
+            size: writer.size,
+        })
+    }
+
+    fn add_json(&self, value: &Value) -> io::Result<Blob> {
+        self.add(value.to_string().as_bytes())
+    }
+}
+
+/// The `manifest.json` of a docker-archive
+#[derive(Deserialize, Debug)]
+#[serde(rename_all = "PascalCase")]
+struct ArchiveManifest {
+    config: String,
+    #[serde(default)]
+    repo_tags: Vec<String>,
+    layers: Vec<String>,
+}
+
+/// Add the image of the docker-archive `archive` to `blobs`
+///
+/// Returns the manifest of the image and its tags.
+fn add_docker_archive(
+    blobs: &BlobStore,
+    archive: &Path,
+) -> Result<(Blob, Vec<String>), ContainerImageError> {
+    let invalid =
+        |message: String| ContainerImageError::InvalidArchive(archive.to_owned(), message);
+
+    let mut files: HashMap<String, Blob> = HashMap::new();
+    let mut manifest = None;
+    for entry in tar::Archive::new(File::open(archive)?).entries()? {
+        let mut entry = entry?;
+        if !entry.header().entry_type().is_file() {
+            continue;
+        }
+        let path = entry
+            .path()?
+            .to_string_lossy()
+            .trim_start_matches("./")
+            .to_string();
+        if path == "manifest.json" {
+            let manifests: Vec<ArchiveManifest> =
+                serde_json::from_reader(entry).map_err(|err| invalid(err.to_string()))?;
+            manifest = manifests.into_iter().next();
+        } else {
+            files.insert(path, blobs.add(&mut entry)?);
+        }
+    }
+
+    let manifest = manifest.ok_or_else(|| invalid("no image in manifest.json".to_string()))?;
+    let blob = |path: &str| {
+        files
+            .get(path)
+            .ok_or_else(|| invalid(format!("missing {path}")))
+    };
+
+    let layers = manifest
+        .layers
+        .iter()
+        .map(|layer| Ok(blob(layer)?.descriptor(OCI_LAYER)))
+        .collect::<Result<Vec<_>, ContainerImageError>>()?;
+    let image_manifest = json!({
+        "schemaVersion": 2,
+        "mediaType": OCI_MANIFEST,
+        "config": blob(&manifest.config)?.descriptor(OCI_CONFIG),
+        "layers": layers,
+    });
+
+    Ok((blobs.add_json(&image_manifest)?, manifest.repo_tags))
+}
+
+/// Combine the docker-archives of `images` into an OCI archive at `output`
+///
+/// The archive's `index.json` references an image index with the image of each platform,
+/// named after the tag of the first image. `work_dir` holds the layout while it is assembled.
+pub fn write_oci_archive(
+    images: &[(Platform, PathBuf)],
+    output: &Path,
+    work_dir: &Path,
+) -> Result<(), ContainerImageError> {
+    let layout = tempfile::tempdir_in(work_dir)?;
+    let blobs = BlobStore::new(layout.path())?;
+
+    let mut manifests = Vec::new();
+    let mut tags = Vec::new();
+    for (platform, archive) in images {
+        let (manifest, mut repo_tags) = add_docker_archive(&blobs, archive)?;
+        let mut descriptor = manifest.descriptor(OCI_MANIFEST);
+        descriptor["platform"] = json!({
+            "os": platform.os,
+            "architecture": platform.architecture,
+        });
+        manifests.push(descriptor);
+        tags.append(&mut repo_tags);
+    }
+
+    let image_index = blobs.add_json(&json!({
+        "schemaVersion": 2,
+        "mediaType": OCI_INDEX,
+        "manifests": manifests,
+    }))?;
+    let mut descriptor = image_index.descriptor(OCI_INDEX);
+    if let Some(tag) = tags.first() {
+        descriptor["annotations"] = json!({ "org.opencontainers.image.ref.name": tag });
+    }
+
+    let index = json!({
+        "schemaVersion": 2,
+        "mediaType": OCI_INDEX,
+        "manifests": [descriptor],
+    });
+    fs::write(layout.path().join("index.json"), index.to_string())?;
+    fs::write(
+        layout.path().join("oci-layout"),
+        json!({ "imageLayoutVersion": "1.0.0" }).to_string(),
+    )?;
+
+    let mut builder = tar::Builder::new(File::create(output)?);
+    builder.append_path_with_name(layout.path().join("oci-layout"), "oci-layout")?;
+    builder.append_path_with_name(layout.path().join("index.json"), "index.json")?;
+    builder.append_dir_all("blobs", layout.path().join("blobs"))?;
+    builder.into_inner()?.flush()?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Write a docker-archive with a single layer `layer` tagged `tag`
+    fn docker_archive(path: &Path, tag: &str, config: &Value, layer: &[u8]) {
+        let mut builder = tar::Builder::new(File::create(path).unwrap());
+        let mut append = |name: &str, contents: &[u8]| {
+            let mut header = tar::Header::new_gnu();
+            header.set_size(contents.len() as u64);
+            header.set_mode(0o644);
+            header.set_cksum();
+            builder.append_data(&mut header, name, contents).unwrap();
+        };
+        let manifest = json!([{
+            "Config": "config.json",
+            "RepoTags": [tag],
+            "Layers": ["layer/layer.tar"],
+        }]);
+        append("config.json", config.to_string().as_bytes());
+        append("layer/layer.tar", layer);
+        append("manifest.json", manifest.to_string().as_bytes());
+        builder.into_inner().unwrap();
+    }
+
+    fn read_blob(layout: &Path, descriptor: &Value) -> Value {
+        let digest = descriptor["digest"].as_str().unwrap();
+        let hash = digest.strip_prefix("sha256:").unwrap();
+        let contents = fs::read(layout.join("blobs").join("sha256").join(hash)).unwrap();
+        assert_eq!(
+            format!("sha256:{:x}", Sha256::digest(&contents)),
+            digest,
+            "blob matches its digest"
+        );
+        assert_eq!(descriptor["size"], contents.len() as u64);
+        serde_json::from_slice(&contents).unwrap()
+    }
+
+    #[test]
+    fn parse_platform_list() {
+        let platforms = parse_platforms("linux/amd64, linux/arm64/v8,linux/amd64").unwrap();
+        assert_eq!(
+            platforms
+                .iter()
+                .map(|platform| (platform.to_string(), platform.system.as_str()))
+                .collect::<Vec<_>>(),
+            vec![
+                ("linux/amd64".to_string(), "x86_64-linux"),
+                ("linux/arm64".to_string(), "aarch64-linux")
+            ]
+        );
+        assert!(matches!(
+            parse_platforms("linux/amd64,windows/amd64"),
+            Err(ContainerImageError::UnknownPlatform(platform)) if platform == "windows/amd64"
+        ));
+    }
+
+    #[test]
+    fn index_images_of_all_platforms() {
+        let dir = tempfile::tempdir().unwrap();
+        let amd64 = dir.path().join("amd64.tar");
+        let arm64 = dir.path().join("arm64.tar");
+        docker_archive(
+            &amd64,
+            "env:latest",
+            &json!({ "architecture": "amd64" }),
+            b"amd64",
+        );
+        docker_archive(
+            &arm64,
+            "env:latest",
+            &json!({ "architecture": "arm64" }),
+            b"arm64",
+        );
+
+        let output = dir.path().join("image.tar");
+        write_oci_archive(
+            &[
+                ("linux/amd64".parse().unwrap(), amd64),
+                ("linux/arm64".parse().unwrap(), arm64),
+            ],
+            &output,
+            dir.path(),
+        )
+        .unwrap();
+
+        let layout = dir.path().join("layout");
+        tar::Archive::new(File::open(&output).unwrap())
+            .unpack(&layout)
+            .unwrap();
+
+        let index: Value =
+            serde_json::from_slice(&fs::read(layout.join("index.json")).unwrap()).unwrap();
+        let images = index["manifests"].as_array().unwrap();
+        assert_eq!(
+            images.len(),
+            1,
+            "index.json references a single image index"
+        );
+        let image = &images[0];
+        assert_eq!(
+            image["annotations"]["org.opencontainers.image.ref.name"],
+            "env:latest"
+        );
+
+        let image_index = read_blob(&layout, image);
+        let manifests = image_index["manifests"].as_array().unwrap();
+        assert_eq!(
+            manifests
+                .iter()
+                .map(|manifest| manifest["platform"]["architecture"].as_str().unwrap())
+                .collect::<Vec<_>>(),
+            vec!["amd64", "arm64"]
+        );
+        for (manifest, architecture) in manifests.iter().zip(["amd64", "arm64"]) {
+            let manifest = read_blob(&layout, manifest);
+            assert_eq!(manifest["mediaType"], OCI_MANIFEST);
+            assert_eq!(
+                read_blob(&layout, &manifest["config"])["architecture"],
+                architecture
+            );
+            let layer = &manifest["layers"][0];
+            assert_eq!(layer["size"], architecture.len() as u64);
+        }
+    }
+}
@@ -0,0 +1,168 @@
+//! Detection of the languages used in a project
+//!
+//! Used by `flox init` to suggest the toolchain packages of a new environment.
+
+use std::path::Path;
+
+use thiserror::Error;
+
+/// Channel suggested packages are installed from
+const SUGGESTION_CHANNEL: &str = "nixpkgs-flox";
+
+/// Packages suggested for a project by a [Detector]
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Suggestion {
+    /// Human readable name of the detected language
+    pub language: &'static str,
+    /// Why the language was detected, e.g. `found package.json`
+    pub reason: String,
+    pub packages: Vec<String>,
+}
+
+/// Inspects a project directory for signs of a language
+pub trait Detector {
+    fn detect(&self, dir: &Path) -> Option<Suggestion>;
+}
+
+/// Detects a language by the presence of any of a set of files
+pub struct FileDetector {
+    pub language: &'static str,
+    pub files: &'static [&'static str],
+    pub packages: &'static [&'static str],
+}
+
+impl Detector for FileDetector {
+    fn detect(&self, dir: &Path) -> Option<Suggestion> {
+        let file = self.files.iter().find(|file| dir.join(file).exists())?;
+
+        Some(Suggestion {
+            language: self.language,
+            reason: format!("found {file}"),
+            packages: self.packages.iter().map(ToString::to_string).collect(),
+        })
+    }
+}
+
+/// The detectors for all languages known to flox
+///
+/// New languages are added by appending a [Detector] here.
+pub fn default_detectors() -> Vec<Box<dyn Detector>> {
+    vec![
+        Box::new(FileDetector {
+            language: "Node.js",
+            files: &["package.json"],
+            packages: &["nodejs"],
+        }),
+        Box::new(FileDetector {
+            language: "Python",
+            files: &["pyproject.toml", "requirements.txt", "setup.py"],
+            packages: &["python3"],
+        }),
+        Box::new(FileDetector {
+            language: "Rust",
+            files: &["Cargo.toml"],
+            packages: &["rustc", "cargo"],
+        }),
+        Box::new(FileDetector {
+            language: "Go",
+            files: &["go.mod"],
+            packages: &["go"],
+        }),
+        Box::new(FileDetector {
+            language: "Ruby",
+            files: &["Gemfile"],
+            packages: &["ruby", "bundler"],
+        }),
+    ]
+}
+
+/// Run all `detectors` against `dir`
+pub fn detect(dir: &Path, detectors: &[Box<dyn Detector>]) -> Vec<Suggestion> {
+    detectors
+        .iter()
+        .filter_map(|detector| detector.detect(dir))
+        .collect()
+}
+
+#[derive(Error, Debug)]
+pub enum SeedFloxNixError {
+    #[error("Failed to add suggested package '{package}': {err}")]
+    Write {
+        package: String,
+        err: nix_editor::write::WriteError,
+    },
+}
+
+/// Add the packages of `suggestions` to the contents of a `flox.nix`
+///
+/// A comment explaining each suggestion is prepended to the file.
+pub fn seed_flox_nix(
+    contents: &str,
+    suggestions: &[Suggestion],
+) -> Result<String, SeedFloxNixError> {
+    let mut seeded = contents.to_string();
+    for package in suggestions
+        .iter()
+        .flat_map(|suggestion| &suggestion.packages)
+    {
+        let query = format!("packages.{SUGGESTION_CHANNEL}.{package}");
+        seeded = nix_editor::write::write(&seeded, &query, "{}").map_err(|err| {
+            SeedFloxNixError::Write {
+                package: package.clone(),
+                err,
+            }
+        })?;
+    }
+
+    let mut comment = String::from("# Packages suggested by `flox init`:\n");
+    for suggestion in suggestions {
+        comment.push_str(&format!(
+            "# - {} for {} ({})\n",
+            suggestion.packages.join(", "),
+            suggestion.language,
+            suggestion.reason
+        ));
+    }
+
+    Ok(comment + &seeded)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn detect_languages() {
+        let dir = tempfile::tempdir().unwrap();
+        std::fs::write(dir.path().join("Cargo.toml"), "").unwrap();
+        std::fs::write(dir.path().join("requirements.txt"), "").unwrap();
+
+        let suggestions = detect(dir.path(), &default_detectors());
+
+        assert_eq!(suggestions.len(), 2);
+        assert_eq!(suggestions[0].language, "Python");
+        assert_eq!(suggestions[0].reason, "found requirements.txt");
+        assert_eq!(suggestions[1].packages, vec!["rustc", "cargo"]);
+    }
+
+    #[test]
+    fn detect_nothing() {
+        let dir = tempfile::tempdir().unwrap();
+        assert!(detect(dir.path(), &default_detectors()).is_empty());
+    }
+
+    #[test]
+    fn seed_packages() {
+        let suggestion = Suggestion {
+            language: "Go",
+            reason: "found go.mod".to_string(),
+            packages: vec!["go".to_string()],
+        };
+
+        let seeded = seed_flox_nix("{\n}\n", &[suggestion]).unwrap();
+
+        assert!(seeded
+            .starts_with("# Packages suggested by `flox init`:\n# - go for Go (found go.mod)\n"));
+        assert!(seeded.contains("packages.nixpkgs-flox.go"));
+    }
+}
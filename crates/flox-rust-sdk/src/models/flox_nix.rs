@@ -0,0 +1,1100 @@
+use std::collections::BTreeMap;
+use std::fmt::Display;
+
+use rnix::ast::{self, AstNode, HasEntry};
+use semver::{Version, VersionReq};
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use thiserror::Error;
+
+use super::flox_package::{ParsePackageRequestError, VersionConstraint};
+
+/// Expected shape of a value in `flox.nix`
+enum Schema {
+    /// Attribute set with arbitrary names, all values of the given schema
+    AnyAttrs(&'static Schema),
+    /// Attribute set with a fixed set of known attributes
+    Attrs(&'static [(&'static str, Schema)]),
+    /// Attribute set with known attributes of the given schemas,
+    /// other attributes are not validated
+    Open(&'static [(&'static str, Schema)]),
+    /// String, including indented strings
+    Str,
+    /// `true` or `false`
+    Bool,
+    /// Attribute that is recognized but not supported, with the reason
+    Unsupported(&'static str),
+    /// List with all elements of the given schema
+    List(&'static Schema),
+    /// Not validated, e.g. arbitrary nix expressions
+    Any,
+}
+
+/// `packages.<channel>.<package> = { version = ...; }`
+///
+/// flox (sh) builds all packages with the default priority,
+/// a `priority` would be ignored silently.
+const PACKAGES: Schema = Schema::AnyAttrs(&Schema::AnyAttrs(&Schema::Open(&[
+    ("version", Schema::Str),
+    (
+        "priority",
+        Schema::Unsupported("packages are built with the default priority"),
+    ),
+])));
+
+const FLOX_NIX: Schema = Schema::Attrs(&[
+    ("packages", PACKAGES),
+    ("inline", Schema::Any),
+    ("environmentVariables", Schema::AnyAttrs(&Schema::Str)),
+    (
+        "shell",
+        Schema::Attrs(&[
+            ("hook", Schema::Str),
+            ("aliases", Schema::AnyAttrs(&Schema::Str)),
+        ]),
+    ),
+    (
+        "profile",
+        Schema::Attrs(&[
+            ("common", Schema::Str),
+            ("bash", Schema::Str),
+            ("zsh", Schema::Str),
+            ("fish", Schema::Str),
+        ]),
+    ),
+    (
+        "secrets",
+        Schema::AnyAttrs(&Schema::Attrs(&[
+            ("command", Schema::Str),
+            ("file", Schema::Str),
+            ("context", Schema::Str),
+        ])),
+    ),
+    (
+        "containerize",
+        Schema::Attrs(&[
+            ("entrypoint", Schema::List(&Schema::Str)),
+            ("cmd", Schema::List(&Schema::Str)),
+            ("exposedPorts", Schema::List(&Schema::Str)),
+            ("environment", Schema::AnyAttrs(&Schema::Str)),
+            ("workingDir", Schema::Str),
+            ("labels", Schema::AnyAttrs(&Schema::Str)),
+        ]),
+    ),
+    (
+        "options",
+        Schema::Attrs(&[
+            ("flox-version", Schema::Str),
+            ("allow", Schema::Attrs(&[("unfree", Schema::Bool)])),
+        ]),
+    ),
+]);
+
+/// A problem found while validating `flox.nix`
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct FloxNixIssue {
+    /// 1-based line number of the offending attribute
+    pub line: usize,
+    pub message: String,
+}
+
+impl Display for FloxNixIssue {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "line {}: {}", self.line, self.message)
+    }
+}
+
+#[derive(Error, Debug)]
+pub enum ValidateFloxNixError {
+    #[error("Failed parsing flox.nix: {0}")]
+    Parse(#[from] rnix::parser::ParseError),
+    #[error("Invalid flox.nix:\n{}", format_issues(.0))]
+    Invalid(Vec<FloxNixIssue>),
+}
+
+fn format_issues(issues: &[FloxNixIssue]) -> String {
+    issues
+        .iter()
+        .map(|issue| format!("  {issue}"))
+        .collect::<Vec<_>>()
+        .join("\n")
+}
+
+/// Validate the contents of a `flox.nix` file against the known attributes
+///
+/// Reports unknown attributes and values of the wrong type with their line numbers.
+/// The file may either be an attribute set, a function returning one
+/// or one defined in `let` bindings.
+pub fn validate(contents: &str) -> Result<(), ValidateFloxNixError> {
+    let root = rnix::Root::parse(contents).ok()?;
+
+    let mut validator = Validator {
+        contents,
+        issues: Vec::new(),
+    };
+    if let Some(expr) = root.expr() {
+        validator.check(&FLOX_NIX, "", toplevel(expr));
+    }
+
+    if validator.issues.is_empty() {
+        Ok(())
+    } else {
+        Err(ValidateFloxNixError::Invalid(validator.issues))
+    }
+}
+
+/// Strip function arguments, `let` bindings and parentheses around the toplevel attribute set
+fn toplevel(expr: ast::Expr) -> ast::Expr {
+    let inner = match expr {
+        ast::Expr::Lambda(ref lambda) => lambda.body(),
+        ast::Expr::LetIn(ref let_in) => let_in.body(),
+        ast::Expr::Paren(ref paren) => paren.expr(),
+        _ => None,
+    };
+    match inner {
+        Some(inner) => toplevel(inner),
+        None => expr,
+    }
+}
+
+struct Validator<'a> {
+    contents: &'a str,
+    issues: Vec<FloxNixIssue>,
+}
+
+impl Validator<'_> {
+    fn report(&mut self, node: &impl AstNode, message: String) {
+        let offset = usize::from(node.syntax().text_range().start());
+        let line = self.contents[..offset].matches('\n').count() + 1;
+        self.issues.push(FloxNixIssue { line, message });
+    }
+
+    /// Check that `expr` found at `path` matches `schema`
+    fn check(&mut self, schema: &Schema, path: &str, expr: ast::Expr) {
+        match (schema, &expr) {
+            (Schema::Any, _) => {},
+            (Schema::Str, ast::Expr::Str(_)) => {},
+            (Schema::Bool, ast::Expr::Ident(ident)) if bool_literal(ident).is_some() => {},
+            (Schema::List(inner), ast::Expr::List(list)) => {
+                for item in list.items() {
+                    self.check(inner, path, item);
+                }
+            },
+            (Schema::AnyAttrs(_) | Schema::Attrs(_) | Schema::Open(_), ast::Expr::AttrSet(set)) => {
+                for entry in set.attrpath_values() {
+                    if let (Some(attrpath), Some(value)) = (entry.attrpath(), entry.value()) {
+                        let names = attrpath.attrs().map(attr_name).collect::<Vec<_>>();
+                        self.check_attrpath(schema, path, &names, value, &entry);
+                    }
+                }
+            },
+            (Schema::Str, _) => self.report(&expr, format!("`{path}` must be a string")),
+            (Schema::Bool, _) => self.report(&expr, format!("`{path}` must be true or false")),
+            (Schema::Unsupported(reason), _) => {
+                self.report(&expr, format!("`{path}` is not supported, {reason}"))
+            },
+            (Schema::List(_), _) => self.report(&expr, format!("`{path}` must be a list")),
+            _ => self.report(&expr, format!("`{path}` must be an attribute set")),
+        }
+    }
+
+    /// Check the value assigned to `names` within the attribute set at `path`
+    fn check_attrpath(
+        &mut self,
+        schema: &Schema,
+        path: &str,
+        names: &[Option<String>],
+        value: ast::Expr,
+        entry: &ast::AttrpathValue,
+    ) {
+        let (name, rest) = match names {
+            [] => return self.check(schema, path, value),
+            // dynamic attributes can not be validated statically
+            [None, ..] => return,
+            [Some(name), rest @ ..] => (name, rest),
+        };
+
+        let attr_path = if path.is_empty() {
+            name.clone()
+        } else {
+            format!("{path}.{name}")
+        };
+
+        match schema {
+            Schema::Any => {},
+            Schema::AnyAttrs(inner) => self.check_attrpath(inner, &attr_path, rest, value, entry),
+            Schema::Attrs(fields) => {
+                match fields.iter().find(|(field, _)| *field == name.as_str()) {
+                    Some((_, inner)) => self.check_attrpath(inner, &attr_path, rest, value, entry),
+                    None => {
+                        let expected = fields
+                            .iter()
+                            .map(|(field, _)| format!("`{field}`"))
+                            .collect::<Vec<_>>()
+                            .join(", ");
+                        self.report(
+                            entry,
+                            format!("unknown attribute `{attr_path}`, expected one of {expected}"),
+                        )
+                    },
+                }
+            },
+            Schema::Open(fields) => {
+                if let Some((_, inner)) = fields.iter().find(|(field, _)| *field == name.as_str()) {
+                    self.check_attrpath(inner, &attr_path, rest, value, entry)
+                }
+            },
+            Schema::Str => self.report(entry, format!("`{path}` must be a string")),
+            Schema::Bool => self.report(entry, format!("`{path}` must be true or false")),
+            Schema::Unsupported(reason) => {
+                self.report(entry, format!("`{path}` is not supported, {reason}"))
+            },
+            Schema::List(_) => self.report(entry, format!("`{path}` must be a list")),
+        }
+    }
+}
+
+/// Snippets sourced into the interactive shell of an activation
+///
+/// Unlike `shell.hook`, which runs in a subshell while the environment is activated,
+/// the profile is sourced by the user's shell itself and can define aliases and functions.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Deserialize)]
+pub struct Profile {
+    /// Sourced by all shells, before the shell specific snippet
+    pub common: Option<String>,
+    pub bash: Option<String>,
+    pub zsh: Option<String>,
+    pub fish: Option<String>,
+}
+
+#[derive(Error, Debug)]
+pub enum ProfileError {
+    #[error("Failed parsing flox.nix: {0}")]
+    Parse(#[from] rnix::parser::ParseError),
+    #[error("Invalid `profile` attribute in flox.nix: {0}")]
+    Invalid(serde_json::Error),
+}
+
+impl Profile {
+    /// The `profile` attribute of the `flox.nix` with `contents`
+    pub fn from_flox_nix(contents: &str) -> Result<Self, ProfileError> {
+        match literal_attr(contents, "profile")? {
+            Value::Null => Ok(Default::default()),
+            value => serde_json::from_value(value).map_err(ProfileError::Invalid),
+        }
+    }
+
+    /// The snippets for `shell`, one of `bash`, `zsh` or `fish`
+    pub fn script(&self, shell: &str) -> String {
+        let specific = match shell {
+            "bash" => &self.bash,
+            "zsh" => &self.zsh,
+            "fish" => &self.fish,
+            _ => &None,
+        };
+
+        [&self.common, specific]
+            .into_iter()
+            .flatten()
+            .map(|snippet| format!("{}\n", snippet.trim_end()))
+            .collect()
+    }
+}
+
+/// A variable exported by `flox activate` whose value is read during the activation
+///
+/// Unlike `environmentVariables` the value is never written to `flox.nix`
+/// or the environment's metadata, which are shared when the environment is pushed.
+#[derive(Debug, Clone, PartialEq, Eq, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Secret {
+    /// Command printing the value to stdout
+    pub command: Option<String>,
+    /// File containing the value, `~/` refers to the home directory
+    pub file: Option<String>,
+    #[serde(default)]
+    pub context: SecretContext,
+}
+
+/// Where the `command` of a [Secret] runs
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum SecretContext {
+    /// With the variables of the calling shell, before the activation changes `PATH`
+    #[default]
+    Caller,
+    /// With the packages of the environment on `PATH`,
+    /// e.g. to use a password manager installed in the environment
+    Environment,
+}
+
+#[derive(Error, Debug)]
+pub enum SecretsError {
+    #[error("Failed parsing flox.nix: {0}")]
+    Parse(#[from] rnix::parser::ParseError),
+    #[error("Invalid `secrets` attribute in flox.nix: {0}")]
+    Invalid(serde_json::Error),
+    #[error("Secret `{0}` must set either `command` or `file`")]
+    Source(String),
+}
+
+/// The `secrets` attribute of the `flox.nix` with `contents`, by variable name
+pub fn secrets(contents: &str) -> Result<BTreeMap<String, Secret>, SecretsError> {
+    let secrets: BTreeMap<String, Secret> = match literal_attr(contents, "secrets")? {
+        Value::Null => Default::default(),
+        value => serde_json::from_value(value).map_err(SecretsError::Invalid)?,
+    };
+
+    for (name, secret) in &secrets {
+        if secret.command.is_some() == secret.file.is_some() {
+            return Err(SecretsError::Source(name.clone()));
+        }
+    }
+    Ok(secrets)
+}
+
+#[derive(Error, Debug)]
+pub enum FloxVersionError {
+    #[error("Failed parsing flox.nix: {0}")]
+    Parse(#[from] rnix::parser::ParseError),
+    #[error("`options.flox-version` must be a version range, e.g. \">=0.2\"")]
+    NotAString,
+    #[error("Invalid version range '{range}' in `options.flox-version`: {err}")]
+    InvalidRange { range: String, err: semver::Error },
+}
+
+/// The versions of flox the `flox.nix` with `contents` requires, `None` if it does not say
+///
+/// `options.flox-version` is a semver range, e.g. `">=0.2"` or `"^0.2.4"`.
+pub fn required_flox_version(contents: &str) -> Result<Option<VersionReq>, FloxVersionError> {
+    let range = match literal_attr(contents, "options")?.get("flox-version") {
+        None | Some(Value::Null) => return Ok(None),
+        Some(Value::String(range)) => range.clone(),
+        Some(_) => return Err(FloxVersionError::NotAString),
+    };
+    VersionReq::parse(&range)
+        .map(Some)
+        .map_err(|err| FloxVersionError::InvalidRange { range, err })
+}
+
+/// Environment variable that allows unfree packages in impure evaluations of nixpkgs
+pub const ALLOW_UNFREE_VAR: &str = "NIXPKGS_ALLOW_UNFREE";
+
+/// Whether the `flox.nix` with `contents` allows unfree packages with `options.allow.unfree`
+///
+/// nixpkgs refuses to evaluate unfree packages unless they are allowed,
+/// flox allows them by setting [ALLOW_UNFREE_VAR] for the evaluation.
+pub fn allows_unfree(contents: &str) -> Result<bool, rnix::parser::ParseError> {
+    let options = literal_attr(contents, "options")?;
+    Ok(options.pointer("/allow/unfree") == Some(&Value::Bool(true)))
+}
+
+/// Whether the flox `version` is in the range `required`, see [flox_version]
+pub fn satisfies_flox_version(required: &VersionReq, version: &str) -> bool {
+    required.matches(&flox_version(version))
+}
+
+/// The release of the flox `version`, e.g. `0.2.4` for `0.2.4-r42`
+///
+/// Only the numeric components of `version` are kept,
+/// so that builds satisfy the ranges of and compare equal to their release.
+pub fn flox_version(version: &str) -> Version {
+    let mut components = version
+        .split(|c: char| !c.is_ascii_digit() && c != '.')
+        .next()
+        .unwrap_or_default()
+        .split('.')
+        .map_while(|component| component.parse::<u64>().ok());
+    Version::new(
+        components.next().unwrap_or(0),
+        components.next().unwrap_or(0),
+        components.next().unwrap_or(0),
+    )
+}
+
+#[derive(Error, Debug)]
+pub enum VersionConstraintsError {
+    #[error("Failed parsing flox.nix: {0}")]
+    Parse(#[from] rnix::parser::ParseError),
+    #[error("Invalid version of package `{package}` in flox.nix: {err}")]
+    Invalid {
+        package: String,
+        err: ParsePackageRequestError,
+    },
+}
+
+/// The `version` of the packages of the `flox.nix` with `contents`,
+/// by package name, e.g. `nodejs` for `packages.nixpkgs-flox.nodejs.version`
+pub fn version_constraints(
+    contents: &str,
+) -> Result<BTreeMap<String, VersionConstraint>, VersionConstraintsError> {
+    let packages = literal_attr(contents, "packages")?;
+
+    let mut constraints = BTreeMap::new();
+    for channel in packages
+        .as_object()
+        .into_iter()
+        .flat_map(|map| map.values())
+    {
+        for (package, attrs) in channel.as_object().into_iter().flatten() {
+            if let Some(version) = attrs.get("version").and_then(Value::as_str) {
+                let constraint =
+                    version
+                        .parse()
+                        .map_err(|err| VersionConstraintsError::Invalid {
+                            package: package.clone(),
+                            err,
+                        })?;
+                constraints.insert(package.clone(), constraint);
+            }
+        }
+    }
+    Ok(constraints)
+}
+
+/// The literal value of the toplevel attribute `name`, `null` if it is not set
+///
+/// Strings without interpolation, booleans, integers and lists and attribute sets of them
+/// are converted to JSON, other expressions can not be read without evaluation
+/// and are skipped.
+pub fn literal_attr(contents: &str, name: &str) -> Result<Value, rnix::parser::ParseError> {
+    let root = rnix::Root::parse(contents).ok()?;
+
+    let mut attrs = Value::Object(Default::default());
+    if let Some(ast::Expr::AttrSet(set)) = root.expr().map(toplevel) {
+        insert_entries(&mut attrs, &set);
+    }
+
+    Ok(attrs.get(name).cloned().unwrap_or(Value::Null))
+}
+
+/// Insert the literal values assigned in `set` into the JSON object `target`
+fn insert_entries(target: &mut Value, set: &ast::AttrSet) {
+    for entry in set.attrpath_values() {
+        let names = entry
+            .attrpath()
+            .and_then(|attrpath| attrpath.attrs().map(attr_name).collect::<Option<Vec<_>>>());
+        let value = entry.value().and_then(literal);
+        if let (Some(names), Some(value)) = (names, value) {
+            insert(target, &names, value);
+        }
+    }
+}
+
+/// Insert `value` at `names` into `target`, merging attribute sets
+/// that are defined in multiple places, e.g. `a.b = "c"; a = { d = "e"; };`
+fn insert(target: &mut Value, names: &[String], value: Value) {
+    let object = match target {
+        Value::Object(object) => object,
+        _ => return,
+    };
+
+    match names {
+        [] => {},
+        [name] => match (object.get_mut(name), value) {
+            (Some(existing @ Value::Object(_)), Value::Object(attrs)) => {
+                for (attr, value) in attrs {
+                    insert(existing, &[attr], value);
+                }
+            },
+            (_, value) => {
+                object.insert(name.clone(), value);
+            },
+        },
+        [name, rest @ ..] => {
+            let child = object
+                .entry(name.clone())
+                .or_insert_with(|| Value::Object(Default::default()));
+            insert(child, rest, value);
+        },
+    }
+}
+
+/// JSON representation of a literal nix expression
+fn literal(expr: ast::Expr) -> Option<Value> {
+    match expr {
+        ast::Expr::Str(s) => match s.normalized_parts().as_slice() {
+            [] => Some(Value::String(String::new())),
+            [ast::InterpolPart::Literal(s)] => Some(Value::String(s.to_string())),
+            _ => None,
+        },
+        ast::Expr::List(list) => list
+            .items()
+            .map(literal)
+            .collect::<Option<Vec<_>>>()
+            .map(Value::Array),
+        ast::Expr::AttrSet(set) => {
+            let mut attrs = Value::Object(Default::default());
+            insert_entries(&mut attrs, &set);
+            Some(attrs)
+        },
+        ast::Expr::Literal(literal) => match literal.kind() {
+            ast::LiteralKind::Integer(integer) => integer.value().ok().map(Value::from),
+            _ => None,
+        },
+        ast::Expr::Paren(paren) => literal(paren.expr()?),
+        ast::Expr::Ident(ident) => bool_literal(&ident).map(Value::Bool),
+        _ => None,
+    }
+}
+
+/// The value of `true` or `false`, `None` for other identifiers
+fn bool_literal(ident: &ast::Ident) -> Option<bool> {
+    match ident.ident_token()?.text() {
+        "true" => Some(true),
+        "false" => Some(false),
+        _ => None,
+    }
+}
+
+/// The static name of an attribute, `None` for interpolated or dynamic attributes
+fn attr_name(attr: ast::Attr) -> Option<String> {
+    match attr {
+        ast::Attr::Ident(ident) => Some(ident.ident_token()?.text().to_string()),
+        ast::Attr::Str(s) => match s.normalized_parts().as_slice() {
+            [ast::InterpolPart::Literal(s)] => Some(s.to_string()),
+            _ => None,
+        },
+        ast::Attr::Dynamic(_) => None,
+    }
+}
+
+/// An attribute that differs between two versions of a `flox.nix`
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct AttrChange {
+    /// Attribute path, e.g. `environmentVariables.LANG`
+    pub attr: String,
+    /// `None` if the attribute was added
+    pub from: Option<Value>,
+    /// `None` if the attribute was removed
+    pub to: Option<Value>,
+}
+
+/// Attributes of `flox.nix` defining hooks, as toplevel attribute and name
+const HOOKS: &[(&str, &str)] = &[
+    ("shell", "hook"),
+    ("profile", "common"),
+    ("profile", "bash"),
+    ("profile", "zsh"),
+    ("profile", "fish"),
+];
+
+/// The changes of `environmentVariables` from the `flox.nix` with contents `from` to `to`
+pub fn variable_changes(from: &str, to: &str) -> Result<Vec<AttrChange>, rnix::parser::ParseError> {
+    fn variables(contents: &str) -> Result<BTreeMap<String, Value>, rnix::parser::ParseError> {
+        Ok(match literal_attr(contents, "environmentVariables")? {
+            Value::Object(variables) => variables
+                .into_iter()
+                .map(|(name, value)| (format!("environmentVariables.{name}"), value))
+                .collect(),
+            _ => Default::default(),
+        })
+    }
+    Ok(attr_changes(variables(from)?, variables(to)?))
+}
+
+/// The changes of the hooks from the `flox.nix` with contents `from` to `to`,
+/// `shell.hook` and the scripts of `profile`
+pub fn hook_changes(from: &str, to: &str) -> Result<Vec<AttrChange>, rnix::parser::ParseError> {
+    fn hooks(contents: &str) -> Result<BTreeMap<String, Value>, rnix::parser::ParseError> {
+        let mut hooks = BTreeMap::new();
+        for (toplevel, name) in HOOKS {
+            if let Some(value) = literal_attr(contents, toplevel)?.get(name) {
+                hooks.insert(format!("{toplevel}.{name}"), value.clone());
+            }
+        }
+        Ok(hooks)
+    }
+    Ok(attr_changes(hooks(from)?, hooks(to)?))
+}
+
+/// The attributes that differ between `from` and `to`, by attribute path
+///
+/// Values that are not literals can not be compared and are treated as unset.
+fn attr_changes(mut from: BTreeMap<String, Value>, to: BTreeMap<String, Value>) -> Vec<AttrChange> {
+    let mut changes = Vec::new();
+    for (attr, to) in to {
+        match from.remove(&attr) {
+            Some(from) if from == to => {},
+            from => changes.push(AttrChange {
+                attr,
+                from,
+                to: Some(to),
+            }),
+        }
+    }
+    changes.extend(from.into_iter().map(|(attr, from)| AttrChange {
+        attr,
+        from: Some(from),
+        to: None,
+    }));
+    changes.sort_by(|a, b| a.attr.cmp(&b.attr));
+    changes
+}
+
+/// An attribute defined with different values by both files of a [merge]
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct MergeConflict {
+    /// Attribute path, e.g. `environmentVariables.LANG`
+    pub attr: String,
+    pub local: Value,
+    pub other: Value,
+}
+
+/// Result of [merge]
+#[derive(Debug)]
+pub struct Merged {
+    pub contents: String,
+    /// Attribute paths added to or replaced in the local file
+    pub changed: Vec<String>,
+    pub conflicts: Vec<MergeConflict>,
+}
+
+#[derive(Error, Debug)]
+pub enum MergeFloxNixError {
+    #[error("Failed parsing flox.nix: {0}")]
+    Parse(#[from] rnix::parser::ParseError),
+    #[error("Failed to write `{attr}` to flox.nix: {err}")]
+    Write {
+        attr: String,
+        err: nix_editor::write::WriteError,
+    },
+}
+
+/// Merge the packages and environment variables of `other` into `contents`
+///
+/// Attributes only defined in `other` are added.
+/// Attributes defined with different values in both files are reported as conflicts
+/// and keep their local value, unless `prefer_other` is set.
+/// Like [literal_attr], only literal values are merged.
+pub fn merge(contents: &str, other: &str, prefer_other: bool) -> Result<Merged, MergeFloxNixError> {
+    let mut merged = Merged {
+        contents: contents.to_string(),
+        changed: Vec::new(),
+        conflicts: Vec::new(),
+    };
+
+    let mut attrs = Vec::new();
+    for (channel, packages) in object_entries(literal_attr(other, "packages")?) {
+        for (package, value) in object_entries(packages) {
+            attrs.push((
+                vec!["packages".to_string(), channel.clone(), package],
+                value,
+            ));
+        }
+    }
+    for (name, value) in object_entries(literal_attr(other, "environmentVariables")?) {
+        attrs.push((vec!["environmentVariables".to_string(), name], value));
+    }
+
+    for (names, value) in attrs {
+        let attr = names.join(".");
+        let local = names[1..]
+            .iter()
+            .try_fold(literal_attr(&merged.contents, &names[0])?, |value, name| {
+                value.get(name).cloned()
+            })
+            .filter(|local| !local.is_null());
+
+        match local {
+            Some(local) if local == value => continue,
+            Some(local) if !prefer_other => {
+                merged.conflicts.push(MergeConflict {
+                    attr,
+                    local,
+                    other: value,
+                });
+                continue;
+            },
+            _ => {},
+        }
+
+        merged.contents = nix_editor::write::write(&merged.contents, &attr, &to_nix(&value))
+            .map_err(|err| MergeFloxNixError::Write {
+                attr: attr.clone(),
+                err,
+            })?;
+        merged.changed.push(attr);
+    }
+
+    Ok(merged)
+}
+
+/// Entries of a JSON object, none for other values
+fn object_entries(value: Value) -> impl Iterator<Item = (String, Value)> {
+    match value {
+        Value::Object(object) => Some(object.into_iter()),
+        _ => None,
+    }
+    .into_iter()
+    .flatten()
+}
+
+/// A JSON value read by [literal_attr] as a nix expression
+pub fn to_nix(value: &Value) -> String {
+    match value {
+        Value::String(s) => format!("{s:?}").replace("${", "\\${"),
+        Value::Array(items) if items.is_empty() => "[ ]".to_string(),
+        Value::Array(items) => format!(
+            "[ {} ]",
+            items.iter().map(to_nix).collect::<Vec<_>>().join(" ")
+        ),
+        Value::Object(attrs) if attrs.is_empty() => "{}".to_string(),
+        Value::Object(attrs) => format!(
+            "{{ {} }}",
+            attrs
+                .iter()
+                .map(|(name, value)| format!("{} = {};", nix_attr_name(name), to_nix(value)))
+                .collect::<Vec<_>>()
+                .join(" ")
+        ),
+        value => value.to_string(),
+    }
+}
+
+/// `name` as an attribute name, quoted unless it is a valid identifier
+fn nix_attr_name(name: &str) -> String {
+    let identifier = name.starts_with(|c: char| c.is_ascii_alphabetic() || c == '_')
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '_' | '-' | '\''));
+    if identifier {
+        name.to_string()
+    } else {
+        to_nix(&Value::String(name.to_string()))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn valid_flox_nix() {
+        validate(
+            r#"{
+              packages.nixpkgs-flox.hello = {};
+              packages.nixpkgs-flox = {
+                nodejs = { version = "^18"; };
+              };
+              environmentVariables.LANG = "en_US.UTF-8";
+              shell.hook = ''
+                echo hello
+              '';
+              containerize.entrypoint = [ "hello" "--greeting" "hi" ];
+              options.flox-version = ">=0.2";
+            }"#,
+        )
+        .unwrap();
+
+        validate(r#"{ ... }: { packages.nixpkgs-flox.hello = {}; }"#).unwrap();
+    }
+
+    #[test]
+    fn let_bindings() {
+        let contents = r#"
+          let
+            version = "1.4.2";
+          in {
+            environmentVariables.APP_VERSION = "${version}";
+            environmentVariables.LANG = "en_US.UTF-8";
+            shell.hook = ''
+              echo "app ${version} in $PWD, literally ''${version}"
+            '';
+          }"#;
+        validate(contents).unwrap();
+
+        assert_eq!(
+            literal_attr(contents, "environmentVariables").unwrap(),
+            serde_json::json!({ "LANG": "en_US.UTF-8" })
+        );
+    }
+
+    #[test]
+    fn profile_for_shell() {
+        let profile = Profile::from_flox_nix(
+            r#"{
+              profile.common = "alias ll='ls -l'";
+              profile.zsh = ''
+                setopt autocd
+              '';
+            }"#,
+        )
+        .unwrap();
+
+        assert_eq!(profile.script("zsh"), "alias ll='ls -l'\nsetopt autocd\n");
+        assert_eq!(profile.script("bash"), "alias ll='ls -l'\n");
+        assert_eq!(Profile::default().script("fish"), "");
+    }
+
+    #[test]
+    fn package_version_constraints() {
+        let constraints = version_constraints(
+            r#"{
+              packages.nixpkgs-flox.nodejs = { version = "^18"; };
+              packages.nixpkgs-flox.hello.version = "2.12.1";
+              packages.nixpkgs-flox.curl = {};
+            }"#,
+        )
+        .unwrap();
+        assert_eq!(constraints.len(), 2);
+        assert!(matches!(
+            constraints.get("nodejs"),
+            Some(VersionConstraint::Range(_))
+        ));
+        assert_eq!(
+            constraints.get("hello"),
+            Some(&VersionConstraint::Exact("2.12.1".to_string()))
+        );
+
+        assert!(matches!(
+            version_constraints(r#"{ packages.nixpkgs-flox.nodejs.version = "^x"; }"#),
+            Err(VersionConstraintsError::Invalid { package, .. }) if package == "nodejs"
+        ));
+    }
+
+    #[test]
+    fn diff_variables_and_hooks() {
+        let from = r#"{
+          environmentVariables.LANG = "en_US.UTF-8";
+          environmentVariables.EDITOR = "vim";
+          shell.hook = "echo hello";
+          profile.bash = ''
+            set -o vi
+          '';
+        }"#;
+        let to = r#"{
+          environmentVariables = { LANG = "C"; PAGER = "less"; };
+          shell.hook = "echo hello";
+          profile.zsh = "bindkey -v";
+        }"#;
+
+        let string = |value: &str| Some(Value::String(value.to_string()));
+        assert_eq!(variable_changes(from, to).unwrap(), vec![
+            AttrChange {
+                attr: "environmentVariables.EDITOR".to_string(),
+                from: string("vim"),
+                to: None,
+            },
+            AttrChange {
+                attr: "environmentVariables.LANG".to_string(),
+                from: string("en_US.UTF-8"),
+                to: string("C"),
+            },
+            AttrChange {
+                attr: "environmentVariables.PAGER".to_string(),
+                from: None,
+                to: string("less"),
+            },
+        ]);
+        assert_eq!(hook_changes(from, to).unwrap(), vec![
+            AttrChange {
+                attr: "profile.bash".to_string(),
+                from: string("set -o vi\n"),
+                to: None,
+            },
+            AttrChange {
+                attr: "profile.zsh".to_string(),
+                from: None,
+                to: string("bindkey -v"),
+            },
+        ]);
+        assert!(variable_changes(from, from).unwrap().is_empty());
+        assert!(hook_changes(to, to).unwrap().is_empty());
+    }
+
+    #[test]
+    fn secrets_by_name() {
+        let secrets = secrets(
+            r#"{
+              secrets.GITHUB_TOKEN = { command = "gh auth token"; };
+              secrets.API_KEY = { file = "~/.config/api-key"; };
+              secrets.DB_PASSWORD = {
+                command = "op read op://vault/db/password";
+                context = "environment";
+              };
+            }"#,
+        )
+        .unwrap();
+
+        assert_eq!(
+            secrets.keys().collect::<Vec<_>>(),
+            vec!["API_KEY", "DB_PASSWORD", "GITHUB_TOKEN"]
+        );
+        assert_eq!(
+            secrets["API_KEY"].file.as_deref(),
+            Some("~/.config/api-key")
+        );
+        assert_eq!(secrets["DB_PASSWORD"].context, SecretContext::Environment);
+        assert_eq!(secrets["GITHUB_TOKEN"].context, SecretContext::Caller);
+
+        assert!(matches!(
+            super::secrets(r#"{ secrets.TOKEN = { command = "a"; file = "b"; }; }"#),
+            Err(SecretsError::Source(name)) if name == "TOKEN"
+        ));
+        assert!(super::secrets("{ }").unwrap().is_empty());
+    }
+
+    #[test]
+    fn merge_packages_and_variables() {
+        let local = r#"{
+  packages.nixpkgs-flox.hello = {};
+  environmentVariables.LANG = "en_US.UTF-8";
+}
+"#;
+        let other = r#"{
+  packages.nixpkgs-flox.hello = {};
+  packages.nixpkgs-flox.nodejs = { version = "^18"; };
+  environmentVariables.LANG = "C";
+  environmentVariables.EDITOR = "vim";
+}
+"#;
+
+        let merged = merge(local, other, false).unwrap();
+        assert_eq!(merged.changed, vec![
+            "packages.nixpkgs-flox.nodejs",
+            "environmentVariables.EDITOR"
+        ]);
+        assert_eq!(merged.conflicts, vec![MergeConflict {
+            attr: "environmentVariables.LANG".to_string(),
+            local: Value::String("en_US.UTF-8".to_string()),
+            other: Value::String("C".to_string()),
+        }]);
+        assert_eq!(
+            literal_attr(&merged.contents, "packages").unwrap(),
+            serde_json::json!({
+                "nixpkgs-flox": { "hello": {}, "nodejs": { "version": "^18" } }
+            })
+        );
+        validate(&merged.contents).unwrap();
+
+        let merged = merge(local, other, true).unwrap();
+        assert!(merged.conflicts.is_empty());
+        assert_eq!(
+            literal_attr(&merged.contents, "environmentVariables").unwrap(),
+            serde_json::json!({ "LANG": "C", "EDITOR": "vim" })
+        );
+    }
+
+    #[test]
+    fn unknown_toplevel_attribute() {
+        let err = validate(
+            r#"{
+              packages.nixpkgs-flox.hello = {};
+              pakages.nixpkgs-flox.curl = {};
+            }"#,
+        )
+        .unwrap_err();
+
+        match err {
+            ValidateFloxNixError::Invalid(issues) => {
+                assert_eq!(issues.len(), 1);
+                assert_eq!(issues[0].line, 3);
+                assert!(issues[0].message.contains("`pakages`"));
+            },
+            _ => panic!("expected invalid flox.nix"),
+        }
+    }
+
+    #[test]
+    fn wrong_value_type() {
+        let err = validate(
+            r#"{
+              environmentVariables = {
+                LANG = {};
+              };
+              shell.hook.foo = "bar";
+            }"#,
+        )
+        .unwrap_err();
+
+        match err {
+            ValidateFloxNixError::Invalid(issues) => {
+                assert_eq!(issues.len(), 2);
+                assert_eq!(issues[0].line, 3);
+                assert_eq!(
+                    issues[0].message,
+                    "`environmentVariables.LANG` must be a string"
+                );
+                assert_eq!(issues[1].line, 5);
+                assert_eq!(issues[1].message, "`shell.hook` must be a string");
+            },
+            _ => panic!("expected invalid flox.nix"),
+        }
+    }
+
+    #[test]
+    fn unsupported_priority() {
+        let err = validate(
+            r#"{
+              packages.nixpkgs-flox.vim = { priority = 4; };
+              packages.nixpkgs-flox.busybox.priority = 6;
+            }"#,
+        )
+        .unwrap_err();
+
+        match err {
+            ValidateFloxNixError::Invalid(issues) => {
+                assert_eq!(issues.len(), 2);
+                assert_eq!(issues[0].line, 2);
+                assert_eq!(
+                    issues[0].message,
+                    "`packages.nixpkgs-flox.vim.priority` is not supported, \
+                     packages are built with the default priority"
+                );
+                assert_eq!(issues[1].line, 3);
+                assert!(issues[1]
+                    .message
+                    .starts_with("`packages.nixpkgs-flox.busybox.priority` is not supported"));
+            },
+            _ => panic!("expected invalid flox.nix"),
+        }
+    }
+
+    #[test]
+    fn allow_unfree() {
+        let allowed = "{ options.allow.unfree = true; packages.nixpkgs-flox.vscode = {}; }";
+        validate(allowed).unwrap();
+        assert!(allows_unfree(allowed).unwrap());
+        assert!(allows_unfree("{ options = { allow = { unfree = (true); }; }; }").unwrap());
+
+        assert!(!allows_unfree("{ options.allow.unfree = false; }").unwrap());
+        assert!(!allows_unfree("{ packages.nixpkgs-flox.hello = {}; }").unwrap());
+
+        match validate(r#"{ options.allow.unfree = "yes"; }"#) {
+            Err(ValidateFloxNixError::Invalid(issues)) => {
+                assert_eq!(issues.len(), 1);
+                assert_eq!(
+                    issues[0].message,
+                    "`options.allow.unfree` must be true or false"
+                );
+            },
+            _ => panic!("expected invalid flox.nix"),
+        }
+    }
+
+    #[test]
+    fn flox_version() {
+        let required = required_flox_version(r#"{ options.flox-version = ">=0.2.4"; }"#)
+            .unwrap()
+            .unwrap();
+        assert!(satisfies_flox_version(&required, "0.2.4"));
+        assert!(satisfies_flox_version(&required, "0.3.0-r42"));
+        assert!(!satisfies_flox_version(&required, "0.2.3-r42"));
+        assert!(!satisfies_flox_version(&required, "0.1"));
+        assert_eq!(flox_version("0.1.1-0.2.6-r42"), Version::new(0, 1, 1));
+        assert!(flox_version("0.2.10") > flox_version("0.2.9-r1"));
+
+        assert!(required_flox_version("{ packages = {}; }")
+            .unwrap()
+            .is_none());
+        assert!(matches!(
+            required_flox_version(r#"{ options.flox-version = "newer"; }"#),
+            Err(FloxVersionError::InvalidRange { .. })
+        ));
+        assert!(matches!(
+            required_flox_version(r#"{ options.flox-version = 2; }"#),
+            Err(FloxVersionError::NotAString)
+        ));
+    }
+}
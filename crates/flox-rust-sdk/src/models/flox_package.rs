@@ -1,3 +1,10 @@
+use std::fmt::Display;
+use std::str::FromStr;
+
+use thiserror::Error;
+
+use super::flox_nix::flox_version;
+
 pub type FloxPackage = String;
 // TODO something like
 // pub struct FloxPackage {
@@ -6,3 +13,585 @@ pub type FloxPackage = String;
 //     name: String,
 //     version: Version,
 // }
+
+/// A package to install, optionally constrained to a version
+///
+/// Parsed from `<package>[@<version>]`, e.g. `nodejs`, `nodejs@20.11.1` or `nodejs@^20`
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct PackageRequest {
+    pub package: FloxPackage,
+    pub version: Option<VersionConstraint>,
+}
+
+/// A package provided by a flake rather than a channel
+///
+/// Parsed from `<flake ref>[#<attr>]`, e.g. `github:me/mytool#default` or `path:./mytool`.
+/// Flake references are recognized by their `<type>:` prefix or a leading `.` or `/`,
+/// store paths are not flake references.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct FlakeInstallable {
+    pub flake_ref: String,
+    /// Attribute of the flake, resolved by nix for the current system, defaults to `default`
+    pub attr: String,
+}
+
+impl FlakeInstallable {
+    pub fn parse(s: &str) -> Option<Self> {
+        let (flake_ref, attr) = match s.split_once('#') {
+            Some((flake_ref, attr)) => (flake_ref, attr),
+            None => (s, "default"),
+        };
+
+        let has_type = flake_ref.split_once(':').map_or(false, |(flake_type, _)| {
+            !flake_type.is_empty()
+                && flake_type
+                    .chars()
+                    .all(|c| c.is_ascii_alphanumeric() || c == '+')
+        });
+        let is_path = flake_ref.starts_with('.')
+            || (flake_ref.starts_with('/') && !flake_ref.starts_with("/nix/store/"));
+        if flake_ref.is_empty() || !(has_type || is_path) {
+            return None;
+        }
+
+        Some(FlakeInstallable {
+            flake_ref: flake_ref.to_string(),
+            attr: if attr.is_empty() { "default" } else { attr }.to_string(),
+        })
+    }
+}
+
+impl FlakeInstallable {
+    /// The installable without the attributes locking its flake, see [Self::locked]
+    pub fn unlocked(&self) -> FlakeInstallable {
+        FlakeInstallable {
+            flake_ref: strip_lock(&self.flake_ref),
+            attr: self.attr.clone(),
+        }
+    }
+
+    /// The installable locked to the revision and content hash of `lock`,
+    /// e.g. `github:me/mytool?rev=<rev>&narHash=<hash>#default`
+    ///
+    /// Path flakes are referred to by the absolute path of the lock,
+    /// upgrades resolve the [unlocked](Self::unlocked) flake again.
+    pub fn locked(&self, lock: &LockedFlake) -> FlakeInstallable {
+        let base = if self.flake_ref.starts_with('.') || self.flake_ref.starts_with('/') {
+            &lock.url
+        } else {
+            &self.flake_ref
+        };
+        let flake_ref = strip_lock(base);
+
+        let mut attributes = Vec::new();
+        if let Some(rev) = &lock.rev {
+            attributes.push(format!("rev={rev}"));
+        }
+        attributes.push(format!("narHash={}", encode_query_value(&lock.nar_hash)));
+        let separator = if flake_ref.contains('?') { '&' } else { '?' };
+
+        FlakeInstallable {
+            flake_ref: format!("{flake_ref}{separator}{}", attributes.join("&")),
+            attr: self.attr.clone(),
+        }
+    }
+
+    /// The content hash the flake is locked to, if any
+    pub fn nar_hash(&self) -> Option<String> {
+        query_attributes(&self.flake_ref)
+            .find(|(name, _)| *name == "narHash")
+            .map(|(_, value)| decode_query_value(value))
+    }
+}
+
+impl Display for FlakeInstallable {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}#{}", self.flake_ref, self.attr)
+    }
+}
+
+/// The lock of a flake, parsed from the output of `nix flake metadata --json`
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct LockedFlake {
+    /// The locked flake reference, e.g. `github:me/mytool/<rev>`
+    pub url: String,
+    /// The locked revision, if the flake is fetched from a version control system
+    pub rev: Option<String>,
+    /// Hash of the contents of the flake, e.g. `sha256-...`
+    pub nar_hash: String,
+}
+
+impl LockedFlake {
+    pub fn from_metadata(metadata: &serde_json::Value) -> Option<Self> {
+        Some(LockedFlake {
+            url: metadata["url"].as_str()?.to_string(),
+            rev: metadata["locked"]["rev"].as_str().map(String::from),
+            nar_hash: metadata["locked"]["narHash"].as_str()?.to_string(),
+        })
+    }
+}
+
+/// Attributes of a flake reference that lock it, see `nix flake metadata`
+const LOCK_ATTRIBUTES: [&str; 4] = ["rev", "narHash", "lastModified", "revCount"];
+
+/// The `name=value` attributes of the query of `flake_ref`
+fn query_attributes(flake_ref: &str) -> impl Iterator<Item = (&str, &str)> {
+    flake_ref
+        .split_once('?')
+        .map_or("", |(_, query)| query)
+        .split('&')
+        .filter(|attribute| !attribute.is_empty())
+        .map(|attribute| attribute.split_once('=').unwrap_or((attribute, "")))
+}
+
+/// `flake_ref` without the [LOCK_ATTRIBUTES] of its query
+fn strip_lock(flake_ref: &str) -> String {
+    let base = flake_ref
+        .split_once('?')
+        .map_or(flake_ref, |(base, _)| base);
+    let attributes = query_attributes(flake_ref)
+        .filter(|(name, _)| !LOCK_ATTRIBUTES.contains(name))
+        .map(|(name, value)| format!("{name}={value}"))
+        .collect::<Vec<_>>();
+
+    if attributes.is_empty() {
+        base.to_string()
+    } else {
+        format!("{base}?{}", attributes.join("&"))
+    }
+}
+
+/// Escape the characters of a base64 hash that are not allowed in a query value
+fn encode_query_value(value: &str) -> String {
+    value
+        .replace('+', "%2B")
+        .replace('/', "%2F")
+        .replace('=', "%3D")
+}
+
+fn decode_query_value(value: &str) -> String {
+    value
+        .replace("%2B", "+")
+        .replace("%2F", "/")
+        .replace("%3D", "=")
+}
+
+/// Version requirement of a [PackageRequest]
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum VersionConstraint {
+    /// Pins the package to exactly this version
+    ///
+    /// Package versions are not necessarily semver,
+    /// thus exact versions are kept verbatim.
+    Exact(String),
+    /// Allows any version matching the semver range,
+    /// so that upgrades stay within the range.
+    Range(semver::VersionReq),
+}
+
+#[derive(Error, Debug)]
+pub enum ParsePackageRequestError {
+    #[error("Package name must not be empty")]
+    EmptyName,
+    #[error("Version of '{0}' must not be empty")]
+    EmptyVersion(String),
+    #[error("Invalid version range '{range}': {err}")]
+    InvalidRange { range: String, err: semver::Error },
+}
+
+impl VersionConstraint {
+    /// Characters that mark a version as semver range rather than an exact version
+    const RANGE_MARKERS: &'static [char] = &['^', '~', '=', '<', '>', '*', ','];
+
+    fn is_range(version: &str) -> bool {
+        version.contains(Self::RANGE_MARKERS)
+            || version.split('.').any(|part| part == "x" || part == "X")
+    }
+
+    /// Whether the constraint allows a single version only,
+    /// an exact version or a range such as `=1.2.3`
+    pub fn is_exact(&self) -> bool {
+        match self {
+            VersionConstraint::Exact(_) => true,
+            VersionConstraint::Range(req) => match req.comparators.as_slice() {
+                [comparator] => {
+                    comparator.op == semver::Op::Exact
+                        && comparator.minor.is_some()
+                        && comparator.patch.is_some()
+                },
+                _ => false,
+            },
+        }
+    }
+
+    /// Whether the package `version` satisfies the constraint
+    ///
+    /// Versions that are not semver are compared by their numeric components,
+    /// e.g. `1.2` as `1.2.0`, see [crate::models::flox_nix::flox_version].
+    pub fn matches(&self, version: &str) -> bool {
+        match self {
+            VersionConstraint::Exact(exact) => exact == version,
+            VersionConstraint::Range(req) => {
+                lenient_version(version).map_or(false, |version| req.matches(&version))
+            },
+        }
+    }
+
+    /// The version of the `available` versions to install, the latest matching a range
+    pub fn resolve<'a>(&self, available: &[&'a str]) -> Option<&'a str> {
+        available
+            .iter()
+            .copied()
+            .filter(|version| self.matches(version))
+            .max_by_key(|version| lenient_version(version))
+    }
+
+    /// Up to `n` of the `available` versions closest to the constraint, in ascending order
+    ///
+    /// Versions are closer if they differ in a less significant component,
+    /// ranges are compared by their first bound, e.g. `20.0.0` for `^20`.
+    pub fn nearest(&self, available: &[&str], n: usize) -> Vec<String> {
+        let target = match self {
+            VersionConstraint::Exact(version) => lenient_version(version),
+            VersionConstraint::Range(req) => req.comparators.first().map(|bound| {
+                semver::Version::new(
+                    bound.major,
+                    bound.minor.unwrap_or(0),
+                    bound.patch.unwrap_or(0),
+                )
+            }),
+        }
+        .unwrap_or_else(|| semver::Version::new(0, 0, 0));
+
+        let mut versions: Vec<(semver::Version, &str)> = available
+            .iter()
+            .filter_map(|version| Some((lenient_version(version)?, *version)))
+            .collect();
+        versions.sort();
+        versions.dedup_by(|(_, a), (_, b)| a == b);
+        versions.sort_by_key(|(version, _)| {
+            (
+                version.major.abs_diff(target.major),
+                version.minor.abs_diff(target.minor),
+                version.patch.abs_diff(target.patch),
+            )
+        });
+        versions.truncate(n);
+        versions.sort();
+        versions
+            .into_iter()
+            .map(|(_, version)| version.to_string())
+            .collect()
+    }
+}
+
+/// The package `version` as semver, `None` if it does not start with a number
+///
+/// Versions that are not semver keep their numeric components, see [flox_version].
+fn lenient_version(version: &str) -> Option<semver::Version> {
+    if !version.starts_with(|c: char| c.is_ascii_digit()) {
+        return None;
+    }
+    Some(semver::Version::parse(version).unwrap_or_else(|_| flox_version(version)))
+}
+
+/// No version of a package available in the catalog satisfies the requested constraint
+#[derive(Error, Debug)]
+#[error(
+    "No version of '{package}' matches '{constraint}', {}",
+    match nearest.as_slice() {
+        [] => "the package is not available in the catalog".to_string(),
+        nearest => format!("nearest available versions: {}", nearest.join(", ")),
+    }
+)]
+pub struct UnavailableVersionError {
+    pub package: FloxPackage,
+    pub constraint: VersionConstraint,
+    pub nearest: Vec<String>,
+}
+
+impl UnavailableVersionError {
+    /// Number of available versions listed by the error
+    pub const NEAREST: usize = 3;
+}
+
+impl FromStr for VersionConstraint {
+    type Err = ParsePackageRequestError;
+
+    fn from_str(version: &str) -> Result<Self, Self::Err> {
+        if Self::is_range(version) {
+            let req = semver::VersionReq::parse(version).map_err(|err| {
+                ParsePackageRequestError::InvalidRange {
+                    range: version.to_string(),
+                    err,
+                }
+            })?;
+            Ok(VersionConstraint::Range(req))
+        } else {
+            Ok(VersionConstraint::Exact(version.to_string()))
+        }
+    }
+}
+
+impl Display for VersionConstraint {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            VersionConstraint::Exact(version) => write!(f, "{version}"),
+            VersionConstraint::Range(req) => write!(f, "{req}"),
+        }
+    }
+}
+
+impl FromStr for PackageRequest {
+    type Err = ParsePackageRequestError;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        // flake references may contain `@`, e.g. `git+ssh://git@github.com/me/mytool`
+        if FlakeInstallable::parse(s).is_some() {
+            return Ok(PackageRequest {
+                package: s.to_string(),
+                version: None,
+            });
+        }
+
+        let (package, version) = match s.rsplit_once('@') {
+            Some((package, version)) => {
+                if version.is_empty() {
+                    return Err(ParsePackageRequestError::EmptyVersion(package.to_string()));
+                }
+                (package, Some(version.parse()?))
+            },
+            None => (s, None),
+        };
+
+        if package.is_empty() {
+            return Err(ParsePackageRequestError::EmptyName);
+        }
+
+        Ok(PackageRequest {
+            package: package.to_string(),
+            version,
+        })
+    }
+}
+
+impl PackageRequest {
+    /// The attribute set describing this package in `flox.nix`
+    pub fn flox_nix_value(&self) -> String {
+        match self.version {
+            Some(ref version) => format!("{{ version = {:?}; }}", version.to_string()),
+            None => "{}".to_string(),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parse_unversioned() {
+        let request: PackageRequest = "nixpkgs-flox.hello".parse().unwrap();
+        assert_eq!(request.package, "nixpkgs-flox.hello");
+        assert_eq!(request.version, None);
+        assert_eq!(request.flox_nix_value(), "{}");
+    }
+
+    #[test]
+    fn parse_exact_version() {
+        let request: PackageRequest = "nodejs@20.11.1".parse().unwrap();
+        assert_eq!(request.package, "nodejs");
+        assert_eq!(
+            request.version,
+            Some(VersionConstraint::Exact("20.11.1".to_string()))
+        );
+        assert_eq!(request.flox_nix_value(), r#"{ version = "20.11.1"; }"#);
+    }
+
+    #[test]
+    fn parse_range() {
+        let request: PackageRequest = "nodejs@^20".parse().unwrap();
+        assert!(matches!(request.version, Some(VersionConstraint::Range(_))));
+        assert_eq!(request.flox_nix_value(), r#"{ version = "^20"; }"#);
+
+        "nodejs@^x.1"
+            .parse::<PackageRequest>()
+            .expect_err("Should not parse invalid range");
+    }
+
+    #[test]
+    fn parse_flake_installable() {
+        assert_eq!(
+            FlakeInstallable::parse("github:me/mytool#default"),
+            Some(FlakeInstallable {
+                flake_ref: "github:me/mytool".to_string(),
+                attr: "default".to_string(),
+            })
+        );
+        assert_eq!(
+            FlakeInstallable::parse("path:./mytool").map(|installable| installable.to_string()),
+            Some("path:./mytool#default".to_string())
+        );
+        assert_eq!(
+            FlakeInstallable::parse("./mytool#packages.x86_64-linux.tool")
+                .map(|installable| installable.attr),
+            Some("packages.x86_64-linux.tool".to_string())
+        );
+        assert_eq!(FlakeInstallable::parse("nixpkgs-flox.hello"), None);
+        assert_eq!(FlakeInstallable::parse("hello@2.12"), None);
+        assert_eq!(FlakeInstallable::parse("/nix/store/aaaa-hello-2.12"), None);
+
+        let request: PackageRequest = "git+ssh://git@github.com/me/mytool".parse().unwrap();
+        assert_eq!(request.package, "git+ssh://git@github.com/me/mytool");
+        assert_eq!(request.version, None);
+    }
+
+    #[test]
+    fn lock_flake_installable() {
+        let lock = LockedFlake::from_metadata(&serde_json::json!({
+            "url": "github:me/mytool/0123abcd",
+            "locked": {
+                "type": "github",
+                "owner": "me",
+                "repo": "mytool",
+                "rev": "0123abcd",
+                "narHash": "sha256-ab+c/d=",
+            },
+        }))
+        .unwrap();
+        assert_eq!(lock.rev.as_deref(), Some("0123abcd"));
+        assert_eq!(lock.nar_hash, "sha256-ab+c/d=");
+
+        let installable = FlakeInstallable::parse("github:me/mytool?dir=tool#default").unwrap();
+        let locked = installable.locked(&lock);
+        assert_eq!(
+            locked.to_string(),
+            "github:me/mytool?dir=tool&rev=0123abcd&narHash=sha256-ab%2Bc%2Fd%3D#default"
+        );
+        assert_eq!(locked.nar_hash().as_deref(), Some("sha256-ab+c/d="));
+        assert_eq!(locked.unlocked(), installable);
+        assert_eq!(installable.nar_hash(), None);
+
+        // locking again replaces the previous lock
+        assert_eq!(locked.locked(&lock), locked);
+    }
+
+    #[test]
+    fn lock_path_flake_installable() {
+        let lock = LockedFlake::from_metadata(&serde_json::json!({
+            "url": "path:/home/me/mytool?lastModified=1680000000&narHash=sha256-abc",
+            "locked": {
+                "type": "path",
+                "path": "/home/me/mytool",
+                "lastModified": 1680000000,
+                "narHash": "sha256-abc",
+            },
+        }))
+        .unwrap();
+        assert_eq!(lock.rev, None);
+
+        let locked = FlakeInstallable::parse("./mytool").unwrap().locked(&lock);
+        assert_eq!(
+            locked.to_string(),
+            "path:/home/me/mytool?narHash=sha256-abc#default"
+        );
+        assert_eq!(
+            locked.unlocked().to_string(),
+            "path:/home/me/mytool#default"
+        );
+
+        assert_eq!(LockedFlake::from_metadata(&serde_json::json!({})), None);
+    }
+
+    #[test]
+    fn match_constraint() {
+        let constraint = |version: &str| version.parse::<VersionConstraint>().unwrap();
+
+        assert!(constraint("20.11.1").is_exact());
+        assert!(constraint("=20.11.1").is_exact());
+        assert!(!constraint("=20.11").is_exact());
+        assert!(!constraint("^1.2").is_exact());
+        assert!(!constraint(">=1.2, <2").is_exact());
+
+        assert!(constraint("2.12.1").matches("2.12.1"));
+        assert!(!constraint("2.12.1").matches("2.12.2"));
+
+        assert!(constraint("^1.2").matches("1.2.0"));
+        assert!(constraint("^1.2").matches("1.9"));
+        assert!(!constraint("^1.2").matches("1.1.9"));
+        assert!(!constraint("^1.2").matches("2.0.0"));
+        assert!(!constraint("^1.2").matches("1.3.0-rc1"));
+        assert!(constraint(">=1.2").matches("3.0.1"));
+        assert!(!constraint(">=1.2").matches("1.1"));
+        assert!(constraint(">=1.2, <2").matches("1.5.2"));
+        assert!(!constraint(">=1.2, <2").matches("2.0"));
+        assert!(!constraint("*").matches("unstable-2023-01-01"));
+    }
+
+    #[test]
+    fn resolve_constraint() {
+        let available = [
+            "16.20.2", "18.19.0", "20.10.0", "20.11.1", "22.0.0", "unstable",
+        ];
+        let constraint = |version: &str| version.parse::<VersionConstraint>().unwrap();
+
+        assert_eq!(constraint("20.11.1").resolve(&available), Some("20.11.1"));
+        assert_eq!(constraint("^20").resolve(&available), Some("20.11.1"));
+        assert_eq!(constraint(">=18, <20").resolve(&available), Some("18.19.0"));
+        assert_eq!(constraint("20.11.2").resolve(&available), None);
+        assert_eq!(constraint("^21").resolve(&available), None);
+    }
+
+    #[test]
+    fn unavailable_version() {
+        let available = [
+            "16.20.2", "18.19.0", "20.10.0", "20.11.1", "22.0.0", "unstable",
+        ];
+        let unavailable = |version: &str| {
+            let constraint = version.parse::<VersionConstraint>().unwrap();
+            UnavailableVersionError {
+                package: "nodejs".to_string(),
+                nearest: constraint.nearest(&available, UnavailableVersionError::NEAREST),
+                constraint,
+            }
+            .to_string()
+        };
+
+        assert_eq!(
+            unavailable("^21"),
+            "No version of 'nodejs' matches '^21', \
+             nearest available versions: 20.10.0, 20.11.1, 22.0.0"
+        );
+        assert_eq!(
+            unavailable("20.11.2"),
+            "No version of 'nodejs' matches '20.11.2', \
+             nearest available versions: 18.19.0, 20.10.0, 20.11.1"
+        );
+        assert_eq!(
+            unavailable("17.1"),
+            "No version of 'nodejs' matches '17.1', \
+             nearest available versions: 16.20.2, 18.19.0, 20.10.0"
+        );
+
+        let constraint = "^1".parse::<VersionConstraint>().unwrap();
+        assert_eq!(
+            UnavailableVersionError {
+                package: "nodejs".to_string(),
+                nearest: constraint.nearest(&[], UnavailableVersionError::NEAREST),
+                constraint,
+            }
+            .to_string(),
+            "No version of 'nodejs' matches '^1', the package is not available in the catalog"
+        );
+    }
+
+    #[test]
+    fn parse_empty() {
+        "@1.0"
+            .parse::<PackageRequest>()
+            .expect_err("Should not parse empty name");
+        "nodejs@"
+            .parse::<PackageRequest>()
+            .expect_err("Should not parse empty version");
+    }
+}
@@ -0,0 +1,71 @@
+//! Environments shared through a git repository rather than FloxHub
+//!
+//! Any git repository reachable over SSH can hold pushed environments,
+//! e.g. on an air-gapped network.
+//! The repository stores each environment like floxmeta does,
+//! as a branch `<system>.<name>` with the metadata and generations of the environment.
+//! The last component of the URL names the environment.
+
+/// Whether `target` is the URL of a git repository rather than the name of an environment
+///
+/// Accepts `ssh://` and `file://` URLs, `git+` prefixed URLs
+/// and the scp-like `[user@]host:path` syntax of git.
+pub fn is_git_url(target: &str) -> bool {
+    let url = target.strip_prefix("git+").unwrap_or(target);
+    if url.starts_with("ssh://") || url.starts_with("file://") {
+        return true;
+    }
+
+    // scp-like syntax, git treats colons after a slash as part of a path
+    match url.split_once(':') {
+        Some((host, path)) => !host.is_empty() && !host.contains('/') && !path.is_empty(),
+        None => false,
+    }
+}
+
+/// The URL to pass to git, without a `git+` prefix
+pub fn git_url(url: &str) -> &str {
+    url.strip_prefix("git+").unwrap_or(url)
+}
+
+/// The name of the environment at `url`, its last path component without `.git`
+pub fn environment_name(url: &str) -> Option<&str> {
+    let path = git_url(url)
+        .rsplit_once(':')
+        .map_or(url, |(_, path)| path)
+        .trim_end_matches('/');
+    let name = path.rsplit('/').next()?;
+    let name = name.strip_suffix(".git").unwrap_or(name);
+
+    if name.is_empty() {
+        return None;
+    }
+    Some(name)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn detect_git_urls() {
+        assert!(is_git_url("ssh://git@host/org/env"));
+        assert!(is_git_url("git+ssh://git@host:2222/org/env.git"));
+        assert!(is_git_url("git@host:org/env"));
+        assert!(is_git_url("file:///srv/environments/env"));
+        assert!(!is_git_url("env"));
+        assert!(!is_git_url("owner/env"));
+        assert!(!is_git_url(".#env"));
+    }
+
+    #[test]
+    fn environment_names() {
+        assert_eq!(environment_name("ssh://git@host/org/env"), Some("env"));
+        assert_eq!(
+            environment_name("git+ssh://git@host:2222/org/env.git/"),
+            Some("env")
+        );
+        assert_eq!(environment_name("git@host:env.git"), Some("env"));
+        assert_eq!(environment_name("file:///"), None);
+    }
+}
@@ -1,9 +1,18 @@
 //# An attempt at defining a domain model for flox
 
+pub mod build_cache;
 pub mod channels;
+pub mod collision;
+pub mod container_config;
+pub mod container_image;
+pub mod detection;
 pub mod environment_ref;
 pub mod flox_installable;
+pub mod flox_nix;
 pub mod flox_package;
+pub mod git_remote;
 pub mod root;
+pub mod sandbox;
+pub mod search;
 pub use runix::{flake_ref, registry};
 pub mod stability;
@@ -1,12 +1,18 @@
 use std::collections::{BTreeMap, HashMap};
-use std::path::PathBuf;
+use std::path::{Path, PathBuf};
 
 use log::debug;
 use serde::{Deserialize, Serialize};
 use thiserror::Error;
 
 use super::floxmeta::Floxmeta;
+use crate::models::flox_nix::{self, AttrChange};
+use crate::models::flox_package::{FlakeInstallable, VersionConstraint};
 use crate::providers::git::{BranchInfo, GitProvider};
+use crate::utils::errors::IoError;
+
+/// Priority of packages installed without one, see `nix profile install --priority`
+const DEFAULT_PRIORITY: i64 = 5;
 
 #[derive(Serialize, Debug)]
 pub struct Environment<'flox, G> {
@@ -78,6 +84,421 @@ pub struct Generation {
     elements: Vec<Element>,
 }
 
+/// A package installed in a [Generation]
+///
+/// Flattened view of an [Element] for machine readable output
+#[derive(Serialize, Debug, Clone, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub struct InstalledPackage {
+    pub install_id: String,
+    pub attr_path: Option<String>,
+    pub version: Option<String>,
+    pub channel: Option<String>,
+    pub url: Option<String>,
+    pub store_paths: Vec<String>,
+    pub priority: Option<i64>,
+    pub active: bool,
+    /// Whether the package is marked broken in its `meta`, `None` if not evaluated
+    pub broken: Option<bool>,
+    /// Whether the package has known vulnerabilities in its `meta`, `None` if not evaluated
+    pub insecure: Option<bool>,
+}
+
+impl Metadata {
+    /// Numbers of all generations of the environment, in ascending order
+    pub fn generation_numbers(&self) -> Vec<u32> {
+        let mut numbers: Vec<u32> = self
+            .generations
+            .keys()
+            .filter_map(|name| name.parse().ok())
+            .collect();
+        numbers.sort_unstable();
+        numbers
+    }
+
+    pub fn generation(&self, generation: &str) -> Option<&GenerationMetadata> {
+        self.generations.get(generation)
+    }
+
+    /// Generations that `flox gc` removes, in ascending order
+    ///
+    /// These are all generations but the `keep` most recent ones
+    /// and those created before `created_before` (seconds since the unix epoch).
+    /// The current generation is never included.
+    pub fn prunable_generations(&self, keep: usize, created_before: Option<u64>) -> Vec<u32> {
+        let numbers = self.generation_numbers();
+        let kept = numbers.len().saturating_sub(keep);
+
+        numbers
+            .iter()
+            .enumerate()
+            .filter(|(_, number)| number.to_string() != self.current_gen)
+            .filter(|(index, number)| {
+                let expired = created_before.map_or(false, |created_before| {
+                    self.generations[&number.to_string()].created < created_before
+                });
+                *index < kept || expired
+            })
+            .map(|(_, number)| *number)
+            .collect()
+    }
+}
+
+impl GenerationMetadata {
+    /// Store path of the profile built for this generation
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    /// Creation time in seconds since the unix epoch
+    pub fn created(&self) -> u64 {
+        self.created
+    }
+
+    /// The message flox recorded when creating this generation
+    pub fn log_message(&self) -> &[String] {
+        &self.log_message
+    }
+
+    /// The command that created this generation, e.g. `install` or `edit`,
+    /// as far as it can be told from its log message
+    pub fn action(&self) -> Option<&'static str> {
+        const ACTIONS: &[(&str, &str)] = &[
+            ("install", "install"),
+            ("remove", "remove"),
+            ("upgrade", "upgrade"),
+            ("edit", "edit"),
+            ("pull", "pull"),
+            ("import", "import"),
+            ("rolled back", "rollback"),
+            ("rollback", "rollback"),
+            ("switch", "switch-generation"),
+            ("creat", "create"),
+        ];
+
+        let message = self.log_message.join(" ").to_lowercase();
+        ACTIONS
+            .iter()
+            .filter_map(|(keyword, action)| message.find(keyword).map(|index| (index, *action)))
+            .min_by_key(|(index, _)| *index)
+            .map(|(_, action)| action)
+    }
+}
+
+/// The name and version of the package at `store_path`
+///
+/// Follows nix' `parseDrvName`:
+/// the version starts at the first dash that is not followed by a letter.
+pub fn parse_store_path_name(store_path: &str) -> Option<(&str, Option<&str>)> {
+    let base_name = store_path.rsplit('/').next()?;
+    // strip `<hash>-`
+    let (_, name) = base_name.split_once('-')?;
+
+    let version_start = name.char_indices().find_map(|(i, c)| {
+        let next = name[i + 1..].chars().next();
+        (c == '-' && !next.map_or(true, char::is_alphabetic)).then_some(i)
+    });
+
+    Some(match version_start {
+        Some(i) => (&name[..i], Some(&name[i + 1..])),
+        None => (name, None),
+    })
+}
+
+impl Element {
+    /// The name and version of the package derived from its first store path
+    fn name_and_version(&self) -> Option<(&str, Option<&str>)> {
+        parse_store_path_name(self.store_paths.first()?)
+    }
+
+    pub fn installed_package(&self) -> InstalledPackage {
+        let (name, version) = match self.name_and_version() {
+            Some((name, version)) => (Some(name), version),
+            None => (None, None),
+        };
+
+        let install_id = self
+            .source
+            .as_ref()
+            .and_then(|source| source.attr_path.rsplit('.').next())
+            .or(name)
+            .unwrap_or_default()
+            .to_string();
+
+        InstalledPackage {
+            install_id,
+            attr_path: self.source.as_ref().map(|source| source.attr_path.clone()),
+            version: version.map(String::from),
+            channel: self
+                .source
+                .as_ref()
+                .map(|source| source.original_url.trim_start_matches("flake:").to_string()),
+            url: self.source.as_ref().map(|source| source.url.clone()),
+            store_paths: self.store_paths.clone(),
+            priority: self.priority,
+            active: self.active,
+            broken: None,
+            insecure: None,
+        }
+    }
+}
+
+impl InstalledPackage {
+    /// The installable this package is re-resolved from when upgrading,
+    /// `<channel>#<attr path>`
+    ///
+    /// Packages installed from a flake are resolved from the unlocked flake.
+    /// `None` for packages installed from a store path.
+    pub fn upgrade_installable(&self) -> Option<String> {
+        if let Some(flake) = self.flake() {
+            return Some(flake.unlocked().to_string());
+        }
+        match (&self.channel, &self.attr_path) {
+            (Some(channel), Some(attr_path)) => Some(format!("{channel}#{attr_path}")),
+            _ => None,
+        }
+    }
+
+    /// The locked flake the package was installed from, `None` for packages of a channel
+    pub fn flake(&self) -> Option<FlakeInstallable> {
+        let flake = FlakeInstallable::parse(self.channel.as_deref()?)?;
+        Some(FlakeInstallable {
+            attr: self.attr_path.clone()?,
+            ..flake
+        })
+    }
+
+    /// The locked installable of the `meta` of this package, `<url>#<attr path>.meta`
+    ///
+    /// `None` for packages installed from a store path.
+    pub fn meta_installable(&self) -> Option<String> {
+        match (&self.url, &self.attr_path) {
+            (Some(url), Some(attr_path)) => Some(format!("{url}#{attr_path}.meta")),
+            _ => None,
+        }
+    }
+
+    /// Record whether the package is broken or insecure according to its `meta`
+    ///
+    /// Packages are insecure if nixpkgs lists `knownVulnerabilities` for them.
+    pub fn with_meta(self, meta: &serde_json::Value) -> Self {
+        let broken = meta.get("broken").and_then(|broken| broken.as_bool());
+        let insecure = meta
+            .get("knownVulnerabilities")
+            .and_then(|vulnerabilities| vulnerabilities.as_array())
+            .map(|vulnerabilities| !vulnerabilities.is_empty());
+        InstalledPackage {
+            broken: Some(broken.unwrap_or(false)),
+            insecure: Some(insecure.unwrap_or(false)),
+            ..self
+        }
+    }
+
+    /// The packages declared in the `packages` attribute of the `flox.nix` with `contents`
+    ///
+    /// Declared packages are not built yet, they have no store paths
+    /// and their version is the version constraint, if any.
+    pub fn declared(contents: &str) -> Result<Vec<InstalledPackage>, rnix::parser::ParseError> {
+        let packages = flox_nix::literal_attr(contents, "packages")?;
+
+        let mut declared = Vec::new();
+        for (channel, channel_packages) in packages.as_object().into_iter().flatten() {
+            for (name, attrs) in channel_packages.as_object().into_iter().flatten() {
+                declared.push(InstalledPackage {
+                    install_id: name.clone(),
+                    attr_path: None,
+                    version: attrs
+                        .get("version")
+                        .and_then(|version| version.as_str())
+                        .map(String::from),
+                    channel: Some(channel.clone()),
+                    url: None,
+                    store_paths: Vec::new(),
+                    priority: None,
+                    active: true,
+                    broken: None,
+                    insecure: None,
+                });
+            }
+        }
+        Ok(declared)
+    }
+
+    /// Whether the package was installed at a specific version
+    ///
+    /// Versioned packages are installed from attributes such as `stable.hello.2_12_1`,
+    /// upgrading them resolves to the same version again.
+    /// Packages whose `constraint` in `flox.nix` allows a single version are pinned too,
+    /// packages constrained to a range are upgraded within the range.
+    pub fn is_pinned(&self, constraint: Option<&VersionConstraint>) -> bool {
+        constraint.map_or(false, VersionConstraint::is_exact)
+            || self
+                .attr_path
+                .as_deref()
+                .and_then(|attr_path| attr_path.rsplit('.').next())
+                .map_or(false, |attr| attr.starts_with(|c: char| c.is_ascii_digit()))
+    }
+}
+
+/// The result of resolving a package of a generation again
+///
+/// Produced by `flox upgrade --dry-run`.
+#[derive(Serialize, Debug, Clone, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub struct PackageUpgrade {
+    pub install_id: String,
+    pub current: InstalledPackage,
+    pub candidate_version: Option<String>,
+    pub candidate_store_path: Option<String>,
+    /// The package is not upgraded because it is pinned to its version
+    /// or the candidate is outside the `constraint`
+    pub held_back: bool,
+    /// The version constraint of the package in `flox.nix`
+    pub constraint: Option<String>,
+}
+
+impl PackageUpgrade {
+    /// Whether upgrading would change the package
+    pub fn is_upgrade(&self) -> bool {
+        !self.held_back
+            && self.candidate_store_path.is_some()
+            && self.current.store_paths.first() != self.candidate_store_path.as_ref()
+    }
+}
+
+/// Changes of the installed packages between two generations
+#[derive(Serialize, Debug, Default, Clone, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub struct GenerationDiff {
+    pub added: Vec<InstalledPackage>,
+    pub removed: Vec<InstalledPackage>,
+    pub changed: Vec<PackageChange>,
+    /// Changed `environmentVariables` of the `flox.nix`, see [GenerationDiff::with_flox_nix]
+    pub variables: Vec<AttrChange>,
+    /// Changed hooks of the `flox.nix`, see [GenerationDiff::with_flox_nix]
+    pub hooks: Vec<AttrChange>,
+}
+
+/// A package installed in both generations of a [GenerationDiff],
+/// but resolved to different store paths
+#[derive(Serialize, Debug, Clone, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub struct PackageChange {
+    pub install_id: String,
+    pub from: InstalledPackage,
+    pub to: InstalledPackage,
+}
+
+/// A package of a [Generation] providing a command
+#[derive(Serialize, Debug, Clone, PartialEq, Eq)]
+#[serde(rename_all = "camelCase")]
+pub struct CommandProvider {
+    pub install_id: String,
+    /// `<store path>/bin/<command>`
+    pub path: PathBuf,
+    pub priority: i64,
+}
+
+impl GenerationDiff {
+    /// Compare the packages `from` and `to` by install id,
+    /// packages changed if their store paths or versions differ
+    pub fn of_packages(from: Vec<InstalledPackage>, to: Vec<InstalledPackage>) -> Self {
+        let by_id = |packages: Vec<InstalledPackage>| {
+            packages
+                .into_iter()
+                .map(|package| (package.install_id.clone(), package))
+                .collect::<BTreeMap<_, _>>()
+        };
+        let mut from = by_id(from);
+        let to = by_id(to);
+
+        let mut diff = GenerationDiff::default();
+        for (install_id, to) in to {
+            match from.remove(&install_id) {
+                None => diff.added.push(to),
+                Some(from) if from.store_paths != to.store_paths || from.version != to.version => {
+                    diff.changed.push(PackageChange {
+                        install_id,
+                        from,
+                        to,
+                    })
+                },
+                Some(_) => {},
+            }
+        }
+        diff.removed = from.into_values().collect();
+
+        diff
+    }
+
+    /// Add the changes of variables and hooks from the `flox.nix` contents `from` to `to`
+    pub fn with_flox_nix(self, from: &str, to: &str) -> Result<Self, rnix::parser::ParseError> {
+        Ok(GenerationDiff {
+            variables: flox_nix::variable_changes(from, to)?,
+            hooks: flox_nix::hook_changes(from, to)?,
+            ..self
+        })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        !self.has_package_changes() && self.variables.is_empty() && self.hooks.is_empty()
+    }
+
+    pub fn has_package_changes(&self) -> bool {
+        !(self.added.is_empty() && self.removed.is_empty() && self.changed.is_empty())
+    }
+}
+
+impl Generation {
+    /// List the packages installed in this generation
+    pub fn packages(&self) -> Vec<InstalledPackage> {
+        self.elements
+            .iter()
+            .map(Element::installed_package)
+            .collect()
+    }
+
+    /// The packages of this generation providing `bin/<command>`,
+    /// in the order they take precedence in the environment
+    ///
+    /// Like in `nix profile`, packages with a lower priority number win
+    /// and packages of the same priority are ordered by installation.
+    /// Store paths that are not available locally are skipped.
+    pub fn command_providers(&self, command: &str) -> Vec<CommandProvider> {
+        let mut providers: Vec<CommandProvider> = self
+            .elements
+            .iter()
+            .filter(|element| element.active)
+            .flat_map(|element| {
+                let install_id = element.installed_package().install_id;
+                let priority = element.priority.unwrap_or(DEFAULT_PRIORITY);
+                element
+                    .store_paths
+                    .iter()
+                    .map(|store_path| Path::new(store_path).join("bin").join(command))
+                    // dangling links still shadow other packages
+                    .filter(|path| path.symlink_metadata().is_ok())
+                    .map(move |path| CommandProvider {
+                        install_id: install_id.clone(),
+                        path,
+                        priority,
+                    })
+            })
+            .collect();
+        providers.sort_by_key(|provider| provider.priority);
+        providers
+    }
+
+    /// Compare the packages of this generation with those of `other`
+    ///
+    /// Packages are matched by their install id.
+    /// Matched packages are considered changed if their store paths differ,
+    /// even if their version is the same.
+    pub fn diff(&self, other: &Generation) -> GenerationDiff {
+        GenerationDiff::of_packages(self.packages(), other.packages())
+    }
+}
+
 /// Implementations for an opened floxmeta
 impl<Git: GitProvider> Floxmeta<'_, Git> {
     pub async fn environment(
@@ -91,6 +512,28 @@ impl<Git: GitProvider> Floxmeta<'_, Git> {
             .ok_or(GetEnvironmentError::NotFound)
     }
 
+    /// Fetch the environment `remote_name` from the git repository at `url`
+    /// and store it as the environment `name`
+    ///
+    /// Only the branch of the current system is fetched,
+    /// it holds the metadata and all generations of the environment.
+    pub async fn fetch_environment(
+        &self,
+        url: &str,
+        remote_name: &str,
+        name: &str,
+        force: bool,
+    ) -> Result<Environment<Git>, FetchEnvironmentError<Git>> {
+        let system = &self.flox.system;
+        let refspec = format!("refs/heads/{system}.{remote_name}:refs/heads/{system}.{name}");
+        self.git
+            .fetch_ref(url, &refspec, force)
+            .await
+            .map_err(FetchEnvironmentError::Fetch)?;
+
+        Ok(self.environment(name).await?)
+    }
+
     /// Detect all environments from a floxmeta repo
     pub async fn environments(&self) -> Result<Vec<Environment<Git>>, GetEnvironmentsError<Git>> {
         self.git
@@ -189,6 +632,31 @@ impl<Git: GitProvider> Floxmeta<'_, Git> {
 
 /// Implementations for an environment
 impl<Git: GitProvider> Environment<'_, Git> {
+    pub fn name(&self) -> &str {
+        &self.name
+    }
+
+    pub fn system(&self) -> &str {
+        &self.system
+    }
+
+    /// Push the environment to the git repository at `url` as the environment `remote_name`
+    ///
+    /// The pushed branch holds the metadata and all generations of the environment.
+    pub async fn push_to(
+        &self,
+        url: &str,
+        remote_name: &str,
+        force: bool,
+    ) -> Result<(), Git::PushError> {
+        let refspec = format!(
+            "refs/heads/{system}.{name}:refs/heads/{system}.{remote_name}",
+            system = self.system,
+            name = self.name
+        );
+        self.floxmeta.git.push_ref(url, &refspec, force).await
+    }
+
     pub async fn metadata(&self) -> Result<Metadata, MetadataError<Git>> {
         let git = &self.floxmeta.git;
         let metadata_str = git
@@ -229,6 +697,87 @@ impl<Git: GitProvider> Environment<'_, Git> {
             elements: manifest.elements,
         })
     }
+
+    /// The `flox.nix` of `generation`, if it has one
+    ///
+    /// flox (sh) keeps the manifest of a generation in `<generation>/pkgs/default/flox.nix`.
+    pub async fn flox_nix(&self, generation: &str) -> Option<String> {
+        let contents = self
+            .floxmeta
+            .git
+            .show(&format!(
+                "{}.{}:{}/pkgs/default/flox.nix",
+                self.system, self.name, generation
+            ))
+            .await
+            .map_err(|err| debug!("No flox.nix in generation {generation}: {err}"))
+            .ok()?;
+
+        Some(contents.to_string_lossy().into_owned())
+    }
+}
+
+/// An environment exported by `flox export` and extracted to a directory
+///
+/// Exports contain the `metadata.json` of the environment
+/// and a directory with the `manifest.json` of each generation.
+pub struct ExportedEnvironment {
+    dir: PathBuf,
+}
+
+impl ExportedEnvironment {
+    pub fn new(dir: impl Into<PathBuf>) -> Self {
+        ExportedEnvironment { dir: dir.into() }
+    }
+
+    pub fn metadata(&self) -> Result<Metadata, ExportError> {
+        self.read_json(&self.dir.join("metadata.json"))
+    }
+
+    /// Read the generation the metadata of the export marks as current
+    pub fn current_generation(&self) -> Result<Generation, ExportError> {
+        let mut metadata = self.metadata()?;
+        let generation_metadata = metadata
+            .generations
+            .remove(&metadata.current_gen)
+            .ok_or_else(|| ExportError::MissingGeneration(metadata.current_gen.clone()))?;
+
+        let manifest_path = self.dir.join(&metadata.current_gen).join("manifest.json");
+        if !manifest_path.exists() {
+            return Err(ExportError::MissingGeneration(metadata.current_gen));
+        }
+        let manifest: Manifest = self.read_json(&manifest_path)?;
+
+        Ok(Generation {
+            name: metadata.current_gen,
+            metadata: generation_metadata,
+            elements: manifest.elements,
+        })
+    }
+
+    fn read_json<T: for<'de> Deserialize<'de>>(&self, file: &Path) -> Result<T, ExportError> {
+        let content = std::fs::read_to_string(file).map_err(|err| IoError::Open {
+            file: file.to_path_buf(),
+            err,
+        })?;
+        serde_json::from_str(&content).map_err(|err| ExportError::Parse {
+            file: file.to_path_buf(),
+            err,
+        })
+    }
+}
+
+#[derive(Error, Debug)]
+pub enum ExportError {
+    #[error(transparent)]
+    Io(#[from] IoError),
+    #[error("Failed parsing '{}': {err}", file.display())]
+    Parse {
+        file: PathBuf,
+        err: serde_json::Error,
+    },
+    #[error("Generation {0} is marked as current but missing from the export")]
+    MissingGeneration(String),
 }
 
 #[derive(Error, Debug)]
@@ -239,6 +788,14 @@ pub enum GetEnvironmentError<Git: GitProvider> {
     GetEnvironment(#[from] GetEnvironmentsError<Git>),
 }
 
+#[derive(Error, Debug)]
+pub enum FetchEnvironmentError<Git: GitProvider> {
+    #[error("Failed fetching environment: {0}")]
+    Fetch(Git::FetchError),
+    #[error(transparent)]
+    GetEnvironment(#[from] GetEnvironmentError<Git>),
+}
+
 #[derive(Error, Debug)]
 pub enum GetEnvironmentsError<Git: GitProvider> {
     #[error("Failed listing environemnt branches: {0}")]
@@ -278,3 +835,390 @@ pub enum ManifestError<Git: GitProvider> {
     #[error("Failed parsing 'manifest.json': {0}")]
     ParseManifest(serde_json::Error),
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn diff_generations() {
+        let generation = |elements| Generation {
+            name: "1".to_string(),
+            metadata: GenerationMetadata {
+                created: 0,
+                last_active: 0,
+                log_message: vec![],
+                path: PathBuf::new(),
+                version: 0,
+            },
+            elements,
+        };
+
+        let from = generation(vec![
+            element("/nix/store/aaaa-hello-2.12.1", Some("stable.hello")),
+            element("/nix/store/bbbb-curl-7.86.0", Some("stable.curl")),
+            element("/nix/store/cccc-jq-1.6", Some("stable.jq")),
+        ]);
+        let to = generation(vec![
+            element("/nix/store/dddd-hello-2.12.1", Some("stable.hello")),
+            element("/nix/store/cccc-jq-1.6", Some("stable.jq")),
+            element("/nix/store/eeee-ripgrep-13.0.0", Some("stable.ripgrep")),
+        ]);
+
+        let diff = from.diff(&to);
+        let ids = |packages: &[InstalledPackage]| {
+            packages
+                .iter()
+                .map(|package| package.install_id.clone())
+                .collect::<Vec<_>>()
+        };
+
+        assert_eq!(ids(&diff.added), vec!["ripgrep"]);
+        assert_eq!(ids(&diff.removed), vec!["curl"]);
+        assert_eq!(diff.changed.len(), 1);
+        assert_eq!(diff.changed[0].install_id, "hello");
+        assert!(from.diff(&from).is_empty());
+    }
+
+    #[test]
+    fn diff_declared_packages() {
+        let committed = r#"{
+          packages.nixpkgs-flox.hello = {};
+          packages.nixpkgs-flox.nodejs = { version = "^18"; };
+          packages.nixpkgs-flox.curl = {};
+          environmentVariables.LANG = "C";
+        }"#;
+        let working = r#"{
+          packages.nixpkgs-flox.hello = {};
+          packages.nixpkgs-flox.nodejs = { version = "^20"; };
+          packages.nixpkgs-flox.ripgrep = {};
+          environmentVariables.LANG = "C";
+          shell.hook = "echo hello";
+        }"#;
+
+        let diff = GenerationDiff::of_packages(
+            InstalledPackage::declared(committed).unwrap(),
+            InstalledPackage::declared(working).unwrap(),
+        )
+        .with_flox_nix(committed, working)
+        .unwrap();
+
+        assert_eq!(diff.added.len(), 1);
+        assert_eq!(diff.added[0].install_id, "ripgrep");
+        assert_eq!(diff.added[0].channel.as_deref(), Some("nixpkgs-flox"));
+        assert_eq!(diff.removed.len(), 1);
+        assert_eq!(diff.removed[0].install_id, "curl");
+        assert_eq!(diff.changed.len(), 1);
+        assert_eq!(diff.changed[0].from.version.as_deref(), Some("^18"));
+        assert_eq!(diff.changed[0].to.version.as_deref(), Some("^20"));
+        assert!(diff.variables.is_empty());
+        assert_eq!(diff.hooks.len(), 1);
+        assert_eq!(diff.hooks[0].attr, "shell.hook");
+
+        let unchanged = GenerationDiff::default()
+            .with_flox_nix(committed, committed)
+            .unwrap();
+        assert!(unchanged.is_empty());
+    }
+
+    #[test]
+    fn generation_action_from_log_message() {
+        let metadata = |log_message: &[&str]| GenerationMetadata {
+            created: 0,
+            last_active: 0,
+            log_message: log_message.iter().map(|line| line.to_string()).collect(),
+            path: PathBuf::new(),
+            version: 0,
+        };
+
+        assert_eq!(
+            metadata(&["alice installed stable.nixpkgs-flox.hello"]).action(),
+            Some("install")
+        );
+        assert_eq!(
+            metadata(&["alice edited declarative profile"]).action(),
+            Some("edit")
+        );
+        assert_eq!(
+            metadata(&["alice upgraded stable.nixpkgs-flox.curl"]).action(),
+            Some("upgrade")
+        );
+        assert_eq!(
+            metadata(&["Generation 3: rolled back to generation 2"]).action(),
+            Some("rollback")
+        );
+        assert_eq!(metadata(&[]).action(), None);
+    }
+
+    #[test]
+    fn generation_numbers_sorted_numerically() {
+        let metadata: Metadata = serde_json::from_value(serde_json::json!({
+            "currentGen": "10",
+            "generations": {
+                "1": { "created": 0, "lastActive": 0, "logMessage": [], "path": "/nix/store/a" },
+                "10": { "created": 0, "lastActive": 0, "logMessage": [], "path": "/nix/store/c" },
+                "2": { "created": 0, "lastActive": 0, "logMessage": [], "path": "/nix/store/b" },
+            },
+        }))
+        .unwrap();
+
+        assert_eq!(metadata.generation_numbers(), vec![1, 2, 10]);
+        assert_eq!(
+            metadata.generation("2").map(GenerationMetadata::path),
+            Some(Path::new("/nix/store/b"))
+        );
+    }
+
+    #[test]
+    fn prune_generations() {
+        let metadata: Metadata = serde_json::from_value(serde_json::json!({
+            "currentGen": "2",
+            "generations": {
+                "1": { "created": 100, "lastActive": 0, "logMessage": [], "path": "/nix/store/a" },
+                "2": { "created": 200, "lastActive": 0, "logMessage": [], "path": "/nix/store/b" },
+                "3": { "created": 300, "lastActive": 0, "logMessage": [], "path": "/nix/store/c" },
+                "4": { "created": 400, "lastActive": 0, "logMessage": [], "path": "/nix/store/d" },
+            },
+        }))
+        .unwrap();
+
+        assert_eq!(metadata.prunable_generations(2, None), vec![1]);
+        assert_eq!(metadata.prunable_generations(0, None), vec![1, 3, 4]);
+        assert_eq!(metadata.prunable_generations(10, Some(350)), vec![1, 3]);
+        assert!(metadata.prunable_generations(10, None).is_empty());
+    }
+
+    #[test]
+    fn command_providers_by_priority() {
+        let store = tempfile::tempdir().unwrap();
+        let package = |name: &str, commands: &[&str]| {
+            let path = store.path().join(name);
+            std::fs::create_dir_all(path.join("bin")).unwrap();
+            for command in commands {
+                std::fs::write(path.join("bin").join(command), "").unwrap();
+            }
+            path.to_string_lossy().into_owned()
+        };
+
+        let mut vim = element(&package("aaaa-vim-9.0", &["vim", "vimdiff"]), None);
+        let neovim = element(&package("bbbb-neovim-0.8.3", &["nvim", "vim"]), None);
+        let mut busybox = element(&package("cccc-busybox-1.36.0", &["vim"]), None);
+        vim.priority = None;
+        busybox.priority = Some(10);
+
+        let generation = Generation {
+            name: "1".to_string(),
+            metadata: GenerationMetadata {
+                created: 0,
+                last_active: 0,
+                log_message: vec![],
+                path: PathBuf::new(),
+                version: 0,
+            },
+            elements: vec![busybox, vim, neovim],
+        };
+
+        let providers = generation
+            .command_providers("vim")
+            .into_iter()
+            .map(|provider| (provider.install_id, provider.priority))
+            .collect::<Vec<_>>();
+        assert_eq!(providers, vec![
+            ("vim".to_string(), 5),
+            ("neovim".to_string(), 5),
+            ("busybox".to_string(), 10)
+        ]);
+        assert_eq!(generation.command_providers("nvim").len(), 1);
+        assert!(generation.command_providers("emacs").is_empty());
+    }
+
+    fn element(store_path: &str, attr_path: Option<&str>) -> Element {
+        Element {
+            active: true,
+            store_paths: vec![store_path.to_string()],
+            priority: Some(5),
+            source: attr_path.map(|attr_path| ElementSource {
+                attr_path: attr_path.to_string(),
+                outputs: None,
+                url: "github:flox/nixpkgs-flox/abcdef".to_string(),
+                original_url: "flake:nixpkgs-flox".to_string(),
+            }),
+        }
+    }
+
+    #[test]
+    fn installed_package_from_catalog() {
+        let package = element(
+            "/nix/store/6k2g6fwdn4wvdwz8a5ncb5pxgx7ygjlj-hello-2.12.1",
+            Some("evalCatalog.x86_64-linux.stable.hello"),
+        )
+        .installed_package();
+
+        assert_eq!(package.install_id, "hello");
+        assert_eq!(package.version.as_deref(), Some("2.12.1"));
+        assert_eq!(package.channel.as_deref(), Some("nixpkgs-flox"));
+    }
+
+    #[test]
+    fn installed_package_from_store_path() {
+        let package = element(
+            "/nix/store/6k2g6fwdn4wvdwz8a5ncb5pxgx7ygjlj-git-lfs-3.3.0",
+            None,
+        )
+        .installed_package();
+
+        assert_eq!(package.install_id, "git-lfs");
+        assert_eq!(package.version.as_deref(), Some("3.3.0"));
+        assert_eq!(package.attr_path, None);
+        assert_eq!(package.channel, None);
+    }
+
+    #[test]
+    fn installed_package_meta() {
+        let package = element(
+            "/nix/store/6k2g6fwdn4wvdwz8a5ncb5pxgx7ygjlj-hello-2.12.1",
+            Some("evalCatalog.x86_64-linux.stable.hello"),
+        )
+        .installed_package();
+        assert_eq!((package.broken, package.insecure), (None, None));
+        assert_eq!(
+            package.meta_installable().as_deref(),
+            Some("github:flox/nixpkgs-flox/abcdef#evalCatalog.x86_64-linux.stable.hello.meta")
+        );
+
+        let package = package.with_meta(&serde_json::json!({
+            "broken": true,
+            "knownVulnerabilities": ["CVE-2023-0001"],
+        }));
+        assert_eq!((package.broken, package.insecure), (Some(true), Some(true)));
+
+        let package = package.with_meta(&serde_json::json!({ "knownVulnerabilities": [] }));
+        assert_eq!(
+            (package.broken, package.insecure),
+            (Some(false), Some(false))
+        );
+
+        let from_store_path = element(
+            "/nix/store/6k2g6fwdn4wvdwz8a5ncb5pxgx7ygjlj-hello-2.12.1",
+            None,
+        )
+        .installed_package();
+        assert_eq!(from_store_path.meta_installable(), None);
+    }
+
+    #[test]
+    fn upgrade_candidates() {
+        let package = element(
+            "/nix/store/6k2g6fwdn4wvdwz8a5ncb5pxgx7ygjlj-hello-2.12.1",
+            Some("evalCatalog.x86_64-linux.stable.hello"),
+        )
+        .installed_package();
+        assert_eq!(
+            package.upgrade_installable().as_deref(),
+            Some("nixpkgs-flox#evalCatalog.x86_64-linux.stable.hello")
+        );
+        assert!(!package.is_pinned(None));
+
+        let pinned = element(
+            "/nix/store/6k2g6fwdn4wvdwz8a5ncb5pxgx7ygjlj-hello-2.12.1",
+            Some("evalCatalog.x86_64-linux.stable.hello.2_12_1"),
+        )
+        .installed_package();
+        assert!(pinned.is_pinned(None));
+
+        let constraint = |version: &str| version.parse::<VersionConstraint>().unwrap();
+        assert!(package.is_pinned(Some(&constraint("2.12.1"))));
+        assert!(package.is_pinned(Some(&constraint("=2.12.1"))));
+        assert!(!package.is_pinned(Some(&constraint("^2.12"))));
+        assert!(!package.is_pinned(Some(&constraint(">=2"))));
+        assert!(pinned.is_pinned(Some(&constraint("^2.12"))));
+
+        let upgrade = PackageUpgrade {
+            install_id: "hello".to_string(),
+            current: package.clone(),
+            candidate_version: Some("2.12.2".to_string()),
+            candidate_store_path: Some("/nix/store/aaaa-hello-2.12.2".to_string()),
+            held_back: false,
+            constraint: None,
+        };
+        assert!(upgrade.is_upgrade());
+        assert!(!PackageUpgrade {
+            candidate_store_path: package.store_paths.first().cloned(),
+            ..upgrade
+        }
+        .is_upgrade());
+    }
+
+    #[test]
+    fn upgrade_flake_package() {
+        let mut installed = element(
+            "/nix/store/6k2g6fwdn4wvdwz8a5ncb5pxgx7ygjlj-mytool-1.0",
+            Some("packages.x86_64-linux.default"),
+        );
+        if let Some(source) = installed.source.as_mut() {
+            source.original_url = "github:me/mytool?rev=0123abcd&narHash=sha256-abc%3D".to_string();
+        }
+        let package = installed.installed_package();
+
+        let flake = package.flake().expect("installed from a flake");
+        assert_eq!(flake.attr, "packages.x86_64-linux.default");
+        assert_eq!(flake.nar_hash().as_deref(), Some("sha256-abc="));
+        assert_eq!(
+            package.upgrade_installable().as_deref(),
+            Some("github:me/mytool#packages.x86_64-linux.default")
+        );
+        assert!(!package.is_pinned(None));
+
+        let catalog = element(
+            "/nix/store/6k2g6fwdn4wvdwz8a5ncb5pxgx7ygjlj-hello-2.12.1",
+            Some("evalCatalog.x86_64-linux.stable.hello"),
+        );
+        assert_eq!(catalog.installed_package().flake(), None);
+    }
+
+    #[test]
+    fn read_exported_environment() {
+        let dir = tempfile::tempdir().unwrap();
+        std::fs::write(
+            dir.path().join("metadata.json"),
+            r#"{
+              "currentGen": "2",
+              "generations": {
+                "1": { "created": 0, "lastActive": 0, "logMessage": [], "path": "/nix/store/a" },
+                "2": { "created": 0, "lastActive": 0, "logMessage": [], "path": "/nix/store/b" }
+              }
+            }"#,
+        )
+        .unwrap();
+
+        let export = ExportedEnvironment::new(dir.path());
+        assert!(matches!(
+            export.current_generation(),
+            Err(ExportError::MissingGeneration(generation)) if generation == "2"
+        ));
+
+        std::fs::create_dir(dir.path().join("2")).unwrap();
+        std::fs::write(
+            dir.path().join("2").join("manifest.json"),
+            r#"{
+              "version": 2,
+              "elements": [
+                { "active": true, "storePaths": ["/nix/store/aaaa-hello-2.12.1"], "priority": 5 }
+              ]
+            }"#,
+        )
+        .unwrap();
+
+        let generation = export.current_generation().unwrap();
+        assert_eq!(generation.packages()[0].install_id, "hello");
+    }
+
+    #[test]
+    fn installed_package_without_version() {
+        let package =
+            element("/nix/store/6k2g6fwdn4wvdwz8a5ncb5pxgx7ygjlj-hello", None).installed_package();
+
+        assert_eq!(package.install_id, "hello");
+        assert_eq!(package.version, None);
+    }
+}
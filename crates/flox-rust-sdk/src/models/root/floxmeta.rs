@@ -115,6 +115,34 @@ impl<'flox, Git: GitProvider> Floxmeta<'flox, Git> {
 
         Ok(floxmeta)
     }
+
+    /// gets the floxmeta reference for a specific owner,
+    /// creating an empty floxmeta repository if none exists yet
+    ///
+    /// Environments of an owner can be pulled before any of them was created.
+    ///
+    /// # Errors
+    ///
+    /// Returns an error if:
+    /// - the floxmeta dir cannot be created or initialized as a git repo
+    /// - the floxmeta dir cannot be opened as a floxmeta repo (see [Self::get_floxmeta])
+    pub async fn get_or_init_floxmeta(
+        flox: &'flox Flox,
+        owner: &str,
+    ) -> Result<Floxmeta<'flox, Git>, GetFloxmetaError<Git>> {
+        let floxmeta_dir = flox.cache_dir.join(FLOXMETA_DIR_NAME).join(owner);
+
+        if !floxmeta_dir.exists() {
+            tokio::fs::create_dir_all(&floxmeta_dir)
+                .await
+                .map_err(|e| GetFloxmetaError::CreateDir(floxmeta_dir.clone(), e))?;
+            Git::init(&floxmeta_dir, false)
+                .await
+                .map_err(|e| GetFloxmetaError::InitRepo(floxmeta_dir.clone(), e))?;
+        }
+
+        Self::get_floxmeta(flox, owner).await
+    }
 }
 
 /// Errors occuring while trying to upgrade to an [`Open<Git>`] [Root]
@@ -164,6 +192,12 @@ pub enum GetFloxmetaError<Git: GitProvider> {
     #[error("Error opening floxmeta dir for {0:?}: Not found")]
     NotFound(String),
 
+    #[error("Could not create floxmeta dir ({0:?}): ({1})")]
+    CreateDir(PathBuf, std::io::Error),
+
+    #[error("Could not initialize floxmeta dir ({0:?}): ({1})")]
+    InitRepo(PathBuf, Git::InitError),
+
     #[error(transparent)]
     OpenFloxmeta(#[from] OpenFloxmetaError),
 }
@@ -197,6 +231,61 @@ mod floxmeta_tests {
         assert!(matches!(floxmeta, Err(_)));
     }
 
+    #[tokio::test]
+    async fn init_without_metadir() {
+        let (flox, cache) = flox_instance();
+
+        Floxmeta::<GitCommandProvider>::get_or_init_floxmeta(&flox, "someone")
+            .await
+            .expect("Should create floxmeta repo");
+        let meta_repo = cache.path().join(FLOXMETA_DIR_NAME).join("someone");
+        assert!(meta_repo.is_dir());
+
+        let floxmeta = Floxmeta::<GitCommandProvider>::get_or_init_floxmeta(&flox, "someone")
+            .await
+            .expect("Should open existing floxmeta repo");
+        let environments = floxmeta
+            .environments()
+            .await
+            .expect("Should succeed with zero environment");
+
+        assert!(environments.is_empty());
+    }
+
+    #[tokio::test]
+    async fn fetch_into_empty_metadir() {
+        let (flox, _cache) = flox_instance();
+
+        // a remote holding the branch of an environment pushed from another machine
+        let remote = tempfile::tempdir().unwrap();
+        let git = |args: &[&str]| {
+            let status = std::process::Command::new("git")
+                .arg("-C")
+                .arg(remote.path())
+                .args(["-c", "user.name=flox", "-c", "user.email=flox@example.com"])
+                .args(args)
+                .status()
+                .unwrap();
+            assert!(status.success(), "git {args:?} failed");
+        };
+        git(&["init"]);
+        git(&["checkout", "-b", &format!("{}.remote", flox.system)]);
+        std::fs::write(remote.path().join("metadata.json"), "{}").unwrap();
+        git(&["add", "metadata.json"]);
+        git(&["commit", "-m", "create environment"]);
+
+        let floxmeta = Floxmeta::<GitCommandProvider>::get_or_init_floxmeta(&flox, "someone")
+            .await
+            .expect("Should create floxmeta repo");
+        let environment = floxmeta
+            .fetch_environment(&remote.path().to_string_lossy(), "remote", "pulled", false)
+            .await
+            .expect("Should fetch environment");
+
+        assert_eq!(environment.name(), "pulled");
+        assert_eq!(environment.system(), flox.system);
+    }
+
     #[tokio::test]
     async fn test_reading_remote_envs() {
         let (flox, cache) = flox_instance();
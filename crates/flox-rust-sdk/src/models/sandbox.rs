@@ -0,0 +1,189 @@
+//! Accesses of a build that the nix sandbox does not allow
+//!
+//! A sandboxed build fails with whatever error its tools print
+//! when they can not reach the network or a file outside of the build's inputs.
+//! [SandboxViolation] finds these errors in the build log
+//! and explains what the build tried to access.
+
+use std::fmt::Display;
+
+use once_cell::sync::Lazy;
+use regex::Regex;
+
+/// Errors of resolvers and tools that can not reach the network, e.g.
+/// curl: (6) Could not resolve host: example.com
+static NETWORK_ERROR: Lazy<Regex> = Lazy::new(|| {
+    Regex::new(concat!(
+        r"(?i)could not resolve host|couldn't resolve host|temporary failure in name resolution|",
+        r"name or service not known|nodename nor servname provided|network is unreachable|",
+        r"getaddrinfo"
+    ))
+    .unwrap()
+});
+
+/// Errors of tools that can not access a file, e.g.
+/// cat: /etc/ssl/certs/ca-bundle.crt: No such file or directory
+static FILESYSTEM_ERROR: Lazy<Regex> = Lazy::new(|| {
+    Regex::new(r"No such file or directory|Permission denied|Operation not permitted").unwrap()
+});
+
+/// Absolute paths on a line of the build log
+static ABSOLUTE_PATH: Lazy<Regex> =
+    Lazy::new(|| Regex::new(r#"(?:^|[\s'"`(])(/[^\s'"`:,;()]+)"#).unwrap());
+
+/// Paths a sandboxed build may access
+///
+/// Besides the store and the build directory on Linux (`/build`) and macOS (`/private/tmp`),
+/// these are devices and the pseudo file systems of the kernel.
+const SANDBOX_PATHS: &[&str] = &[
+    "/nix/store",
+    "/build",
+    "/tmp",
+    "/private/tmp",
+    "/private/var/folders",
+    "/dev",
+    "/proc",
+    "/bin/sh",
+];
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum SandboxViolation {
+    /// The build tried to reach the network
+    Network {
+        /// The line of the build log reporting the failure
+        line: String,
+    },
+    /// The build tried to access a path outside of its inputs
+    Filesystem {
+        path: String,
+        /// The line of the build log reporting the failure
+        line: String,
+    },
+}
+
+impl SandboxViolation {
+    /// The forbidden accesses reported in the log of a failed build
+    pub fn parse_build_log(log: &str) -> Vec<SandboxViolation> {
+        let mut violations = Vec::new();
+        for line in log.lines() {
+            let line = line.trim_start_matches('>').trim();
+            let violation = if NETWORK_ERROR.is_match(line) {
+                SandboxViolation::Network {
+                    line: line.to_string(),
+                }
+            } else if FILESYSTEM_ERROR.is_match(line) {
+                let path = ABSOLUTE_PATH
+                    .captures_iter(line)
+                    .map(|captures| captures[1].to_string())
+                    .find(|path| !is_sandbox_path(path));
+                match path {
+                    Some(path) => SandboxViolation::Filesystem {
+                        path,
+                        line: line.to_string(),
+                    },
+                    None => continue,
+                }
+            } else {
+                continue;
+            };
+
+            if !violations.contains(&violation) {
+                violations.push(violation);
+            }
+        }
+        violations
+    }
+}
+
+impl Display for SandboxViolation {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            SandboxViolation::Network { line } => write!(
+                f,
+                "The build tried to access the network, which the sandbox does not allow:\n  {line}"
+            ),
+            // `$HOME` of sandboxed builds, see `nix-build(1)`
+            SandboxViolation::Filesystem { path, line }
+                if path.starts_with("/homeless-shelter") =>
+            {
+                write!(
+                    f,
+                    "The build tried to access '{path}' in the home directory, \
+                     which does not exist in the sandbox:\n  {line}"
+                )
+            },
+            SandboxViolation::Filesystem { path, line } => write!(
+                f,
+                "The build tried to access '{path}', which is not one of its inputs:\n  {line}"
+            ),
+        }
+    }
+}
+
+/// Whether a sandboxed build may access `path`
+fn is_sandbox_path(path: &str) -> bool {
+    SANDBOX_PATHS.iter().any(|allowed| {
+        path.strip_prefix(allowed)
+            .map_or(false, |rest| rest.is_empty() || rest.starts_with('/'))
+    })
+}
+
+/// What the sandbox allows on `system`
+///
+/// The sandbox of macOS is not as strict as the one of Linux,
+/// builds that pass on macOS may still fail on Linux.
+pub fn sandbox_limitations(system: &str) -> &'static str {
+    if system.ends_with("-darwin") {
+        "On macOS the sandbox denies network access but allows reading system paths \
+         such as /usr/lib and /System/Library, builds that read them fail on Linux."
+    } else {
+        "On Linux the sandbox has no network access and only provides the inputs of the build, \
+         /bin/sh and the build directory."
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parse_violations() {
+        let log = "\
+unpacking sources
+curl: (6) Could not resolve host: example.com
+> cat: /etc/ssl/certs/ca-bundle.crt: No such file or directory
+mkdir: cannot create directory '/homeless-shelter': Permission denied
+cp: cannot stat '/build/source/missing': No such file or directory
+cat: /nix/store/00000000000000000000000000000000-foo/bar: No such file or directory
+curl: (6) Could not resolve host: example.com
+";
+
+        let violations = SandboxViolation::parse_build_log(log);
+        assert_eq!(violations, vec![
+            SandboxViolation::Network {
+                line: "curl: (6) Could not resolve host: example.com".to_string()
+            },
+            SandboxViolation::Filesystem {
+                path: "/etc/ssl/certs/ca-bundle.crt".to_string(),
+                line: "cat: /etc/ssl/certs/ca-bundle.crt: No such file or directory"
+                    .to_string()
+            },
+            SandboxViolation::Filesystem {
+                path: "/homeless-shelter".to_string(),
+                line: "mkdir: cannot create directory '/homeless-shelter': Permission denied"
+                    .to_string()
+            },
+        ]);
+        assert!(violations[2].to_string().contains("home directory"));
+    }
+
+    #[test]
+    fn sandbox_paths() {
+        assert!(is_sandbox_path("/build"));
+        assert!(is_sandbox_path(
+            "/nix/store/00000000000000000000000000000000-foo"
+        ));
+        assert!(!is_sandbox_path("/buildkite/cache"));
+        assert!(!is_sandbox_path("/etc/hosts"));
+    }
+}
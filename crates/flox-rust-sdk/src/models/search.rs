@@ -0,0 +1,561 @@
+use std::collections::BTreeSet;
+use std::fs;
+use std::path::PathBuf;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+use thiserror::Error;
+
+use crate::utils::errors::IoError;
+use crate::utils::stable_hash;
+
+/// Criteria to filter package search results by their `meta` attributes
+///
+/// Search results are JSON objects that carry nixpkgs' `meta` attributes
+/// either in a `meta` field or at the top level.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct SearchFilter {
+    /// SPDX identifiers of the accepted licenses, all licenses are accepted if empty
+    pub licenses: Vec<String>,
+    /// Drop packages marked as unfree
+    pub no_unfree: bool,
+    /// Drop packages marked as broken
+    pub no_broken: bool,
+}
+
+impl SearchFilter {
+    /// Whether any results could be dropped by this filter
+    pub fn is_empty(&self) -> bool {
+        self == &SearchFilter::default()
+    }
+
+    /// Whether `result` passes this filter
+    ///
+    /// Packages with unknown license are dropped if licenses are given,
+    /// packages not explicitly marked as unfree or broken are kept.
+    pub fn matches(&self, result: &Value) -> bool {
+        let meta = result.get("meta").unwrap_or(result);
+
+        if !self.licenses.is_empty() {
+            let licenses = licenses(meta);
+            let accepted = licenses.iter().any(|license| {
+                self.licenses
+                    .iter()
+                    .any(|accepted| accepted.eq_ignore_ascii_case(license))
+            });
+            if !accepted {
+                return false;
+            }
+        }
+
+        if self.no_unfree && is_unfree(meta) {
+            return false;
+        }
+
+        if self.no_broken && meta.get("broken").and_then(Value::as_bool) == Some(true) {
+            return false;
+        }
+
+        true
+    }
+}
+
+/// How well a search result matches a search term, better matches compare lower
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum MatchRank {
+    /// The package name is the search term
+    ExactName,
+    /// The package name starts with the search term
+    NamePrefix,
+    /// The package name contains the search term
+    NameSubstring,
+    /// The package name contains the characters of the search term in order,
+    /// e.g. `pgsql` in `postgresql`
+    NameFuzzy,
+    /// The description contains the search term
+    Description,
+    /// The result was returned by the channel for other reasons
+    Other,
+}
+
+impl MatchRank {
+    /// Rank `result` for `term`, ignoring case
+    pub fn of(result: &Value, term: &str) -> MatchRank {
+        let term = term.to_lowercase();
+        let name = package_name(result).unwrap_or_default().to_lowercase();
+
+        if name == term {
+            MatchRank::ExactName
+        } else if name.starts_with(&term) {
+            MatchRank::NamePrefix
+        } else if name.contains(&term) {
+            MatchRank::NameSubstring
+        } else if is_subsequence(&term, &name) {
+            MatchRank::NameFuzzy
+        } else if description(result).map_or(false, |description| {
+            description.to_lowercase().contains(&term)
+        }) {
+            MatchRank::Description
+        } else {
+            MatchRank::Other
+        }
+    }
+}
+
+/// Sort search results by their [MatchRank] for `term`
+///
+/// Results of the same rank are ordered by name and attribute path,
+/// so the same results are always returned in the same order.
+pub fn rank_results(results: &mut [Value], term: &str) {
+    results.sort_by_cached_key(|result| {
+        (
+            MatchRank::of(result, term),
+            package_name(result).unwrap_or_default().to_lowercase(),
+            attr_path(result),
+        )
+    });
+}
+
+/// The name of the package of a search result,
+/// its `pname` or the last element of its attribute path
+pub fn package_name(result: &Value) -> Option<&str> {
+    if let Some(pname) = result.get("pname").and_then(Value::as_str) {
+        return Some(pname);
+    }
+    match result.get("attrPath")? {
+        Value::Array(attr_path) => attr_path.last().and_then(Value::as_str),
+        Value::String(attr_path) => attr_path.rsplit('.').next(),
+        _ => None,
+    }
+}
+
+/// The versions of the package `name` among search `results`,
+/// matching its [package_name] or the last element of its attribute path
+pub fn package_versions<'a>(results: &'a [Value], name: &str) -> Vec<&'a str> {
+    results
+        .iter()
+        .filter(|result| {
+            package_name(result) == Some(name)
+                || attr_path(result).map_or(false, |attr_path| {
+                    attr_path.rsplit('.').next() == Some(name)
+                })
+        })
+        .filter_map(|result| result.get("version").and_then(Value::as_str))
+        .collect()
+}
+
+/// The attribute path of a search result joined by `.`
+pub fn attr_path(result: &Value) -> Option<String> {
+    match result.get("attrPath")? {
+        Value::Array(attr_path) => Some(
+            attr_path
+                .iter()
+                .filter_map(Value::as_str)
+                .collect::<Vec<_>>()
+                .join("."),
+        ),
+        Value::String(attr_path) => Some(attr_path.clone()),
+        _ => None,
+    }
+}
+
+/// The description of a search result,
+/// either at the top level or in its `meta` attributes
+pub fn description(result: &Value) -> Option<&str> {
+    result
+        .get("description")
+        .or_else(|| result.get("meta").and_then(|meta| meta.get("description")))
+        .and_then(Value::as_str)
+}
+
+/// Whether the characters of `needle` appear in `haystack` in order
+fn is_subsequence(needle: &str, haystack: &str) -> bool {
+    let mut haystack = haystack.chars();
+    needle
+        .chars()
+        .all(|needle| haystack.any(|candidate| candidate == needle))
+}
+
+/// License identifiers of a package
+///
+/// `meta.license` is either a string, a license attrset or a list of either.
+/// For attrsets the SPDX identifier is preferred over the short name.
+fn licenses(meta: &Value) -> Vec<&str> {
+    fn license_id(license: &Value) -> Option<&str> {
+        match license {
+            Value::String(id) => Some(id),
+            Value::Object(license) => license
+                .get("spdxId")
+                .or_else(|| license.get("shortName"))
+                .and_then(Value::as_str),
+            _ => None,
+        }
+    }
+
+    match meta.get("license") {
+        Some(Value::Array(licenses)) => licenses.iter().filter_map(license_id).collect(),
+        Some(license) => license_id(license).into_iter().collect(),
+        None => Vec::new(),
+    }
+}
+
+/// Whether a package is marked unfree, or any of its licenses is not free
+fn is_unfree(meta: &Value) -> bool {
+    if meta.get("unfree").and_then(Value::as_bool) == Some(true) {
+        return true;
+    }
+
+    let not_free = |license: &Value| license.get("free").and_then(Value::as_bool) == Some(false);
+    match meta.get("license") {
+        Some(Value::Array(licenses)) => licenses.iter().any(not_free),
+        Some(license) => not_free(license),
+        None => false,
+    }
+}
+
+/// File in a [SearchCache] listing the package names of all cached results
+///
+/// Read for shell completions, which must not parse every cached search.
+const NAMES_FILE: &str = "names";
+
+/// On-disk cache of search results
+///
+/// Used to answer searches when the channels can not be reached.
+/// Entries are keyed by the search query, including the searched channels.
+/// The least recently written entries are evicted once the cache exceeds its size.
+pub struct SearchCache {
+    dir: PathBuf,
+    max_size: u64,
+}
+
+/// Search results read from a [SearchCache]
+#[derive(Debug)]
+pub struct CachedSearch {
+    pub results: Vec<Value>,
+    /// Time since the results were cached
+    pub age: Duration,
+}
+
+#[derive(Serialize, Deserialize)]
+struct CacheEntry {
+    query: Vec<String>,
+    /// Seconds since the unix epoch
+    created: u64,
+    results: Vec<Value>,
+}
+
+#[derive(Error, Debug)]
+pub enum SearchCacheError {
+    #[error(transparent)]
+    Io(#[from] IoError),
+    #[error("Failed to serialize search results: {0}")]
+    Serialize(serde_json::Error),
+}
+
+impl SearchCache {
+    /// A cache in `dir` of at most `max_size` bytes
+    pub fn new(dir: impl Into<PathBuf>, max_size: u64) -> Self {
+        SearchCache {
+            dir: dir.into(),
+            max_size,
+        }
+    }
+
+    /// File caching the results of `query`
+    fn entry_path(&self, query: &[String]) -> PathBuf {
+        self.dir.join(format!("{:016x}.json", stable_hash(query)))
+    }
+
+    /// Cache the `results` of `query` and evict old entries if the cache grew too large
+    pub fn store(&self, query: &[String], results: &[Value]) -> Result<(), SearchCacheError> {
+        fs::create_dir_all(&self.dir).map_err(|err| IoError::Write {
+            file: self.dir.clone(),
+            err,
+        })?;
+
+        let entry = CacheEntry {
+            query: query.to_vec(),
+            created: SystemTime::now()
+                .duration_since(UNIX_EPOCH)
+                .unwrap_or_default()
+                .as_secs(),
+            results: results.to_vec(),
+        };
+        let file = self.entry_path(query);
+        let contents = serde_json::to_string(&entry).map_err(SearchCacheError::Serialize)?;
+        fs::write(&file, contents).map_err(|err| IoError::Write { file, err })?;
+
+        self.add_names(results)?;
+        self.evict()
+    }
+
+    /// Add the names of the packages in `results` to the [NAMES_FILE]
+    ///
+    /// Names are kept when their results are evicted,
+    /// they are only used to suggest packages.
+    fn add_names(&self, results: &[Value]) -> Result<(), SearchCacheError> {
+        let file = self.dir.join(NAMES_FILE);
+        let mut names = fs::read_to_string(&file)
+            .unwrap_or_default()
+            .lines()
+            .map(String::from)
+            .collect::<BTreeSet<_>>();
+        names.extend(results.iter().filter_map(package_name).map(String::from));
+
+        let contents: String = names.into_iter().map(|name| name + "\n").collect();
+        fs::write(&file, contents).map_err(|err| IoError::Write { file, err })?;
+        Ok(())
+    }
+
+    /// Names of packages in cached results starting with `prefix`, in alphabetical order
+    pub fn package_names(&self, prefix: &str) -> Vec<String> {
+        fs::read_to_string(self.dir.join(NAMES_FILE))
+            .unwrap_or_default()
+            .lines()
+            .filter(|name| name.starts_with(prefix))
+            .map(String::from)
+            .collect()
+    }
+
+    /// Names of packages in cached results that approximately match `term`,
+    /// the closest matches first
+    ///
+    /// Names match if they contain the characters of `term` in order, ignoring case,
+    /// e.g. `postgresql` for `pgsql`.
+    /// Shorter names are closer matches, names of the same length are ordered alphabetically.
+    pub fn similar_package_names(&self, term: &str) -> Vec<String> {
+        let term = term.to_lowercase();
+        let mut names = self
+            .package_names("")
+            .into_iter()
+            .filter(|name| is_subsequence(&term, &name.to_lowercase()))
+            .collect::<Vec<_>>();
+        names.sort_by_key(|name| name.len());
+        names
+    }
+
+    /// Cached results of `query` that are not older than `ttl`
+    ///
+    /// Unreadable entries are treated as missing.
+    pub fn load(&self, query: &[String], ttl: Duration) -> Option<CachedSearch> {
+        let contents = fs::read_to_string(self.entry_path(query)).ok()?;
+        let entry: CacheEntry = serde_json::from_str(&contents).ok()?;
+        // guard against hash collisions
+        if entry.query != query {
+            return None;
+        }
+
+        let age = SystemTime::now()
+            .duration_since(UNIX_EPOCH + Duration::from_secs(entry.created))
+            .unwrap_or_default();
+        if age > ttl {
+            return None;
+        }
+
+        Some(CachedSearch {
+            results: entry.results,
+            age,
+        })
+    }
+
+    /// Remove the oldest entries until the cache fits into its maximum size
+    fn evict(&self) -> Result<(), SearchCacheError> {
+        let entries = fs::read_dir(&self.dir).map_err(|err| IoError::Open {
+            file: self.dir.clone(),
+            err,
+        })?;
+
+        // entries removed concurrently are skipped
+        let mut entries = entries
+            .filter_map(|entry| {
+                let entry = entry.ok()?;
+                if entry.file_name() == NAMES_FILE {
+                    return None;
+                }
+                let metadata = entry.metadata().ok()?;
+                let modified = metadata.modified().unwrap_or(UNIX_EPOCH);
+                Some((modified, metadata.len(), entry.path()))
+            })
+            .collect::<Vec<_>>();
+
+        // newest first
+        entries.sort_unstable_by(|a, b| b.0.cmp(&a.0));
+
+        let mut size = 0;
+        for (_, len, path) in entries {
+            size += len;
+            if size > self.max_size {
+                let _ = fs::remove_file(path);
+            }
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use serde_json::json;
+
+    use super::*;
+
+    #[test]
+    fn filter_by_license() {
+        let filter = SearchFilter {
+            licenses: vec!["MIT".to_string(), "Apache-2.0".to_string()],
+            ..Default::default()
+        };
+
+        assert!(filter.matches(&json!({ "meta": { "license": { "spdxId": "mit" } } })));
+        assert!(filter.matches(&json!({ "license": [{ "spdxId": "GPL-3.0" }, "Apache-2.0"] })));
+        assert!(!filter.matches(&json!({ "meta": { "license": { "spdxId": "GPL-3.0" } } })));
+        assert!(!filter.matches(&json!({ "meta": {} })));
+    }
+
+    #[test]
+    fn filter_unfree_and_broken() {
+        let filter = SearchFilter {
+            no_unfree: true,
+            no_broken: true,
+            ..Default::default()
+        };
+
+        assert!(filter.matches(&json!({ "meta": { "unfree": false, "broken": false } })));
+        assert!(filter.matches(&json!({ "pname": "hello" })));
+        assert!(!filter.matches(&json!({ "meta": { "unfree": true } })));
+        assert!(!filter.matches(&json!({ "meta": { "license": { "free": false } } })));
+        assert!(!filter.matches(&json!({ "meta": { "broken": true } })));
+        assert!(SearchFilter::default().matches(&json!({ "meta": { "broken": true } })));
+    }
+
+    #[test]
+    fn rank_by_relevance() {
+        let mut results = vec![
+            json!({ "pname": "pgcli", "description": "Command-line interface for postgres" }),
+            json!({ "attrPath": ["stable", "nixpkgs-flox", "postgresql_15"] }),
+            json!({ "pname": "libpostgres" }),
+            json!({ "pname": "postgres" }),
+            json!({ "pname": "postgresql", "attrPath": "stable.nixpkgs-flox.postgresql" }),
+            json!({ "pname": "psql-tools" }),
+        ];
+        rank_results(&mut results, "Postgres");
+
+        let names = results
+            .iter()
+            .map(|result| package_name(result).unwrap())
+            .collect::<Vec<_>>();
+        assert_eq!(names, vec![
+            "postgres",
+            "postgresql",
+            "postgresql_15",
+            "libpostgres",
+            "pgcli",
+            "psql-tools"
+        ]);
+        assert_eq!(
+            MatchRank::of(&json!({ "pname": "postgresql" }), "pgsql"),
+            MatchRank::NameFuzzy
+        );
+    }
+
+    #[test]
+    fn versions_of_package() {
+        let results = vec![
+            json!({ "pname": "nodejs", "version": "18.19.0" }),
+            json!({ "attrPath": "stable.nixpkgs-flox.nodejs", "pname": "node", "version": "20.11.1" }),
+            json!({ "pname": "nodejs-slim", "version": "20.11.1" }),
+            json!({ "pname": "nodejs" }),
+        ];
+        assert_eq!(package_versions(&results, "nodejs"), vec![
+            "18.19.0", "20.11.1"
+        ]);
+        assert!(package_versions(&results, "python3").is_empty());
+    }
+
+    #[test]
+    fn cache_search_results() {
+        let dir = tempfile::tempdir().unwrap();
+        let cache = SearchCache::new(dir.path(), 1024 * 1024);
+        let query = vec!["search".to_string(), "hello".to_string()];
+
+        assert!(cache.load(&query, Duration::from_secs(60)).is_none());
+
+        cache.store(&query, &[json!({ "pname": "hello" })]).unwrap();
+        let cached = cache.load(&query, Duration::from_secs(60)).unwrap();
+        assert_eq!(cached.results, vec![json!({ "pname": "hello" })]);
+
+        assert!(cache
+            .load(
+                &["search".to_string(), "curl".to_string()],
+                Duration::from_secs(60)
+            )
+            .is_none());
+    }
+
+    #[test]
+    fn complete_cached_package_names() {
+        let dir = tempfile::tempdir().unwrap();
+        let cache = SearchCache::new(dir.path(), 1024 * 1024);
+
+        cache
+            .store(&["search".to_string(), "hello".to_string()], &[
+                json!({ "pname": "hello" }),
+                json!({ "pname": "hello-wayland" }),
+            ])
+            .unwrap();
+        cache
+            .store(&["search".to_string(), "help".to_string()], &[
+                json!({ "attrPath": ["stable", "nixpkgs-flox", "help2man"] }),
+                json!({ "pname": "hello" }),
+            ])
+            .unwrap();
+
+        assert_eq!(cache.package_names("hel"), vec![
+            "hello",
+            "hello-wayland",
+            "help2man"
+        ]);
+        assert_eq!(cache.package_names("hello-"), vec!["hello-wayland"]);
+        assert!(SearchCache::new(dir.path().join("missing"), 0)
+            .package_names("")
+            .is_empty());
+    }
+
+    #[test]
+    fn similar_cached_package_names() {
+        let dir = tempfile::tempdir().unwrap();
+        let cache = SearchCache::new(dir.path(), 1024 * 1024);
+
+        cache
+            .store(&["search".to_string(), "postgres".to_string()], &[
+                json!({ "pname": "postgresql_15" }),
+                json!({ "pname": "postgresql" }),
+                json!({ "pname": "pgcli" }),
+                json!({ "pname": "PgSQL-tools" }),
+            ])
+            .unwrap();
+
+        assert_eq!(cache.similar_package_names("pgsql"), vec![
+            "postgresql",
+            "PgSQL-tools",
+            "postgresql_15"
+        ]);
+        assert!(cache.similar_package_names("mysql").is_empty());
+    }
+
+    #[test]
+    fn evict_oldest_results() {
+        let dir = tempfile::tempdir().unwrap();
+        let cache = SearchCache::new(dir.path(), 100);
+        let old = vec!["old".to_string()];
+        let new = vec!["new".to_string()];
+
+        cache.store(&old, &[json!("x".repeat(40))]).unwrap();
+        // ensure distinct modification times
+        std::thread::sleep(Duration::from_millis(10));
+        cache.store(&new, &[json!("y".repeat(40))]).unwrap();
+
+        assert!(cache.load(&old, Duration::MAX).is_none());
+        assert!(cache.load(&new, Duration::MAX).is_some());
+    }
+}
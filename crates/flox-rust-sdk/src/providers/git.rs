@@ -40,6 +40,7 @@ pub trait GitProvider: Send + Sized + std::fmt::Debug {
         + std::fmt::Debug
         + 'static;
     type FetchError: std::error::Error;
+    type PushError: std::error::Error;
 
     async fn discover<P: AsRef<Path>>(path: P) -> Result<Self, Self::DiscoverError>;
     async fn init<P: AsRef<Path>>(path: P, bare: bool) -> Result<Self, Self::InitError>;
@@ -57,6 +58,15 @@ pub trait GitProvider: Send + Sized + std::fmt::Debug {
     async fn list_branches(&self) -> Result<Vec<BranchInfo>, Self::ListBranchesError>;
 
     async fn fetch(&self) -> Result<(), Self::FetchError>;
+    /// Fetch `refspec` from the repository at `url` without adding it as a remote
+    async fn fetch_ref(
+        &self,
+        url: &str,
+        refspec: &str,
+        force: bool,
+    ) -> Result<(), Self::FetchError>;
+    /// Push `refspec` to the repository at `url` without adding it as a remote
+    async fn push_ref(&self, url: &str, refspec: &str, force: bool) -> Result<(), Self::PushError>;
 
     fn workdir(&self) -> Option<&Path>;
     fn path(&self) -> &Path;
@@ -98,6 +108,7 @@ impl GitProvider for LibGit2Provider {
     type InitError = git2::Error;
     type ListBranchesError = EmptyError;
     type MvError = EmptyError;
+    type PushError = EmptyError;
     type RmError = EmptyError;
     type ShowError = EmptyError;
 
@@ -153,6 +164,24 @@ impl GitProvider for LibGit2Provider {
         todo!()
     }
 
+    async fn fetch_ref(
+        &self,
+        _url: &str,
+        _refspec: &str,
+        _force: bool,
+    ) -> Result<(), Self::FetchError> {
+        todo!()
+    }
+
+    async fn push_ref(
+        &self,
+        _url: &str,
+        _refspec: &str,
+        _force: bool,
+    ) -> Result<(), Self::PushError> {
+        todo!()
+    }
+
     async fn discover<P: AsRef<Path>>(path: P) -> Result<Self, Self::DiscoverError> {
         Ok(LibGit2Provider {
             repository: git2::Repository::discover(path)?,
@@ -229,6 +258,7 @@ impl GitProvider for GitCommandProvider {
     type InitError = GitCommandError;
     type ListBranchesError = GitCommandError;
     type MvError = GitCommandError;
+    type PushError = GitCommandError;
     type RmError = GitCommandError;
     type ShowError = GitCommandError;
 
@@ -392,6 +422,37 @@ impl GitProvider for GitCommandProvider {
         Ok(())
     }
 
+    async fn fetch_ref(
+        &self,
+        url: &str,
+        refspec: &str,
+        force: bool,
+    ) -> Result<(), Self::FetchError> {
+        let mut command =
+            GitCommandProvider::new_command(&self.workdir.as_deref().or(Some(&self.path)));
+        command.arg("fetch");
+        if force {
+            command.arg("--force");
+        }
+        command.arg(url).arg(refspec);
+
+        GitCommandProvider::run_command(&mut command).await?;
+        Ok(())
+    }
+
+    async fn push_ref(&self, url: &str, refspec: &str, force: bool) -> Result<(), Self::PushError> {
+        let mut command =
+            GitCommandProvider::new_command(&self.workdir.as_deref().or(Some(&self.path)));
+        command.arg("push");
+        if force {
+            command.arg("--force");
+        }
+        command.arg(url).arg(refspec);
+
+        GitCommandProvider::run_command(&mut command).await?;
+        Ok(())
+    }
+
     async fn discover<P: AsRef<Path>>(path: P) -> Result<Self, Self::DiscoverError> {
         let out = GitCommandProvider::run_command(
             GitCommandProvider::new_command(&Some(path))
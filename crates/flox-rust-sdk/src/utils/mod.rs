@@ -66,3 +66,16 @@ pub async fn find_and_replace(
 
     Ok(())
 }
+
+/// 64 bit FNV-1a hash of `parts`
+///
+/// Unlike [std::hash::Hash] the result is stable across releases,
+/// so it can be used to name files in caches.
+pub fn stable_hash(parts: &[String]) -> u64 {
+    parts
+        .join("\0")
+        .bytes()
+        .fold(0xcbf29ce484222325_u64, |hash, byte| {
+            (hash ^ byte as u64).wrapping_mul(0x100000001b3)
+        })
+}
@@ -1,16 +1,186 @@
-use anyhow::Result;
+use std::collections::HashSet;
+use std::process::ExitCode;
+use std::time::Duration;
+
+use anyhow::{bail, Context, Result};
 use bpaf::Bpaf;
 use flox_rust_sdk::flox::Flox;
+use flox_rust_sdk::models::search::{
+    attr_path,
+    description,
+    package_name,
+    rank_results,
+    SearchCache,
+    SearchFilter,
+};
+use log::{debug, warn};
+use serde_json::Value;
 
 use crate::config::features::Feature;
-use crate::flox_forward;
+use crate::config::Config;
+use crate::utils::errors::{classify_nix_errors, FloxExitCode};
+use crate::{
+    bail_with,
+    capture_in_flox_with_stderr,
+    flox_forward,
+    subcommand_metric,
+    FloxShellErrorCode,
+};
+
+/// Directory within the cache dir storing search results
+const SEARCH_CACHE_DIR: &str = "search";
+/// Maximum size of the search cache in MiB
+const DEFAULT_SEARCH_CACHE_SIZE: u64 = 50;
+/// Maximum age of cached search results in seconds
+const DEFAULT_SEARCH_CACHE_TTL: u64 = 7 * 24 * 60 * 60;
+/// Number of search results shown unless `--limit` is given
+const DEFAULT_SEARCH_LIMIT: usize = 25;
+/// Number of similar package names searched for besides the search term
+const SIMILAR_SEARCHES: usize = 3;
 
 #[derive(Bpaf, Clone)]
 pub struct ChannelArgs {}
 
 impl ChannelCommands {
-    pub async fn handle(&self, flox: Flox) -> Result<()> {
+    pub async fn handle(&self, config: Config, flox: Flox) -> Result<()> {
         match self {
+            // flox (sh) can neither filter nor cache search results,
+            // process its JSON output instead
+            ChannelCommands::Search {
+                channel,
+                json,
+                search_term,
+                license,
+                no_unfree,
+                no_broken,
+                offline,
+                exact,
+                limit,
+            } if !Feature::Env.is_forwarded()? || !self.forwards_search() => {
+                subcommand_metric!("search");
+
+                let filter = SearchFilter {
+                    licenses: license
+                        .iter()
+                        .flat_map(|licenses| licenses.split(','))
+                        .map(|license| license.trim().to_string())
+                        .filter(|license| !license.is_empty())
+                        .collect(),
+                    no_unfree: *no_unfree,
+                    no_broken: *no_broken,
+                };
+
+                let mut query = vec!["search".to_string(), "--json".to_string()];
+                for channel in channel {
+                    query.extend(["--channel".to_string(), channel.clone()]);
+                }
+                let mut args = query.clone();
+                args.extend(search_term.clone());
+
+                let cache = search_cache(&config, &flox);
+                let ttl = Duration::from_secs(
+                    config
+                        .flox
+                        .search_cache_ttl
+                        .unwrap_or(DEFAULT_SEARCH_CACHE_TTL),
+                );
+
+                let fetched = if *offline {
+                    None
+                } else {
+                    fetch_search_results(&flox, &args).await?
+                };
+                let results = match fetched {
+                    Some(results) => {
+                        if let Err(err) = cache.store(&args, &results) {
+                            debug!("Could not cache search results: {err}");
+                        }
+                        results
+                    },
+                    None => {
+                        let cached = match cache.load(&args, ttl) {
+                            Some(cached) => cached,
+                            None if *offline => bail!(
+                                "No cached results for this search, search again without '--offline'"
+                            ),
+                            None => bail_with!(
+                                FloxExitCode::Network,
+                                "Could not reach the channels and there are no cached results for this search"
+                            ),
+                        };
+                        warn!(
+                            "Showing results {}, they may be stale",
+                            format_age(cached.age)
+                        );
+                        cached.results
+                    },
+                };
+
+                // approximate terms such as `pgsql` rarely match in the channels,
+                // also search for packages of similar names found by earlier searches
+                let mut results = results;
+                if let (Some(search_term), false) = (search_term, exact) {
+                    let found = results
+                        .iter()
+                        .filter_map(package_name)
+                        .map(str::to_lowercase)
+                        .collect::<HashSet<_>>();
+                    let similar = cache
+                        .similar_package_names(search_term)
+                        .into_iter()
+                        .filter(|name| !found.contains(&name.to_lowercase()))
+                        .take(SIMILAR_SEARCHES);
+                    for name in similar {
+                        let mut args = query.clone();
+                        args.push(name);
+                        results.extend(search_similar(&flox, &cache, &args, ttl, *offline).await);
+                    }
+
+                    let mut seen = HashSet::new();
+                    results.retain(|result| {
+                        seen.insert(attr_path(result).unwrap_or_else(|| result.to_string()))
+                    });
+                }
+
+                let total = results.len();
+                let mut results: Vec<Value> = results
+                    .into_iter()
+                    .filter(|result| filter.matches(result))
+                    .collect();
+                let matched = results.len();
+
+                // `--exact` keeps the results in the order of the channels
+                if let (Some(search_term), false) = (search_term, exact) {
+                    rank_results(&mut results, search_term);
+                }
+                let limit = match (limit, exact, json) {
+                    (Some(limit), _, _) => Some(*limit),
+                    (None, false, false) => Some(DEFAULT_SEARCH_LIMIT),
+                    _ => None,
+                };
+                if let Some(limit) = limit {
+                    results.truncate(limit);
+                }
+
+                if *json {
+                    println!("{}", serde_json::to_string_pretty(&results)?);
+                } else {
+                    for result in &results {
+                        println!("{}", format_search_result(result));
+                    }
+                }
+
+                if !filter.is_empty() {
+                    eprintln!("{matched} results ({} hidden by filters)", total - matched);
+                }
+                if results.len() < matched {
+                    eprintln!(
+                        "showing {} of {matched} results, use '--limit' to show more",
+                        results.len()
+                    );
+                }
+            },
+
             _ if Feature::Env.is_forwarded()? => flox_forward(&flox).await?,
 
             _ => todo!(),
@@ -20,6 +190,83 @@ impl ChannelCommands {
     }
 }
 
+impl ChannelCommands {
+    /// Whether flox (sh) can run the command as given
+    ///
+    /// flox (sh) does not know the filters of `search`, its cache and ranking.
+    fn forwards_search(&self) -> bool {
+        match self {
+            ChannelCommands::Search {
+                license,
+                no_unfree,
+                no_broken,
+                offline,
+                exact,
+                limit,
+                ..
+            } => {
+                license.is_none()
+                    && !no_unfree
+                    && !no_broken
+                    && !offline
+                    && !exact
+                    && limit.is_none()
+            },
+            _ => true,
+        }
+    }
+}
+
+/// Results of a search for a similar package name, see [SearchCache::similar_package_names]
+///
+/// Falls back to cached results and to none at all, without failing the original search.
+async fn search_similar(
+    flox: &Flox,
+    cache: &SearchCache,
+    args: &[String],
+    ttl: Duration,
+    offline: bool,
+) -> Vec<Value> {
+    let fetched = if offline {
+        None
+    } else {
+        match fetch_search_results(flox, args).await {
+            Ok(fetched) => fetched,
+            Err(err) => {
+                debug!("Could not search for {args:?}: {err:#}");
+                return Vec::new();
+            },
+        }
+    };
+    match fetched {
+        Some(results) => {
+            if let Err(err) = cache.store(args, &results) {
+                debug!("Could not cache search results: {err}");
+            }
+            results
+        },
+        None => cache
+            .load(args, ttl)
+            .map(|cached| cached.results)
+            .unwrap_or_default(),
+    }
+}
+
+/// Search with flox (sh), `None` if the channels can not be reached
+pub(super) async fn fetch_search_results(
+    flox: &Flox,
+    args: &[String],
+) -> Result<Option<Vec<Value>>> {
+    let (code, output, stderr) = capture_in_flox_with_stderr(flox, args).await?;
+    match (code, classify_nix_errors(&stderr)) {
+        (0, _) => Ok(Some(
+            serde_json::from_str(&output).context("Could not parse search results")?,
+        )),
+        (_, Some(FloxExitCode::Network)) => Ok(None),
+        (code, _) => Err(FloxShellErrorCode(ExitCode::from(code)).into()),
+    }
+}
+
 #[derive(Bpaf, Clone)]
 pub enum ChannelCommands {
     /// subscribe to channel URL
@@ -50,6 +297,31 @@ pub enum ChannelCommands {
         #[bpaf(long)]
         json: bool,
 
+        /// only show packages with one of these licenses (comma separated SPDX identifiers)
+        #[bpaf(long, argument("LICENSES"))]
+        license: Option<String>,
+
+        /// hide packages with an unfree license
+        #[bpaf(long("no-unfree"))]
+        no_unfree: bool,
+
+        /// hide packages marked as broken
+        #[bpaf(long("no-broken"))]
+        no_broken: bool,
+
+        /// only show results cached by previous searches
+        #[bpaf(long)]
+        offline: bool,
+
+        /// show the results in the order of the channels instead of ranking them by relevance,
+        /// without limiting their number
+        #[bpaf(long)]
+        exact: bool,
+
+        /// show at most N results, defaults to 25 unless '--json' or '--exact' is given
+        #[bpaf(long, argument("N"))]
+        limit: Option<usize>,
+
         #[bpaf(positional("search term"))]
         search_term: Option<String>,
     },
@@ -63,5 +335,48 @@ pub enum ChannelCommands {
     },
 }
 
+/// The cache of search results in the cache dir, limited to `search_cache_size` MiB
+pub(super) fn search_cache(config: &Config, flox: &Flox) -> SearchCache {
+    let cache_size = config
+        .flox
+        .search_cache_size
+        .unwrap_or(DEFAULT_SEARCH_CACHE_SIZE);
+    SearchCache::new(
+        flox.cache_dir.join(SEARCH_CACHE_DIR),
+        cache_size * 1024 * 1024,
+    )
+}
+
+/// Format the age of cached search results, e.g. `cached 3 hours ago`
+fn format_age(age: Duration) -> String {
+    let minutes = age.as_secs() / 60;
+    match minutes {
+        0 => "cached less than a minute ago".to_string(),
+        1..=59 => format!("cached {minutes} minutes ago"),
+        60..=1439 => format!("cached {} hours ago", minutes / 60),
+        _ => format!("cached {} days ago", minutes / 1440),
+    }
+}
+
+/// Format a search result as `<attrPath> <version> - <description>`
+fn format_search_result(result: &Value) -> String {
+    let mut line = attr_path(result).unwrap_or_else(|| {
+        result
+            .get("pname")
+            .and_then(Value::as_str)
+            .unwrap_or("<unknown>")
+            .to_string()
+    });
+    if let Some(version) = result.get("version").and_then(Value::as_str) {
+        line.push(' ');
+        line.push_str(version);
+    }
+    if let Some(description) = description(result) {
+        line.push_str(" - ");
+        line.push_str(description);
+    }
+    line
+}
+
 pub type ChannelRef = String;
 pub type Url = String;
@@ -1,16 +1,70 @@
-use std::path::PathBuf;
+use std::collections::{BTreeMap, BTreeSet, HashMap, HashSet};
+use std::env;
+use std::ffi::OsString;
+use std::io::{Read, Write};
+use std::os::unix::ffi::{OsStrExt, OsStringExt};
+use std::os::unix::fs::PermissionsExt;
+use std::path::{Path, PathBuf};
+use std::process::{ExitCode, ExitStatus, Stdio};
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
 
-use anyhow::Result;
+use anyhow::{anyhow, bail, Context, Result};
 use bpaf::{construct, Bpaf, Parser, ShellComp};
+use flox_rust_sdk::environment::NIX_BIN;
 use flox_rust_sdk::flox::Flox;
+use flox_rust_sdk::models::collision::FileCollision;
+use flox_rust_sdk::models::environment_ref::Project;
+use flox_rust_sdk::models::flox_nix::{self, Profile, Secret, SecretContext};
+use flox_rust_sdk::models::git_remote;
+use flox_rust_sdk::models::root::environment::{
+    Environment,
+    ExportedEnvironment,
+    Generation,
+    GenerationDiff,
+    GenerationError,
+    InstalledPackage,
+    Metadata,
+    PackageUpgrade,
+};
 use flox_rust_sdk::models::root::floxmeta::Floxmeta;
+use flox_rust_sdk::models::search;
 use flox_rust_sdk::nix::command_line::NixCommandLine;
-use flox_rust_sdk::prelude::flox_package::FloxPackage;
+use flox_rust_sdk::prelude::flox_package::{
+    FlakeInstallable,
+    FloxPackage,
+    LockedFlake,
+    PackageRequest,
+    UnavailableVersionError,
+    VersionConstraint,
+};
 use flox_rust_sdk::providers::git::{GitCommandProvider, GitProvider};
+use futures::stream::{self, StreamExt};
+use log::{debug, error, info, warn};
+use serde::{Deserialize, Serialize};
 use serde_json::json;
+use time::format_description::well_known::Rfc3339;
+use time::OffsetDateTime;
 
+use super::channel::fetch_search_results;
 use crate::config::features::Feature;
-use crate::{flox_forward, subcommand_metric};
+use crate::config::Config;
+use crate::utils::activations::{Activations, Registration};
+use crate::utils::dialog::{Confirm, Dialog};
+use crate::utils::errors::{classify_nix_errors, ExitCodeError, FloxExitCode};
+use crate::utils::init::is_quiet;
+use crate::utils::metrics::FLOX_VERSION;
+use crate::utils::retry::{after_attempts, retry, DEFAULT_RETRIES, RETRY_DELAY};
+use crate::utils::shell::{self, Shell, ShellKind};
+use crate::{
+    bail_with,
+    capture_bytes_in_flox,
+    capture_in_flox,
+    flox_forward,
+    run_in_flox,
+    run_in_flox_with_stderr,
+    subcommand_metric,
+    FloxShellErrorCode,
+};
 
 #[derive(Bpaf, Clone)]
 pub struct EnvironmentArgs {
@@ -21,76 +75,4431 @@ pub struct EnvironmentArgs {
 pub type EnvironmentRef = PathBuf;
 
 impl EnvironmentCommands {
-    pub async fn handle(&self, flox: Flox) -> Result<()> {
+    pub async fn handle(&self, config: Config, flox: Flox) -> Result<()> {
+        // fail before resolving anything if an environment requires a newer flox
         match self {
+            // ephemeral activations realise deferred environments without clearing the record
+            EnvironmentCommands::Activate {
+                environment: environments,
+                generation,
+                ephemeral,
+                ..
+            } if environments.is_empty() => {
+                check_required_flox_version(&flox, None, *generation).await?;
+                if !ephemeral {
+                    realise_deferred(&flox.cache_dir, &environment_name(None)).await?
+                }
+            },
+            EnvironmentCommands::Activate {
+                environment: environments,
+                generation,
+                ephemeral,
+                ..
+            } => {
+                for environment in environments {
+                    check_required_flox_version(&flox, Some(environment), *generation).await?;
+                    if !ephemeral {
+                        realise_deferred(&flox.cache_dir, &environment_name(Some(environment)))
+                            .await?;
+                    }
+                }
+            },
+            EnvironmentCommands::Install { environment, .. } => {
+                check_required_flox_version(&flox, environment.as_ref(), None).await?;
+                allow_unfree(&flox, environment.as_ref()).await
+            },
+            EnvironmentCommands::Upgrade { environment, .. } => {
+                allow_unfree(&flox, environment.as_ref()).await
+            },
+            _ => {},
+        }
+
+        match self {
+            command if command.modifies_environment() && env::var_os(EPHEMERAL_VAR).is_some() => {
+                bail!("Environments can not be modified within an ephemeral activation ('flox activate --ephemeral')")
+            },
+
+            // within a layered activation list the packages of all layered environments
+            EnvironmentCommands::List {
+                environment: None,
+                generation: None,
+                json,
+                ..
+            } if env::var_os(LAYERED_ENVIRONMENTS_VAR).is_some()
+                && !Feature::Env.is_forwarded()? =>
+            {
+                let layered = env::var(LAYERED_ENVIRONMENTS_VAR)?;
+
+                let mut packages = Vec::new();
+                for name in layered.split(':').filter(|name| !name.is_empty()) {
+                    let environment = EnvironmentRef::from(name);
+                    let (floxmeta, name) =
+                        open_environment_floxmeta(&flox, Some(&environment)).await?;
+                    let environment = floxmeta.environment(&name).await?;
+                    let generation = match pinned_generation(&name) {
+                        Some(generation) => generation.to_string(),
+                        None => environment.metadata().await?.current_gen,
+                    };
+                    packages.extend(
+                        environment
+                            .generation(&generation)
+                            .await?
+                            .packages()
+                            .into_iter()
+                            .map(|package| LayeredPackage {
+                                environment: name.clone(),
+                                package,
+                            }),
+                    );
+                }
+
+                match json {
+                    Some(ListOutput::Json) => {
+                        packages = stream::iter(packages)
+                            .map(|layered| async move {
+                                LayeredPackage {
+                                    environment: layered.environment,
+                                    package: evaluate_meta(layered.package).await,
+                                }
+                            })
+                            .buffered(CONCURRENT_EVALUATIONS)
+                            .collect()
+                            .await;
+                        println!("{}", serde_json::to_string_pretty(&packages)?)
+                    },
+                    _ => {
+                        for LayeredPackage {
+                            environment,
+                            package,
+                        } in &packages
+                        {
+                            match package.version {
+                                Some(ref version) => {
+                                    println!("{} {version} ({environment})", package.install_id)
+                                },
+                                None => println!("{} ({environment})", package.install_id),
+                            }
+                        }
+                    },
+                }
+            },
+
             EnvironmentCommands::List {
                 environment_args: _,
                 environment,
-                json: _,
-                generation: _,
+                json,
+                generation,
+            } if !Feature::Env.is_forwarded()? => {
+                let (floxmeta, name) =
+                    open_environment_floxmeta(&flox, environment.as_ref()).await?;
+
+                let environment = floxmeta.environment(&name).await?;
+                let metadata = environment.metadata().await?;
+                let generation = environment
+                    .generation(
+                        &generation
+                            .or_else(|| pinned_generation(&name))
+                            .map(|generation| generation.to_string())
+                            .unwrap_or(metadata.current_gen),
+                    )
+                    .await?;
+
+                match json {
+                    Some(ListOutput::Json) => {
+                        let packages: Vec<_> = stream::iter(generation.packages())
+                            .map(evaluate_meta)
+                            .buffered(CONCURRENT_EVALUATIONS)
+                            .collect()
+                            .await;
+                        println!("{}", serde_json::to_string_pretty(&packages).unwrap())
+                    },
+                    _ => println!("{}", serde_json::to_string_pretty(&generation).unwrap()),
+                }
+            },
+
+            EnvironmentCommands::Diff {
+                environment_args: _,
+                environment,
+                json,
+                from,
+                to,
+            } if !Feature::Env.is_forwarded()? => {
+                subcommand_metric!("diff");
+
+                let (floxmeta, name) =
+                    open_environment_floxmeta(&flox, environment.as_ref()).await?;
+                let environment = floxmeta.environment(&name).await?;
+                let metadata = environment.metadata().await?;
+
+                // without generations compare the working copy with the current generation
+                let (from, to) = match (from, to) {
+                    (Some(from), to) => {
+                        let current: u32 = metadata
+                            .current_gen
+                            .parse()
+                            .context("Could not parse current generation")?;
+                        (*from, to.unwrap_or(current))
+                    },
+                    (None, _) => {
+                        let committed = current_flox_nix(&environment, &name).await?;
+                        let path = project_flox_nix(&flox, &name).await?;
+                        let working = tokio::fs::read_to_string(&path)
+                            .await
+                            .with_context(|| format!("Could not read {}", path.display()))?;
+                        let diff = GenerationDiff::of_packages(
+                            InstalledPackage::declared(&committed)?,
+                            InstalledPackage::declared(&working)?,
+                        )
+                        .with_flox_nix(&committed, &working)?;
+
+                        if *json {
+                            println!("{}", serde_json::to_string_pretty(&diff)?);
+                        } else if diff.is_empty() {
+                            eprintln!(
+                                "No changes between generation {} and {}",
+                                metadata.current_gen,
+                                path.display()
+                            );
+                        } else {
+                            print_generation_diff(&diff);
+                        }
+                        return Ok(());
+                    },
+                };
+
+                let mut generations = Vec::new();
+                let mut manifests = Vec::new();
+                for generation in [from, to] {
+                    match environment.generation(&generation.to_string()).await {
+                        Ok(generation) => generations.push(generation),
+                        Err(GenerationError::NotFound) => bail_with!(
+                            FloxExitCode::NotFound,
+                            "Generation {generation} of environment '{name}' does not exist, valid generations are: {}",
+                            format_generations(&metadata.generation_numbers())
+                        ),
+                        Err(e) => Err(e)?,
+                    }
+                    manifests.push(
+                        environment
+                            .flox_nix(&generation.to_string())
+                            .await
+                            .unwrap_or_default(),
+                    );
+                }
+                let diff = generations[0]
+                    .diff(&generations[1])
+                    .with_flox_nix(&manifests[0], &manifests[1])?;
+
+                if *json {
+                    println!("{}", serde_json::to_string_pretty(&diff)?);
+                } else if diff.is_empty() {
+                    eprintln!("No changes between generation {from} and {to}");
+                } else {
+                    print_generation_diff(&diff);
+                }
+            },
+
+            EnvironmentCommands::Log {
+                environment_args: _,
+                environment,
+                patch,
+                json,
+            } if !Feature::Env.is_forwarded()? => {
+                subcommand_metric!("log");
+
+                let (floxmeta, name) =
+                    open_environment_floxmeta(&flox, environment.as_ref()).await?;
+                let environment = floxmeta.environment(&name).await?;
+                let metadata = environment.metadata().await?;
+
+                // diff each generation against the one before it
+                let mut entries = Vec::new();
+                let mut manifests = Vec::new();
+                let mut previous: Option<Generation> = None;
+                let mut previous_manifest = None;
+                for number in metadata.generation_numbers() {
+                    let generation_metadata = metadata
+                        .generation(&number.to_string())
+                        .context("Generation listed in metadata is missing")?;
+                    let generation = environment.generation(&number.to_string()).await?;
+                    let changes = match previous {
+                        Some(ref previous) => previous.diff(&generation),
+                        None => GenerationDiff {
+                            added: generation.packages(),
+                            ..Default::default()
+                        },
+                    };
+                    entries.push(LogEntry {
+                        generation: number,
+                        current: number.to_string() == metadata.current_gen,
+                        created: generation_metadata.created(),
+                        action: generation_metadata.action(),
+                        message: generation_metadata.log_message().to_vec(),
+                        changes,
+                    });
+
+                    let manifest = if *patch {
+                        environment.flox_nix(&number.to_string()).await
+                    } else {
+                        None
+                    };
+                    manifests.push((previous_manifest.take(), manifest.clone()));
+                    previous_manifest = manifest;
+                    previous = Some(generation);
+                }
+                entries.reverse();
+                manifests.reverse();
+
+                if *json {
+                    println!("{}", serde_json::to_string_pretty(&entries)?);
+                    return Ok(());
+                }
+
+                for (index, (entry, (from, to))) in entries.iter().zip(manifests).enumerate() {
+                    if index > 0 {
+                        println!();
+                    }
+                    print_log_entry(entry);
+                    if !*patch {
+                        continue;
+                    }
+
+                    println!();
+                    match (from, to) {
+                        (from, Some(to)) => print_manifest_diff(&from.unwrap_or_default(), &to),
+                        _ => print_generation_diff(&entry.changes),
+                    }
+                }
+            },
+
+            EnvironmentCommands::Which {
+                environment_args: _,
+                environment,
+                all,
+                json,
+                command,
             } if !Feature::Env.is_forwarded()? => {
-                let name = environment
-                    .as_ref()
-                    .map(|path| path.as_os_str().to_string_lossy())
-                    .unwrap_or_else(|| "default".into());
-
-                // todo rename project!
-                // this is now just a root
-
-                // assume local for now. next, parse environment
-                // assume local exists
-                let floxmeta = flox
-                    .project(flox.cache_dir.join("meta").join("local"))
-                    .guard::<GitCommandProvider>()
+                subcommand_metric!("which");
+
+                let (floxmeta, name) =
+                    open_environment_floxmeta(&flox, environment.as_ref()).await?;
+                let environment = floxmeta.environment(&name).await?;
+                let generation = match pinned_generation(&name) {
+                    Some(generation) => generation.to_string(),
+                    None => environment.metadata().await?.current_gen,
+                };
+                let providers = environment
+                    .generation(&generation)
                     .await?
-                    .open()
-                    .expect("Expected repository exist")
-                    .guard_floxmeta()
+                    .command_providers(command);
+
+                if *json {
+                    println!("{}", serde_json::to_string_pretty(&providers)?);
+                    return Ok(());
+                }
+
+                let (provider, shadowed) = match providers.split_first() {
+                    Some(split) => split,
+                    None => {
+                        bail!("'{command}' is not provided by any package of environment '{name}'")
+                    },
+                };
+
+                if *all {
+                    for provider in &providers {
+                        println!(
+                            "{} (priority {}): {}",
+                            provider.install_id,
+                            provider.priority,
+                            provider.path.display()
+                        );
+                    }
+                } else {
+                    println!("{} ({})", provider.path.display(), provider.install_id);
+                    if !shadowed.is_empty() {
+                        warn!(
+                            "{} shadows '{command}' of {}, \
+                             use '--all' to list all providers in resolution order",
+                            provider.install_id,
+                            shadowed
+                                .iter()
+                                .map(|provider| provider.install_id.as_str())
+                                .collect::<Vec<_>>()
+                                .join(", ")
+                        );
+                    }
+                }
+            },
+
+            EnvironmentCommands::Doctor {
+                environment_args: _,
+                environment,
+                json,
+                offline,
+            } if !Feature::Env.is_forwarded()? => {
+                subcommand_metric!("doctor");
+
+                let (floxmeta, name) =
+                    open_environment_floxmeta(&flox, environment.as_ref()).await?;
+                let floxmeta_environment = floxmeta.environment(&name).await?;
+                let metadata = floxmeta_environment.metadata().await?;
+                let current = metadata.current_gen.clone();
+                let generation = floxmeta_environment.generation(&current).await?;
+                let packages = generation.packages();
+                let flox_nix = floxmeta_environment.flox_nix(&current).await;
+                let profile = metadata
+                    .generation(&current)
+                    .map(|generation| generation.path());
+
+                let mut checks = vec![
+                    DoctorCheck::new(
+                        "manifest",
+                        check_manifest(flox_nix.as_deref(), &packages, &name),
+                    ),
+                    DoctorCheck::new("packages", check_packages(&packages, &name)),
+                    DoctorCheck::new(
+                        "store paths",
+                        check_store_paths(
+                            &flox,
+                            environment.as_ref(),
+                            profile,
+                            &packages,
+                            &name,
+                            &current,
+                        ),
+                    ),
+                    DoctorCheck::new("commands", check_commands(&generation)),
+                ];
+                if *offline {
+                    checks.push(DoctorCheck::skipped("substituters"));
+                    checks.push(DoctorCheck::skipped("flox version"));
+                } else {
+                    checks.push(DoctorCheck::new("substituters", check_substituters().await));
+                    match check_latest_flox_release().await {
+                        Some(findings) => checks.push(DoctorCheck::new("flox version", findings)),
+                        None => {
+                            warn!("Could not determine the latest flox release");
+                            checks.push(DoctorCheck::skipped("flox version"));
+                        },
+                    }
+                }
+
+                let problems: usize = checks.iter().map(|check| check.findings.len()).sum();
+                if *json {
+                    let report = json!({
+                        "environment": name,
+                        "generation": current,
+                        "passed": problems == 0,
+                        "checks": checks,
+                    });
+                    println!("{}", serde_json::to_string_pretty(&report)?);
+                } else {
+                    println!("Environment '{name}', generation {current}:");
+                    print_doctor_checks(&checks);
+                }
+
+                if problems > 0 {
+                    if !*json {
+                        error!("Found {problems} problems in environment '{name}'");
+                    }
+                    Err(FloxShellErrorCode(ExitCode::from(1)))?
+                }
+            },
+
+            EnvironmentCommands::Upgrade {
+                dry_run: false,
+                exit_code: true,
+                ..
+            } => {
+                bail!("'--exit-code' only applies to '--dry-run'")
+            },
+
+            EnvironmentCommands::Upgrade {
+                environment_args: _,
+                environment,
+                dry_run: true,
+                exit_code,
+                packages,
+            } if !Feature::Env.is_forwarded()? => {
+                subcommand_metric!("upgrade");
+
+                let (floxmeta, name) =
+                    open_environment_floxmeta(&flox, environment.as_ref()).await?;
+                let environment = floxmeta.environment(&name).await?;
+                let metadata = environment.metadata().await?;
+                let generation = environment.generation(&metadata.current_gen).await?;
+                check_selected_packages(packages, &generation.packages(), &name)?;
+                let constraints = match environment.flox_nix(&metadata.current_gen).await {
+                    Some(contents) => flox_nix::version_constraints(&contents)?,
+                    None => Default::default(),
+                };
+
+                let mut upgrades = Vec::new();
+                for package in generation.packages() {
+                    if packages.is_empty() || is_selected(packages, &package) {
+                        let constraint = constraints.get(&package.install_id);
+                        upgrades.push(resolve_upgrade(package, constraint).await?);
+                    }
+                }
+
+                print_upgrades(&upgrades);
+
+                if *exit_code && upgrades.iter().any(PackageUpgrade::is_upgrade) {
+                    Err(FloxShellErrorCode(FloxExitCode::UpgradesAvailable.into()))?
+                }
+            },
+
+            // upgrade only the given packages
+            // and show that no other package of the environment changed
+            EnvironmentCommands::Upgrade {
+                environment_args: _,
+                environment: environment_ref,
+                packages,
+                ..
+            } if !packages.is_empty() && !Feature::Env.is_forwarded()? => {
+                subcommand_metric!("upgrade");
+
+                let (floxmeta, name) =
+                    open_environment_floxmeta(&flox, environment_ref.as_ref()).await?;
+                let environment = floxmeta.environment(&name).await?;
+                let current = environment
+                    .generation(&environment.metadata().await?.current_gen)
+                    .await?;
+                check_selected_packages(packages, &current.packages(), &name)?;
+
+                forward_reporting_collisions(&flox).await?;
+                let selected = current
+                    .packages()
+                    .into_iter()
+                    .filter(|package| is_selected(packages, package))
+                    .collect::<Vec<_>>();
+                upgrade_flake_packages(&flox, environment_ref.as_ref(), &selected).await?;
+
+                let upgraded = environment
+                    .generation(&environment.metadata().await?.current_gen)
+                    .await?;
+                let diff = current.diff(&upgraded);
+                if diff.is_empty() {
+                    info!("The selected packages are up to date");
+                } else {
+                    print_generation_diff(&diff);
+                }
+            },
+
+            EnvironmentCommands::Upgrade {
+                environment: environment_ref,
+                ..
+            } if !Feature::Env.is_forwarded()? => {
+                forward_reporting_collisions(&flox).await?;
+
+                let (floxmeta, name) =
+                    open_environment_floxmeta(&flox, environment_ref.as_ref()).await?;
+                let environment = floxmeta.environment(&name).await?;
+                let current = environment
+                    .generation(&environment.metadata().await?.current_gen)
+                    .await?;
+                upgrade_flake_packages(&flox, environment_ref.as_ref(), &current.packages())
+                    .await?;
+            },
+
+            EnvironmentCommands::Remove {
+                packages, matching, ..
+            } if packages.is_empty() && matching.is_empty() => {
+                bail!("At least one package or '--match' is required")
+            },
+
+            // resolve all packages before removing any, so that an unknown name
+            // leaves the environment unchanged, and remove them in a single generation
+            // flox (sh) removes several packages, but does not know the other options
+            EnvironmentCommands::Remove {
+                environment_args,
+                environment,
+                matching,
+                ignore_missing,
+                yes,
+                packages,
+            } if !Feature::Env.is_forwarded()?
+                || !matching.is_empty()
+                || *ignore_missing
+                || *yes =>
+            {
+                subcommand_metric!("remove");
+
+                let (floxmeta, name) =
+                    open_environment_floxmeta(&flox, environment.as_ref()).await?;
+                let floxmeta_environment = floxmeta.environment(&name).await?;
+                let current = floxmeta_environment
+                    .generation(&floxmeta_environment.metadata().await?.current_gen)
+                    .await?;
+                let installed = current.packages();
+
+                let mut selected = Vec::new();
+                let mut missing = Vec::new();
+                for package in packages {
+                    match installed.iter().find(|installed| {
+                        *package == installed.install_id
+                            || installed.attr_path.as_ref() == Some(package)
+                    }) {
+                        Some(installed) => selected.push(installed.install_id.clone()),
+                        None => missing.push(package.clone()),
+                    }
+                }
+                if !*ignore_missing {
+                    check_selected_packages(&missing, &installed, &name)?;
+                }
+                for package in &missing {
+                    warn!("Package '{package}' is not installed in environment '{name}', skipping");
+                }
+
+                if !matching.is_empty() {
+                    let matched: Vec<String> = glob_matching_packages(matching, &installed)
+                        .into_iter()
+                        .filter(|id| !selected.contains(id))
+                        .collect();
+
+                    if matched.is_empty() && !*ignore_missing {
+                        bail!(
+                            "No package of environment '{name}' matches {}",
+                            matching
+                                .iter()
+                                .map(|glob| format!("'{glob}'"))
+                                .collect::<Vec<_>>()
+                                .join(", ")
+                        );
+                    }
+                    if !matched.is_empty() && !*yes {
+                        if !Dialog::can_prompt() {
+                            bail!(
+                                "'--match' selected {}, use '--yes' to remove them non-interactively",
+                                matched.join(", ")
+                            );
+                        }
+                        let message =
+                            format!("Remove {} from environment '{name}'?", matched.join(", "));
+                        let dialog = Dialog {
+                            message: &message,
+                            help_message: None,
+                            typed: Confirm {
+                                default: Some(false),
+                            },
+                        };
+                        if !dialog.prompt().await? {
+                            bail!("Aborted, environment '{name}' is unchanged");
+                        }
+                    }
+                    selected.extend(matched);
+                }
+
+                if selected.is_empty() {
+                    info!("No packages to remove from environment '{name}'");
+                    return Ok(());
+                }
+
+                let mut args: Vec<OsString> = vec!["remove".into()];
+                if let Some(ref system) = environment_args.system {
+                    args.extend(["--system".into(), system.into()]);
+                }
+                if let Some(environment) = environment {
+                    args.extend(["-e".into(), environment.into()]);
+                }
+                args.extend(selected.iter().map(OsString::from));
+                let result = run_in_flox(Some(&flox), &args).await?;
+                if result != 0 {
+                    Err(FloxShellErrorCode(ExitCode::from(result)))?
+                }
+
+                let removed = floxmeta_environment
+                    .generation(&floxmeta_environment.metadata().await?.current_gen)
                     .await?;
+                let removed = current.diff(&removed).removed;
+                info!(
+                    "Removed {} from environment '{name}'",
+                    removed
+                        .iter()
+                        .map(|package| package.install_id.as_str())
+                        .collect::<Vec<_>>()
+                        .join(", ")
+                );
+            },
+
+            EnvironmentCommands::Gc {
+                keep,
+                older_than,
+                store,
+                dry_run,
+            } if !Feature::Env.is_forwarded()? => {
+                subcommand_metric!("gc");
+
+                let keep = keep
+                    .or(config.flox.gc_keep_generations)
+                    .unwrap_or(DEFAULT_GC_KEEP_GENERATIONS);
+                let created_before = older_than.or(config.flox.gc_older_than).map(|days| {
+                    SystemTime::now()
+                        .duration_since(UNIX_EPOCH)
+                        .unwrap_or_default()
+                        .as_secs()
+                        .saturating_sub(days * 24 * 60 * 60)
+                });
+
+                let mut environments = HashSet::new();
+                let mut pruned = Vec::new();
+                for floxmeta in Floxmeta::<GitCommandProvider>::list_floxmetas(&flox).await? {
+                    let mut dir = floxmeta.git.workdir();
+                    let dir = dir.get_or_insert_with(|| floxmeta.git.path());
+                    let owner = dir
+                        .file_name()
+                        .map(|owner| owner.to_string_lossy().into_owned())
+                        .unwrap_or_default();
+
+                    for environment in floxmeta.environments().await? {
+                        let name = format!("{owner}/{}", environment.name());
+                        environments.insert(name.clone());
+
+                        // the generation of a running activation is not known
+                        if !Activations::new(&flox.cache_dir, &name)
+                            .running()?
+                            .is_empty()
+                        {
+                            info!("Skipping environment '{name}', it is still activated");
+                            continue;
+                        }
+
+                        let metadata = environment.metadata().await?;
+                        for generation in metadata.prunable_generations(keep, created_before) {
+                            let link = generation_link(
+                                &flox,
+                                &owner,
+                                environment.system(),
+                                environment.name(),
+                                generation,
+                            );
+                            if link.symlink_metadata().is_err() {
+                                continue;
+                            }
+                            let path = metadata
+                                .generation(&generation.to_string())
+                                .map(|generation| generation.path().to_owned());
+                            pruned.push((name.clone(), generation, link, path));
+                        }
+                    }
+                }
+
+                let mut stale = Vec::new();
+                for name in Activations::environments(&flox.cache_dir)? {
+                    let activations = Activations::new(&flox.cache_dir, &name);
+                    if !environments.contains(&name) && activations.running()?.is_empty() {
+                        stale.push((name, activations));
+                    }
+                }
+
+                if *dry_run {
+                    let mut total = 0;
+                    for (name, generation, _, path) in &pruned {
+                        let size = match path {
+                            Some(path) => closure_size(path).await,
+                            None => None,
+                        };
+                        total += size.unwrap_or_default();
+                        println!(
+                            "Would remove generation {generation} of '{name}' ({})",
+                            size.map_or("unknown size".to_string(), format_size)
+                        );
+                    }
+                    for (name, _) in &stale {
+                        println!("Would remove activation state of '{name}'");
+                    }
+                    if !pruned.is_empty() {
+                        println!(
+                            "Up to {} could be reclaimed by collecting garbage in the nix store",
+                            format_size(total)
+                        );
+                    }
+                    return Ok(());
+                }
+
+                for (name, generation, link, _) in &pruned {
+                    std::fs::remove_file(link)
+                        .with_context(|| format!("Could not remove {}", link.display()))?;
+                    info!("Removed generation {generation} of '{name}'");
+                }
+                for (name, activations) in &stale {
+                    activations.clear()?;
+                    info!("Removed activation state of '{name}'");
+                }
+
+                if *store {
+                    let nix_store = Path::new(NIX_BIN).with_file_name("nix-store");
+                    let status = tokio::process::Command::new(nix_store)
+                        .arg("--gc")
+                        .status()
+                        .await
+                        .context("Failed to run nix-store")?;
+                    if !status.success() {
+                        bail!("Collecting garbage in the nix store failed");
+                    }
+                }
+            },
+
+            EnvironmentCommands::Envs if !Feature::Env.is_forwarded()? => {
+                let floxmetas = Floxmeta::<GitCommandProvider>::list_floxmetas(&flox).await?;
+
+                let mut values = Vec::new();
+
+                for meta in floxmetas {
+                    let envs = meta.environments().await?;
+                    let mut dir = meta.git.workdir();
+                    let dir = dir.get_or_insert_with(|| meta.git.path());
+
+                    values.push(json!({
+                        "type": "floxmeta",
+                        "path": dir,
+                        "envs": envs,
+                    }));
+                }
+
+                println!("{}", serde_json::to_string_pretty(&values)?);
+            },
+
+            // flox (sh) reports flakes without a package for this system
+            // only once it fails to build the environment, check them upfront
+            // and install them locked to the checked revision and content hash
+            EnvironmentCommands::Install { packages, .. }
+                if packages
+                    .iter()
+                    .any(|package| FlakeInstallable::parse(package).is_some())
+                    && !Feature::Env.is_forwarded()? =>
+            {
+                let mut locked = HashMap::new();
+                for package in packages {
+                    match FlakeInstallable::parse(package) {
+                        Some(installable) => {
+                            let checked =
+                                check_flake_installable(&installable, &flox.system).await?;
+                            locked.insert(
+                                OsString::from(package),
+                                OsString::from(checked.to_string()),
+                            );
+                        },
+                        None => {
+                            let request: PackageRequest = package.parse()?;
+                            if let Some(ref constraint) = request.version {
+                                check_available_version(&flox, &request.package, constraint)
+                                    .await?;
+                            }
+                        },
+                    }
+                }
+
+                let args = lock_install_args(env::args_os().skip(1), &locked);
+                run_in_flox_reporting_errors(&flox, &args).await?
+            },
+
+            EnvironmentCommands::Install {
+                packages,
+                environment_args: EnvironmentArgs { .. },
+                environment,
+            } if !Feature::Env.is_forwarded()? => {
+                subcommand_metric!("install");
+
+                let packages = packages
+                    .iter()
+                    .map(|package| package.parse())
+                    .collect::<Result<Vec<PackageRequest>, _>>()?;
+                for package in &packages {
+                    if let Some(ref constraint) = package.version {
+                        check_available_version(&flox, &package.package, constraint).await?;
+                    }
+                }
+
+                flox.environment(environment.clone().unwrap())?
+                    .install::<NixCommandLine>(&packages)
+                    .await?
+            },
+
+            EnvironmentCommands::Activate {
+                arguments: Some(_),
+                no_profile: true,
+                ..
+            } => {
+                bail_with!(FloxExitCode::Usage, "'--no-profile' only applies to interactive shells and cannot be combined with a command")
+            },
+
+            EnvironmentCommands::Activate {
+                arguments: Some(_),
+                print_script: true,
+                ..
+            } => {
+                bail_with!(
+                    FloxExitCode::Usage,
+                    "'--print-script' cannot be combined with a command"
+                )
+            },
+
+            EnvironmentCommands::Activate {
+                arguments: None,
+                run_command: true,
+                ..
+            } => {
+                bail_with!(FloxExitCode::Usage, "'--command' requires a command after '--', e.g. 'flox activate --command -- mytool --flag'")
+            },
+
+            EnvironmentCommands::Activate {
+                arguments: None,
+                dir: Some(_),
+                ..
+            } => {
+                bail_with!(FloxExitCode::Usage, "'--dir' only applies to commands")
+            },
+
+            EnvironmentCommands::Activate { dir: Some(dir), .. } if !dir.is_dir() => {
+                bail_with!(
+                    FloxExitCode::Usage,
+                    "Can not run the command in {}, it is not a directory",
+                    dir.display()
+                )
+            },
+
+            EnvironmentCommands::Activate {
+                print_script: false,
+                shell: Some(_),
+                ..
+            } if !in_direnv() => {
+                bail_with!(
+                    FloxExitCode::Usage,
+                    "'--shell' only applies to '--print-script'"
+                )
+            },
+
+            EnvironmentCommands::Activate {
+                arguments: None,
+                ephemeral,
+                watch,
+                ..
+            } if (*ephemeral || *watch) && in_direnv() => {
+                bail_with!(
+                    FloxExitCode::Usage,
+                    "'--ephemeral' and '--watch' start a subshell and cannot be used in .envrc"
+                )
+            },
+
+            EnvironmentCommands::Activate {
+                watch: true,
+                arguments: Some(_),
+                ..
+            }
+            | EnvironmentCommands::Activate {
+                watch: true,
+                print_script: true,
+                ..
+            }
+            | EnvironmentCommands::Activate {
+                watch: true,
+                json: true,
+                ..
+            }
+            | EnvironmentCommands::Activate {
+                watch: true,
+                generation: Some(_),
+                ..
+            } => {
+                bail_with!(
+                    FloxExitCode::Usage,
+                    "'--watch' only applies to subshells activating the current generation"
+                )
+            },
+
+            EnvironmentCommands::Activate {
+                json: true,
+                arguments: Some(_),
+                ..
+            }
+            | EnvironmentCommands::Activate {
+                json: true,
+                print_script: true,
+                ..
+            } => {
+                bail_with!(
+                    FloxExitCode::Usage,
+                    "'--json' cannot be combined with '--print-script' or a command"
+                )
+            },
+
+            EnvironmentCommands::Activate {
+                ephemeral: true,
+                print_script: true,
+                ..
+            }
+            | EnvironmentCommands::Activate {
+                ephemeral: true,
+                json: true,
+                ..
+            }
+            | EnvironmentCommands::Activate {
+                ephemeral: true,
+                watch: true,
+                ..
+            } => {
+                bail_with!(FloxExitCode::Usage, "'--ephemeral' only applies to subshells and commands and cannot be combined with '--print-script', '--json' or '--watch'")
+            },
+
+            EnvironmentCommands::Activate {
+                environment_args,
+                environment,
+                no_profile,
+                generation,
+                print_script,
+                shell,
+                json,
+                env_file,
+                env_file_optional,
+                watch,
+                dir,
+                ephemeral,
+                arguments,
+                ..
+            } => {
+                let activation = Activation {
+                    flox: &flox,
+                    environment_args,
+                    environments: environment,
+                    generation: *generation,
+                    env_files: env_file,
+                    env_files_optional: *env_file_optional,
+                    ephemeral: *ephemeral,
+                };
+
+                // flox (sh) runs the activation as a child of this process,
+                // unless it does not know the flags or the features used by the environments
+                let mode = match arguments {
+                    Some(_) if self.forwards_activation() && activation.forwards(None).await? => {
+                        return flox_forward(&flox).await;
+                    },
+                    Some((command, args)) => ActivationMode::Command {
+                        command,
+                        args,
+                        dir: dir.as_deref(),
+                    },
+                    None if *json => ActivationMode::Json,
+                    // direnv evaluates .envrc with bash and loads the exported variables
+                    // into the user's shell itself, print the script instead of starting a shell
+                    None if *print_script || in_direnv() => {
+                        // the export statements for bash and zsh are POSIX, only fish differs
+                        ActivationMode::Print(shell.unwrap_or(ShellKind::Bash))
+                    },
+                    None if *watch => ActivationMode::Watch {
+                        shell: Shell::detect()?,
+                        source_profile: !no_profile,
+                    },
+                    None => match Shell::detect() {
+                        Ok(shell)
+                            if self.forwards_activation()
+                                && activation.forwards(Some(shell.kind)).await? =>
+                        {
+                            return flox_forward(&flox).await;
+                        },
+                        Ok(shell) => ActivationMode::Spawn {
+                            shell,
+                            source_profile: !no_profile,
+                        },
+                        // flox (sh) falls back to a shell of its own,
+                        // but secrets are only resolved once a shell is known
+                        Err(_)
+                            if self.forwards_activation() && activation.forwards(None).await? =>
+                        {
+                            return flox_forward(&flox).await;
+                        },
+                        Err(err) => {
+                            return Err(err.context(
+                                "Activating the environment requires a supported shell \
+                                 or a command given after '--'",
+                            ))
+                        },
+                    },
+                };
+
+                subcommand_metric!("activate");
+                activation.run(mode).await?;
+            },
+
+            EnvironmentCommands::Destroy {
+                force, environment, ..
+            } if !Feature::Env.is_forwarded()? => {
+                let name = environment_name(environment.as_ref());
+                let activations = Activations::new(&flox.cache_dir, &name);
+
+                let running = activations.running()?;
+                if !running.is_empty() && !force {
+                    bail!(
+                        "Environment '{name}' is still activated by process {}, \
+                         leave the activations or use '--force' to destroy it anyway",
+                        running
+                            .iter()
+                            .map(ToString::to_string)
+                            .collect::<Vec<_>>()
+                            .join(", ")
+                    );
+                }
+
+                flox_forward(&flox).await?;
+                activations.clear()?;
+            },
+
+            // flox (sh) does not know about pinned generations,
+            // list the pinned rather than the current generation explicitly
+            EnvironmentCommands::List {
+                environment,
+                generation: None,
+                ..
+            } if pinned_generation(&environment_name(environment.as_ref())).is_some() => {
+                let generation = pinned_generation(&environment_name(environment.as_ref()))
+                    .expect("checked by guard");
+
+                let mut args = env::args_os().skip(1).collect::<Vec<_>>();
+                args.push(generation.to_string().into());
+
+                let result = run_in_flox(Some(&flox), &args).await?;
+                if result != 0 {
+                    Err(FloxShellErrorCode(ExitCode::from(result)))?
+                }
+            },
+
+            EnvironmentCommands::Pull {
+                target:
+                    Some(PullFloxmainOrEnv::Env {
+                        mode: PullMode::Link,
+                        into: Some(_),
+                        ..
+                    }),
+                ..
+            } => bail_with!(
+                FloxExitCode::Usage,
+                "'--into' requires '--copy' or '--merge'"
+            ),
+
+            // git remotes are fetched from directly, without flox (sh)
+            EnvironmentCommands::Pull {
+                target,
+                url: Some(url),
+                force,
+                ..
+            } => {
+                subcommand_metric!("pull");
+
+                let (environment, no_render, no_realize, mode, into) = match target {
+                    Some(PullFloxmainOrEnv::Main) => bail_with!(
+                        FloxExitCode::Usage,
+                        "'--main' can not be pulled from a git URL"
+                    ),
+                    Some(PullFloxmainOrEnv::Env {
+                        env,
+                        no_render,
+                        no_realize,
+                        mode,
+                        into,
+                    }) => (env.clone(), *no_render, *no_realize, *mode, into.as_deref()),
+                    None => (None, false, false, PullMode::Link, None),
+                };
+                let remote_name = remote_environment_name(url)?;
+                let environment = environment.unwrap_or_else(|| EnvironmentRef::from(remote_name));
+
+                // the environment may be the first one pulled for its owner
+                let (owner, name) = environment_owner(&environment_name(Some(&environment)));
+                let floxmeta =
+                    Floxmeta::<GitCommandProvider>::get_or_init_floxmeta(&flox, &owner).await?;
+                let (pulled, attempts) = retry(
+                    max_retries(&config),
+                    RETRY_DELAY,
+                    || {
+                        floxmeta.fetch_environment(
+                            git_remote::git_url(url),
+                            remote_name,
+                            &name,
+                            *force,
+                        )
+                    },
+                    |result| matches!(result, Err(err) if is_network_error(err)),
+                )
+                .await;
+                let pulled = pulled.map_err(|err| {
+                    git_remote_error(
+                        err,
+                        format!("Could not pull from {url} {}", after_attempts(attempts)),
+                    )
+                })?;
+
+                let name = environment_name(Some(&environment));
+                if let Ok(contents) = current_flox_nix(&pulled, &name).await {
+                    require_flox_version(&name, &contents)?;
+                }
+                match mode {
+                    PullMode::Link if no_render => {},
+                    PullMode::Link => {
+                        let metadata = pulled.metadata().await?;
+                        link_current_generation(&flox, &name, &pulled, &metadata, !no_realize)
+                            .await?
+                    },
+                    PullMode::Copy | PullMode::Merge => {
+                        let flox_nix = current_flox_nix(&pulled, &name).await?;
+                        if mode == PullMode::Copy {
+                            let into = into.unwrap_or(remote_name);
+                            copy_into_project(&flox, &name, &flox_nix, into, *force).await?
+                        } else {
+                            merge_into_project(&flox, &name, &flox_nix, into, *force).await?
+                        }
+                    },
+                }
+
+                info!("Pulled environment '{name}' from {url}");
+            },
+
+            EnvironmentCommands::Pull {
+                target:
+                    Some(PullFloxmainOrEnv::Env {
+                        env: environment,
+                        mode: mode @ (PullMode::Copy | PullMode::Merge),
+                        into,
+                        ..
+                    }),
+                force,
+                ..
+            } => {
+                subcommand_metric!("pull");
+
+                let name = environment_name(environment.as_ref());
+                let pulled = pull_flox_nix(&flox, environment.as_ref()).await?;
+                require_flox_version(&name, &pulled)?;
+
+                match mode {
+                    PullMode::Copy => {
+                        let into = into.clone().unwrap_or_else(|| {
+                            name.rsplit('/').next().unwrap_or(&name).to_string()
+                        });
+                        copy_into_project(&flox, &name, &pulled, &into, *force).await?
+                    },
+                    _ => merge_into_project(&flox, &name, &pulled, into.as_deref(), *force).await?,
+                }
+            },
+
+            // `--no-realize` is the public name of flox (sh)'s `--no-render`,
+            // `--link` is its default and unknown to it
+            EnvironmentCommands::Pull {
+                target:
+                    Some(PullFloxmainOrEnv::Env {
+                        env: environment, ..
+                    }),
+                ..
+            } => {
+                let args = env::args_os()
+                    .skip(1)
+                    .filter(|arg| arg != "--link")
+                    .map(|arg| {
+                        if arg == "--no-realize" {
+                            "--no-render".into()
+                        } else {
+                            arg
+                        }
+                    })
+                    .collect::<Vec<_>>();
+
+                // check the pulled flox.nix before flox (sh) builds the environment
+                if !args.iter().any(|arg| arg == "--no-render") {
+                    let mut fetch_args = args.clone();
+                    fetch_args.push("--no-render".into());
+                    run_in_flox_retrying(&flox, max_retries(&config), &fetch_args).await?;
+                    check_required_flox_version(&flox, environment.as_ref(), None).await?;
+                }
+
+                run_in_flox_retrying(&flox, max_retries(&config), &args).await?;
+
+                let name = environment_name(environment.as_ref());
+                if args.iter().any(|arg| arg == "--no-render") {
+                    let (floxmeta, name) =
+                        open_environment_floxmeta(&flox, environment.as_ref()).await?;
+                    let metadata = floxmeta.environment(&name).await?.metadata().await?;
+                    if let Some(generation) = metadata.generation(&metadata.current_gen) {
+                        defer_realisation(&flox.cache_dir, &name, generation.path())?;
+                    }
+                } else {
+                    clear_deferred_realisation(&flox.cache_dir, &name)?;
+                }
+            },
+
+            EnvironmentCommands::Push {
+                target: Some(PushFloxmainOrEnv::Main),
+                check_cached,
+                require_cached,
+                ..
+            } if *check_cached || *require_cached => {
+                bail_with!(
+                    FloxExitCode::Usage,
+                    "'--check-cached' and '--require-cached' only apply to environments"
+                )
+            },
+
+            // git remotes are pushed to directly, without flox (sh)
+            EnvironmentCommands::Push {
+                target,
+                url: Some(url),
+                force,
+                check_cached,
+                require_cached,
+                ..
+            } => {
+                subcommand_metric!("push");
+
+                let environment = match target {
+                    Some(PushFloxmainOrEnv::Main) => bail_with!(
+                        FloxExitCode::Usage,
+                        "'--main' can not be pushed to a git URL"
+                    ),
+                    Some(PushFloxmainOrEnv::Env { env }) => env.as_ref(),
+                    None => None,
+                };
+                let remote_name = remote_environment_name(url)?;
+                if *check_cached || *require_cached {
+                    check_cached_store_paths(&flox, environment, *require_cached).await?;
+                }
+
+                let (floxmeta, name) = open_environment_floxmeta(&flox, environment).await?;
+                let pushed = floxmeta.environment(&name).await?;
+                let (result, attempts) = retry(
+                    max_retries(&config),
+                    RETRY_DELAY,
+                    || pushed.push_to(git_remote::git_url(url), remote_name, *force),
+                    |result| matches!(result, Err(err) if is_network_error(err)),
+                )
+                .await;
+                result.map_err(|err| {
+                    git_remote_error(
+                        err,
+                        format!("Could not push to {url} {}", after_attempts(attempts)),
+                    )
+                })?;
+
+                info!("Pushed environment '{name}' to {url}");
+            },
+
+            // flox (sh) does not know about substituters,
+            // check the environment before forwarding the push without our flags
+            EnvironmentCommands::Push {
+                target,
+                check_cached,
+                require_cached,
+                ..
+            } if *check_cached || *require_cached => {
+                let environment = match target {
+                    Some(PushFloxmainOrEnv::Env { env }) => env.as_ref(),
+                    _ => None,
+                };
+                check_cached_store_paths(&flox, environment, *require_cached).await?;
+
+                let args = without_cache_checks(env::args_os().skip(1));
+
+                run_in_flox_retrying(&flox, max_retries(&config), &args).await?;
+            },
+
+            EnvironmentCommands::Edit {
+                environment_args,
+                environment,
+                file,
+                dry_run,
+            } => {
+                let name = environment_name(environment.as_ref());
+                if let Some(generation) = pinned_generation(&name) {
+                    bail!(
+                        "Generation {generation} of environment '{name}' is activated read-only, \
+                         leave the activation to edit the environment"
+                    );
+                }
+
+                // `--file -` reads the manifest from stdin,
+                // keep a copy for the editor script
+                let (contents, file) = match file {
+                    None if *dry_run => {
+                        bail_with!(
+                            FloxExitCode::Usage,
+                            "'--dry-run' requires a manifest given with '--file'"
+                        )
+                    },
+                    None => match edit_flox_nix(&flox, environment.as_ref(), &name).await? {
+                        Some(edited) => edited,
+                        // flox (sh) creates environments that do not exist yet
+                        None => return flox_forward(&flox).await,
+                    },
+                    Some(file) if file == Path::new("-") => {
+                        let mut contents = String::new();
+                        std::io::stdin()
+                            .read_to_string(&mut contents)
+                            .context("Could not read manifest from stdin")?;
+                        let file = flox.temp_dir.join("flox.nix");
+                        tokio::fs::write(&file, &contents)
+                            .await
+                            .context("Could not write manifest")?;
+                        (contents, file)
+                    },
+                    Some(file) => {
+                        let contents = tokio::fs::read_to_string(file)
+                            .await
+                            .with_context(|| format!("Could not read {}", file.display()))?;
+                        (contents, file.canonicalize()?)
+                    },
+                };
+
+                subcommand_metric!("edit");
+
+                flox_nix::validate(&contents)?;
+                require_flox_version(&name, &contents)?;
+
+                if *dry_run {
+                    lock_manifest_channels(&contents).await?;
+                    info!("The manifest is valid, environment '{name}' was not changed");
+                    return Ok(());
+                }
+
+                edit_from_file(&flox, environment_args, environment.as_ref(), &file).await?;
+            },
+
+            EnvironmentCommands::Export {
+                environment_args,
+                environment,
+                output: Some(output),
+            } => {
+                subcommand_metric!("export");
+
+                let args = sh_args("export", environment_args, environment.as_ref());
+                let archive = capture_bytes_in_flox(&flox, &args, &[]).await?;
+                tokio::fs::write(output, archive)
+                    .await
+                    .with_context(|| format!("Could not write {}", output.display()))?;
+
+                info!(
+                    "Exported environment '{}' to {}",
+                    environment_name(environment.as_ref()),
+                    output.display()
+                );
+            },
+
+            EnvironmentCommands::Import {
+                file: ImportFile::Path(file),
+                ..
+            } => {
+                verify_export(&flox, file).await?;
+                forward_reporting_collisions(&flox).await?
+            },
+
+            EnvironmentCommands::Install { .. } | EnvironmentCommands::Import { .. } => {
+                forward_reporting_collisions(&flox).await?
+            },
+
+            EnvironmentCommands::Pull { .. } | EnvironmentCommands::Push { .. } => {
+                let args = env::args_os().skip(1).collect::<Vec<_>>();
+                run_in_flox_retrying(&flox, max_retries(&config), &args).await?
+            },
+
+            _ => flox_forward(&flox).await?,
+        }
+
+        Ok(())
+    }
+
+    /// Whether the command runs with its own `--quiet` flag
+    pub fn quiet(&self) -> bool {
+        matches!(self, EnvironmentCommands::Activate { quiet: true, .. })
+    }
+
+    /// Whether flox (sh) understands the arguments of `flox activate`,
+    /// it does not know the flags added since activation moved to Rust
+    fn forwards_activation(&self) -> bool {
+        match self {
+            EnvironmentCommands::Activate {
+                no_profile,
+                env_file,
+                run_command,
+                dir,
+                quiet,
+                ..
+            } => !no_profile && env_file.is_empty() && !run_command && dir.is_none() && !quiet,
+            _ => true,
+        }
+    }
+
+    /// Whether the command changes an environment or its generations
+    fn modifies_environment(&self) -> bool {
+        matches!(
+            self,
+            EnvironmentCommands::Create { .. }
+                | EnvironmentCommands::Destroy { .. }
+                | EnvironmentCommands::Edit { dry_run: false, .. }
+                | EnvironmentCommands::Import { .. }
+                | EnvironmentCommands::Install { .. }
+                | EnvironmentCommands::Pull { .. }
+                | EnvironmentCommands::Remove { .. }
+                | EnvironmentCommands::Rollback { .. }
+                | EnvironmentCommands::SwitchGeneration { .. }
+                | EnvironmentCommands::Upgrade { dry_run: false, .. }
+                | EnvironmentCommands::Gc { dry_run: false, .. }
+                | EnvironmentCommands::WipeHistory { .. }
+        )
+    }
+}
+
+/// Environment variable marking a generation activated by `flox activate --generation`
+///
+/// Set to `<environment>@<generation>` inside the activation.
+const PINNED_GENERATION_VAR: &str = "FLOX_PINNED_GENERATION";
+
+/// Environment variable marking an activation by `flox activate --ephemeral`
+///
+/// Environments can not be modified while it is set.
+const EPHEMERAL_VAR: &str = "FLOX_EPHEMERAL";
+
+/// Environment variable listing the environments layered by `flox activate -e <a> -e <b>`
+///
+/// Set to the `:` separated names of the environments in the order of activation.
+const LAYERED_ENVIRONMENTS_VAR: &str = "FLOX_LAYERED_ENVIRONMENTS";
+
+/// Environment variable set by direnv while it evaluates an `.envrc`
+const DIRENV_IN_ENVRC_VAR: &str = "DIRENV_IN_ENVRC";
+
+/// Whether flox is invoked by direnv evaluating an `.envrc`
+fn in_direnv() -> bool {
+    env::var_os(DIRENV_IN_ENVRC_VAR).is_some()
+}
+
+/// The name of the environment referred to by `environment`, `default` if absent
+fn environment_name(environment: Option<&EnvironmentRef>) -> String {
+    environment
+        .map(|path| path.as_os_str().to_string_lossy().into_owned())
+        .unwrap_or_else(|| "default".to_string())
+}
+
+/// An activation of environments by `flox activate`
+///
+/// Every [ActivationMode] uses the same script, see [Activation::script].
+struct Activation<'a> {
+    flox: &'a Flox,
+    environment_args: &'a EnvironmentArgs,
+    environments: &'a [EnvironmentRef],
+    /// The generation pinned with `--generation`
+    generation: Option<u32>,
+    env_files: &'a [PathBuf],
+    env_files_optional: bool,
+    ephemeral: bool,
+}
+
+/// What `flox activate` does with an [Activation]
+enum ActivationMode<'a> {
+    /// Start an interactive subshell
+    Spawn { shell: Shell, source_profile: bool },
+    /// Start an interactive subshell that reloads the activation when an environment changes
+    Watch { shell: Shell, source_profile: bool },
+    /// Run `command` with its `args` passed verbatim, in `dir` if given
+    Command {
+        command: &'a str,
+        args: &'a [String],
+        dir: Option<&'a Path>,
+    },
+    /// Print the statements exporting the activated environment for a shell of this kind
+    Print(ShellKind),
+    /// Print the activated environment as [ActivationJson]
+    Json,
+}
+
+impl Activation<'_> {
+    /// Whether flox (sh) can run the activation instead
+    ///
+    /// flox (sh) can neither pin generations, activate ephemerally, layer environments
+    /// nor resolve secrets, and the interactive `shell` it starts, if any,
+    /// does not source the environments' profiles.
+    async fn forwards(&self, shell: Option<ShellKind>) -> Result<bool> {
+        if self.generation.is_some()
+            || self.ephemeral
+            || self.environments.len() > 1
+            || is_quiet()
+            || declares_secrets(self.flox, self.environments, None).await?
+        {
+            return Ok(false);
+        }
+        Ok(match shell {
+            Some(kind) => profile_script(self.flox, self.environments, None, kind)
+                .await
+                .is_empty(),
+            None => true,
+        })
+    }
+
+    /// The script activating the environments in a shell of `kind`
+    ///
+    /// Sets up the environments, then exports their secrets and the env files,
+    /// followed by the environments' profiles if the script is sourced by an `interactive` shell.
+    /// Ephemeral activations only write to `state_dir`, see [ephemeral_activation_script].
+    /// Dropping the returned path removes the file the secrets are sourced from.
+    async fn script(
+        &self,
+        state_dir: &Path,
+        kind: ShellKind,
+        interactive: bool,
+    ) -> Result<(String, Option<tempfile::TempPath>)> {
+        let mut script = match self.generation {
+            Some(generation) => {
+                let (name, path) =
+                    generation_profile(self.flox, self.environments, generation).await?;
+                pinned_activation_script(kind, &name, generation, &path)
+            },
+            None if self.ephemeral => {
+                ephemeral_activation_script(self.flox, self.environments, state_dir, kind).await?
+            },
+            None => {
+                activation_script(
+                    self.flox,
+                    self.environment_args,
+                    self.environments,
+                    Some(kind),
+                )
+                .await?
+            },
+        };
+        if self.ephemeral {
+            script.push('\n');
+            script.push_str(&kind.export(EPHEMERAL_VAR, "1"));
+            script.push('\n');
+        }
+
+        let (secrets, secrets_file) =
+            sourced_secrets_script(self.flox, self.environments, self.generation, kind).await?;
+        script.push_str(&secrets);
+        script.push_str(&env_file_script(
+            kind,
+            self.env_files,
+            self.env_files_optional,
+        )?);
+        if interactive {
+            script.push_str(
+                &profile_script(self.flox, self.environments, self.generation, kind).await,
+            );
+        }
+
+        Ok((script, secrets_file))
+    }
+
+    /// Register this process as an activation of the environments, unless it is ephemeral
+    fn register(&self) -> Result<Vec<Registration>> {
+        if self.ephemeral {
+            return Ok(Vec::new());
+        }
+        register_activations(self.flox, self.environments)
+    }
+
+    /// The environments and their generations set up by the activation
+    async fn describe(&self) -> Result<Vec<ActivatedEnvironment>> {
+        if let Some(generation) = self.generation {
+            let (_, path) = generation_profile(self.flox, self.environments, generation).await?;
+            return Ok(vec![ActivatedEnvironment {
+                name: environment_name(self.environments.first()),
+                generation,
+                path,
+            }]);
+        }
+
+        let refs = if self.environments.is_empty() {
+            vec![None]
+        } else {
+            self.environments.iter().map(Some).collect()
+        };
+        let mut environments = Vec::new();
+        for environment in refs {
+            environments.push(describe_environment(self.flox, environment).await?);
+        }
+        Ok(environments)
+    }
+
+    /// Activate the environments in `mode`
+    ///
+    /// Fails with the exit code of the shell or command if it does not succeed.
+    async fn run(&self, mode: ActivationMode<'_>) -> Result<()> {
+        // ephemeral activations keep their shell state in a directory
+        // that is removed when the shell or command exits
+        let ephemeral_dir = if self.ephemeral {
+            Some(tempfile::tempdir().context("Could not create temporary state directory")?)
+        } else {
+            None
+        };
+        let state_dir = match ephemeral_dir {
+            Some(ref dir) => dir.path(),
+            None => self.flox.temp_dir.as_path(),
+        };
+
+        let status = match mode {
+            ActivationMode::Spawn {
+                shell,
+                source_profile,
+            } => {
+                let (script, _secrets_file) = self.script(state_dir, shell.kind, true).await?;
+                let _registrations = self.register()?;
+                shell.spawn(state_dir, &script, source_profile).await?
+            },
+            ActivationMode::Watch {
+                shell,
+                source_profile,
+            } => {
+                let _registrations = self.register()?;
+                self.watch(shell, source_profile).await?
+            },
+            ActivationMode::Command { command, args, dir } => {
+                let (script, _secrets_file) =
+                    self.script(state_dir, ShellKind::Bash, false).await?;
+                let _registrations = self.register()?;
+                shell::run_with_script(state_dir, &script, dir, command, args).await?
+            },
+            ActivationMode::Print(kind) => {
+                let (script, _secrets_file) =
+                    self.script(state_dir, ShellKind::Bash, false).await?;
+                // the hooks run once here, the printed script only exports what they set up
+                let activated = shell::activated_environment(state_dir, &script).await?;
+
+                // direnv unloads the environment on its own when leaving the directory,
+                // a shell it runs the script in is not an activation
+                if !in_direnv() {
+                    register_sourced_activations(self.flox, self.environments)?;
+                }
+
+                println!(
+                    "{}",
+                    ActivationChanges::new(activated).script(kind).trim_end()
+                );
+                return Ok(());
+            },
+            ActivationMode::Json => {
+                let (script, _secrets_file) =
+                    self.script(state_dir, ShellKind::Bash, false).await?;
+                let activated = shell::activated_environment(state_dir, &script).await?;
+
+                let activation = ActivationJson::new(self.describe().await?, activated);
+                println!("{}", serde_json::to_string_pretty(&activation)?);
+                return Ok(());
+            },
+        };
+
+        if !status.success() {
+            Err(FloxShellErrorCode(ExitCode::from(
+                status.code().unwrap_or(1) as u8,
+            )))?
+        }
+        Ok(())
+    }
+
+    /// Run an interactive `shell` that sources the activation again before its next prompt
+    /// whenever the generation of an environment changes
+    ///
+    /// The working copies of project environments are rebuilt when they are edited,
+    /// which activates a new generation.
+    async fn watch(&self, shell: Shell, source_profile: bool) -> Result<ExitStatus> {
+        let flox = self.flox;
+        let environments = self.environments;
+
+        let reload = flox.temp_dir.join("reload");
+        let (script, _secrets_file) = self.script(&flox.temp_dir, shell.kind, true).await?;
+        let script = format!("{script}\n{}", shell.kind.reload_before_prompt(&reload));
+        let mut child = shell
+            .command(&flox.temp_dir, &script, source_profile)
+            .await?
+            .spawn()
+            .with_context(|| format!("Failed to start {}", shell.exe.display()))?;
+
+        let links = profile_links(flox, environments);
+        let generations = || {
+            links
+                .iter()
+                .map(|link| std::fs::read_link(link).ok())
+                .collect::<Vec<_>>()
+        };
+        let mut current = generations();
+        let mut _reload_secrets_file = None;
+
+        let refs = if environments.is_empty() {
+            vec![None]
+        } else {
+            environments.iter().map(Some).collect()
+        };
+        let mut manifests = Vec::new();
+        for environment in refs {
+            if let Ok(file) = project_flox_nix(flox, &environment_name(environment)).await {
+                manifests.push((environment, file));
+            }
+        }
+        let modified = || {
+            manifests
+                .iter()
+                .map(|(_, file)| std::fs::metadata(file).and_then(|m| m.modified()).ok())
+                .collect::<Vec<_>>()
+        };
+        let mut edited = modified();
+
+        loop {
+            tokio::select! {
+                status = child.wait() => {
+                    return status
+                        .with_context(|| format!("{} failed to run", shell.exe.display()));
+                },
+                _ = tokio::time::sleep(WATCH_INTERVAL) => {},
+            }
+
+            let changed = modified();
+            if changed != edited {
+                // wait for successive edits to settle
+                tokio::time::sleep(WATCH_DEBOUNCE).await;
+                if modified() != changed {
+                    continue;
+                }
+
+                for (((environment, file), before), after) in
+                    manifests.iter().zip(&edited).zip(&changed)
+                {
+                    if before == after {
+                        continue;
+                    }
+                    info!("{} changed, rebuilding the environment", file.display());
+                    // a new generation is activated below
+                    if let Err(err) =
+                        rebuild_edited_flox_nix(flox, self.environment_args, *environment, file)
+                            .await
+                    {
+                        warn!(
+                            "Could not rebuild environment '{}', \
+                             keeping the current activation: {err:#}",
+                            environment_name(*environment)
+                        );
+                    }
+                }
+                edited = changed;
+            }
+
+            let changed = generations();
+            if changed == current {
+                continue;
+            }
+            // wait for successive edits to settle
+            tokio::time::sleep(WATCH_DEBOUNCE).await;
+            if generations() != changed {
+                continue;
+            }
+            current = changed;
+
+            let result = match self.script(&flox.temp_dir, shell.kind, true).await {
+                Ok((script, secrets_file)) => {
+                    _reload_secrets_file = secrets_file;
+                    write_reload_script(&reload, &script)
+                },
+                Err(err) => Err(err),
+            };
+            match result {
+                Ok(()) => info!("Environment changed, reloading at the next prompt"),
+                Err(err) => warn!(
+                    "Could not reactivate the changed environment, \
+                     keeping the current activation: {err:#}"
+                ),
+            }
+        }
+    }
+}
+
+/// Whether any of `environments` declares `secrets`, without resolving them
+async fn declares_secrets(
+    flox: &Flox,
+    environments: &[EnvironmentRef],
+    generation: Option<u32>,
+) -> Result<bool> {
+    let refs = if environments.is_empty() {
+        vec![None]
+    } else {
+        environments.iter().map(Some).collect()
+    };
+
+    for environment in refs {
+        let name = environment_name(environment);
+        let contents = match read_flox_nix(flox, environment, generation).await {
+            Ok((Some(contents), _)) => contents,
+            _ => continue,
+        };
+        let secrets = flox_nix::secrets(&contents)
+            .with_context(|| format!("Could not read the secrets of environment '{name}'"))?;
+        if !secrets.is_empty() {
+            return Ok(true);
+        }
+    }
+    Ok(false)
+}
+
+/// Version of the [ActivationJson] schema
+///
+/// Must be increased whenever fields are removed or change their meaning,
+/// adding fields is backwards compatible.
+const ACTIVATION_JSON_VERSION: u32 = 1;
+
+/// Description of an activation printed by `flox activate --json`
+///
+/// Consumed by editor integrations, see [ACTIVATION_JSON_VERSION].
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+struct ActivationJson {
+    version: u32,
+    flox_version: &'static str,
+    environments: Vec<ActivatedEnvironment>,
+    #[serde(flatten)]
+    changes: ActivationChanges,
+}
+
+/// The variables an activation sets, compared to those of this process
+#[derive(Serialize, Debug, PartialEq, Eq)]
+struct ActivationChanges {
+    /// Variables set or changed by the activation, except `PATH`
+    variables: BTreeMap<String, String>,
+    /// Directories the activation added to `PATH`, in order of precedence
+    path: Vec<String>,
+}
+
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+struct ActivatedEnvironment {
+    name: String,
+    generation: u32,
+    /// Store path of the profile of the activated generation
+    path: PathBuf,
+}
+
+impl ActivationJson {
+    fn new(environments: Vec<ActivatedEnvironment>, activated: BTreeMap<String, String>) -> Self {
+        ActivationJson {
+            version: ACTIVATION_JSON_VERSION,
+            flox_version: FLOX_VERSION,
+            environments,
+            changes: ActivationChanges::new(activated),
+        }
+    }
+}
+
+impl ActivationChanges {
+    /// Variables maintained by the shell rather than the activation
+    const SHELL_VARIABLES: &'static [&'static str] = &["_", "PWD", "OLDPWD", "SHLVL"];
+
+    /// Compare the variables of an `activated` environment to the current one
+    fn new(activated: BTreeMap<String, String>) -> Self {
+        let current_path = env::var("PATH").unwrap_or_default();
+        let current_path = env::split_paths(&current_path).collect::<Vec<_>>();
+        let path = activated
+            .get("PATH")
+            .map(|path| {
+                env::split_paths(path)
+                    .filter(|dir| !current_path.contains(dir))
+                    .map(|dir| dir.to_string_lossy().into_owned())
+                    .collect()
+            })
+            .unwrap_or_default();
+
+        let variables = activated
+            .into_iter()
+            .filter(|(name, value)| {
+                name != "PATH"
+                    && !Self::SHELL_VARIABLES.contains(&name.as_str())
+                    && env::var(name).ok().as_ref() != Some(value)
+            })
+            .collect();
+
+        ActivationChanges { variables, path }
+    }
+
+    /// Statements making these changes in a shell of `kind`
+    fn script(&self, kind: ShellKind) -> String {
+        let mut script = String::new();
+        // the first directory takes precedence, so it is prepended last
+        for dir in self.path.iter().rev() {
+            script.push_str(&kind.prepend_path("PATH", Path::new(dir)));
+            script.push('\n');
+        }
+        for (name, value) in &self.variables {
+            script.push_str(&kind.export(name, value));
+            script.push('\n');
+        }
+        script
+    }
+}
+
+/// The generation of `environment` an activation sets up
+async fn describe_environment(
+    flox: &Flox,
+    environment: Option<&EnvironmentRef>,
+) -> Result<ActivatedEnvironment> {
+    let (floxmeta, name) = open_environment_floxmeta(flox, environment).await?;
+    let metadata = floxmeta.environment(&name).await?.metadata().await?;
+
+    let generation = match pinned_generation(&name) {
+        Some(generation) => generation,
+        None => metadata
+            .current_gen
+            .parse()
+            .context("Could not parse current generation")?,
+    };
+    let path = metadata
+        .generation(&generation.to_string())
+        .with_context(|| format!("Generation {generation} of environment '{name}' does not exist"))?
+        .path()
+        .to_path_buf();
+
+    Ok(ActivatedEnvironment {
+        name: environment_name(environment),
+        generation,
+        path,
+    })
+}
+
+/// The names activations of `environments` are registered as
+fn activation_names(environments: &[EnvironmentRef]) -> Vec<String> {
+    if environments.is_empty() {
+        vec![environment_name(None)]
+    } else {
+        environments
+            .iter()
+            .map(|environment| environment_name(Some(environment)))
+            .collect()
+    }
+}
+
+/// Register the current process as an activation of each of `environments`
+fn register_activations(flox: &Flox, environments: &[EnvironmentRef]) -> Result<Vec<Registration>> {
+    activation_names(environments)
+        .iter()
+        .map(|name| Activations::new(&flox.cache_dir, name).register())
+        .collect()
+}
+
+/// Register the shell sourcing the activation script as an activation of each of `environments`
+///
+/// The script is printed for the shell that runs flox, i.e. the parent of this process.
+fn register_sourced_activations(flox: &Flox, environments: &[EnvironmentRef]) -> Result<()> {
+    let shell = nix::unistd::getppid().as_raw();
+    activation_names(environments)
+        .iter()
+        .try_for_each(|name| Activations::new(&flox.cache_dir, name).register_sourced(shell))
+}
+
+/// The owner and the name of `environment` within the owner's floxmeta
+///
+/// Environments are referred to as `[<owner>/]<name>`,
+/// if no owner is given the environment is assumed to be local.
+fn environment_owner(environment: &str) -> (String, String) {
+    environment
+        .split_once('/')
+        .map(|(owner, name)| (owner.to_string(), name.to_string()))
+        .unwrap_or_else(|| ("local".to_string(), environment.to_string()))
+}
+
+/// Open the floxmeta repository containing `environment`
+///
+/// Returns the floxmeta and the name of the environment within it,
+/// see [environment_owner].
+async fn open_environment_floxmeta<'flox>(
+    flox: &'flox Flox,
+    environment: Option<&EnvironmentRef>,
+) -> Result<(Floxmeta<'flox, GitCommandProvider>, String)> {
+    let environment = environment_name(environment);
+    let (owner, name) = environment_owner(&environment);
+
+    // todo rename project!
+    // this is now just a root
+
+    let floxmeta = flox
+        .project(flox.cache_dir.join("meta").join(&owner))
+        .guard::<GitCommandProvider>()
+        .await?
+        .open()
+        .map_err(|_| {
+            anyhow!(
+                "No environment metadata for '{environment}', \
+                 the environments of '{owner}' have not been created or pulled"
+            )
+        })?
+        .guard_floxmeta()
+        .await?;
+
+    Ok((floxmeta, name))
+}
+
+/// Check that substituters provide the store paths of the current generation of `environment`
+///
+/// Warns about store paths that are not available,
+/// or fails listing them if `require_cached` is set.
+async fn check_cached_store_paths(
+    flox: &Flox,
+    environment: Option<&EnvironmentRef>,
+    require_cached: bool,
+) -> Result<()> {
+    let (floxmeta, name) = open_environment_floxmeta(flox, environment).await?;
+    let environment = floxmeta.environment(&name).await?;
+    let metadata = environment.metadata().await?;
+    let generation = environment.generation(&metadata.current_gen).await?;
+
+    let store_paths = generation
+        .packages()
+        .into_iter()
+        .flat_map(|package| package.store_paths)
+        .collect::<Vec<_>>();
+    let uncached = uncached_store_paths(&store_paths).await?;
+
+    if uncached.is_empty() {
+        info!(
+            "All {} store paths of environment '{name}' are available from substituters",
+            store_paths.len()
+        );
+    } else {
+        let message = uncached_message(&name, store_paths.len(), &uncached);
+        if require_cached {
+            bail!("{message}");
+        }
+        warn!("{message}");
+    }
+    Ok(())
+}
+
+/// Report of the `uncached` store paths among the `total` store paths of environment `name`
+fn uncached_message(name: &str, total: usize, uncached: &[String]) -> String {
+    format!(
+        "{} of {total} store paths of environment '{name}' are not available \
+         from any configured substituter and will have to be built by its users:\n{}",
+        uncached.len(),
+        uncached
+            .iter()
+            .map(|path| format!("  {path}"))
+            .collect::<Vec<_>>()
+            .join("\n")
+    )
+}
+
+/// `args` without the flags checking substituters, which flox (sh) does not know
+fn without_cache_checks(args: impl IntoIterator<Item = OsString>) -> Vec<OsString> {
+    args.into_iter()
+        .filter(|arg| arg != "--check-cached" && arg != "--require-cached")
+        .collect()
+}
+
+/// Forward to flox (sh) with [run_in_flox_reporting_errors]
+async fn forward_reporting_collisions(flox: &Flox) -> Result<()> {
+    let args = env::args_os().skip(1).collect::<Vec<_>>();
+    run_in_flox_reporting_errors(flox, &args).await
+}
+
+/// Run flox (sh) and explain collisions of files that fail the build of the environment
+///
+/// nix only names the store paths of colliding files,
+/// [FileCollision] names the packages and how to resolve the collision.
+/// flox (sh) exits with 1 for most failures,
+/// the errors of nix and git on its stderr select a more specific [FloxExitCode].
+/// Both need the captured stderr, which is kept a terminal in interactive use,
+/// see [run_in_flox_with_stderr].
+async fn run_in_flox_reporting_errors(flox: &Flox, args: &[OsString]) -> Result<()> {
+    let (result, stderr) = run_in_flox_with_stderr(flox, args).await?;
+    report_flox_errors(result, &stderr)
+}
+
+/// Run flox (sh) like [run_in_flox_reporting_errors],
+/// again after network errors of its pushes and pulls
+///
+/// Errors are only recognized if the stderr of flox (sh) is captured,
+/// see [crate::utils::logger::plain_stderr].
+async fn run_in_flox_retrying(flox: &Flox, max_retries: u32, args: &[OsString]) -> Result<()> {
+    let (result, attempts) = retry(
+        max_retries,
+        RETRY_DELAY,
+        || run_in_flox_with_stderr(flox, args),
+        |result| {
+            matches!(result, Ok((code, stderr))
+                if *code != 0 && classify_nix_errors(stderr) == Some(FloxExitCode::Network))
+        },
+    )
+    .await;
+    let (result, stderr) = result?;
+    if result != 0 && attempts > 1 {
+        error!("Could not reach the remote {}", after_attempts(attempts));
+    }
+    report_flox_errors(result, &stderr)
+}
+
+/// Report the errors of flox (sh) exiting with `result`,
+/// with the [FloxExitCode] of the failure it wrote to `stderr`
+fn report_flox_errors(result: u8, stderr: &str) -> Result<()> {
+    if result != 0 {
+        for collision in FileCollision::parse_nix_errors(stderr) {
+            error!("{collision}");
+        }
+        let code = match classify_nix_errors(stderr) {
+            Some(code) if result == u8::from(FloxExitCode::Failure) => u8::from(code),
+            _ => result,
+        };
+        Err(FloxShellErrorCode(ExitCode::from(code)))?
+    }
+    Ok(())
+}
+
+/// Fetch the metadata of `environment` and read the `flox.nix` of its current generation
+async fn pull_flox_nix(flox: &Flox, environment: Option<&EnvironmentRef>) -> Result<String> {
+    let mut args: Vec<OsString> = vec!["pull".into(), "--no-render".into()];
+    if let Some(environment) = environment {
+        args.extend(["-e".into(), environment.into()]);
+    }
+    run_in_flox_reporting_errors(flox, &args).await?;
+
+    let (floxmeta, name) = open_environment_floxmeta(flox, environment).await?;
+    let pulled = floxmeta.environment(&name).await?;
+    current_flox_nix(&pulled, &environment_name(environment)).await
+}
+
+/// Read the `flox.nix` of the current generation of the pulled environment `name`
+async fn current_flox_nix(
+    pulled: &Environment<'_, GitCommandProvider>,
+    name: &str,
+) -> Result<String> {
+    let generation = pulled.metadata().await?.current_gen;
+    pulled.flox_nix(&generation).await.with_context(|| {
+        format!("Environment '{name}' is not defined by a flox.nix and can only be linked")
+    })
+}
+
+/// The working tree of the flox project in the current directory
+async fn project_workdir(flox: &Flox) -> Result<PathBuf> {
+    let project = flox
+        .project(env::current_dir()?)
+        .guard::<GitCommandProvider>()
+        .await?
+        .open()
+        .map_err(|_| anyhow!("Not in a git repository"))?
+        .guard()
+        .await?
+        .open()
+        .map_err(|_| anyhow!("Not in a flox project, create one with 'flox init'"))?;
+    Ok(project
+        .workdir()
+        .context("The flox project is a bare repository")?
+        .to_path_buf())
+}
+
+/// The `flox.nix` of the project environment `name` in the current directory,
+/// the working copy of an environment pulled with `flox pull --copy`
+async fn project_flox_nix(flox: &Flox, name: &str) -> Result<PathBuf> {
+    let flox_nix = project_workdir(flox)
+        .await?
+        .join("pkgs")
+        .join(name)
+        .join("flox.nix");
+    if !flox_nix.exists() {
+        bail_with!(
+            FloxExitCode::NotFound,
+            "The project has no working copy of environment '{name}', \
+             pull one with 'flox pull --copy' or compare generations with 'flox diff <from> [<to>]'"
+        );
+    }
+    Ok(flox_nix)
+}
+
+/// Copy the pulled `flox.nix` of `name` to the project environment `into`
+/// in the current directory
+async fn copy_into_project(
+    flox: &Flox,
+    name: &str,
+    pulled: &str,
+    into: &str,
+    force: bool,
+) -> Result<()> {
+    let workdir = project_workdir(flox).await?;
+
+    let flox_nix = workdir.join("pkgs").join(into).join("flox.nix");
+    if flox_nix.exists() && !force {
+        bail_with!(
+            FloxExitCode::Resolution,
+            "Project environment '{into}' already exists, \
+             use '--force' to replace it or '--merge' to merge into it"
+        );
+    }
+
+    tokio::fs::create_dir_all(flox_nix.parent().expect("has parent")).await?;
+    tokio::fs::write(&flox_nix, pulled)
+        .await
+        .with_context(|| format!("Could not write {}", flox_nix.display()))?;
+    // flakes only see files tracked by git
+    GitCommandProvider::discover(workdir)
+        .await?
+        .add(&[&flox_nix])
+        .await?;
+
+    info!("Copied environment '{name}' to project environment '{into}'");
+    Ok(())
+}
+
+/// Merge the pulled `flox.nix` of `name` into a project environment in the current directory
+///
+/// Conflicting attributes keep their local value unless `force` is set
+/// and are reported as an error after the other changes are written.
+async fn merge_into_project(
+    flox: &Flox,
+    name: &str,
+    pulled: &str,
+    into: Option<&str>,
+    force: bool,
+) -> Result<()> {
+    let projects =
+        Project::find::<NixCommandLine, GitCommandProvider>(flox, into.unwrap_or_default()).await?;
+    let project = match projects.as_slice() {
+        [project] => project,
+        [] => bail_with!(
+            FloxExitCode::NotFound,
+            "No project environment to merge into, create one with 'flox init'"
+        ),
+        _ => bail_with!(
+            FloxExitCode::Usage,
+            "Multiple project environments found, select one with '--into': {}",
+            projects
+                .iter()
+                .map(|project| project.name.as_str())
+                .collect::<Vec<_>>()
+                .join(", ")
+        ),
+    };
+
+    let flox_nix = project
+        .workdir
+        .join("pkgs")
+        .join(&project.name)
+        .join("flox.nix");
+    let local = tokio::fs::read_to_string(&flox_nix)
+        .await
+        .with_context(|| format!("Could not read {}", flox_nix.display()))?;
+
+    let merged = flox_nix::merge(&local, pulled, force)?;
+    if !merged.changed.is_empty() {
+        flox_nix::validate(&merged.contents)?;
+        tokio::fs::write(&flox_nix, &merged.contents)
+            .await
+            .with_context(|| format!("Could not write {}", flox_nix.display()))?;
+        for attr in &merged.changed {
+            info!("merged {attr}");
+        }
+    }
+
+    if !merged.conflicts.is_empty() {
+        for conflict in &merged.conflicts {
+            warn!(
+                "conflict in {}: {} in '{}', {} in '{name}'",
+                conflict.attr,
+                flox_nix::to_nix(&conflict.local),
+                project.name,
+                flox_nix::to_nix(&conflict.other),
+            );
+        }
+        bail_with!(
+            FloxExitCode::Resolution,
+            "Kept the local value of {} conflicting attributes, \
+             resolve them with 'flox edit' or use '--force' to take the pulled values",
+            merged.conflicts.len()
+        );
+    }
+
+    if merged.changed.is_empty() {
+        info!(
+            "Project environment '{}' already contains environment '{name}'",
+            project.name
+        );
+    }
+
+    Ok(())
+}
+
+/// Install ids of the packages of the current or pinned generation of `environment`
+pub(super) async fn installed_package_ids(
+    flox: &Flox,
+    environment: Option<&EnvironmentRef>,
+) -> Result<Vec<String>> {
+    let (floxmeta, name) = open_environment_floxmeta(flox, environment).await?;
+    let environment = floxmeta.environment(&name).await?;
+    let generation = match pinned_generation(&name) {
+        Some(generation) => generation.to_string(),
+        None => environment.metadata().await?.current_gen,
+    };
+
+    Ok(environment
+        .generation(&generation)
+        .await?
+        .packages()
+        .into_iter()
+        .map(|package| package.install_id)
+        .collect())
+}
+
+/// The generation of the environment `name` pinned by the current activation, if any
+fn pinned_generation(name: &str) -> Option<u32> {
+    let pinned = env::var(PINNED_GENERATION_VAR).ok()?;
+    let (environment, generation) = pinned.rsplit_once('@')?;
+    let environment = environment
+        .split_once('/')
+        .map_or(environment, |(_, name)| name);
+    let name = name.split_once('/').map_or(name, |(_, name)| name);
+
+    if environment != name {
+        return None;
+    }
+    generation.parse().ok()
+}
+
+/// Find the profile of `generation` of the given environment
+///
+/// Returns the name of the environment and the store path of the profile,
+/// which is realised if it is not yet present.
+/// Fails listing the valid generations if `generation` does not exist.
+async fn generation_profile(
+    flox: &Flox,
+    environments: &[EnvironmentRef],
+    generation: u32,
+) -> Result<(String, PathBuf)> {
+    let environment = match environments {
+        [] => None,
+        [environment] => Some(environment),
+        _ => bail_with!(
+            FloxExitCode::Usage,
+            "'--generation' can only be used with a single environment"
+        ),
+    };
+    let (floxmeta, name) = open_environment_floxmeta(flox, environment).await?;
+    let metadata = floxmeta.environment(&name).await?.metadata().await?;
+
+    let path = match metadata.generation(&generation.to_string()) {
+        Some(generation_metadata) => generation_metadata.path().to_owned(),
+        None => bail_with!(
+            FloxExitCode::NotFound,
+            "Generation {generation} of environment '{name}' does not exist, valid generations are: {}",
+            format_generations(&metadata.generation_numbers())
+        ),
+    };
+
+    // environments pulled with `--no-realize` are only fetched when activated
+    if !path.exists() {
+        realise(&path).await?;
+    }
+
+    Ok((name, path))
+}
+
+/// The file recording the store path of `environment`
+/// whose realisation `flox pull --no-realize` deferred to its next activation
+fn deferred_realisation_record(cache_dir: &Path, environment: &str) -> PathBuf {
+    let (owner, name) = environment
+        .split_once('/')
+        .unwrap_or(("local", environment));
+    cache_dir.join("deferred").join(owner).join(name)
+}
+
+/// Record that `path` of `environment` is to be realised when it is activated
+fn defer_realisation(cache_dir: &Path, environment: &str, path: &Path) -> Result<()> {
+    let record = deferred_realisation_record(cache_dir, environment);
+    std::fs::create_dir_all(record.parent().expect("has parent"))
+        .and_then(|_| std::fs::write(&record, path.as_os_str().as_bytes()))
+        .with_context(|| format!("Could not write {}", record.display()))
+}
+
+/// The store path of `environment` whose realisation was deferred, if any
+fn deferred_realisation(cache_dir: &Path, environment: &str) -> Result<Option<PathBuf>> {
+    let record = deferred_realisation_record(cache_dir, environment);
+    match std::fs::read(&record) {
+        Ok(path) => Ok(Some(PathBuf::from(OsString::from_vec(path)))),
+        Err(err) if err.kind() == std::io::ErrorKind::NotFound => Ok(None),
+        Err(err) => Err(err).with_context(|| format!("Could not read {}", record.display())),
+    }
+}
+
+fn clear_deferred_realisation(cache_dir: &Path, environment: &str) -> Result<()> {
+    let record = deferred_realisation_record(cache_dir, environment);
+    match std::fs::remove_file(&record) {
+        Err(err) if err.kind() != std::io::ErrorKind::NotFound => {
+            Err(err).with_context(|| format!("Could not remove {}", record.display()))
+        },
+        _ => Ok(()),
+    }
+}
+
+/// Realise the store path of `environment` deferred by `flox pull --no-realize`
+///
+/// The record is kept until the path is realised,
+/// so an interrupted activation fetches it again.
+async fn realise_deferred(cache_dir: &Path, environment: &str) -> Result<()> {
+    let path = match deferred_realisation(cache_dir, environment)? {
+        Some(path) => path,
+        None => return Ok(()),
+    };
+    if !path.exists() {
+        realise(&path).await?;
+    }
+    clear_deferred_realisation(cache_dir, environment)
+}
+
+/// Build or substitute `path` into the local store
+async fn realise(path: &Path) -> Result<()> {
+    info!("Fetching {}...", path.display());
+
+    let nix_store = Path::new(NIX_BIN).with_file_name("nix-store");
+    let output = tokio::process::Command::new(nix_store)
+        .arg("--realise")
+        .arg(path)
+        .stdout(Stdio::null())
+        .output()
+        .await
+        .context("Failed to run nix-store")?;
+
+    if !output.status.success() {
+        bail!(
+            "Could not fetch {}:\n{}",
+            path.display(),
+            String::from_utf8_lossy(&output.stderr)
+        );
+    }
+    Ok(())
+}
+
+/// Statements exporting the variables defined in `env_files`, in order
+///
+/// Files use dotenv syntax, i.e. `[export] NAME=value` lines and `#` comments.
+/// Missing files are an error unless `optional` is set.
+fn env_file_script(kind: ShellKind, env_files: &[PathBuf], optional: bool) -> Result<String> {
+    let mut script = String::new();
+    for file in env_files {
+        if optional && !file.exists() {
+            debug!("Skipping missing env file {}", file.display());
+            continue;
+        }
+
+        let variables = dotenv::from_path_iter(file)
+            .with_context(|| format!("Could not read env file {}", file.display()))?;
+        for variable in variables {
+            let (name, value) =
+                variable.with_context(|| format!("Could not parse env file {}", file.display()))?;
+            script.push_str(&kind.export(&name, &value));
+            script.push('\n');
+        }
+    }
+    Ok(script)
+}
+
+/// The `profile` snippets of the environments' `flox.nix` for `kind`
+///
+/// The snippets are read from `generation`, if given, or the activated generation.
+/// Unlike the hook that runs in a subshell during the activation,
+/// they are sourced by the interactive shell itself and can define aliases and functions.
+/// Environments whose `flox.nix` can not be read are skipped.
+async fn profile_script(
+    flox: &Flox,
+    environments: &[EnvironmentRef],
+    generation: Option<u32>,
+    kind: ShellKind,
+) -> String {
+    let refs = if environments.is_empty() {
+        vec![None]
+    } else {
+        environments.iter().map(Some).collect()
+    };
+
+    let mut script = String::new();
+    for environment in refs {
+        let name = environment_name(environment);
+        let contents = read_flox_nix(flox, environment, generation)
+            .await
+            .map(|(contents, _)| contents);
+
+        match contents {
+            Ok(Some(contents)) => match Profile::from_flox_nix(&contents) {
+                Ok(profile) => script.push_str(&profile.script(&kind.to_string())),
+                Err(err) => warn!("Skipping the profile of environment '{name}': {err}"),
+            },
+            Ok(None) => {},
+            Err(err) => debug!("Could not read the profile of environment '{name}': {err:#}"),
+        }
+    }
+    script
+}
+
+/// The `flox.nix` of an environment and the store path of its profile
+///
+/// Reads `generation`, the generation pinned by the activation,
+/// or the current generation of the environment.
+async fn read_flox_nix(
+    flox: &Flox,
+    environment: Option<&EnvironmentRef>,
+    generation: Option<u32>,
+) -> Result<(Option<String>, Option<PathBuf>)> {
+    let (floxmeta, name) = open_environment_floxmeta(flox, environment).await?;
+    let environment = floxmeta.environment(&name).await?;
+    let metadata = environment.metadata().await?;
+    let generation = match generation.or_else(|| pinned_generation(&name)) {
+        Some(generation) => generation.to_string(),
+        None => metadata.current_gen.clone(),
+    };
+
+    let path = metadata
+        .generation(&generation)
+        .map(|generation| generation.path().to_owned());
+    Ok((environment.flox_nix(&generation).await, path))
+}
+
+/// Fail if `environment` requires a newer flox, see [require_flox_version]
+///
+/// Reads the `flox.nix` of `generation` or the current generation.
+/// Environments that do not exist or are not defined by a `flox.nix` are not checked,
+/// flox (sh) reports them when it uses them.
+async fn check_required_flox_version(
+    flox: &Flox,
+    environment: Option<&EnvironmentRef>,
+    generation: Option<u32>,
+) -> Result<()> {
+    let name = environment_name(environment);
+    let owner = name.split_once('/').map_or("local", |(owner, _)| owner);
+    if !flox.cache_dir.join("meta").join(owner).exists() {
+        return Ok(());
+    }
+
+    match read_flox_nix(flox, environment, generation).await {
+        Ok((Some(contents), _)) => require_flox_version(&name, &contents),
+        Ok((None, _)) => Ok(()),
+        Err(err) => {
+            debug!("Not checking the flox version required by '{name}': {err}");
+            Ok(())
+        },
+    }
+}
+
+/// Allow unfree packages in the builds of `environment`
+/// if its `flox.nix` sets `options.allow.unfree`
+///
+/// Environments are built with impure evaluations by flox (sh) and the Rust implementation,
+/// both inherit [flox_nix::ALLOW_UNFREE_VAR] from this process.
+async fn allow_unfree(flox: &Flox, environment: Option<&EnvironmentRef>) {
+    let name = environment_name(environment);
+    let owner = name.split_once('/').map_or("local", |(owner, _)| owner);
+    if !flox.cache_dir.join("meta").join(owner).exists() {
+        return;
+    }
+
+    match read_flox_nix(flox, environment, None).await {
+        Ok((Some(contents), _)) if flox_nix::allows_unfree(&contents).unwrap_or(false) => {
+            debug!("Allowing unfree packages in '{name}'");
+            env::set_var(flox_nix::ALLOW_UNFREE_VAR, "1");
+        },
+        Ok(_) => {},
+        Err(err) => debug!("Not checking whether '{name}' allows unfree packages: {err}"),
+    }
+}
+
+/// Fail if the `flox.nix` of `name` requires a newer flox with `options.flox-version`
+fn require_flox_version(name: &str, contents: &str) -> Result<()> {
+    let required = match flox_nix::required_flox_version(contents)? {
+        Some(required) => required,
+        None => return Ok(()),
+    };
+    if !flox_nix::satisfies_flox_version(&required, FLOX_VERSION) {
+        bail!(
+            "Environment '{name}' requires flox {required}, but this is flox {FLOX_VERSION}.\n\
+             Update flox the way it was installed, e.g. with the flox installer or nix profile"
+        );
+    }
+    Ok(())
+}
+
+/// Replace the manifest of `environment` with the validated `file` and build it
+///
+/// flox (sh) opens the manifest in `$EDITOR`,
+/// use an "editor" that replaces it with the file.
+async fn edit_from_file(
+    flox: &Flox,
+    environment_args: &EnvironmentArgs,
+    environment: Option<&EnvironmentRef>,
+    file: &Path,
+) -> Result<()> {
+    let editor = flox.temp_dir.join("edit-from-file");
+    tokio::fs::write(
+        &editor,
+        format!(
+            "#!/bin/sh\nexec cp {} \"$1\"\n",
+            shell_escape::escape(file.to_string_lossy())
+        ),
+    )
+    .await
+    .context("Could not write editor script")?;
+    tokio::fs::set_permissions(&editor, std::fs::Permissions::from_mode(0o755)).await?;
+    env::set_var("EDITOR", &editor);
+    env::set_var("VISUAL", &editor);
+
+    let args = sh_args("edit", environment_args, environment);
+    run_in_flox_reporting_errors(flox, &args).await
+}
+
+/// Build the project's working copy `file` of `environment` if it is valid,
+/// for `flox activate --watch`
+async fn rebuild_edited_flox_nix(
+    flox: &Flox,
+    environment_args: &EnvironmentArgs,
+    environment: Option<&EnvironmentRef>,
+    file: &Path,
+) -> Result<()> {
+    let contents = tokio::fs::read_to_string(file)
+        .await
+        .with_context(|| format!("Could not read {}", file.display()))?;
+    flox_nix::validate(&contents)?;
+    require_flox_version(&environment_name(environment), &contents)?;
+    edit_from_file(flox, environment_args, environment, file).await
+}
+
+/// Open the current `flox.nix` of `name` in the user's editor until it is valid
+///
+/// Invalid edits are reported and, if the user agrees, opened again.
+/// Returns the edited contents and the file they are written to,
+/// or `None` if the environment has no `flox.nix` to edit yet.
+async fn edit_flox_nix(
+    flox: &Flox,
+    environment: Option<&EnvironmentRef>,
+    name: &str,
+) -> Result<Option<(String, PathBuf)>> {
+    let current: Result<String> = async {
+        let (floxmeta, name) = open_environment_floxmeta(flox, environment).await?;
+        current_flox_nix(&floxmeta.environment(&name).await?, &name).await
+    }
+    .await;
+    let mut contents = match current {
+        Ok(contents) => contents,
+        Err(err) => {
+            debug!("Could not read the flox.nix of environment '{name}': {err:#}");
+            return Ok(None);
+        },
+    };
+
+    let editor = env::var("VISUAL")
+        .or_else(|_| env::var("EDITOR"))
+        .unwrap_or_else(|_| "vi".to_string());
+    let file = flox.temp_dir.join("flox.nix");
+    loop {
+        tokio::fs::write(&file, &contents)
+            .await
+            .context("Could not write manifest")?;
+
+        // `$EDITOR` may contain arguments, e.g. `code --wait`
+        let status = tokio::process::Command::new("sh")
+            .args(["-c", &format!("{editor} \"$1\""), "sh"])
+            .arg(&file)
+            .status()
+            .await
+            .context("Failed to run sh")?;
+        if !status.success() {
+            bail!("'{editor}' failed with {status}, environment '{name}' is unchanged");
+        }
+
+        contents = tokio::fs::read_to_string(&file)
+            .await
+            .with_context(|| format!("Could not read {}", file.display()))?;
+        let err = match flox_nix::validate(&contents) {
+            Ok(()) => match require_flox_version(name, &contents) {
+                Ok(()) => return Ok(Some((contents, file))),
+                Err(err) => err,
+            },
+            Err(err) => err.into(),
+        };
+
+        if !Dialog::can_prompt() {
+            return Err(err);
+        }
+        error!("{err:#}");
+        let dialog = Dialog {
+            message: "The manifest is invalid, edit it again?",
+            help_message: Some("Declining discards the changes"),
+            typed: Confirm {
+                default: Some(true),
+            },
+        };
+        if !dialog.prompt().await? {
+            bail!("Aborted, environment '{name}' is unchanged");
+        }
+    }
+}
+
+/// Statements exporting the `secrets` of `environments`
+///
+/// Secrets are resolved every time the script is requested,
+/// fails if any of them can not be resolved.
+/// Scripts that are written to disk source them with [sourced_secrets_script] instead.
+async fn secrets_script(
+    flox: &Flox,
+    environments: &[EnvironmentRef],
+    generation: Option<u32>,
+    kind: ShellKind,
+) -> Result<String> {
+    let refs = if environments.is_empty() {
+        vec![None]
+    } else {
+        environments.iter().map(Some).collect()
+    };
+
+    let mut script = String::new();
+    for environment in refs {
+        let name = environment_name(environment);
+        let (contents, profile) = match read_flox_nix(flox, environment, generation).await {
+            Ok((Some(contents), profile)) => (contents, profile),
+            Ok((None, _)) => continue,
+            Err(err) => {
+                debug!("Could not read the secrets of environment '{name}': {err:#}");
+                continue;
+            },
+        };
+
+        let secrets = flox_nix::secrets(&contents)
+            .with_context(|| format!("Could not read the secrets of environment '{name}'"))?;
+        for (variable, secret) in &secrets {
+            let value = resolve_secret(secret, profile.as_deref())
+                .await
+                .with_context(|| {
+                    format!("Could not resolve secret '{variable}' of environment '{name}'")
+                })?;
+            script.push_str(&kind.export(variable, &value));
+            script.push('\n');
+        }
+    }
+    Ok(script)
+}
+
+/// Statements sourcing the `secrets` of `environments` from a separate file
+///
+/// The rcfiles of activations are kept in `flox.temp_dir` with `--debug`,
+/// so the resolved values are written to a file only readable by the user instead,
+/// which the shell removes right after sourcing it.
+/// Dropping the returned path removes the file if the shell never got to source it.
+async fn sourced_secrets_script(
+    flox: &Flox,
+    environments: &[EnvironmentRef],
+    generation: Option<u32>,
+    kind: ShellKind,
+) -> Result<(String, Option<tempfile::TempPath>)> {
+    let secrets = secrets_script(flox, environments, generation, kind).await?;
+    if secrets.is_empty() {
+        return Ok((String::new(), None));
+    }
+    let (script, path) = write_secrets_file(kind, &secrets)?;
+    Ok((script, Some(path)))
+}
+
+/// Write `secrets` to a new file only readable by the user
+/// and return the statements sourcing and removing it
+fn write_secrets_file(kind: ShellKind, secrets: &str) -> Result<(String, tempfile::TempPath)> {
+    // created with mode 0600
+    let mut file = tempfile::Builder::new()
+        .prefix("flox-secrets-")
+        .tempfile()
+        .context("Could not create a file for the secrets")?;
+    file.write_all(secrets.as_bytes())
+        .context("Could not write the secrets")?;
+    let path = file.into_temp_path();
+
+    Ok((format!("{}\n", kind.source_and_remove(&path)), path))
+}
+
+/// Run the command or read the file of `secret`
+///
+/// Commands run in the environment of `flox`, with `profile`'s `bin` directory
+/// prepended to `PATH` for [SecretContext::Environment].
+/// Like `$(...)`, trailing newlines are stripped from the value.
+async fn resolve_secret(secret: &Secret, profile: Option<&Path>) -> Result<String> {
+    let value = match (&secret.command, &secret.file) {
+        (Some(command), _) => {
+            let mut child = tokio::process::Command::new("sh");
+            // allow password managers to prompt for a password
+            child
+                .args(["-c", command])
+                .stdin(Stdio::inherit())
+                .stderr(Stdio::inherit());
+            if let (SecretContext::Environment, Some(profile)) = (secret.context, profile) {
+                let path = env::var_os("PATH").unwrap_or_default();
+                let paths = std::iter::once(profile.join("bin")).chain(env::split_paths(&path));
+                child.env("PATH", env::join_paths(paths)?);
+            }
+
+            let output = child.output().await.context("Failed to run sh")?;
+            if !output.status.success() {
+                bail!("`{command}` failed with {}", output.status);
+            }
+            String::from_utf8(output.stdout)
+                .with_context(|| format!("`{command}` printed a value that is not valid UTF-8"))?
+        },
+        (None, Some(file)) => {
+            let path = match file.strip_prefix("~/") {
+                Some(file) => dirs::home_dir()
+                    .context("Could not find the home directory")?
+                    .join(file),
+                None => PathBuf::from(file),
+            };
+            tokio::fs::read_to_string(&path)
+                .await
+                .with_context(|| format!("Could not read {}", path.display()))?
+        },
+        (None, None) => unreachable!("secrets are validated to have either a command or a file"),
+    };
+
+    Ok(value.trim_end_matches('\n').to_string())
+}
+
+/// Script activating the profile of a single generation at `path`
+fn pinned_activation_script(kind: ShellKind, name: &str, generation: u32, path: &Path) -> String {
+    [
+        kind.prepend_path("PATH", &path.join("bin")),
+        kind.export(PINNED_GENERATION_VAR, &format!("{name}@{generation}")),
+        kind.source_if_exists(&path.join("activate")),
+    ]
+    .join("\n")
+}
+
+/// Format generation numbers as ranges, e.g. `1-3, 5, 7-9`
+fn format_generations(generations: &[u32]) -> String {
+    let mut ranges: Vec<(u32, u32)> = Vec::new();
+    for &generation in generations {
+        match ranges.last_mut() {
+            Some((_, end)) if *end + 1 == generation => *end = generation,
+            _ => ranges.push((generation, generation)),
+        }
+    }
+
+    if ranges.is_empty() {
+        return "none".to_string();
+    }
+
+    ranges
+        .iter()
+        .map(|(start, end)| {
+            if start == end {
+                start.to_string()
+            } else {
+                format!("{start}-{end}")
+            }
+        })
+        .collect::<Vec<_>>()
+        .join(", ")
+}
+
+/// Print a [GenerationDiff] as one line per package
+///
+/// Added packages are marked with `+`, removed ones with `-`
+/// and packages resolved to different store paths with `~`.
+fn print_generation_diff(diff: &GenerationDiff) {
+    let describe = |package: &InstalledPackage| match package.version {
+        Some(ref version) => format!("{} {version}", package.install_id),
+        None => package.install_id.clone(),
+    };
+
+    for package in &diff.added {
+        println!("+ {}", describe(package));
+    }
+    for package in &diff.removed {
+        println!("- {}", describe(package));
+    }
+    for change in &diff.changed {
+        if change.from.version == change.to.version {
+            println!("~ {} (rebuilt)", describe(&change.to));
+            for store_path in &change.to.store_paths {
+                println!("    {store_path}");
+            }
+        } else {
+            println!(
+                "~ {} {} -> {}",
+                change.install_id,
+                change.from.version.as_deref().unwrap_or("<unknown>"),
+                change.to.version.as_deref().unwrap_or("<unknown>")
+            );
+        }
+    }
+    for change in diff.variables.iter().chain(&diff.hooks) {
+        let show = |value: &Option<serde_json::Value>| match value {
+            Some(serde_json::Value::String(value)) => format!("{value:?}"),
+            Some(value) => value.to_string(),
+            None => "<unset>".to_string(),
+        };
+        match (&change.from, &change.to) {
+            (None, _) => println!("+ {} = {}", change.attr, show(&change.to)),
+            (_, None) => println!("- {} = {}", change.attr, show(&change.from)),
+            _ => println!(
+                "~ {} {} -> {}",
+                change.attr,
+                show(&change.from),
+                show(&change.to)
+            ),
+        }
+    }
+}
+
+/// A generation listed by `flox log`
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+struct LogEntry {
+    generation: u32,
+    current: bool,
+    /// Creation time in seconds since the unix epoch
+    created: u64,
+    action: Option<&'static str>,
+    message: Vec<String>,
+    /// Changes of the packages since the previous generation
+    changes: GenerationDiff,
+}
+
+fn print_log_entry(entry: &LogEntry) {
+    let current = if entry.current { " (current)" } else { "" };
+    println!("generation {}{current}", entry.generation);
+
+    let created = OffsetDateTime::from_unix_timestamp(entry.created as i64)
+        .ok()
+        .and_then(|created| created.format(&Rfc3339).ok())
+        .unwrap_or_else(|| entry.created.to_string());
+    println!("Date:   {created}");
+    if let Some(action) = entry.action {
+        println!("Action: {action}");
+    }
+
+    println!();
+    for line in &entry.message {
+        println!("    {line}");
+    }
+    println!("    {}", summarize_generation_diff(&entry.changes));
+}
+
+/// Describe a [GenerationDiff] in a single line, e.g. `+ripgrep 13.0.0, -jq`
+fn summarize_generation_diff(diff: &GenerationDiff) -> String {
+    if !diff.has_package_changes() {
+        return "no package changes".to_string();
+    }
+
+    let describe = |package: &InstalledPackage| match package.version {
+        Some(ref version) => format!("{} {version}", package.install_id),
+        None => package.install_id.clone(),
+    };
+    let added = diff
+        .added
+        .iter()
+        .map(|package| format!("+{}", describe(package)));
+    let removed = diff
+        .removed
+        .iter()
+        .map(|package| format!("-{}", describe(package)));
+    let changed = diff.changed.iter().map(|change| {
+        if change.from.version == change.to.version {
+            format!("~{} (rebuilt)", describe(&change.to))
+        } else {
+            format!(
+                "~{} {} -> {}",
+                change.install_id,
+                change.from.version.as_deref().unwrap_or("<unknown>"),
+                change.to.version.as_deref().unwrap_or("<unknown>")
+            )
+        }
+    });
+
+    added
+        .chain(removed)
+        .chain(changed)
+        .collect::<Vec<_>>()
+        .join(", ")
+}
+
+/// Print the lines that differ between two versions of a `flox.nix`
+///
+/// Changed lines are shown with [MANIFEST_DIFF_CONTEXT] unchanged lines around them,
+/// omitted lines are marked with `...`.
+fn print_manifest_diff(from: &str, to: &str) {
+    let lines = diff::lines(from, to);
+    let changed: Vec<bool> = lines
+        .iter()
+        .map(|line| !matches!(line, diff::Result::Both(..)))
+        .collect();
+
+    let mut last_printed = None;
+    for (index, line) in lines.iter().enumerate() {
+        let start = index.saturating_sub(MANIFEST_DIFF_CONTEXT);
+        let end = (index + MANIFEST_DIFF_CONTEXT + 1).min(lines.len());
+        if !changed[start..end].contains(&true) {
+            continue;
+        }
+
+        let skipped = match last_printed {
+            Some(last) => index > last + 1,
+            None => index > 0,
+        };
+        if skipped {
+            println!("...");
+        }
+        match line {
+            diff::Result::Left(line) => println!("-{line}"),
+            diff::Result::Right(line) => println!("+{line}"),
+            diff::Result::Both(line, _) => println!(" {line}"),
+        }
+        last_printed = Some(index);
+    }
+
+    if last_printed.is_none() {
+        println!("no manifest changes");
+    } else if last_printed != Some(lines.len() - 1) {
+        println!("...");
+    }
+}
+
+/// Check that each of `selected` names a package of `installed`
+///
+/// Packages are selected by install id or attribute path,
+/// unknown names are reported with the most similar install id.
+fn check_selected_packages(
+    selected: &[FloxPackage],
+    installed: &[InstalledPackage],
+    environment: &str,
+) -> Result<()> {
+    for selected in selected {
+        let found = installed.iter().any(|package| {
+            *selected == package.install_id || package.attr_path.as_ref() == Some(selected)
+        });
+        if found {
+            continue;
+        }
+
+        let closest = installed
+            .iter()
+            .map(|package| {
+                (
+                    strsim::levenshtein(&package.install_id, selected),
+                    package.install_id.as_str(),
+                )
+            })
+            .min()
+            .filter(|(distance, _)| *distance <= 3);
+        match closest {
+            Some((_, suggestion)) => bail!(
+                "Package '{selected}' is not installed in environment '{environment}', \
+                 did you mean '{suggestion}'?"
+            ),
+            None => bail!(
+                "Package '{selected}' is not installed in environment '{environment}', \
+                 installed packages are: {}",
+                installed
+                    .iter()
+                    .map(|package| package.install_id.as_str())
+                    .collect::<Vec<_>>()
+                    .join(", ")
+            ),
+        }
+    }
+    Ok(())
+}
+
+/// Whether `package` is one of the `selected` install ids or attribute paths
+fn is_selected(selected: &[FloxPackage], package: &InstalledPackage) -> bool {
+    selected.iter().any(|selected| {
+        *selected == package.install_id || package.attr_path.as_ref() == Some(selected)
+    })
+}
+
+/// Install the latest revision of the flakes `packages` were installed from
+///
+/// flox (sh) upgrades packages from the flake reference they were installed from,
+/// which is locked for flakes (see [check_flake_installable]) and never changes.
+/// Packages whose flake changed are removed and installed locked to the new revision,
+/// a package that fails to install is installed again at its current revision.
+async fn upgrade_flake_packages(
+    flox: &Flox,
+    environment: Option<&EnvironmentRef>,
+    packages: &[InstalledPackage],
+) -> Result<()> {
+    for package in packages {
+        let current = match package.flake() {
+            Some(flake) => flake,
+            None => continue,
+        };
+        let unlocked = current.unlocked();
+        let latest = unlocked.locked(&lock_flake(&unlocked, true).await?);
+        if latest.nar_hash() == current.nar_hash() {
+            debug!("{unlocked} is up to date");
+            continue;
+        }
+
+        let args = |command: &str, installable: &FlakeInstallable| {
+            let mut args: Vec<OsString> = vec![command.into()];
+            if let Some(environment) = environment {
+                args.extend(["-e".into(), environment.into()]);
+            }
+            args.push(installable.to_string().into());
+            args
+        };
+        run_in_flox_reporting_errors(flox, &args("remove", &current)).await?;
+        if let Err(err) = run_in_flox_reporting_errors(flox, &args("install", &latest)).await {
+            run_in_flox_reporting_errors(flox, &args("install", &current)).await?;
+            return Err(err.context(format!("Could not upgrade '{}'", package.install_id)));
+        }
+        info!(
+            "Upgraded '{}' to the latest revision of {}",
+            package.install_id, unlocked.flake_ref
+        );
+    }
+    Ok(())
+}
+
+/// Check that a version of `package` in the catalog satisfies `constraint`
+///
+/// The constraint rather than the resolved version is written to `flox.nix`,
+/// so that upgrades stay within a range.
+async fn check_available_version(
+    flox: &Flox,
+    package: &str,
+    constraint: &VersionConstraint,
+) -> Result<()> {
+    let name = package.rsplit('.').next().unwrap_or(package);
+    let args = ["search".to_string(), "--json".to_string(), name.to_string()];
+    let results = match fetch_search_results(flox, &args).await? {
+        Some(results) => results,
+        None => bail_with!(
+            FloxExitCode::Network,
+            "Could not reach the channels to resolve '{package}@{constraint}'"
+        ),
+    };
+
+    let available = search::package_versions(&results, name);
+    match constraint.resolve(&available) {
+        Some(version) => {
+            debug!("Resolved '{package}@{constraint}' to version {version}");
+            Ok(())
+        },
+        None => Err(ExitCodeError::new(
+            FloxExitCode::Resolution,
+            UnavailableVersionError {
+                package: package.to_string(),
+                nearest: constraint.nearest(&available, UnavailableVersionError::NEAREST),
+                constraint: constraint.clone(),
+            },
+        )
+        .into()),
+    }
+}
+
+/// Number of packages whose `meta` is evaluated at the same time
+const CONCURRENT_EVALUATIONS: usize = 8;
+
+/// Record from its `meta` whether `package` is broken or insecure
+///
+/// The `meta` is evaluated from the locked flake the package was installed from.
+/// If it can not be evaluated, e.g. for packages installed from a store path,
+/// `broken` and `insecure` stay unknown.
+async fn evaluate_meta(package: InstalledPackage) -> InstalledPackage {
+    let installable = match package.meta_installable() {
+        Some(installable) => installable,
+        None => return package,
+    };
+
+    debug!("Evaluating {installable}");
+    let output = tokio::process::Command::new(NIX_BIN)
+        .args(["--extra-experimental-features", "nix-command flakes"])
+        .args(["eval", "--json", &installable])
+        .arg("--apply")
+        .arg("builtins.intersectAttrs { broken = null; knownVulnerabilities = null; }")
+        .output()
+        .await;
+
+    let meta = match output {
+        Ok(output) if output.status.success() => {
+            serde_json::from_slice::<serde_json::Value>(&output.stdout).ok()
+        },
+        Ok(output) => {
+            debug!(
+                "Could not evaluate {installable}:\n{}",
+                String::from_utf8_lossy(&output.stderr)
+            );
+            None
+        },
+        Err(err) => {
+            debug!("Failed to run nix: {err}");
+            None
+        },
+    };
+
+    match meta {
+        Some(meta) => package.with_meta(&meta),
+        None => package,
+    }
+}
+
+/// Resolve the version `package` would be upgraded to without building it
+///
+/// Like `nix profile upgrade`, the package is evaluated again from its channel.
+/// Packages installed from a flake are evaluated from the latest revision of the flake.
+/// A candidate outside the version `constraint` of the package is held back.
+async fn resolve_upgrade(
+    package: InstalledPackage,
+    constraint: Option<&VersionConstraint>,
+) -> Result<PackageUpgrade> {
+    #[derive(Deserialize)]
+    #[serde(rename_all = "camelCase")]
+    struct Candidate {
+        version: String,
+        out_path: String,
+    }
+
+    let held_back = package.is_pinned(constraint);
+    let installable = match package.upgrade_installable() {
+        Some(installable) if !held_back => installable,
+        _ => {
+            return Ok(PackageUpgrade {
+                install_id: package.install_id.clone(),
+                current: package,
+                candidate_version: None,
+                candidate_store_path: None,
+                held_back,
+                constraint: constraint.map(ToString::to_string),
+            })
+        },
+    };
+
+    debug!("Resolving {installable}");
+    let mut command = tokio::process::Command::new(NIX_BIN);
+    command
+        .args(["--extra-experimental-features", "nix-command flakes"])
+        .args(["eval", "--json", "--impure", &installable])
+        .arg("--apply")
+        .arg("p: { version = (builtins.parseDrvName p.name).version; outPath = p.outPath; }");
+    if package.flake().is_some() {
+        command.arg("--refresh");
+    }
+    let output = command.output().await.context("Failed to run nix")?;
+
+    if !output.status.success() {
+        bail!(
+            "Could not resolve {installable}:\n{}",
+            String::from_utf8_lossy(&output.stderr)
+        );
+    }
+    let candidate: Candidate = serde_json::from_slice(&output.stdout)
+        .with_context(|| format!("Could not parse evaluation of {installable}"))?;
+
+    let held_back = constraint.map_or(false, |constraint| !constraint.matches(&candidate.version));
+    Ok(PackageUpgrade {
+        install_id: package.install_id.clone(),
+        current: package,
+        candidate_version: Some(candidate.version).filter(|version| !version.is_empty()),
+        candidate_store_path: Some(candidate.out_path),
+        held_back,
+        constraint: constraint.map(ToString::to_string),
+    })
+}
+
+/// Print a table of the current and candidate version of each package
+fn print_upgrades(upgrades: &[PackageUpgrade]) {
+    let rows = upgrades
+        .iter()
+        .map(|upgrade| {
+            let current = upgrade.current.version.as_deref().unwrap_or("<unknown>");
+            let candidate = if let (true, Some(version), Some(constraint)) = (
+                upgrade.held_back,
+                &upgrade.candidate_version,
+                &upgrade.constraint,
+            ) {
+                format!("held back ({version} is outside {constraint})")
+            } else if upgrade.held_back {
+                "held back (pinned version)".to_string()
+            } else if upgrade.candidate_store_path.is_none() {
+                "not upgradable (installed from store path)".to_string()
+            } else if !upgrade.is_upgrade() {
+                "up to date".to_string()
+            } else {
+                upgrade
+                    .candidate_version
+                    .clone()
+                    .unwrap_or_else(|| "<unknown>".to_string())
+            };
+            (upgrade, current, candidate)
+        })
+        .collect::<Vec<_>>();
+
+    let id_width = rows
+        .iter()
+        .map(|(upgrade, ..)| upgrade.install_id.len())
+        .chain(["PACKAGE".len()])
+        .max()
+        .unwrap_or_default();
+    let current_width = rows
+        .iter()
+        .map(|(_, current, _)| current.len())
+        .chain(["CURRENT".len()])
+        .max()
+        .unwrap_or_default();
+
+    println!(
+        "{:id_width$}  {:current_width$}  CANDIDATE",
+        "PACKAGE", "CURRENT"
+    );
+    for (upgrade, current, candidate) in &rows {
+        println!(
+            "{:id_width$}  {current:current_width$}  {candidate}",
+            upgrade.install_id
+        );
+        if upgrade.is_upgrade() {
+            if let (Some(from), Some(to)) = (
+                upgrade.current.store_paths.first(),
+                &upgrade.candidate_store_path,
+            ) {
+                println!("    {from} -> {to}");
+            }
+        }
+    }
+
+    let n_upgrades = upgrades
+        .iter()
+        .filter(|upgrade| upgrade.is_upgrade())
+        .count();
+    match n_upgrades {
+        0 => eprintln!("No upgrades available"),
+        1 => eprintln!("1 package would be upgraded"),
+        _ => eprintln!("{n_upgrades} packages would be upgraded"),
+    }
+}
+
+/// Arguments running the flox (sh) `subcommand` on `environment`
+fn sh_args(
+    subcommand: &str,
+    environment_args: &EnvironmentArgs,
+    environment: Option<&EnvironmentRef>,
+) -> Vec<OsString> {
+    let mut args: Vec<OsString> = vec![subcommand.into()];
+    if let Some(ref system) = environment_args.system {
+        args.extend(["--system".into(), system.into()]);
+    }
+    if let Some(environment) = environment {
+        args.extend(["--environment".into(), environment.as_os_str().to_owned()]);
+    }
+    args
+}
+
+/// Check an archive created by `flox export` before importing it
+///
+/// Fails if the current generation of the export is missing or unreadable.
+/// Warns if its packages are neither in the local store
+/// nor available from the configured substituters.
+async fn verify_export(flox: &Flox, file: &Path) -> Result<()> {
+    let dir =
+        tempfile::tempdir_in(&flox.temp_dir).context("Could not create temporary directory")?;
+    let output = tokio::process::Command::new("tar")
+        .arg("-xf")
+        .arg(file)
+        .arg("-C")
+        .arg(dir.path())
+        .output()
+        .await
+        .context("Failed to run tar")?;
+    if !output.status.success() {
+        bail!(
+            "Could not extract {}:\n{}",
+            file.display(),
+            String::from_utf8_lossy(&output.stderr)
+        );
+    }
+
+    let generation = ExportedEnvironment::new(dir.path())
+        .current_generation()
+        .with_context(|| format!("{} is not a valid environment export", file.display()))?;
+
+    let store_paths = generation
+        .packages()
+        .into_iter()
+        .flat_map(|package| package.store_paths)
+        .collect::<Vec<_>>();
+    if store_paths.is_empty() {
+        return Ok(());
+    }
+
+    let nix_store = Path::new(NIX_BIN).with_file_name("nix-store");
+    let output = tokio::process::Command::new(nix_store)
+        .arg("--realise")
+        .arg("--dry-run")
+        .args(&store_paths)
+        .output()
+        .await
+        .context("Failed to run nix-store")?;
+    if !output.status.success() {
+        warn!(
+            "Some packages of {} are not available from the configured substituters \
+             and will have to be built or copied manually:\n{}",
+            file.display(),
+            String::from_utf8_lossy(&output.stderr)
+        );
+    }
+
+    Ok(())
+}
+
+/// Lock the channels of the packages in a `flox.nix` without building them
+///
+/// Reports all channels that can not be locked, e.g. because they are not subscribed.
+async fn lock_manifest_channels(contents: &str) -> Result<()> {
+    let mut failed = Vec::new();
+    for (channel, flake_ref) in manifest_channels(contents)? {
+        let output = tokio::process::Command::new(NIX_BIN)
+            .args(["--extra-experimental-features", "nix-command flakes"])
+            .args(["flake", "metadata", "--json", &flake_ref])
+            .output()
+            .await
+            .context("Failed to run nix")?;
+        if output.status.success() {
+            debug!("Locked channel {channel}");
+        } else {
+            failed.push(format!(
+                "  {channel}: {}",
+                String::from_utf8_lossy(&output.stderr).trim_end()
+            ));
+        }
+    }
+
+    if !failed.is_empty() {
+        let failed = failed.join("\n");
+        bail_with!(
+            classify_nix_errors(&failed).unwrap_or(FloxExitCode::Resolution),
+            "Could not lock the channels of the manifest:\n{failed}"
+        );
+    }
+    Ok(())
+}
+
+/// The channels of the packages in a `flox.nix` with the flake references they resolve to
+///
+/// Channels that are not flake references already are looked up in the registry.
+fn manifest_channels(contents: &str) -> Result<Vec<(String, String)>> {
+    let packages = flox_nix::literal_attr(contents, "packages")?;
+    let channels = packages
+        .as_object()
+        .into_iter()
+        .flat_map(|channels| channels.keys())
+        .map(|channel| {
+            let flake_ref = if channel.contains(':') {
+                channel.clone()
+            } else {
+                format!("flake:{channel}")
+            };
+            (channel.clone(), flake_ref)
+        })
+        .collect();
+    Ok(channels)
+}
+
+/// Install ids of the `installed` packages matching any of the `globs`
+fn glob_matching_packages(globs: &[String], installed: &[InstalledPackage]) -> Vec<String> {
+    installed
+        .iter()
+        .map(|package| package.install_id.clone())
+        .filter(|id| globs.iter().any(|glob| glob_matches(glob, id)))
+        .collect()
+}
+
+/// Whether `name` matches the shell style glob `pattern`
+///
+/// `*` matches any sequence of characters and `?` a single character.
+fn glob_matches(pattern: &str, name: &str) -> bool {
+    let pattern: Vec<char> = pattern.chars().collect();
+    let name: Vec<char> = name.chars().collect();
+
+    let (mut p, mut n) = (0, 0);
+    // the last `*` and the position in `name` up to which it matches
+    let mut star = None;
+    while n < name.len() {
+        match pattern.get(p) {
+            Some('*') => {
+                star = Some((p, n));
+                p += 1;
+            },
+            Some(c) if *c == '?' || *c == name[n] => {
+                p += 1;
+                n += 1;
+            },
+            // let the last `*` match one more character
+            _ => match star {
+                Some((star_p, star_n)) => {
+                    star = Some((star_p, star_n + 1));
+                    p = star_p + 1;
+                    n = star_n + 1;
+                },
+                None => return false,
+            },
+        }
+    }
+    pattern[p..].iter().all(|c| *c == '*')
+}
+
+/// Lock the flake of `installable` to its current revision and content hash
+///
+/// `refresh` bypasses the cache of nix, which reuses fetched flakes for an hour.
+async fn lock_flake(installable: &FlakeInstallable, refresh: bool) -> Result<LockedFlake> {
+    let mut command = tokio::process::Command::new(NIX_BIN);
+    command
+        .args(["--extra-experimental-features", "nix-command flakes"])
+        .args(["flake", "metadata", "--json", &installable.flake_ref]);
+    if refresh {
+        command.arg("--refresh");
+    }
+    let output = command.output().await.context("Failed to run nix")?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        bail_with!(
+            classify_nix_errors(&stderr).unwrap_or(FloxExitCode::Resolution),
+            "Could not lock flake {}:\n{stderr}",
+            installable.flake_ref
+        );
+    }
+    let metadata: serde_json::Value = serde_json::from_slice(&output.stdout)
+        .with_context(|| format!("Could not parse metadata of {}", installable.flake_ref))?;
+    let lock = LockedFlake::from_metadata(&metadata)
+        .with_context(|| format!("nix did not report a lock for {}", installable.flake_ref))?;
+    debug!("Locked {} to {}", installable.flake_ref, lock.url);
+
+    Ok(lock)
+}
+
+/// The arguments of `flox install` with the flake installables replaced by their `locked` form
+fn lock_install_args(
+    args: impl IntoIterator<Item = OsString>,
+    locked: &HashMap<OsString, OsString>,
+) -> Vec<OsString> {
+    args.into_iter()
+        .map(|arg| locked.get(&arg).cloned().unwrap_or(arg))
+        .collect()
+}
+
+/// Lock `installable` and check that it provides a package for `system`
+///
+/// Packages that can only be evaluated impurely are rejected,
+/// the environment could not be reproduced from their locked flake.
+/// Returns the locked installable, which is recorded in the environment.
+async fn check_flake_installable(
+    installable: &FlakeInstallable,
+    system: &str,
+) -> Result<FlakeInstallable> {
+    let lock = lock_flake(installable, false).await?;
+    let locked = installable.locked(&lock);
+
+    let output = tokio::process::Command::new(NIX_BIN)
+        .args(["--extra-experimental-features", "nix-command flakes"])
+        .args(["eval", "--raw", &locked.to_string()])
+        .args(["--apply", "p: p.outPath"])
+        .output()
+        .await
+        .context("Failed to run nix")?;
+    if output.status.success() {
+        return Ok(locked);
+    }
+
+    let stderr = String::from_utf8_lossy(&output.stderr);
+    if stderr.contains("pure evaluation mode") {
+        bail_with!(
+            FloxExitCode::Resolution,
+            "'{installable}' can only be evaluated with '--impure', \
+             which is not supported for packages of an environment:\n{stderr}"
+        );
+    }
+    if stderr.contains("does not provide attribute") {
+        let systems = flake_package_systems(&installable.flake_ref).await;
+        if !systems.is_empty() && !systems.iter().any(|provided| provided == system) {
+            bail_with!(
+                FloxExitCode::NotFound,
+                "'{installable}' does not provide packages for {system}, only for: {}",
+                systems.join(", ")
+            );
+        }
+    }
+    bail_with!(
+        classify_nix_errors(&stderr).unwrap_or(FloxExitCode::Resolution),
+        "Could not evaluate '{installable}':\n{stderr}"
+    )
+}
+
+/// The systems `flake_ref` provides `packages` for, empty if unknown
+async fn flake_package_systems(flake_ref: &str) -> Vec<String> {
+    let output = tokio::process::Command::new(NIX_BIN)
+        .args(["--extra-experimental-features", "nix-command flakes"])
+        .args(["eval", "--json", &format!("{flake_ref}#packages")])
+        .args(["--apply", "builtins.attrNames"])
+        .output()
+        .await;
+
+    match output {
+        Ok(output) if output.status.success() => {
+            serde_json::from_slice(&output.stdout).unwrap_or_default()
+        },
+        _ => Vec::new(),
+    }
+}
+
+/// Number of generations `flox gc` keeps of each environment by default
+const DEFAULT_GC_KEEP_GENERATIONS: usize = 10;
+
+/// Number of unchanged lines shown around the changes of `flox log --patch`
+const MANIFEST_DIFF_CONTEXT: usize = 3;
+
+/// How often `flox activate --watch` checks for edits and new generations
+const WATCH_INTERVAL: Duration = Duration::from_secs(1);
+
+/// Time an edit or a new generation must settle before `flox activate --watch` applies it
+const WATCH_DEBOUNCE: Duration = Duration::from_millis(500);
+
+/// Links pointing to the current generation of each of `environments`
+///
+/// flox (sh) keeps a nix profile per environment in `<data dir>/environments/<owner>`,
+/// its `<system>.<name>` link points to the current generation.
+fn profile_links(flox: &Flox, environments: &[EnvironmentRef]) -> Vec<PathBuf> {
+    let names = if environments.is_empty() {
+        vec![environment_name(None)]
+    } else {
+        environments
+            .iter()
+            .map(|environment| environment_name(Some(environment)))
+            .collect()
+    };
+
+    names
+        .iter()
+        .map(|name| {
+            let (owner, name) = name.split_once('/').unwrap_or(("local", name));
+            flox.data_dir
+                .join("environments")
+                .join(owner)
+                .join(format!("{}.{name}", flox.system))
+        })
+        .collect()
+}
+
+/// Atomically replace the script sourced by a watching subshell
+fn write_reload_script(path: &Path, script: &str) -> Result<()> {
+    let partial = path.with_extension("partial");
+    std::fs::write(&partial, script)
+        .with_context(|| format!("Could not write {}", partial.display()))?;
+    std::fs::rename(&partial, path)
+        .with_context(|| format!("Could not write {}", path.display()))?;
+    Ok(())
+}
+
+/// Link rooting a generation of the environment `<owner>/<system>.<name>`
+///
+/// See [profile_links], each generation has a `<system>.<name>-<generation>-link`.
+fn generation_link(flox: &Flox, owner: &str, system: &str, name: &str, generation: u32) -> PathBuf {
+    flox.data_dir
+        .join("environments")
+        .join(owner)
+        .join(format!("{system}.{name}-{generation}-link"))
+}
+
+/// The name of the environment at the git URL `url`
+fn remote_environment_name(url: &str) -> Result<&str> {
+    if !git_remote::is_git_url(url) {
+        bail_with!(
+            FloxExitCode::Usage,
+            "'{url}' is not a git URL, e.g. 'ssh://git@example.com/environments/NAME'"
+        );
+    }
+    match git_remote::environment_name(url) {
+        Some(name) => Ok(name),
+        None => bail_with!(
+            FloxExitCode::Usage,
+            "'{url}' does not name an environment, its last path component is used as the name"
+        ),
+    }
+}
+
+/// The number of times network operations are retried, see [crate::utils::retry]
+fn max_retries(config: &Config) -> u32 {
+    config.flox.max_retries.unwrap_or(DEFAULT_RETRIES)
+}
+
+/// Whether git failed to reach the remote, rather than e.g. the push being rejected
+fn is_network_error(error: &impl std::error::Error) -> bool {
+    classify_nix_errors(&error.to_string()) == Some(FloxExitCode::Network)
+}
+
+/// Attach the [FloxExitCode] of the failure of git to `error`
+///
+/// git exits with 1 for unreachable remotes and rejected pushes alike.
+fn git_remote_error(
+    error: impl std::error::Error + Send + Sync + 'static,
+    context: String,
+) -> ExitCodeError {
+    let code = classify_nix_errors(&error.to_string()).unwrap_or(FloxExitCode::Failure);
+    ExitCodeError::new(code, anyhow::Error::new(error).context(context))
+}
+
+/// Point the profile of the pulled environment `name` to its current generation
+///
+/// Links the store path of the generation like flox (sh) does, see [profile_links].
+/// Unless `realize` is set the store path is fetched once the generation is activated.
+async fn link_current_generation(
+    flox: &Flox,
+    name: &str,
+    pulled: &Environment<'_, GitCommandProvider>,
+    metadata: &Metadata,
+    realize: bool,
+) -> Result<()> {
+    let generation: u32 = metadata
+        .current_gen
+        .parse()
+        .with_context(|| format!("Invalid current generation of '{name}'"))?;
+    let path = metadata
+        .generation(&metadata.current_gen)
+        .map(|generation| generation.path().to_owned())
+        .with_context(|| format!("Current generation of '{name}' does not exist"))?;
+    if !realize && !path.exists() {
+        defer_realisation(&flox.cache_dir, name, &path)?;
+    } else {
+        if !path.exists() {
+            realise(&path).await?;
+        }
+        clear_deferred_realisation(&flox.cache_dir, name)?;
+    }
+
+    let (owner, _) = name.split_once('/').unwrap_or(("local", name));
+    let link = generation_link(flox, owner, pulled.system(), pulled.name(), generation);
+    let profile = link.with_file_name(format!("{}.{}", pulled.system(), pulled.name()));
+    replace_link(&path, &link)?;
+    replace_link(
+        Path::new(link.file_name().expect("has file name")),
+        &profile,
+    )
+}
+
+/// Atomically point the symlink `link` to `target`
+fn replace_link(target: &Path, link: &Path) -> Result<()> {
+    let file_name = link.file_name().expect("has file name").to_string_lossy();
+    let partial = link.with_file_name(format!("{file_name}.partial"));
+    std::fs::create_dir_all(link.parent().expect("has parent"))
+        .with_context(|| format!("Could not create {}", link.display()))?;
+    let _ = std::fs::remove_file(&partial);
+    std::os::unix::fs::symlink(target, &partial)
+        .with_context(|| format!("Could not create {}", link.display()))?;
+    std::fs::rename(&partial, link)
+        .with_context(|| format!("Could not create {}", link.display()))?;
+    Ok(())
+}
+
+/// Size in bytes of the closure of `path`
+///
+/// `None` if the size can not be determined, e.g. because `path` is not in the store.
+async fn closure_size(path: &Path) -> Option<u64> {
+    let output = tokio::process::Command::new(NIX_BIN)
+        .args(["--extra-experimental-features", "nix-command"])
+        .args(["path-info", "--closure-size"])
+        .arg(path)
+        .output()
+        .await
+        .ok()?;
+    if !output.status.success() {
+        return None;
+    }
+
+    // <path>\t<size>
+    String::from_utf8_lossy(&output.stdout)
+        .split_whitespace()
+        .last()?
+        .parse()
+        .ok()
+}
+
+/// Human readable size of `bytes`, e.g. `1.5 GiB`
+fn format_size(bytes: u64) -> String {
+    const UNITS: [&str; 4] = ["KiB", "MiB", "GiB", "TiB"];
+
+    if bytes < 1024 {
+        return format!("{bytes} B");
+    }
+    let mut size = bytes as f64 / 1024.0;
+    let mut unit = 0;
+    while size >= 1024.0 && unit < UNITS.len() - 1 {
+        size /= 1024.0;
+        unit += 1;
+    }
+    format!("{size:.1} {}", UNITS[unit])
+}
+
+/// Number of store paths looked up in substituters at the same time
+const CONCURRENT_SUBSTITUTER_QUERIES: usize = 16;
+
+/// The `store_paths` that none of the configured substituters provide
+///
+/// Paths are looked up in the substituters in order of their configuration,
+/// regardless of whether they are present in the local store.
+async fn uncached_store_paths(store_paths: &[String]) -> Result<Vec<String>> {
+    let substituters = nix_substituters().await?;
+
+    let is_cached = |path: String| {
+        let substituters = &substituters;
+        async move {
+            for substituter in substituters {
+                let status = tokio::process::Command::new(NIX_BIN)
+                    .args(["--extra-experimental-features", "nix-command"])
+                    .args(["path-info", "--store", substituter, &path])
+                    .stdout(Stdio::null())
+                    .stderr(Stdio::null())
+                    .status()
+                    .await;
+                if matches!(status, Ok(status) if status.success()) {
+                    debug!("{path} is available from {substituter}");
+                    return (path, true);
+                }
+            }
+            (path, false)
+        }
+    };
+
+    let mut uncached = stream::iter(store_paths.iter().cloned())
+        .map(is_cached)
+        .buffer_unordered(CONCURRENT_SUBSTITUTER_QUERIES)
+        .filter_map(|(path, cached)| async move { (!cached).then_some(path) })
+        .collect::<Vec<_>>()
+        .await;
+    uncached.sort();
+
+    Ok(uncached)
+}
 
-                let environment = floxmeta.environment(&name).await?;
-                let metadata = environment.metadata().await?;
-                let generation = environment.generation(&metadata.current_gen).await?;
+/// The substituters configured for nix, in order of their configuration
+async fn nix_substituters() -> Result<Vec<String>> {
+    let output = tokio::process::Command::new(NIX_BIN)
+        .args(["--extra-experimental-features", "nix-command"])
+        .args(["show-config", "--json"])
+        .output()
+        .await
+        .context("Failed to run nix")?;
+    if !output.status.success() {
+        bail!(
+            "Could not read nix configuration:\n{}",
+            String::from_utf8_lossy(&output.stderr)
+        );
+    }
+    parse_substituters(&output.stdout)
+}
 
-                println!("{}", serde_json::to_string_pretty(&generation).unwrap())
-            },
+/// The substituters in the output of `nix show-config --json`
+fn parse_substituters(nix_config: &[u8]) -> Result<Vec<String>> {
+    #[derive(Deserialize)]
+    struct Setting {
+        value: Vec<String>,
+    }
+    #[derive(Deserialize)]
+    struct NixConfig {
+        substituters: Setting,
+    }
 
-            EnvironmentCommands::Envs if !Feature::Env.is_forwarded()? => {
-                let floxmetas = Floxmeta::<GitCommandProvider>::list_floxmetas(&flox).await?;
+    let config: NixConfig =
+        serde_json::from_slice(nix_config).context("Could not parse nix configuration")?;
+    Ok(config.substituters.value)
+}
 
-                let mut values = Vec::new();
+/// A check of `flox doctor` and the problems it found
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+struct DoctorCheck {
+    name: &'static str,
+    /// The check needs network access and `--offline` was given
+    skipped: bool,
+    findings: Vec<Finding>,
+}
 
-                for meta in floxmetas {
-                    let envs = meta.environments().await?;
-                    let mut dir = meta.git.workdir();
-                    let dir = dir.get_or_insert_with(|| meta.git.path());
+/// A problem found by `flox doctor` and how to fix it
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+struct Finding {
+    problem: String,
+    fix: String,
+}
 
-                    values.push(json!({
-                        "type": "floxmeta",
-                        "path": dir,
-                        "envs": envs,
-                    }));
-                }
+impl DoctorCheck {
+    fn new(name: &'static str, findings: Vec<Finding>) -> Self {
+        DoctorCheck {
+            name,
+            skipped: false,
+            findings,
+        }
+    }
 
-                println!("{}", serde_json::to_string_pretty(&values)?);
-            },
+    fn skipped(name: &'static str) -> Self {
+        DoctorCheck {
+            name,
+            skipped: true,
+            findings: Vec::new(),
+        }
+    }
+}
 
-            EnvironmentCommands::Install {
-                packages,
-                environment_args: EnvironmentArgs { .. },
-                environment,
-            } if !Feature::Env.is_forwarded()? => {
-                subcommand_metric!("install");
+/// Time to wait for a substituter or the flox release to respond
+const DOCTOR_NETWORK_TIMEOUT: Duration = Duration::from_secs(10);
 
-                flox.environment(environment.clone().unwrap())?
-                    .install::<NixCommandLine>(packages)
-                    .await?
+/// Latest flox release, compared to the running version by `flox doctor`
+const FLOX_LATEST_RELEASE_URL: &str = "https://api.github.com/repos/flox/flox/releases/latest";
+
+/// Compare the packages declared in the `flox.nix` of a generation to its installed packages
+///
+/// Both differ if the manifest was changed without building a new generation.
+fn check_manifest(
+    flox_nix: Option<&str>,
+    packages: &[InstalledPackage],
+    name: &str,
+) -> Vec<Finding> {
+    let contents = match flox_nix {
+        Some(contents) => contents,
+        // environments managed with `flox install` only have a lock
+        None => return Vec::new(),
+    };
+    let fix = format!("run 'flox edit -e {name}' and save the manifest to build it again");
+
+    if let Err(err) = flox_nix::validate(contents) {
+        return vec![Finding {
+            problem: format!("flox.nix is invalid: {err}"),
+            fix,
+        }];
+    }
+    let declared = match flox_nix::literal_attr(contents, "packages") {
+        Ok(declared) => declared,
+        Err(err) => {
+            return vec![Finding {
+                problem: format!("flox.nix can not be parsed: {err}"),
+                fix,
+            }]
+        },
+    };
+    let declared: HashSet<&str> = declared
+        .as_object()
+        .into_iter()
+        .flat_map(|channels| channels.values())
+        .filter_map(|packages| packages.as_object())
+        .flat_map(|packages| packages.keys().map(String::as_str))
+        .collect();
+
+    let installed: HashSet<&str> = packages
+        .iter()
+        .map(|package| package.install_id.as_str())
+        .collect();
+
+    let mut findings = Vec::new();
+    for package in declared.difference(&installed) {
+        findings.push(Finding {
+            problem: format!("'{package}' is declared in flox.nix but not installed"),
+            fix: fix.clone(),
+        });
+    }
+    // packages installed from store paths are not declared by name
+    for package in packages.iter().filter(|package| package.channel.is_some()) {
+        if !declared.contains(package.install_id.as_str()) {
+            findings.push(Finding {
+                problem: format!(
+                    "'{}' is installed but not declared in flox.nix",
+                    package.install_id
+                ),
+                fix: fix.clone(),
+            });
+        }
+    }
+    findings.sort_by(|a, b| a.problem.cmp(&b.problem));
+    findings
+}
+
+/// Find packages that did not resolve to any store path
+fn check_packages(packages: &[InstalledPackage], name: &str) -> Vec<Finding> {
+    packages
+        .iter()
+        .filter(|package| package.store_paths.is_empty())
+        .map(|package| Finding {
+            problem: format!("'{}' did not resolve to any store path", package.install_id),
+            fix: format!(
+                "run 'flox upgrade -e {name} {}' or remove and install it again",
+                package.install_id
+            ),
+        })
+        .collect()
+}
+
+/// Find the profile and store paths of `generation` that are missing from the local store
+fn check_store_paths(
+    flox: &Flox,
+    environment: Option<&EnvironmentRef>,
+    profile: Option<&Path>,
+    packages: &[InstalledPackage],
+    name: &str,
+    generation: &str,
+) -> Vec<Finding> {
+    let mut findings = Vec::new();
+
+    match profile {
+        Some(profile) if !profile.exists() => findings.push(Finding {
+            problem: format!(
+                "the profile of generation {generation} is missing from the store: {}",
+                profile.display()
+            ),
+            fix: format!(
+                "run 'flox activate -e {name} --generation {generation} -- true' to rebuild it"
+            ),
+        }),
+        Some(profile) => {
+            let environments: Vec<EnvironmentRef> = environment.into_iter().cloned().collect();
+            let link = &profile_links(flox, &environments)[0];
+            if std::fs::canonicalize(link).ok().as_deref() != Some(profile) {
+                findings.push(Finding {
+                    problem: format!(
+                        "{} does not point to the current generation {generation}",
+                        link.display()
+                    ),
+                    fix: format!("run 'flox switch-generation -e {name} {generation}'"),
+                });
+            }
+        },
+        None => {},
+    }
+
+    for package in packages.iter().filter(|package| package.active) {
+        for store_path in &package.store_paths {
+            if !Path::new(store_path).exists() {
+                findings.push(Finding {
+                    problem: format!(
+                        "{store_path} of '{}' is missing from the store",
+                        package.install_id
+                    ),
+                    fix: format!("run 'nix-store --realise {store_path}' to fetch or build it"),
+                });
+            }
+        }
+    }
+    findings
+}
+
+/// Find commands provided by several packages with the same priority
+///
+/// Which package wins only depends on the order of installation then.
+/// Packages shadowing others with a lower priority number are not reported.
+fn check_commands(generation: &Generation) -> Vec<Finding> {
+    let commands: BTreeSet<String> = generation
+        .packages()
+        .iter()
+        .filter(|package| package.active)
+        .flat_map(|package| package.store_paths.iter())
+        .filter_map(|store_path| std::fs::read_dir(Path::new(store_path).join("bin")).ok())
+        .flatten()
+        .filter_map(|entry| entry.ok()?.file_name().into_string().ok())
+        .collect();
+
+    commands
+        .iter()
+        .filter_map(|command| {
+            let providers = generation.command_providers(command);
+            match providers.as_slice() {
+                [winner, shadowed, ..]
+                    if winner.priority == shadowed.priority
+                        && winner.install_id != shadowed.install_id =>
+                {
+                    Some(Finding {
+                        problem: format!(
+                            "'{command}' is provided by '{}' and '{}' with the same priority {}, \
+                             '{}' wins because it was installed first",
+                            winner.install_id,
+                            shadowed.install_id,
+                            winner.priority,
+                            winner.install_id
+                        ),
+                        fix: format!(
+                            "remove the package that should not provide '{command}', \
+                             or install the other one first"
+                        ),
+                    })
+                },
+                _ => None,
+            }
+        })
+        .collect()
+}
+
+/// Find configured substituters that can not be reached
+async fn check_substituters() -> Vec<Finding> {
+    let substituters = match nix_substituters().await {
+        Ok(substituters) => substituters,
+        Err(err) => {
+            return vec![Finding {
+                problem: format!("{err:#}"),
+                fix: "check the nix installation and nix.conf".to_string(),
+            }]
+        },
+    };
+
+    let ping = |substituter: String| async move {
+        let status = tokio::time::timeout(
+            DOCTOR_NETWORK_TIMEOUT,
+            tokio::process::Command::new(NIX_BIN)
+                .args(["--extra-experimental-features", "nix-command"])
+                .args(["store", "ping", "--store", &substituter])
+                .stdout(Stdio::null())
+                .stderr(Stdio::null())
+                .status(),
+        )
+        .await;
+        let reachable = matches!(status, Ok(Ok(status)) if status.success());
+        (substituter, reachable)
+    };
+
+    stream::iter(substituters)
+        .map(ping)
+        .buffered(CONCURRENT_SUBSTITUTER_QUERIES)
+        .filter_map(|(substituter, reachable)| async move {
+            (!reachable).then(|| Finding {
+                problem: format!("substituter {substituter} can not be reached"),
+                fix: "check the network connection, or remove it from 'substituters' in nix.conf"
+                    .to_string(),
+            })
+        })
+        .collect()
+        .await
+}
+
+/// Compare the running flox to the latest release
+///
+/// `None` if the latest release can not be determined, e.g. without network access.
+async fn check_latest_flox_release() -> Option<Vec<Finding>> {
+    #[derive(Deserialize)]
+    struct Release {
+        tag_name: String,
+    }
+
+    let release: Release = reqwest::Client::builder()
+        .timeout(DOCTOR_NETWORK_TIMEOUT)
+        .build()
+        .ok()?
+        .get(FLOX_LATEST_RELEASE_URL)
+        .header("User-Agent", format!("flox/{FLOX_VERSION}"))
+        .send()
+        .await
+        .map_err(|err| debug!("Could not fetch the latest flox release: {err}"))
+        .ok()?
+        .json()
+        .await
+        .map_err(|err| debug!("Could not parse the latest flox release: {err}"))
+        .ok()?;
+
+    let latest = release.tag_name.trim_start_matches('v');
+    if flox_nix::flox_version(FLOX_VERSION) >= flox_nix::flox_version(latest) {
+        return Some(Vec::new());
+    }
+    Some(vec![Finding {
+        problem: format!("flox {FLOX_VERSION} is older than the latest release {latest}"),
+        fix: "update flox the way it was installed, e.g. with the flox installer or nix profile"
+            .to_string(),
+    }])
+}
+
+/// Print the results of `flox doctor`
+fn print_doctor_checks(checks: &[DoctorCheck]) {
+    for check in checks {
+        match check.findings.as_slice() {
+            _ if check.skipped => println!("skip {} (offline)", check.name),
+            [] => println!("ok   {}", check.name),
+            findings => {
+                println!("FAIL {}", check.name);
+                for finding in findings {
+                    println!("     {}", finding.problem);
+                    println!("       fix: {}", finding.fix);
+                }
             },
+        }
+    }
+}
 
-            _ => flox_forward(&flox).await?,
+/// A package listed by `flox list` within a layered activation
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+struct LayeredPackage {
+    /// The layered environment providing the package
+    environment: String,
+    #[serde(flatten)]
+    package: InstalledPackage,
+}
+
+/// Warn about the variables set by several of `environments`
+///
+/// Layered environments are activated in order, the last one setting a variable wins.
+async fn report_overridden_variables(flox: &Flox, environments: &[EnvironmentRef]) {
+    let mut set_by: BTreeMap<String, String> = BTreeMap::new();
+    for environment in environments {
+        let name = environment_name(Some(environment));
+        let contents = match read_flox_nix(flox, Some(environment), None).await {
+            Ok((Some(contents), _)) => contents,
+            _ => continue,
+        };
+        let variables = match flox_nix::literal_attr(&contents, "environmentVariables") {
+            Ok(variables) => variables,
+            Err(_) => continue,
+        };
+
+        for variable in variables
+            .as_object()
+            .into_iter()
+            .flat_map(|variables| variables.keys())
+        {
+            if let Some(previous) = set_by.insert(variable.clone(), name.clone()) {
+                warn!(
+                    "'{variable}' of environment '{previous}' is overridden by environment '{name}'"
+                );
+            }
         }
+    }
+}
 
-        Ok(())
+/// Retrieve the script setting up the given environments from flox (sh)
+///
+/// flox (sh) prints the script rather than spawning a subshell
+/// if its output is not a terminal.
+/// The script is written for `shell` if given, otherwise for the user's `$SHELL`.
+///
+/// Several environments are layered by activating them one after the other,
+/// so that later environments take precedence: their `bin` directories come first
+/// in `PATH`, their variables replace those of earlier environments
+/// and their hooks run last.
+async fn activation_script(
+    flox: &Flox,
+    environment_args: &EnvironmentArgs,
+    environments: &[EnvironmentRef],
+    shell: Option<ShellKind>,
+) -> Result<String> {
+    if environments.len() < 2 {
+        return environment_activation_script(flox, environment_args, environments.first(), shell)
+            .await;
+    }
+
+    report_overridden_variables(flox, environments).await;
+
+    let mut script = String::new();
+    for environment in environments {
+        script += &environment_activation_script(flox, environment_args, Some(environment), shell)
+            .await?;
+        script.push('\n');
+    }
+
+    let kind = match shell {
+        Some(kind) => kind,
+        None => Shell::detect()?.kind,
+    };
+    let layered = environments
+        .iter()
+        .map(|environment| environment_name(Some(environment)))
+        .collect::<Vec<_>>()
+        .join(":");
+    script += &kind.export(LAYERED_ENVIRONMENTS_VAR, &layered);
+    script.push('\n');
+    Ok(script)
+}
+
+/// Script activating the current generations of `environments` without changing any state
+///
+/// Unlike [activation_script], flox (sh) is not involved,
+/// which realises the environments and links their generations.
+/// Environments without a generation are built from the working copy of the project
+/// into `state_dir`, along with the lock of the project's flake.
+async fn ephemeral_activation_script(
+    flox: &Flox,
+    environments: &[EnvironmentRef],
+    state_dir: &Path,
+    kind: ShellKind,
+) -> Result<String> {
+    let refs = if environments.is_empty() {
+        vec![None]
+    } else {
+        environments.iter().map(Some).collect()
+    };
+    if refs.len() > 1 {
+        report_overridden_variables(flox, environments).await;
+    }
+
+    let mut script = String::new();
+    for environment in &refs {
+        let name = environment_name(*environment);
+        let path = match describe_environment(flox, *environment).await {
+            Ok(activated) => {
+                // environments pulled with `--no-realize` are only fetched when activated
+                if !activated.path.exists() {
+                    realise(&activated.path).await?;
+                }
+                activated.path
+            },
+            Err(err) => match project_flox_nix(flox, &name).await {
+                Ok(_) => build_ephemeral_project(flox, &name, state_dir).await?,
+                Err(_) => return Err(err),
+            },
+        };
+        script.push_str(&kind.prepend_path("PATH", &path.join("bin")));
+        script.push('\n');
+        script.push_str(&kind.source_if_exists(&path.join("activate")));
+        script.push('\n');
+    }
+
+    if refs.len() > 1 {
+        let layered = refs
+            .iter()
+            .map(|environment| environment_name(*environment))
+            .collect::<Vec<_>>()
+            .join(":");
+        script.push_str(&kind.export(LAYERED_ENVIRONMENTS_VAR, &layered));
+        script.push('\n');
+    }
+    Ok(script)
+}
+
+/// Build the working copy of the project environment `name` into `state_dir`
+///
+/// The lock of the project's flake is written to `state_dir` as well,
+/// a project that has not been locked yet is left as it is.
+async fn build_ephemeral_project(flox: &Flox, name: &str, state_dir: &Path) -> Result<PathBuf> {
+    let workdir = project_workdir(flox).await?;
+    let installable = format!(
+        "git+file://{}#floxEnvs.{}.{name}",
+        workdir.display(),
+        flox.system
+    );
+    let out_link = state_dir.join(format!("{}.{name}", flox.system));
+
+    info!("Building environment '{name}' of the project...");
+    let output = tokio::process::Command::new(NIX_BIN)
+        .args(["--extra-experimental-features", "nix-command flakes"])
+        .args(["build", "--impure", &installable])
+        .arg("--out-link")
+        .arg(&out_link)
+        .arg("--output-lock-file")
+        .arg(state_dir.join("flake.lock"))
+        .output()
+        .await
+        .context("Failed to run nix")?;
+
+    if !output.status.success() {
+        bail!(
+            "Could not build environment '{name}':\n{}",
+            String::from_utf8_lossy(&output.stderr)
+        );
+    }
+    std::fs::read_link(&out_link).context("nix did not link the built environment")
+}
+
+/// Retrieve the script setting up `environment`, the default environment if absent
+async fn environment_activation_script(
+    flox: &Flox,
+    environment_args: &EnvironmentArgs,
+    environment: Option<&EnvironmentRef>,
+    shell: Option<ShellKind>,
+) -> Result<String> {
+    let mut args: Vec<OsString> = vec!["activate".into()];
+    if let Some(ref system) = environment_args.system {
+        args.extend(["--system".into(), system.into()]);
+    }
+    if let Some(environment) = environment {
+        args.extend(["--environment".into(), environment.as_os_str().to_owned()]);
+    }
+
+    match shell {
+        Some(shell) => {
+            let shell = shell.to_string();
+            capture_in_flox(flox, &args, &[("SHELL", shell.as_str())]).await
+        },
+        None => capture_in_flox(flox, &args, &[]).await,
     }
 }
 
@@ -134,9 +4543,35 @@ pub enum PullFloxmainOrEnv {
         /// (Flox internal use only.)
         #[bpaf(long("no-render"))]
         no_render: bool,
+        /// only fetch the environment's metadata without realizing its store paths.
+        /// Store paths are fetched once a generation is activated.
+        #[bpaf(long("no-realize"))]
+        no_realize: bool,
+        #[bpaf(external(pull_mode), fallback(PullMode::Link))]
+        mode: PullMode,
+        /// project environment to copy or merge into,
+        /// defaults to the name of the pulled environment or the only project environment
+        #[bpaf(long("into"), argument("NAME"))]
+        into: Option<String>,
     },
 }
 
+/// What `flox pull` does with a pulled environment
+#[derive(Bpaf, Clone, Copy, Debug, PartialEq, Eq)]
+pub enum PullMode {
+    /// keep the local copy linked to the remote environment (default)
+    #[bpaf(long)]
+    Link,
+    /// copy the environment into a project environment in the current directory,
+    /// which is not linked to the remote
+    #[bpaf(long)]
+    Copy,
+    /// merge the packages and variables of the environment
+    /// into a project environment in the current directory
+    #[bpaf(long)]
+    Merge,
+}
+
 #[derive(Bpaf, Clone)]
 pub enum PushFloxmainOrEnv {
     /// push the `floxmain` branch to sync configuration
@@ -169,6 +4604,58 @@ pub enum EnvironmentCommands {
         #[bpaf(long, short, argument("ENV"))]
         environment: Vec<EnvironmentRef>,
 
+        /// Do not source the user's shell profile and rc files in the subshell
+        #[bpaf(long("no-profile"))]
+        no_profile: bool,
+
+        /// Activate this generation of the environment without switching to it
+        #[bpaf(long("generation"), argument("GENERATION"))]
+        generation: Option<u32>,
+
+        /// Print the statements exporting the activated environment instead of starting a shell
+        #[bpaf(long("print-script"))]
+        print_script: bool,
+
+        /// Shell to print the script for (bash, zsh or fish), defaults to POSIX sh
+        #[bpaf(long("shell"), argument("SHELL"))]
+        shell: Option<ShellKind>,
+
+        /// Print the variables and PATH entries set up by the activation as JSON
+        #[bpaf(long("json"))]
+        json: bool,
+
+        /// Export the variables of this dotenv file after those of the environment,
+        /// can be given multiple times
+        #[bpaf(long("env-file"), argument("FILE"))]
+        env_file: Vec<PathBuf>,
+
+        /// Skip env files given with '--env-file' that do not exist
+        #[bpaf(long("env-file-optional"))]
+        env_file_optional: bool,
+
+        /// Reload the activation in the subshell when an environment changes
+        #[bpaf(long("watch"))]
+        watch: bool,
+
+        /// Run the command given after '--' with its arguments passed verbatim,
+        /// the default if a command is given
+        #[bpaf(long("command"))]
+        run_command: bool,
+
+        /// Working directory of the command, the environment is activated in the current directory
+        #[bpaf(long("dir"), argument("DIR"))]
+        dir: Option<PathBuf>,
+
+        /// Do not register the activation or keep any state after the shell or command exits,
+        /// environments can not be modified within the activation
+        #[bpaf(long("ephemeral"))]
+        ephemeral: bool,
+
+        /// Only report warnings and errors while setting up the activation,
+        /// the output of the shell or command is not affected
+        #[bpaf(long("quiet"))]
+        quiet: bool,
+
         #[bpaf(external(activate_run_args))]
         arguments: Option<(String, Vec<String>)>,
     },
@@ -207,6 +4694,16 @@ pub enum EnvironmentCommands {
 
         #[bpaf(long, short, argument("ENV"))]
         environment: Option<EnvironmentRef>,
+
+        /// Replace the configuration with the contents of FILE instead of opening an editor,
+        /// '-' reads it from stdin
+        #[bpaf(long, short, argument("FILE"))]
+        file: Option<PathBuf>,
+
+        /// Validate the configuration given with '--file' and lock its channels
+        /// without changing the environment
+        #[bpaf(long("dry-run"))]
+        dry_run: bool,
     },
 
     /// export declarative environment manifest to STDOUT
@@ -217,6 +4714,91 @@ pub enum EnvironmentCommands {
 
         #[bpaf(long, short, argument("ENV"))]
         environment: Option<EnvironmentRef>,
+
+        /// write the export to FILE instead of STDOUT
+        #[bpaf(long, short, argument("FILE"))]
+        output: Option<PathBuf>,
+    },
+
+    /// compare two generations of an environment, or its working copy with the current one
+    #[bpaf(command)]
+    Diff {
+        #[bpaf(external(environment_args), group_help("Environment Options"))]
+        environment_args: EnvironmentArgs,
+
+        #[bpaf(long, short, argument("ENV"))]
+        environment: Option<EnvironmentRef>,
+
+        /// print the differences as JSON
+        #[bpaf(long)]
+        json: bool,
+
+        /// The generation to compare from,
+        /// without it the project's working copy is compared with the current generation
+        #[bpaf(positional("FROM"))]
+        from: Option<u32>,
+
+        /// The generation to compare to, defaults to the current generation
+        #[bpaf(positional("TO"))]
+        to: Option<u32>,
+    },
+
+    /// list the generations of an environment, newest first, with their changes
+    #[bpaf(command)]
+    Log {
+        #[bpaf(external(environment_args), group_help("Environment Options"))]
+        environment_args: EnvironmentArgs,
+
+        #[bpaf(long, short, argument("ENV"))]
+        environment: Option<EnvironmentRef>,
+
+        /// Show the changes of the manifest of each generation
+        #[bpaf(short('p'), long("patch"))]
+        patch: bool,
+
+        /// Print the generations and their package changes as JSON
+        #[bpaf(long)]
+        json: bool,
+    },
+
+    /// show which package of an environment provides a command
+    #[bpaf(command)]
+    Which {
+        #[bpaf(external(environment_args), group_help("Environment Options"))]
+        environment_args: EnvironmentArgs,
+
+        #[bpaf(long, short, argument("ENV"))]
+        environment: Option<EnvironmentRef>,
+
+        /// list all packages providing the command, in resolution order
+        #[bpaf(long)]
+        all: bool,
+
+        /// print the providers as JSON
+        #[bpaf(long)]
+        json: bool,
+
+        /// The command to look up
+        #[bpaf(positional("COMMAND"))]
+        command: String,
+    },
+
+    /// check an environment for common problems and suggest how to fix them
+    #[bpaf(command)]
+    Doctor {
+        #[bpaf(external(environment_args), group_help("Environment Options"))]
+        environment_args: EnvironmentArgs,
+
+        #[bpaf(long, short, argument("ENV"))]
+        environment: Option<EnvironmentRef>,
+
+        /// print the checks and their findings as JSON
+        #[bpaf(long)]
+        json: bool,
+
+        /// skip the checks that need network access
+        #[bpaf(long)]
+        offline: bool,
     },
 
     /// list environment generations with contents
@@ -313,6 +4895,20 @@ pub enum EnvironmentCommands {
         /// forceably overwrite the remote copy of the environment
         #[bpaf(long, short)]
         force: bool,
+
+        /// Warn about packages of the environment that are not available
+        /// from any configured substituter
+        #[bpaf(long("check-cached"))]
+        check_cached: bool,
+
+        /// Like '--check-cached' but refuse to push if any package is not available
+        #[bpaf(long("require-cached"))]
+        require_cached: bool,
+
+        /// git repository to push the environment to instead of the remote registry,
+        /// e.g. 'ssh://git@example.com/environments/NAME'
+        #[bpaf(positional("URL"))]
+        url: Option<String>,
     },
 
     /// pull environment metadata from remote registry
@@ -327,6 +4923,11 @@ pub enum EnvironmentCommands {
         /// forceably overwrite the local copy of the environment
         #[bpaf(long, short)]
         force: bool,
+
+        /// git repository to pull the environment from instead of the remote registry,
+        /// e.g. 'ssh://git@example.com/environments/NAME'
+        #[bpaf(positional("URL"))]
+        url: Option<String>,
     },
 
     /// remove packages from an environment
@@ -338,7 +4939,19 @@ pub enum EnvironmentCommands {
         #[bpaf(long, short, argument("ENV"))]
         environment: Option<EnvironmentRef>,
 
-        #[bpaf(positional("PACKAGES"), some("At least one package"))]
+        /// remove all packages whose install id matches GLOB, e.g. 'python3*'
+        #[bpaf(long("match"), argument("GLOB"))]
+        matching: Vec<String>,
+
+        /// skip packages that are not installed instead of failing
+        #[bpaf(long("ignore-missing"))]
+        ignore_missing: bool,
+
+        /// remove the packages matched by '--match' without asking for confirmation
+        #[bpaf(long, short)]
+        yes: bool,
+
+        #[bpaf(positional("PACKAGES"))]
         packages: Vec<FloxPackage>,
     },
 
@@ -380,10 +4993,38 @@ pub enum EnvironmentCommands {
         #[bpaf(long, short, argument("ENV"))]
         environment: Option<EnvironmentRef>,
 
+        /// Show the version each package would be upgraded to without upgrading
+        #[bpaf(long("dry-run"))]
+        dry_run: bool,
+
+        /// Exit with status 100 if upgrades are available, requires '--dry-run'
+        #[bpaf(long("exit-code"))]
+        exit_code: bool,
+
         #[bpaf(positional("PACKAGES"))]
         packages: Vec<FloxPackage>,
     },
 
+    /// remove old generations and stale activation state of all environments
+    #[bpaf(command)]
+    Gc {
+        /// Number of most recent generations to keep of each environment
+        #[bpaf(long("keep"), argument("N"))]
+        keep: Option<usize>,
+
+        /// Also remove generations created more than DAYS days ago
+        #[bpaf(long("older-than"), argument("DAYS"))]
+        older_than: Option<u64>,
+
+        /// Collect garbage in the nix store afterwards
+        #[bpaf(long("store"))]
+        store: bool,
+
+        /// List what would be removed without removing anything
+        #[bpaf(long("dry-run"))]
+        dry_run: bool,
+    },
+
     /// delete non-current versions of an environment
     #[bpaf(command("wipe-history"))]
     WipeHistory {
@@ -404,3 +5045,377 @@ pub enum ListOutput {
     #[bpaf(long)]
     Json,
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn parse(args: &[&str]) -> EnvironmentCommands {
+        environment_commands()
+            .to_options()
+            .run_inner(args.into())
+            .unwrap_or_else(|_| panic!("Could not parse {args:?}"))
+    }
+
+    #[test]
+    fn forwards_activation() {
+        assert!(parse(&["activate"]).forwards_activation());
+        assert!(parse(&["activate", "--", "ls", "-l"]).forwards_activation());
+
+        assert!(!parse(&["activate", "--command", "--", "ls", "-l"]).forwards_activation());
+        assert!(!parse(&["activate", "--dir", "/tmp", "--", "ls"]).forwards_activation());
+        assert!(!parse(&["activate", "--quiet", "--", "ls"]).forwards_activation());
+        assert!(!parse(&["activate", "--no-profile"]).forwards_activation());
+    }
+
+    #[test]
+    fn command_arguments_verbatim() {
+        match parse(&["activate", "--command", "--", "tool", "a b", "c", "--flag"]) {
+            EnvironmentCommands::Activate {
+                run_command,
+                arguments,
+                ..
+            } => {
+                assert!(run_command);
+                assert_eq!(
+                    arguments,
+                    Some((
+                        "tool".to_string(),
+                        vec!["a b".to_string(), "c".to_string(), "--flag".to_string()]
+                    ))
+                );
+            },
+            _ => panic!("expected activate"),
+        }
+    }
+
+    #[test]
+    fn activation_json_schema() {
+        let current_path = env::var("PATH").unwrap_or_default();
+        let activated = BTreeMap::from([
+            (
+                "PATH".to_string(),
+                format!("/nix/store/aaaa-profile/bin:{current_path}"),
+            ),
+            ("FLOX_TEST_ACTIVATED".to_string(), "1".to_string()),
+            ("SHLVL".to_string(), "7".to_string()),
+        ]);
+        let environments = vec![ActivatedEnvironment {
+            name: "owner/env".to_string(),
+            generation: 3,
+            path: PathBuf::from("/nix/store/aaaa-profile"),
+        }];
+
+        let activation = ActivationJson::new(environments, activated);
+        assert_eq!(
+            serde_json::to_value(&activation).unwrap(),
+            json!({
+                "version": ACTIVATION_JSON_VERSION,
+                "floxVersion": FLOX_VERSION,
+                "environments": [{
+                    "name": "owner/env",
+                    "generation": 3,
+                    "path": "/nix/store/aaaa-profile",
+                }],
+                "variables": { "FLOX_TEST_ACTIVATED": "1" },
+                "path": ["/nix/store/aaaa-profile/bin"],
+            })
+        );
+    }
+
+    #[tokio::test]
+    async fn print_script_exports() {
+        let state_dir = tempfile::tempdir().unwrap();
+        let hook = "export FLOX_TEST_HOOK=\"$(echo ran once)\"; \
+                    export PATH=/nix/store/aaaa-profile/bin:/nix/store/bbbb-tools/bin:$PATH";
+        let activated = shell::activated_environment(state_dir.path(), hook)
+            .await
+            .unwrap();
+        let changes = ActivationChanges::new(activated);
+
+        assert_eq!(
+            changes.script(ShellKind::Bash),
+            "export PATH=/nix/store/bbbb-tools/bin\"${PATH:+:$PATH}\";\n\
+             export PATH=/nix/store/aaaa-profile/bin\"${PATH:+:$PATH}\";\n\
+             export FLOX_TEST_HOOK='ran once';\n"
+        );
+        assert_eq!(
+            changes.script(ShellKind::Fish),
+            "set -gx PATH /nix/store/bbbb-tools/bin $PATH;\n\
+             set -gx PATH /nix/store/aaaa-profile/bin $PATH;\n\
+             set -gx FLOX_TEST_HOOK 'ran once';\n"
+        );
+    }
+
+    #[test]
+    fn secrets_file() {
+        let (script, path) = write_secrets_file(ShellKind::Bash, "export TOKEN=secret;\n").unwrap();
+
+        assert!(!script.contains("secret;"));
+        assert!(script.contains(&*path.to_string_lossy()));
+        assert_eq!(
+            std::fs::metadata(&path).unwrap().permissions().mode() & 0o777,
+            0o600
+        );
+        assert_eq!(
+            std::fs::read_to_string(&path).unwrap(),
+            "export TOKEN=secret;\n"
+        );
+
+        let file = path.to_path_buf();
+        drop(path);
+        assert!(!file.exists());
+    }
+
+    #[tokio::test]
+    async fn defer_realisation_until_activation() {
+        let cache_dir = tempfile::tempdir().unwrap();
+        let store_path = cache_dir.path().join("store-path");
+
+        assert!(deferred_realisation(cache_dir.path(), "owner/env")
+            .unwrap()
+            .is_none());
+
+        defer_realisation(cache_dir.path(), "owner/env", &store_path).unwrap();
+        assert_eq!(
+            deferred_realisation(cache_dir.path(), "owner/env").unwrap(),
+            Some(store_path.clone())
+        );
+        assert!(deferred_realisation(cache_dir.path(), "other/env")
+            .unwrap()
+            .is_none());
+
+        // the path exists, so activating only clears the record
+        std::fs::create_dir(&store_path).unwrap();
+        realise_deferred(cache_dir.path(), "owner/env")
+            .await
+            .unwrap();
+        assert!(deferred_realisation(cache_dir.path(), "owner/env")
+            .unwrap()
+            .is_none());
+
+        clear_deferred_realisation(cache_dir.path(), "owner/env").unwrap();
+    }
+
+    /// The files below `dir` and their contents
+    fn snapshot(dir: &Path) -> BTreeMap<PathBuf, Vec<u8>> {
+        let mut files = BTreeMap::new();
+        let mut dirs = vec![dir.to_path_buf()];
+        while let Some(dir) = dirs.pop() {
+            for entry in std::fs::read_dir(dir).unwrap() {
+                let path = entry.unwrap().path();
+                if path.is_dir() {
+                    dirs.push(path);
+                } else {
+                    files.insert(path.clone(), std::fs::read(&path).unwrap());
+                }
+            }
+        }
+        files
+    }
+
+    #[tokio::test]
+    async fn ephemeral_activation_writes_nothing() {
+        let dirs = tempfile::tempdir().unwrap();
+        let flox = Flox {
+            system: "x86_64-linux".to_string(),
+            cache_dir: dirs.path().join("cache"),
+            data_dir: dirs.path().join("data"),
+            temp_dir: dirs.path().join("temp"),
+            ..Default::default()
+        };
+        std::fs::create_dir_all(&flox.data_dir).unwrap();
+        std::fs::create_dir_all(&flox.temp_dir).unwrap();
+
+        // a realised generation of the default environment
+        let profile = dirs.path().join("profile");
+        std::fs::create_dir_all(profile.join("bin")).unwrap();
+        std::fs::write(profile.join("activate"), "export FLOX_TEST_PROFILE=1\n").unwrap();
+
+        let meta = flox.cache_dir.join("meta").join("local");
+        std::fs::create_dir_all(&meta).unwrap();
+        let git = |args: &[&str]| {
+            let status = std::process::Command::new("git")
+                .arg("-C")
+                .arg(&meta)
+                .args(["-c", "user.name=flox", "-c", "user.email=flox@example.com"])
+                .args(args)
+                .status()
+                .unwrap();
+            assert!(status.success(), "git {args:?} failed");
+        };
+        git(&["init"]);
+        git(&["checkout", "-b", &format!("{}.default", flox.system)]);
+        let metadata = json!({
+            "currentGen": "1",
+            "generations": {
+                "1": {
+                    "created": 0,
+                    "lastActive": 0,
+                    "logMessage": ["create environment"],
+                    "path": profile,
+                },
+            },
+        });
+        std::fs::write(meta.join("metadata.json"), metadata.to_string()).unwrap();
+        git(&["add", "metadata.json"]);
+        git(&["commit", "-m", "create environment"]);
+        // floxmeta is fetched by every command reading it
+        git(&["fetch", "--all"]);
+
+        let cache = snapshot(&flox.cache_dir);
+        let data = snapshot(&flox.data_dir);
+
+        let output = dirs.path().join("output");
+        let activation = Activation {
+            flox: &flox,
+            environment_args: &EnvironmentArgs { system: None },
+            environments: &[],
+            generation: None,
+            env_files: &[],
+            env_files_optional: false,
+            ephemeral: true,
+        };
+        activation
+            .run(ActivationMode::Command {
+                command: "sh",
+                args: &[
+                    "-c".to_string(),
+                    "echo \"$FLOX_EPHEMERAL $FLOX_TEST_PROFILE\" > \"$1\"".to_string(),
+                    "sh".to_string(),
+                    output.to_string_lossy().into_owned(),
+                ],
+                dir: None,
+            })
+            .await
+            .unwrap();
+
+        assert_eq!(std::fs::read_to_string(&output).unwrap(), "1 1\n");
+        assert_eq!(snapshot(&flox.cache_dir), cache);
+        assert_eq!(snapshot(&flox.data_dir), data);
+        assert!(snapshot(&flox.temp_dir).is_empty());
+    }
+
+    #[test]
+    fn install_args_of_locked_flakes() {
+        let locked = HashMap::from([(
+            OsString::from("github:owner/repo#tool"),
+            OsString::from("github:owner/repo/0123abcd?narHash=sha256-aaaa#tool"),
+        )]);
+        let args =
+            ["install", "-e", "env", "github:owner/repo#tool", "hello@^2"].map(OsString::from);
+
+        assert_eq!(
+            lock_install_args(args, &locked),
+            [
+                "install",
+                "-e",
+                "env",
+                "github:owner/repo/0123abcd?narHash=sha256-aaaa#tool",
+                "hello@^2",
+            ]
+            .map(OsString::from)
+        );
+    }
+
+    #[test]
+    fn edit_dry_run() {
+        assert!(!parse(&["edit", "--file", "-", "--dry-run"]).modifies_environment());
+        assert!(parse(&["edit", "--file", "-"]).modifies_environment());
+
+        let channels = manifest_channels(
+            r#"{
+              packages.nixpkgs-flox.hello = { };
+              packages."github:flox/floxpkgs".flox = { };
+            }"#,
+        )
+        .unwrap();
+        assert_eq!(
+            channels,
+            [
+                (
+                    "github:flox/floxpkgs".to_string(),
+                    "github:flox/floxpkgs".to_string()
+                ),
+                ("nixpkgs-flox".to_string(), "flake:nixpkgs-flox".to_string()),
+            ]
+        );
+        assert!(manifest_channels("{ }").unwrap().is_empty());
+    }
+
+    #[test]
+    fn check_cached_store_paths_of_push() {
+        let nix_config = br#"{
+            "substituters": {
+                "aliases": [ "binary-caches" ],
+                "defaultValue": [ "https://cache.nixos.org/" ],
+                "value": [ "https://cache.nixos.org/", "https://cache.example.com" ]
+            },
+            "sandbox": { "value": true }
+        }"#;
+        assert_eq!(
+            parse_substituters(nix_config).unwrap(),
+            ["https://cache.nixos.org/", "https://cache.example.com"]
+        );
+        assert!(parse_substituters(b"{}").is_err());
+
+        let uncached = ["/nix/store/a-hello", "/nix/store/b-tool"].map(String::from);
+        assert_eq!(
+            uncached_message("default", 3, &uncached),
+            "2 of 3 store paths of environment 'default' are not available \
+             from any configured substituter and will have to be built by its users:\n  \
+             /nix/store/a-hello\n  /nix/store/b-tool"
+        );
+
+        let args = ["push", "--check-cached", "-e", "env", "--require-cached"];
+        assert_eq!(
+            without_cache_checks(args.map(OsString::from)),
+            ["push", "-e", "env"].map(OsString::from)
+        );
+    }
+
+    #[test]
+    fn glob() {
+        assert!(glob_matches("*", "python3"));
+        assert!(glob_matches("*", ""));
+        assert!(glob_matches("python*", "python3"));
+        assert!(glob_matches("*3", "python3"));
+        assert!(glob_matches("py*on*", "python3"));
+        assert!(glob_matches("python?", "python3"));
+        assert!(glob_matches("?ython?", "python3"));
+
+        assert!(!glob_matches("python?", "python"));
+        assert!(!glob_matches("python?", "python39"));
+        assert!(!glob_matches("node*", "python3"));
+        assert!(!glob_matches("python", "python3"));
+    }
+
+    #[test]
+    fn select_packages_by_glob() {
+        let installed: Vec<InstalledPackage> = ["python3", "python39", "nodejs", "ripgrep"]
+            .into_iter()
+            .map(|id| InstalledPackage {
+                install_id: id.to_string(),
+                attr_path: None,
+                version: None,
+                channel: None,
+                url: None,
+                store_paths: Vec::new(),
+                priority: None,
+                active: true,
+                broken: None,
+                insecure: None,
+            })
+            .collect();
+        let select = |globs: &[&str]| {
+            let globs: Vec<String> = globs.iter().map(|glob| glob.to_string()).collect();
+            glob_matching_packages(&globs, &installed)
+        };
+
+        assert_eq!(select(&["python*"]), vec!["python3", "python39"]);
+        assert_eq!(select(&["python?"]), vec!["python3"]);
+        assert_eq!(select(&["node*", "rip*"]), vec!["nodejs", "ripgrep"]);
+        assert_eq!(select(&["*"]).len(), 4);
+        assert!(select(&["go*"]).is_empty());
+    }
+}
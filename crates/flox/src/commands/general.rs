@@ -8,8 +8,12 @@ use flox_rust_sdk::nix::command_line::{Group, NixCliCommand, NixCommandLine, ToA
 use flox_rust_sdk::nix::Run;
 use flox_rust_sdk::prelude::{Channel, Stability};
 use fslock::LockFile;
+use log::{info, warn};
 
+use super::channel::search_cache;
+use super::environment::{installed_package_ids, EnvironmentRef};
 use crate::config::features::Feature;
+use crate::config::keys::{ConfigFile, ConfigKey, ValueSource, CONFIG_KEYS};
 use crate::config::Config;
 use crate::utils::init::init_telemetry_consent;
 use crate::utils::metrics::{
@@ -19,6 +23,9 @@ use crate::utils::metrics::{
 };
 use crate::{flox_forward, subcommand_metric};
 
+/// Number of completions printed by `flox __complete` unless `--limit` is given
+const DEFAULT_COMPLETION_LIMIT: usize = 50;
+
 #[derive(Bpaf, Clone)]
 pub struct GeneralArgs {}
 
@@ -78,6 +85,114 @@ impl GeneralCommands {
 
                 init_telemetry_consent(&flox.data_dir, &flox.cache_dir).await?;
             },
+
+            // the keys of flox (sh) are listed by flox (sh) after the ones managed here
+            GeneralCommands::Config(ConfigArgs::List) => {
+                subcommand_metric!("config");
+
+                let file = ConfigFile::open(&config.flox.config_dir)?;
+                for key in CONFIG_KEYS {
+                    let (value, source) = file.effective(key);
+                    let source = match source {
+                        ValueSource::Default => "default".to_string(),
+                        ValueSource::File(path) => format!("set in {}", path.display()),
+                        ValueSource::Env(var) => format!("set by ${var}"),
+                    };
+                    println!(
+                        "{} = {} ({source})",
+                        key.name,
+                        value.as_deref().unwrap_or(key.default)
+                    );
+                }
+
+                flox_forward(&flox).await?
+            },
+
+            GeneralCommands::Config(ConfigArgs::Get(ConfigGet { key, .. }))
+                if ConfigKey::get(key).is_some() =>
+            {
+                subcommand_metric!("config");
+
+                let key = ConfigKey::find(key)?;
+                let file = ConfigFile::open(&config.flox.config_dir)?;
+                let (value, _) = file.effective(key);
+                println!("{}", value.as_deref().unwrap_or(key.default));
+            },
+
+            GeneralCommands::Config(ConfigArgs::Set(ConfigSet { key, value, .. }))
+                if ConfigKey::get(key).is_some() =>
+            {
+                subcommand_metric!("config");
+
+                let key = ConfigKey::find(key)?;
+                let value = key.parse(value)?;
+                let mut file = ConfigFile::open(&config.flox.config_dir)?;
+                file.set(key, value);
+                file.save()?;
+                warn_if_overridden(key);
+            },
+
+            GeneralCommands::Config(ConfigArgs::SetNumber(ConfigSetNumber {
+                key, value, ..
+            })) if ConfigKey::get(key).is_some() => {
+                subcommand_metric!("config");
+
+                let key = ConfigKey::find(key)?;
+                let value = key.parse(&value.to_string())?;
+                let mut file = ConfigFile::open(&config.flox.config_dir)?;
+                file.set(key, value);
+                file.save()?;
+                warn_if_overridden(key);
+            },
+
+            GeneralCommands::Config(ConfigArgs::Delete(ConfigDelete { key, .. }))
+                if ConfigKey::get(key).is_some() =>
+            {
+                subcommand_metric!("config");
+
+                let key = ConfigKey::find(key)?;
+                let mut file = ConfigFile::open(&config.flox.config_dir)?;
+                if file.delete(key) {
+                    file.save()?;
+                } else {
+                    info!("'{}' is not set in {}", key.name, file.path().display());
+                }
+            },
+
+            // keys not managed here may be known to flox (sh)
+            GeneralCommands::Config(_) => flox_forward(&flox).await?,
+
+            // no metric, shells call this on every <TAB>
+            GeneralCommands::Complete {
+                environment,
+                json,
+                limit,
+                command,
+                partial,
+            } => {
+                let partial = partial.as_deref().unwrap_or_default();
+                let mut completions = match command.as_str() {
+                    "install" => search_cache(&config, &flox).package_names(partial),
+                    // completion must not fail, complete nothing if the environment is unknown
+                    "remove" | "upgrade" => installed_package_ids(&flox, environment.as_ref())
+                        .await
+                        .unwrap_or_default()
+                        .into_iter()
+                        .filter(|id| id.starts_with(partial))
+                        .collect(),
+                    _ => Vec::new(),
+                };
+                completions.truncate(limit.unwrap_or(DEFAULT_COMPLETION_LIMIT));
+
+                if *json {
+                    println!("{}", serde_json::to_string(&completions)?);
+                } else {
+                    for completion in completions {
+                        println!("{completion}");
+                    }
+                }
+            },
+
             _ if Feature::All.is_forwarded()? => flox_forward(&flox).await?,
             _ => todo!(),
         }
@@ -85,6 +200,17 @@ impl GeneralCommands {
     }
 }
 
+/// Warn that a value set in `flox.toml` has no effect in the current environment
+fn warn_if_overridden(key: &ConfigKey) {
+    if env::var_os(key.env_var()).is_some() {
+        warn!(
+            "'{}' is overridden by ${} in the current environment",
+            key.name,
+            key.env_var()
+        );
+    }
+}
+
 /// General Commands
 #[derive(Bpaf, Clone)]
 pub enum GeneralCommands {
@@ -100,6 +226,29 @@ pub enum GeneralCommands {
     #[bpaf(command("reset-metrics"))]
     ResetMetrics,
 
+    /// print completions of `<partial>` for the arguments of `<command>`,
+    /// used by the shell completion scripts
+    #[bpaf(command("__complete"), hide)]
+    Complete {
+        /// the environment `remove` and `upgrade` complete packages of
+        #[bpaf(long, short, argument("ENV"))]
+        environment: Option<EnvironmentRef>,
+
+        /// print completions as a JSON list
+        #[bpaf(long)]
+        json: bool,
+
+        /// print at most N completions, defaults to 50
+        #[bpaf(long, argument("N"))]
+        limit: Option<usize>,
+
+        #[bpaf(positional("command"))]
+        command: String,
+
+        #[bpaf(positional("partial"))]
+        partial: Option<String>,
+    },
+
     /// access to the nix CLI
     Nix(#[bpaf(external(parse_nix_passthru))] WrappedNix),
 }
@@ -116,11 +265,24 @@ pub enum ConfigArgs {
     #[bpaf(short, long)]
     Confirm,
 
+    Get(#[bpaf(external(config_get))] ConfigGet),
     Set(#[bpaf(external(config_set))] ConfigSet),
     SetNumber(#[bpaf(external(config_set_number))] ConfigSetNumber),
     Delete(#[bpaf(external(config_delete))] ConfigDelete),
 }
 
+/// Arguments for `flox config --get`
+#[derive(Debug, Clone, Bpaf)]
+#[bpaf(adjacent)]
+#[allow(unused)]
+pub struct ConfigGet {
+    /// print the effective value of <key>
+    get: (),
+    /// Configuration key
+    #[bpaf(positional("key"))]
+    key: String,
+}
+
 /// Arguments for `flox config --set`
 #[derive(Debug, Clone, Bpaf)]
 #[bpaf(adjacent)]
@@ -21,6 +21,8 @@ use crate::utils::init::{
     init_access_tokens,
     init_channels,
     init_git_conf,
+    init_nix_network_config,
+    init_quiet_progress,
     init_telemetry_consent,
     init_uuid,
 };
@@ -53,6 +55,28 @@ impl Default for Verbosity {
     }
 }
 
+/// Format of the messages logged by flox
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum LogFormat {
+    /// Human readable messages, styled if the terminal supports it
+    #[default]
+    Human,
+    /// One JSON object per line, for consumption by CI systems
+    Json,
+}
+
+impl FromStr for LogFormat {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "human" => Ok(LogFormat::Human),
+            "json" => Ok(LogFormat::Json),
+            _ => anyhow::bail!("Unsupported log format: {s}, expected one of human, json"),
+        }
+    }
+}
+
 #[derive(Bpaf)]
 #[bpaf(options, version(FLOX_VERSION))]
 pub struct FloxArgs {
@@ -66,6 +90,15 @@ pub struct FloxArgs {
     #[bpaf(long, switch, many, map(vec_not_empty))]
     pub debug: bool,
 
+    /// Format of log messages, one of `human` or `json`.
+    #[bpaf(
+        long("log-format"),
+        env("FLOX_LOG_FORMAT"),
+        argument("FORMAT"),
+        fallback(Default::default())
+    )]
+    pub log_format: LogFormat,
+
     #[bpaf(external(commands))]
     command: Commands,
 }
@@ -97,6 +130,8 @@ impl FloxArgs {
             env::set_var("FLOX_DISABLE_METRICS", "true");
         }
 
+        init_nix_network_config(config.flox.connect_timeout, config.flox.max_retries);
+
         let channels = init_channels(&config.flox.config_dir)?;
 
         let access_tokens = init_access_tokens(&config.nix.access_tokens)?;
@@ -156,8 +191,17 @@ impl FloxArgs {
                 );
                 command.handle(config, flox).await?
             },
-            Commands::Environment(ref environment) => environment.handle(flox).await?,
-            Commands::Channel(ref channel) => channel.handle(flox).await?,
+            Commands::Environment(ref environment) => {
+                // keep the verbosity that was asked for explicitly
+                if environment.quiet()
+                    && !self.debug
+                    && matches!(self.verbosity, Verbosity::Verbose(0))
+                {
+                    init_quiet_progress();
+                }
+                environment.handle(config, flox).await?
+            },
+            Commands::Channel(ref channel) => channel.handle(config, flox).await?,
             Commands::General(ref general) => general.handle(config, flox).await?,
         }
 
@@ -239,3 +283,16 @@ impl BashPassthru {
         None
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parse_log_format() {
+        assert_eq!("human".parse::<LogFormat>().unwrap(), LogFormat::Human);
+        assert_eq!("json".parse::<LogFormat>().unwrap(), LogFormat::Json);
+        assert!("JSON".parse::<LogFormat>().is_err());
+        assert_eq!(LogFormat::default(), LogFormat::Human);
+    }
+}
@@ -1,13 +1,22 @@
 use std::env;
 use std::fmt::Debug;
+use std::os::unix::fs::PermissionsExt;
 use std::path::{Path, PathBuf};
+use std::process::Stdio;
 
 use anyhow::{bail, Context, Result};
 use bpaf::{construct, Bpaf, Parser};
 use crossterm::tty::IsTty;
+use flox_rust_sdk::environment::NIX_BIN;
 use flox_rust_sdk::flox::{EnvironmentRef, Flox};
+use flox_rust_sdk::models::build_cache::{BuildCache, BuildOutputs};
+use flox_rust_sdk::models::container_config::ContainerConfig;
+use flox_rust_sdk::models::container_image::{self, Platform};
+use flox_rust_sdk::models::detection;
+use flox_rust_sdk::models::flox_nix;
 use flox_rust_sdk::models::root::project::Project;
 use flox_rust_sdk::models::root::{self, Closed, Root};
+use flox_rust_sdk::models::sandbox::{sandbox_limitations, SandboxViolation};
 use flox_rust_sdk::nix::arguments::eval::EvaluationArgs;
 use flox_rust_sdk::nix::arguments::flake::FlakeArgs;
 use flox_rust_sdk::nix::arguments::NixArgs;
@@ -16,17 +25,19 @@ use flox_rust_sdk::nix::command_line::{Group, NixCliCommand, NixCommandLine, ToA
 use flox_rust_sdk::nix::{Run as RunC, RunTyped};
 use flox_rust_sdk::prelude::{Installable, Stability};
 use flox_rust_sdk::providers::git::{GitCommandProvider, GitProvider};
-use indoc::indoc;
+use indoc::{formatdoc, indoc};
 use inquire::error::InquireResult;
 use itertools::Itertools;
-use log::{debug, info};
+use log::{debug, info, warn};
 
 use crate::commands::package::interface::ResolveInstallable;
 use crate::config::features::Feature;
 use crate::config::Config;
 use crate::utils::dialog::{Confirm, Dialog, Text};
+use crate::utils::errors::FloxExitCode;
+use crate::utils::metrics::FLOX_VERSION;
 use crate::utils::resolve_installable_from_environment_refs;
-use crate::{flox_forward, subcommand_metric};
+use crate::{bail_with, flox_forward, subcommand_metric};
 
 async fn env_ref_to_installable<Git: GitProvider + 'static>(
     flox: &Flox,
@@ -39,9 +50,12 @@ async fn env_ref_to_installable<Git: GitProvider + 'static>(
 }
 
 pub(crate) mod interface {
+    use std::collections::BTreeMap;
+
     use async_trait::async_trait;
     use bpaf::{Bpaf, Parser};
     use flox_rust_sdk::flox::Flox;
+    use flox_rust_sdk::models::container_config::ContainerConfig;
     use flox_rust_sdk::prelude::Installable;
     use flox_rust_sdk::providers::git::GitProvider;
 
@@ -126,6 +140,15 @@ pub(crate) mod interface {
         pub(crate) name: Option<String>,
         #[bpaf(short('i'), long("init-git"), switch)]
         pub(crate) init_git: bool,
+        /// Add the packages suggested for the project without asking for confirmation
+        #[bpaf(long("auto"), switch)]
+        pub(crate) auto: bool,
+        /// Do not suggest packages based on the files in the project
+        #[bpaf(long("no-detect"), switch)]
+        pub(crate) no_detect: bool,
+        /// Write an .envrc activating the environment with direnv without asking for confirmation
+        #[bpaf(long("direnv"), switch)]
+        pub(crate) direnv: bool,
     }
     pub(crate) fn template_arg(
     ) -> impl Parser<Option<InstallableArgument<Parsed, TemplateInstallable>>> {
@@ -140,6 +163,18 @@ pub(crate) mod interface {
         #[bpaf(short('A'), hide)]
         pub(crate) _attr_flag: bool,
 
+        /// Build even if the outputs of a build with the same inputs are still available
+        #[bpaf(long("no-cache"))]
+        pub(crate) no_cache: bool,
+
+        /// Build without network access and with the filesystem restricted to the build's inputs
+        #[bpaf(long)]
+        pub(crate) sandbox: bool,
+
+        /// Build outside of the sandbox and evaluate impurely, e.g. for builds that need the network
+        #[bpaf(long)]
+        pub(crate) impure: bool,
+
         #[bpaf(external(InstallableArgument::positional), optional, catch)]
         pub(crate) installable_arg: Option<InstallableArgument<Parsed, BuildInstallable>>,
     }
@@ -239,11 +274,68 @@ pub(crate) mod interface {
         #[bpaf(long("environment"), short('e'), argument("ENV"))]
         pub(crate) environment_name: Option<String>,
 
+        /// File to write the image to as docker-archive tarball, `-` for stdout
+        #[bpaf(long("output"), argument("FILE"))]
+        pub(crate) output: Option<PathBuf>,
+
+        /// Command to run as the entrypoint of the image instead of a shell
+        #[bpaf(long("entrypoint"), argument("COMMAND"))]
+        pub(crate) entrypoint: Option<String>,
+
+        /// Argument passed to the entrypoint, can be given multiple times
+        #[bpaf(long("cmd"), argument("ARG"))]
+        pub(crate) cmd: Vec<String>,
+
+        /// Port to expose as <port>[/tcp|/udp], can be given multiple times
+        #[bpaf(long("expose"), argument("PORT"))]
+        pub(crate) expose: Vec<String>,
+
+        /// Default value of an environment variable, can be given multiple times
+        #[bpaf(long("env"), argument("NAME=VALUE"))]
+        pub(crate) env: Vec<String>,
+
+        /// Working directory of the entrypoint
+        #[bpaf(long("workdir"), argument("DIR"))]
+        pub(crate) workdir: Option<String>,
+
+        /// OCI label of the image, can be given multiple times
+        #[bpaf(long("label"), argument("KEY=VALUE"))]
+        pub(crate) label: Vec<String>,
+
+        /// Platforms to build the image for, e.g. 'linux/amd64,linux/arm64',
+        /// images for several platforms are written to '--output' as OCI archive
+        #[bpaf(long("platform"), argument("PLATFORMS"))]
+        pub(crate) platform: Option<String>,
+
         #[bpaf(short('A'), hide)]
         pub _attr_flag: bool,
     }
     parseable!(Containerize, containerize);
 
+    impl Containerize {
+        /// The image configuration given on the command line
+        pub(crate) fn container_config(&self) -> anyhow::Result<ContainerConfig> {
+            Ok(ContainerConfig {
+                entrypoint: self.entrypoint.clone().map(|entrypoint| vec![entrypoint]),
+                cmd: (!self.cmd.is_empty()).then(|| self.cmd.clone()),
+                exposed_ports: self.expose.clone(),
+                environment: key_values("--env", &self.env)?,
+                working_dir: self.workdir.clone(),
+                labels: key_values("--label", &self.label)?,
+            })
+        }
+    }
+
+    /// Parse `<key>=<value>` arguments of `flag`
+    fn key_values(flag: &str, args: &[String]) -> anyhow::Result<BTreeMap<String, String>> {
+        args.iter()
+            .map(|arg| match arg.split_once('=') {
+                Some((key, value)) if !key.is_empty() => Ok((key.to_string(), value.to_string())),
+                _ => anyhow::bail!("Invalid {flag} '{arg}', expected <key>=<value>"),
+            })
+            .collect()
+    }
+
     #[derive(Bpaf, Clone, Debug)]
     pub struct Run {
         #[bpaf(short('A'), hide)]
@@ -332,7 +424,7 @@ impl interface::PackageCommands {
                     .unwrap_or("NAME")
                     .to_owned();
 
-                let git_repo = ensure_project_repo(&flox, cwd, &command).await?;
+                let git_repo = ensure_project_repo(&flox, cwd.clone(), &command).await?;
                 let project = ensure_project(git_repo, &command).await?;
 
                 let name = match command.inner.name {
@@ -363,10 +455,45 @@ impl interface::PackageCommands {
                     project
                         .init_flox_package::<NixCommandLine>(command.nix_args, template, name)
                         .await?;
+
+                    // only environment templates contain a flox.nix to add packages to
+                    let workdir = project
+                        .workdir()
+                        .context("Could not determine repository root")?;
+                    let flox_nix = workdir.join("pkgs").join(name).join("flox.nix");
+                    if !command.inner.no_detect && flox_nix.exists() {
+                        suggest_packages(&cwd, &flox_nix, command.inner.auto).await?;
+                    }
+                    if flox_nix.exists() {
+                        offer_envrc(workdir, name, command.inner.direnv).await?;
+                    }
                 }
             },
             interface::PackageCommands::Build(command) => {
                 subcommand_metric!("build");
+
+                if command.inner.sandbox && command.inner.impure {
+                    bail_with!(
+                        FloxExitCode::Usage,
+                        "'--sandbox' and '--impure' can not be combined"
+                    );
+                }
+                let sandboxed =
+                    command.inner.sandbox || (config.flox.build_sandbox && !command.inner.impure);
+
+                let mut nix_args = command.nix_args;
+                if sandboxed {
+                    if let Some(arg) = sandbox_override(&nix_args) {
+                        bail_with!(
+                            FloxExitCode::Usage,
+                            "'{arg}' disables the sandbox, use '--impure' instead"
+                        );
+                    }
+                    nix_args.extend(SANDBOX_NIX_ARGS.map(String::from));
+                } else if command.inner.impure {
+                    nix_args.extend(IMPURE_NIX_ARGS.map(String::from));
+                }
+
                 let installable_arg = command
                     .inner
                     .installable_arg
@@ -374,9 +501,48 @@ impl interface::PackageCommands {
                     .resolve_installable(&flox)
                     .await?;
 
-                flox.package(installable_arg, config.flox.stability, command.nix_args)
+                // nixpkgs only reads the variable when evaluated impurely
+                if allows_unfree(&installable_arg).await? {
+                    env::set_var(flox_nix::ALLOW_UNFREE_VAR, "1");
+                    if !nix_args.iter().any(|arg| arg == "--impure") {
+                        nix_args.push("--impure".to_string());
+                    }
+                }
+
+                let result: Result<()> = if command.inner.no_cache {
+                    flox.package(
+                        installable_arg.clone(),
+                        config.flox.stability.clone(),
+                        nix_args,
+                    )
                     .build::<NixCommandLine>()
-                    .await?;
+                    .await
+                    .map_err(Into::into)
+                } else {
+                    build_cached(
+                        &flox,
+                        installable_arg.clone(),
+                        config.flox.stability.clone(),
+                        nix_args,
+                    )
+                    .await
+                };
+
+                match result {
+                    Err(err) if sandboxed => {
+                        match explain_sandbox_failure(
+                            &flox,
+                            &installable_arg,
+                            &config.flox.stability,
+                        )
+                        .await
+                        {
+                            Some(explanation) => Err(err.context(explanation))?,
+                            None => Err(err)?,
+                        }
+                    },
+                    result => result?,
+                }
             },
             interface::PackageCommands::Develop(command) => {
                 subcommand_metric!("develop");
@@ -457,20 +623,57 @@ impl interface::PackageCommands {
             interface::PackageCommands::Containerize(command) => {
                 subcommand_metric!("containerize");
 
-                let installable = env_ref_to_installable::<GitCommandProvider>(
+                let env_refs = EnvironmentRef::<GitCommandProvider>::find(
                     &flox,
-                    "containerize",
-                    &command.inner.environment_name.unwrap_or_default(),
+                    command
+                        .inner
+                        .environment_name
+                        .as_deref()
+                        .unwrap_or_default(),
                 )
                 .await?;
 
-                if std::io::stdout().is_tty() {
+                // only project environments are defined by a flox.nix
+                let flox_nix = match env_refs.as_slice() {
+                    [EnvironmentRef::Project(project)] => Some(
+                        project
+                            .workdir
+                            .join("pkgs")
+                            .join(&project.name)
+                            .join("flox.nix"),
+                    ),
+                    _ => None,
+                };
+
+                let installable =
+                    resolve_installable_from_environment_refs(&flox, "containerize", env_refs)
+                        .await?;
+
+                let container_config = match flox_nix {
+                    Some(ref flox_nix) if flox_nix.exists() => {
+                        let contents = tokio::fs::read_to_string(flox_nix)
+                            .await
+                            .with_context(|| format!("Could not read {}", flox_nix.display()))?;
+                        ContainerConfig::from_flox_nix(&contents)?
+                    },
+                    _ => ContainerConfig::default(),
+                }
+                .merge(command.inner.container_config()?);
+
+                let output = command
+                    .inner
+                    .output
+                    .filter(|output| output != Path::new("-"));
+
+                if output.is_none() && std::io::stdout().is_tty() {
                     bail!(
                         indoc! {"
                         'flox containerize' pipes a container image to stdout, but stdout is
                         attached to the terminal. Instead, run this command as:
 
                             $ {command} | docker load
+
+                        or write the image to a file using '--output <file>'.
                     "},
                         command = env::args()
                             .map(|arg| shell_escape::escape(arg.into()))
@@ -478,43 +681,110 @@ impl interface::PackageCommands {
                     );
                 }
 
+                let platforms = match command.inner.platform {
+                    Some(ref platforms) => container_image::parse_platforms(platforms)?,
+                    None => Vec::new(),
+                };
+                if platforms.len() > 1 && output.is_none() {
+                    bail!(
+                        "Images for several platforms are written as OCI archive, \
+                         use '--output <file>' to write it to a file"
+                    );
+                }
+                // fail before building anything if any platform can not be assembled
+                check_platforms_supported(&flox.system, &platforms).await?;
+                let installables = match platforms.as_slice() {
+                    [] => vec![installable.clone()],
+                    platforms => platforms
+                        .iter()
+                        .map(|platform| {
+                            platform_installable(&installable, &flox.system, &platform.system)
+                        })
+                        .collect::<Result<Vec<_>>>()?,
+                };
+
                 let nix = flox.nix::<NixCommandLine>(command.nix_args);
 
                 let nix_args = NixArgs::default();
 
                 info!("Building container...");
 
-                let command = Build {
-                    installables: [Installable {
-                        flakeref: installable.flakeref,
-                        attr_path: installable.attr_path + ".passthru.streamLayeredImage",
-                    }]
-                    .into(),
-                    eval: EvaluationArgs {
-                        impure: true.into(),
-                    },
-                    ..Default::default()
-                };
-
-                let mut out: BuildOut = command.run_typed(&nix, &nix_args).await?;
+                // build the scripts of all platforms before streaming any image,
+                // along with their environments to check the entrypoint
+                let mut scripts = Vec::new();
+                let mut environments = Vec::new();
+                for (index, installable) in installables.iter().enumerate() {
+                    let image = if container_config.is_empty() {
+                        Installable {
+                            flakeref: installable.flakeref.clone(),
+                            attr_path: installable.attr_path.clone()
+                                + ".passthru.streamLayeredImage",
+                        }
+                    } else {
+                        let dir = flox.temp_dir.join(format!("container-{index}"));
+                        configured_image(installable, &container_config, &dir).await?
+                    };
+
+                    let command = Build {
+                        installables: [image, installable.clone()].into(),
+                        eval: EvaluationArgs {
+                            impure: true.into(),
+                        },
+                        ..Default::default()
+                    };
+
+                    let mut out: BuildOut = command.run_typed(&nix, &nix_args).await?;
+
+                    let environment = out
+                        .pop()
+                        .context("Environment not built")?
+                        .outputs
+                        .remove("out")
+                        .context("Environment output not found")?;
+                    let script = out
+                        .pop()
+                        .context("Container script not built")?
+                        .outputs
+                        .remove("out")
+                        .context("Container script output not found")?;
+
+                    debug!("Got container script: {:?}", script);
+                    scripts.push(PathBuf::from(script));
+                    environments.push(PathBuf::from(environment));
+                }
 
                 info!("Done.");
 
-                let script = out
-                    .pop()
-                    .context("Container script not built")?
-                    .outputs
-                    .remove("out")
-                    .context("Container script output not found")?;
+                if let Some(ref entrypoint) = container_config.entrypoint {
+                    warn_missing_entrypoint(&environments[0], entrypoint);
+                }
 
-                debug!("Got container script: {:?}", script);
+                match (platforms.as_slice(), output) {
+                    ([_, _, ..], Some(output)) => {
+                        let mut images = Vec::new();
+                        for (platform, script) in platforms.iter().zip(&scripts) {
+                            info!("Streaming image for {platform}...");
+                            let archive =
+                                flox.temp_dir.join(format!("image-{}.tar", platform.system));
+                            stream_image(script, Some(&archive)).await?;
+                            images.push((platform.clone(), archive));
+                        }
+                        container_image::write_oci_archive(&images, &output, &flox.temp_dir)?;
+
+                        info!(
+                            "Wrote OCI image for {} to {}",
+                            platforms.iter().map(ToString::to_string).join(", "),
+                            output.display()
+                        );
+                    },
+                    (_, output) => {
+                        stream_image(&scripts[0], output.as_deref()).await?;
 
-                tokio::process::Command::new(script)
-                    .spawn()
-                    .context("Failed to start container script")?
-                    .wait()
-                    .await
-                    .context("Container script failed to run")?;
+                        if let Some(output) = output {
+                            info!("Wrote container image to {}", output.display());
+                        }
+                    },
+                }
             },
             interface::PackageCommands::Flake(command) => {
                 /// A custom nix command that passes its arguments to `nix flake`
@@ -573,6 +843,544 @@ impl interface::PackageCommands {
     }
 }
 
+/// Directory in the cache dir recording the outputs of previous builds
+const BUILD_CACHE_DIR: &str = "builds";
+
+/// nix options of `flox build --sandbox`
+///
+/// Without `sandbox-fallback` nix builds without the sandbox
+/// if it can not be set up, rather than failing.
+const SANDBOX_NIX_ARGS: [&str; 6] = [
+    "--option",
+    "sandbox",
+    "true",
+    "--option",
+    "sandbox-fallback",
+    "false",
+];
+
+/// nix options of `flox build --impure`
+const IMPURE_NIX_ARGS: [&str; 4] = ["--impure", "--option", "sandbox", "false"];
+
+/// Whether `installable` is a project environment whose `flox.nix` sets `options.allow.unfree`
+///
+/// Project environments are built from `pkgs/<name>/flox.nix` in the working tree of the project,
+/// other installables are built as they are.
+async fn allows_unfree(installable: &Installable) -> Result<bool> {
+    let workdir = match installable
+        .flakeref
+        .strip_prefix("git+file://")
+        .or_else(|| installable.flakeref.strip_prefix("path:"))
+        .and_then(|flakeref| flakeref.split(['?', '#']).next())
+    {
+        Some(workdir) => workdir,
+        None => return Ok(false),
+    };
+    let name = installable.attr_path.rsplit('.').next().unwrap_or_default();
+
+    let manifest = Path::new(workdir).join("pkgs").join(name).join("flox.nix");
+    if name.is_empty() || !manifest.exists() {
+        return Ok(false);
+    }
+    let contents = tokio::fs::read_to_string(&manifest)
+        .await
+        .with_context(|| format!("Could not read {}", manifest.display()))?;
+    Ok(flox_nix::allows_unfree(&contents)?)
+}
+
+/// Build `installable` unless a build with the same inputs is still available
+///
+/// Builds whose inputs can not be determined are not cached.
+async fn build_cached(
+    flox: &Flox,
+    installable: Installable,
+    stability: Stability,
+    nix_args: Vec<String>,
+) -> Result<()> {
+    let cache = BuildCache::new(flox.cache_dir.join(BUILD_CACHE_DIR));
+    let inputs = build_inputs(&installable, &stability, &nix_args).await;
+
+    if let Some(ref inputs) = inputs {
+        if let Some(outputs) = cache.load(inputs) {
+            debug!(
+                "Inputs of {}#{} unchanged, reusing cached build",
+                installable.flakeref, installable.attr_path
+            );
+            return link_outputs(&outputs, &nix_args).await;
+        }
+    }
+
+    let nix = flox.nix::<NixCommandLine>(nix_args);
+    let command = Build {
+        flake: FlakeArgs {
+            override_inputs: [stability.as_override()].into(),
+            ..Default::default()
+        },
+        installables: [installable].into(),
+        ..Default::default()
+    };
+    let out: BuildOut = command.run_typed(&nix, &NixArgs::default()).await?;
+
+    if let Some(inputs) = inputs {
+        let outputs = out
+            .into_iter()
+            .map(|built| {
+                built
+                    .outputs
+                    .into_iter()
+                    .map(|(name, path)| (name, PathBuf::from(path)))
+                    .collect()
+            })
+            .collect::<Vec<BuildOutputs>>();
+        if let Err(err) = cache.store(&inputs, &outputs) {
+            warn!("Could not cache build: {err}");
+        }
+    }
+
+    Ok(())
+}
+
+/// The nix arguments in `nix_args` that would weaken the sandbox, if any
+fn sandbox_override(nix_args: &[String]) -> Option<String> {
+    nix_args
+        .iter()
+        .enumerate()
+        .find_map(|(index, arg)| match arg.as_str() {
+            "--impure" | "--no-sandbox" | "--relaxed-sandbox" => Some(arg.clone()),
+            "--option" => match nix_args.get(index + 1).map(String::as_str) {
+                Some(name @ ("sandbox" | "sandbox-fallback")) => Some(format!("--option {name}")),
+                _ => None,
+            },
+            _ => None,
+        })
+}
+
+/// Explain the accesses forbidden by the sandbox that failed the build of `installable`
+///
+/// Reads the log of the failed build with `nix log`,
+/// `None` if it reports no forbidden access.
+async fn explain_sandbox_failure(
+    flox: &Flox,
+    installable: &Installable,
+    stability: &Stability,
+) -> Option<String> {
+    let flake_args = FlakeArgs {
+        override_inputs: [stability.as_override()].into(),
+        ..Default::default()
+    };
+    let output = tokio::process::Command::new(NIX_BIN)
+        .args(["--extra-experimental-features", "nix-command flakes"])
+        .arg("log")
+        .args(flake_args.to_args())
+        .arg(format!(
+            "{}#{}",
+            installable.flakeref, installable.attr_path
+        ))
+        .output()
+        .await
+        .ok()?;
+
+    if !output.status.success() {
+        debug!(
+            "Could not read the build log of {}#{}:\n{}",
+            installable.flakeref,
+            installable.attr_path,
+            String::from_utf8_lossy(&output.stderr)
+        );
+        return None;
+    }
+
+    let violations = SandboxViolation::parse_build_log(&String::from_utf8_lossy(&output.stdout));
+    if violations.is_empty() {
+        return None;
+    }
+    Some(formatdoc! {"
+        {violations}
+        {limitations}
+        Fetch sources with a fixed-output derivation, e.g. 'fetchurl' with a hash, \
+        or build with '--impure' if the build needs the network.",
+        violations = violations.iter().join("\n"),
+        limitations = sandbox_limitations(&flox.system),
+    })
+}
+
+/// Inputs identifying a build of `installable`
+///
+/// Besides the flox version and the build arguments,
+/// this includes the locked flake and all of its inputs.
+/// Their `narHash`es cover the sources, build scripts and dependencies.
+/// `None` if the flake can not be locked, e.g. outside of a project.
+async fn build_inputs(
+    installable: &Installable,
+    stability: &Stability,
+    nix_args: &[String],
+) -> Option<Vec<String>> {
+    let flake_args = FlakeArgs {
+        override_inputs: [stability.as_override()].into(),
+        ..Default::default()
+    };
+    let output = tokio::process::Command::new(NIX_BIN)
+        .args(["--extra-experimental-features", "nix-command flakes"])
+        .args(["flake", "metadata", "--json"])
+        .args(flake_args.to_args())
+        .arg(installable.flakeref.to_string())
+        .output()
+        .await
+        .ok()?;
+
+    if !output.status.success() {
+        debug!(
+            "Not caching build, could not lock {}:\n{}",
+            installable.flakeref,
+            String::from_utf8_lossy(&output.stderr)
+        );
+        return None;
+    }
+
+    let metadata: serde_json::Value = serde_json::from_slice(&output.stdout).ok()?;
+    let locked = metadata.get("locked")?;
+    if locked.get("narHash").is_none() {
+        debug!("Not caching build, {} has no narHash", installable.flakeref);
+        return None;
+    }
+
+    Some(vec![
+        format!("flox {FLOX_VERSION}"),
+        format!("{}-{}", env::consts::ARCH, env::consts::OS),
+        format!("{}#{}", installable.flakeref, installable.attr_path),
+        stability.to_string(),
+        nix_args.join(" "),
+        locked.to_string(),
+        metadata.get("locks")?.to_string(),
+    ])
+}
+
+/// Run the `streamLayeredImage` `script`
+///
+/// The image is streamed to `output` if given, otherwise to stdout.
+async fn stream_image(script: &Path, output: Option<&Path>) -> Result<()> {
+    let mut container_command = tokio::process::Command::new(script);
+
+    // the script streams the image to its stdout,
+    // redirect it to the output file rather than a docker daemon.
+    // The image is written to a temporary file next to the output file first,
+    // so that a failing script leaves an existing output file untouched.
+    let temp_output = match output {
+        Some(output) => {
+            let dir = match output.parent() {
+                Some(dir) if !dir.as_os_str().is_empty() => dir,
+                _ => Path::new("."),
+            };
+            let file = tempfile::NamedTempFile::new_in(dir)
+                .with_context(|| format!("Could not create output file {}", output.display()))?;
+            container_command.stdout(file.reopen().context("Could not open output file")?);
+            Some(file)
+        },
+        None => None,
+    };
+
+    let status = container_command
+        .spawn()
+        .context("Failed to start container script")?
+        .wait()
+        .await
+        .context("Container script failed to run")?;
+
+    if !status.success() {
+        bail!("Container script failed with {status}");
+    }
+
+    if let (Some(temp_output), Some(output)) = (temp_output, output) {
+        // temporary files are only readable by their owner
+        std::fs::set_permissions(temp_output.path(), std::fs::Permissions::from_mode(0o644))
+            .context("Could not set permissions of output file")?;
+        temp_output
+            .persist(output)
+            .with_context(|| format!("Could not write output file {}", output.display()))?;
+    }
+    Ok(())
+}
+
+/// The environment `installable` built for `system` instead of the `host` system
+fn platform_installable(
+    installable: &Installable,
+    host: &str,
+    system: &str,
+) -> Result<Installable> {
+    let host_attr = format!("floxEnvs.{host}.");
+    if !installable.attr_path.contains(&host_attr) {
+        bail!(
+            "'--platform' only applies to environments, {} is not an environment",
+            installable.attr_path
+        );
+    }
+    Ok(Installable {
+        flakeref: installable.flakeref.clone(),
+        attr_path: installable
+            .attr_path
+            .replacen(&host_attr, &format!("floxEnvs.{system}."), 1),
+    })
+}
+
+/// Fail unless the images of all `platforms` can be assembled on the `host` system
+///
+/// The script streaming an image is built for the platform of the image,
+/// it only runs natively or with emulation for the systems in `extra-platforms`.
+async fn check_platforms_supported(host: &str, platforms: &[Platform]) -> Result<()> {
+    let foreign: Vec<&Platform> = platforms
+        .iter()
+        .filter(|platform| platform.system != host)
+        .collect();
+    if foreign.is_empty() {
+        return Ok(());
+    }
+
+    let output = tokio::process::Command::new(NIX_BIN)
+        .args(["--extra-experimental-features", "nix-command"])
+        .args(["show-config", "--json"])
+        .output()
+        .await
+        .context("Failed to run nix")?;
+    if !output.status.success() {
+        bail!(
+            "Could not read nix configuration:\n{}",
+            String::from_utf8_lossy(&output.stderr)
+        );
+    }
+    let config: serde_json::Value =
+        serde_json::from_slice(&output.stdout).context("Could not parse nix configuration")?;
+    let extra_platforms: Vec<&str> = config["extra-platforms"]["value"]
+        .as_array()
+        .into_iter()
+        .flatten()
+        .filter_map(serde_json::Value::as_str)
+        .collect();
+
+    let unsupported: Vec<String> = foreign
+        .iter()
+        .filter(|platform| !extra_platforms.contains(&platform.system.as_str()))
+        .map(|platform| format!("{platform} ({})", platform.system))
+        .collect();
+    if !unsupported.is_empty() {
+        bail!(
+            indoc! {"
+                Can not build images for {platforms} on {host}.
+                Their packages and image scripts are built for and run on these systems,
+                configure emulation, e.g. with binfmt_misc, and add the systems
+                to 'extra-platforms' in nix.conf.
+            "},
+            platforms = unsupported.join(", "),
+            host = host
+        );
+    }
+    Ok(())
+}
+
+/// A flake in `dir` providing the `streamLayeredImage` script
+/// of the environment `installable` with `config` applied
+///
+/// The script is configured by overriding the `config` of the image on the Nix side,
+/// see [ContainerConfig::override_image].
+/// Returns the installable of the configured script.
+async fn configured_image(
+    installable: &Installable,
+    config: &ContainerConfig,
+    dir: &Path,
+) -> Result<Installable> {
+    let image = format!(
+        "(builtins.getFlake {}).{}.passthru.streamLayeredImage",
+        flox_nix::to_nix(&serde_json::Value::String(installable.flakeref.clone())),
+        installable.attr_path.trim_start_matches('.')
+    );
+    let flake = formatdoc! {"
+        {{
+          outputs = _: {{
+            image = {image};
+          }};
+        }}
+        ",
+        image = config.override_image(&image)?,
+    };
+
+    tokio::fs::create_dir_all(dir)
+        .await
+        .context("Could not create container configuration")?;
+    tokio::fs::write(dir.join("flake.nix"), flake)
+        .await
+        .context("Could not write container configuration")?;
+
+    Ok(Installable {
+        flakeref: format!("path:{}", dir.display()),
+        attr_path: "image".to_string(),
+    })
+}
+
+/// Warn if the image `entrypoint` is not provided by the built `environment`
+///
+/// Commands are looked up in the `bin` directory of the environment,
+/// absolute paths relative to its root.
+fn warn_missing_entrypoint(environment: &Path, entrypoint: &[String]) {
+    let command = match entrypoint.first() {
+        Some(command) => command,
+        None => return,
+    };
+
+    let path = if Path::new(command).is_absolute() {
+        environment.join(command.trim_start_matches('/'))
+    } else {
+        environment.join("bin").join(command)
+    };
+    if !path.exists() {
+        warn!("Entrypoint '{command}' is not provided by the environment, the image may not start");
+    }
+}
+
+/// Create the `result` links to cached `outputs` like `nix build` would
+///
+/// Honors `--no-link` and `--out-link` in `nix_args`.
+async fn link_outputs(outputs: &[BuildOutputs], nix_args: &[String]) -> Result<()> {
+    if nix_args.iter().any(|arg| arg == "--no-link") {
+        return Ok(());
+    }
+    let out_link = nix_args
+        .iter()
+        .position(|arg| arg == "--out-link" || arg == "-o")
+        .and_then(|index| nix_args.get(index + 1))
+        .map_or("result", String::as_str);
+
+    let nix_store = Path::new(NIX_BIN).with_file_name("nix-store");
+    for (index, built) in outputs.iter().enumerate() {
+        for (name, path) in built {
+            // same naming as `nix build`: <out-link>[-<index>][-<output>]
+            let mut link = out_link.to_string();
+            if index > 0 {
+                link.push_str(&format!("-{index}"));
+            }
+            if name != "out" {
+                link.push_str(&format!("-{name}"));
+            }
+
+            // registers the link as a gc root
+            let status = tokio::process::Command::new(&nix_store)
+                .arg("--realise")
+                .arg(path)
+                .args(["--add-root", &link, "--indirect"])
+                .stdout(Stdio::null())
+                .status()
+                .await
+                .context("Failed to run nix-store")?;
+            if !status.success() {
+                bail!("Could not link {link} to {}", path.display());
+            }
+        }
+    }
+
+    Ok(())
+}
+
+/// Write an `.envrc` to `project_dir` that activates the project environment `name`
+/// whenever direnv loads the directory
+///
+/// Unless `force` is set, this is only offered if direnv is installed
+/// and the user confirms. An existing `.envrc` is never changed.
+async fn offer_envrc(project_dir: &Path, name: &str, force: bool) -> Result<()> {
+    let envrc = project_dir.join(".envrc");
+    let stanza = formatdoc! {"
+        # activate the flox environment '{name}' when entering this directory
+        watch_file pkgs/{name}/flox.nix
+        eval \"$(flox activate -e .#{name})\"
+    "};
+
+    if envrc.exists() {
+        if force {
+            info!(
+                "Not changing the existing {}, add the following to it:\n{stanza}",
+                envrc.display()
+            );
+        }
+        return Ok(());
+    }
+
+    if !force {
+        let direnv_installed = env::var_os("PATH")
+            .map(|path| env::split_paths(&path).any(|dir| dir.join("direnv").is_file()))
+            .unwrap_or(false);
+        if !direnv_installed || !Dialog::can_prompt() {
+            return Ok(());
+        }
+
+        let dialog = Dialog {
+            message: "Write an .envrc to activate the environment with direnv?",
+            help_message: Some("direnv has to be allowed to load it with 'direnv allow'"),
+            typed: Confirm {
+                default: Some(true),
+            },
+        };
+        if !dialog.prompt().await? {
+            return Ok(());
+        }
+    }
+
+    tokio::fs::write(&envrc, stanza)
+        .await
+        .with_context(|| format!("Could not write {}", envrc.display()))?;
+
+    info!(
+        "Wrote {}, run 'direnv allow' to activate the environment",
+        envrc.display()
+    );
+    Ok(())
+}
+
+/// Detect the languages used in `project_dir`
+/// and add the suggested toolchain packages to `flox_nix`
+///
+/// Unless `auto` is set, the user is asked to confirm the suggestions.
+async fn suggest_packages(project_dir: &Path, flox_nix: &Path, auto: bool) -> Result<()> {
+    let suggestions = detection::detect(project_dir, &detection::default_detectors());
+    if suggestions.is_empty() {
+        return Ok(());
+    }
+
+    for suggestion in &suggestions {
+        info!(
+            "Detected {} project ({}), suggesting: {}",
+            suggestion.language,
+            suggestion.reason,
+            suggestion.packages.join(", ")
+        );
+    }
+
+    if !auto {
+        if !Dialog::can_prompt() {
+            info!("Not adding suggested packages, use '--auto' to add them non-interactively");
+            return Ok(());
+        }
+
+        let dialog = Dialog {
+            message: "Add the suggested packages to the environment?",
+            help_message: None,
+            typed: Confirm {
+                default: Some(true),
+            },
+        };
+        if !dialog.prompt().await? {
+            return Ok(());
+        }
+    }
+
+    let contents = tokio::fs::read_to_string(flox_nix)
+        .await
+        .with_context(|| format!("Could not read {}", flox_nix.display()))?;
+    let seeded = detection::seed_flox_nix(&contents, &suggestions)?;
+    tokio::fs::write(flox_nix, seeded)
+        .await
+        .with_context(|| format!("Could not write {}", flox_nix.display()))?;
+
+    info!("Added suggested packages to {}", flox_nix.display());
+    Ok(())
+}
+
 async fn ensure_project_repo<'flox>(
     flox: &'flox Flox,
     cwd: PathBuf,
@@ -721,3 +1529,33 @@ mod parseable_macro {
     }
     pub(crate) use parseable;
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn write_envrc() {
+        let project_dir = tempfile::tempdir().unwrap();
+        let envrc = project_dir.path().join(".envrc");
+
+        offer_envrc(project_dir.path(), "myenv", true)
+            .await
+            .unwrap();
+        assert_eq!(
+            std::fs::read_to_string(&envrc).unwrap(),
+            indoc! {"
+                # activate the flox environment 'myenv' when entering this directory
+                watch_file pkgs/myenv/flox.nix
+                eval \"$(flox activate -e .#myenv)\"
+            "}
+        );
+
+        // an existing .envrc is never changed
+        std::fs::write(&envrc, "use nix\n").unwrap();
+        offer_envrc(project_dir.path(), "myenv", true)
+            .await
+            .unwrap();
+        assert_eq!(std::fs::read_to_string(&envrc).unwrap(), "use nix\n");
+    }
+}
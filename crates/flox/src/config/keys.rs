@@ -0,0 +1,339 @@
+//! Settings of [super::FloxConfig] managed by `flox config`
+//!
+//! Keys are validated against [CONFIG_KEYS] before they are written to the
+//! user's `flox.toml`, so a typo is reported rather than silently ignored.
+
+use std::env;
+use std::path::{Path, PathBuf};
+
+use anyhow::{bail, Context, Result};
+
+use super::FLOX_CONFIG_FILE;
+
+/// Type of the value of a [ConfigKey]
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ValueType {
+    Bool,
+    Integer,
+    String,
+}
+
+/// A setting that can be changed with `flox config`
+#[derive(Debug)]
+pub struct ConfigKey {
+    /// Name of the key in `flox.toml`
+    pub name: &'static str,
+    pub value_type: ValueType,
+    /// Description of the behavior if the key is unset
+    pub default: &'static str,
+    pub description: &'static str,
+}
+
+pub const CONFIG_KEYS: &[ConfigKey] = &[
+    ConfigKey {
+        name: "stability",
+        value_type: ValueType::String,
+        default: "stable",
+        description: "Stability of the nixpkgs channel, e.g. stable, staging or unstable",
+    },
+    ConfigKey {
+        name: "disable_metrics",
+        value_type: ValueType::Bool,
+        default: "false",
+        description: "Do not submit usage metrics",
+    },
+    ConfigKey {
+        name: "connect_timeout",
+        value_type: ValueType::Integer,
+        default: "nix default",
+        description: "Seconds to wait for a connection when downloading",
+    },
+    ConfigKey {
+        name: "max_retries",
+        value_type: ValueType::Integer,
+        default: "4",
+        description: "Number of times a download, push or pull is retried after a transient error",
+    },
+    ConfigKey {
+        name: "search_cache_ttl",
+        value_type: ValueType::Integer,
+        default: "604800",
+        description: "Maximum age in seconds of cached search results",
+    },
+    ConfigKey {
+        name: "search_cache_size",
+        value_type: ValueType::Integer,
+        default: "50",
+        description: "Maximum size in MiB of the search result cache",
+    },
+    ConfigKey {
+        name: "gc_keep_generations",
+        value_type: ValueType::Integer,
+        default: "10",
+        description: "Number of generations `flox gc` keeps of each environment",
+    },
+    ConfigKey {
+        name: "gc_older_than",
+        value_type: ValueType::Integer,
+        default: "none",
+        description: "Age in days after which `flox gc` removes generations",
+    },
+    ConfigKey {
+        name: "build_sandbox",
+        value_type: ValueType::Bool,
+        default: "false",
+        description: "Run `flox build` in the sandbox unless `--impure` is given",
+    },
+];
+
+impl ConfigKey {
+    /// The known key `name`, if any
+    pub fn get(name: &str) -> Option<&'static ConfigKey> {
+        CONFIG_KEYS.iter().find(|key| key.name == name)
+    }
+
+    /// The known key `name`
+    ///
+    /// Fails with a suggestion of the most similar key if `name` is unknown.
+    pub fn find(name: &str) -> Result<&'static ConfigKey> {
+        if let Some(key) = Self::get(name) {
+            return Ok(key);
+        }
+
+        let closest = CONFIG_KEYS
+            .iter()
+            .map(|key| (strsim::levenshtein(key.name, name), key.name))
+            .min()
+            .filter(|(distance, _)| *distance <= 3);
+        match closest {
+            Some((_, suggestion)) => {
+                bail!("Unknown config key '{name}', did you mean '{suggestion}'?")
+            },
+            None => bail!(
+                "Unknown config key '{name}', expected one of {}",
+                CONFIG_KEYS
+                    .iter()
+                    .map(|key| key.name)
+                    .collect::<Vec<_>>()
+                    .join(", ")
+            ),
+        }
+    }
+
+    /// Variable overriding the key, e.g. `FLOX_MAX_RETRIES`
+    pub fn env_var(&self) -> String {
+        format!("FLOX_{}", self.name.to_uppercase())
+    }
+
+    /// Parse `value` as the type of the key
+    pub fn parse(&self, value: &str) -> Result<toml::Value> {
+        let parsed = match self.value_type {
+            ValueType::Bool => value.parse().map(toml::Value::Boolean).ok(),
+            ValueType::Integer => value
+                .parse::<u32>()
+                .map(|value| toml::Value::Integer(value.into()))
+                .ok(),
+            ValueType::String if !value.is_empty() => Some(toml::Value::String(value.to_string())),
+            ValueType::String => None,
+        };
+
+        parsed.with_context(|| {
+            let expected = match self.value_type {
+                ValueType::Bool => "true or false",
+                ValueType::Integer => "a non-negative integer",
+                ValueType::String => "a non-empty string",
+            };
+            format!(
+                "Invalid value '{value}' for '{}', expected {expected}",
+                self.name
+            )
+        })
+    }
+}
+
+/// Where the effective value of a [ConfigKey] comes from
+#[derive(Debug)]
+pub enum ValueSource {
+    Default,
+    File(PathBuf),
+    Env(String),
+}
+
+/// The user's `flox.toml` in the config directory
+pub struct ConfigFile {
+    path: PathBuf,
+    table: toml::value::Table,
+}
+
+impl ConfigFile {
+    /// Read the `flox.toml` in `config_dir`, which may not exist yet
+    pub fn open(config_dir: &Path) -> Result<Self> {
+        let path = config_dir.join(FLOX_CONFIG_FILE);
+        let table = match std::fs::read_to_string(&path) {
+            Ok(contents) => toml::from_str(&contents)
+                .with_context(|| format!("Could not parse {}", path.display()))?,
+            Err(err) if err.kind() == std::io::ErrorKind::NotFound => Default::default(),
+            Err(err) => {
+                return Err(err).with_context(|| format!("Could not read {}", path.display()))
+            },
+        };
+        Ok(ConfigFile { path, table })
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    pub fn get(&self, key: &ConfigKey) -> Option<&toml::Value> {
+        self.table.get(key.name)
+    }
+
+    pub fn set(&mut self, key: &ConfigKey, value: toml::Value) {
+        self.table.insert(key.name.to_string(), value);
+    }
+
+    /// Remove `key`, returns whether it was set
+    pub fn delete(&mut self, key: &ConfigKey) -> bool {
+        self.table.remove(key.name).is_some()
+    }
+
+    /// Write the file, comments and formatting are not preserved
+    pub fn save(&self) -> Result<()> {
+        let contents = toml::to_string(&self.table).context("Could not serialize config")?;
+        std::fs::write(&self.path, contents)
+            .with_context(|| format!("Could not write {}", self.path.display()))
+    }
+
+    /// The effective value of `key` and its source
+    ///
+    /// Variables take precedence over a `flox.toml` in the current directory,
+    /// which takes precedence over the user's file.
+    pub fn effective(&self, key: &ConfigKey) -> (Option<String>, ValueSource) {
+        self.effective_in(key, Path::new("."))
+    }
+
+    /// Like [Self::effective], with the local `flox.toml` in `local_dir`
+    fn effective_in(&self, key: &ConfigKey, local_dir: &Path) -> (Option<String>, ValueSource) {
+        let var = key.env_var();
+        if let Ok(value) = env::var(&var) {
+            return (Some(value), ValueSource::Env(var));
+        }
+
+        if let Ok(local) = ConfigFile::open(local_dir) {
+            if let Some(value) = local.get(key) {
+                return (Some(display_value(value)), ValueSource::File(local.path));
+            }
+        }
+
+        match self.get(key) {
+            Some(value) => (
+                Some(display_value(value)),
+                ValueSource::File(self.path.clone()),
+            ),
+            None => (None, ValueSource::Default),
+        }
+    }
+}
+
+/// `value` without the quotes of TOML strings
+fn display_value(value: &toml::Value) -> String {
+    match value {
+        toml::Value::String(value) => value.clone(),
+        value => value.to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn find_key() {
+        assert_eq!(ConfigKey::find("max_retries").unwrap().name, "max_retries");
+        assert!(ConfigKey::get("floxpkgs_channel").is_none());
+
+        let err = ConfigKey::find("max_retry").unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            "Unknown config key 'max_retry', did you mean 'max_retries'?"
+        );
+        let err = ConfigKey::find("something_else").unwrap_err();
+        assert!(err.to_string().starts_with(
+            "Unknown config key 'something_else', expected one of stability, disable_metrics"
+        ));
+    }
+
+    #[test]
+    fn parse_values() {
+        let key = |name| ConfigKey::find(name).unwrap();
+
+        assert_eq!(
+            key("disable_metrics").parse("true").unwrap(),
+            toml::Value::Boolean(true)
+        );
+        assert_eq!(
+            key("max_retries").parse("3").unwrap(),
+            toml::Value::Integer(3)
+        );
+        assert_eq!(
+            key("stability").parse("unstable").unwrap(),
+            toml::Value::String("unstable".to_string())
+        );
+
+        assert!(key("disable_metrics").parse("yes").is_err());
+        assert!(key("max_retries").parse("-1").is_err());
+        let err = key("stability").parse("").unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            "Invalid value '' for 'stability', expected a non-empty string"
+        );
+    }
+
+    #[test]
+    fn effective_value_precedence() {
+        let key = ConfigKey::find("gc_older_than").unwrap();
+        let config_dir = tempfile::tempdir().unwrap();
+        let local_dir = tempfile::tempdir().unwrap();
+
+        let mut file = ConfigFile::open(config_dir.path()).unwrap();
+        assert!(matches!(
+            file.effective_in(key, local_dir.path()),
+            (None, ValueSource::Default)
+        ));
+
+        file.set(key, toml::Value::Integer(30));
+        file.save().unwrap();
+        let file = ConfigFile::open(config_dir.path()).unwrap();
+        match file.effective_in(key, local_dir.path()) {
+            (Some(value), ValueSource::File(path)) => {
+                assert_eq!(value, "30");
+                assert_eq!(path, config_dir.path().join(FLOX_CONFIG_FILE));
+            },
+            other => panic!("expected the value of the user's file, got {other:?}"),
+        }
+
+        std::fs::write(
+            local_dir.path().join(FLOX_CONFIG_FILE),
+            "gc_older_than = 7\n",
+        )
+        .unwrap();
+        match file.effective_in(key, local_dir.path()) {
+            (Some(value), ValueSource::File(path)) => {
+                assert_eq!(value, "7");
+                assert_eq!(path, local_dir.path().join(FLOX_CONFIG_FILE));
+            },
+            other => panic!("expected the value of the local file, got {other:?}"),
+        }
+
+        env::set_var(key.env_var(), "1");
+        let effective = file.effective_in(key, local_dir.path());
+        env::remove_var(key.env_var());
+        match effective {
+            (Some(value), ValueSource::Env(var)) => {
+                assert_eq!(value, "1");
+                assert_eq!(var, "FLOX_GC_OLDER_THAN");
+            },
+            other => panic!("expected the value of the variable, got {other:?}"),
+        }
+    }
+}
@@ -15,6 +15,9 @@ use xdg::BaseDirectories;
 /// Name of flox managed directories (config, data, cache)
 const FLOX_DIR_NAME: &'_ str = "flox";
 
+/// Name of the configuration file in the config directory
+pub const FLOX_CONFIG_FILE: &str = "flox.toml";
+
 #[derive(Clone, Debug, Deserialize, Default)]
 pub struct Config {
     /// flox configuration options
@@ -46,6 +49,34 @@ pub struct FloxConfig {
     pub config_dir: PathBuf,
     #[serde(default)]
     pub stability: Stability,
+    /// Seconds to wait for a connection when downloading
+    #[serde(default)]
+    #[serde_as(as = "Option<DisplayFromStr>")]
+    pub connect_timeout: Option<u32>,
+    /// Number of times a download is retried after a transient error
+    #[serde(default)]
+    #[serde_as(as = "Option<DisplayFromStr>")]
+    pub max_retries: Option<u32>,
+    /// Maximum age in seconds of cached search results
+    #[serde(default)]
+    #[serde_as(as = "Option<DisplayFromStr>")]
+    pub search_cache_ttl: Option<u64>,
+    /// Maximum size in MiB of the search result cache
+    #[serde(default)]
+    #[serde_as(as = "Option<DisplayFromStr>")]
+    pub search_cache_size: Option<u64>,
+    /// Number of generations `flox gc` keeps of each environment
+    #[serde(default)]
+    #[serde_as(as = "Option<DisplayFromStr>")]
+    pub gc_keep_generations: Option<usize>,
+    /// Age in days after which `flox gc` removes generations
+    #[serde(default)]
+    #[serde_as(as = "Option<DisplayFromStr>")]
+    pub gc_older_than: Option<u64>,
+    /// Run `flox build` in the sandbox unless `--impure` is given
+    #[serde(default)]
+    #[serde_as(as = "DisplayFromStr")]
+    pub build_sandbox: bool,
 }
 
 // TODO: move to runix?
@@ -59,6 +90,7 @@ pub struct NixConfig {
 #[derive(Clone, Debug, Deserialize, Default)]
 pub struct GithubConfig {}
 pub mod features;
+pub mod keys;
 
 impl Config {
     /// Creates a raw [Config] object and caches it for the lifetime of the program
@@ -95,6 +127,7 @@ impl Config {
                 .set_default("data_dir", data_dir.to_str().unwrap())?
                 // config dir is added to the config for completenes, the config file cannot chenge the config dir
                 .set_default("config_dir", config_dir.to_str().unwrap())?
+                .add_source(config::File::from(config_dir.join(FLOX_CONFIG_FILE)).required(false))
                 .add_source(
                     config::File::with_name("flox")
                         .required(false),
@@ -3,19 +3,21 @@ use std::ffi::OsString;
 use std::fmt::{Debug, Display};
 use std::os::unix::process::ExitStatusExt;
 use std::path::Path;
-use std::process::{ExitCode, ExitStatus};
+use std::process::{ExitCode, ExitStatus, Stdio};
 
-use anyhow::{anyhow, Context, Result};
+use anyhow::{Context, Result};
 use bpaf::Parser;
-use commands::{BashPassthru, FloxArgs, Prefix};
+use commands::{BashPassthru, FloxArgs, LogFormat, Prefix};
 use flox_rust_sdk::environment::default_nix_subprocess_env;
 use fslock::LockFile;
 use itertools::Itertools;
 use log::{debug, error, warn};
 use serde_json::json;
-use tokio::io::{AsyncReadExt, AsyncSeekExt, AsyncWriteExt};
-use tokio::process::Command;
-use utils::init::init_logger;
+use tokio::io::{AsyncBufReadExt, AsyncReadExt, AsyncSeekExt, AsyncWriteExt, BufReader};
+use tokio::process::{ChildStderr, Command};
+use utils::errors::{exit_code, format_error, FloxExitCode};
+use utils::init::{init_logger, is_quiet};
+use utils::logger;
 use utils::metrics::{METRICS_LOCK_FILE_NAME, METRICS_UUID_FILE_NAME};
 
 mod build;
@@ -26,7 +28,11 @@ mod utils;
 use flox_rust_sdk::flox::{Flox, FLOX_SH};
 
 async fn run(args: FloxArgs) -> Result<()> {
-    init_logger(Some(args.verbosity.clone()), Some(args.debug));
+    init_logger(
+        Some(args.verbosity.clone()),
+        Some(args.debug),
+        Some(args.log_format),
+    );
     set_user()?;
     set_parent_process_id();
     args.handle(config::Config::parse()?).await?;
@@ -35,7 +41,7 @@ async fn run(args: FloxArgs) -> Result<()> {
 
 #[tokio::main]
 async fn main() -> ExitCode {
-    init_logger(None, None);
+    init_logger(None, None, None);
 
     // redirect to flox early if `--bash-passthru` is present
     if let Some(args) = BashPassthru::check() {
@@ -54,18 +60,22 @@ async fn main() -> ExitCode {
         return ExitCode::from(0);
     }
 
-    let (verbosity, debug) = {
+    let (verbosity, debug, log_format) = {
         let verbosity_parser = commands::verbosity();
         let debug_parser = bpaf::long("debug").switch();
+        let log_format_parser = bpaf::long("log-format")
+            .env("FLOX_LOG_FORMAT")
+            .argument::<LogFormat>("FORMAT")
+            .fallback(Default::default());
         let other_parser = bpaf::any::<String>("ANY").many();
 
-        bpaf::construct!(verbosity_parser, debug_parser, other_parser)
-            .map(|(v, d, _)| (v, d))
+        bpaf::construct!(verbosity_parser, debug_parser, log_format_parser, other_parser)
+            .map(|(v, d, l, _)| (v, d, l))
             .to_options()
             .try_run()
             .unwrap_or_default()
     };
-    init_logger(Some(verbosity), Some(debug));
+    init_logger(Some(verbosity), Some(debug), Some(log_format));
 
     let args = commands::flox_args().try_run().map_err(|err| match err {
         bpaf::ParseFailure::Stdout(_) => err,
@@ -95,7 +105,7 @@ async fn main() -> ExitCode {
             },
             bpaf::ParseFailure::Stderr(m) => {
                 error!("{m}");
-                return ExitCode::from(1);
+                return FloxExitCode::Usage.into();
             },
         }
     }
@@ -109,9 +119,10 @@ async fn main() -> ExitCode {
                 return e.downcast_ref::<FloxShellErrorCode>().unwrap().0;
             }
 
-            error!("{:?}", anyhow!(e));
+            let code = exit_code(&e);
+            error!("{}", format_error(&e));
 
-            ExitCode::from(1)
+            code.into()
         },
     }
 }
@@ -134,6 +145,139 @@ pub async fn flox_forward(flox: &Flox) -> Result<()> {
     Ok(())
 }
 
+/// Run flox (sh) with the given arguments and capture its standard output
+///
+/// Unlike [flox_forward], stdout is piped rather than inherited.
+/// flox (sh) detects this and produces output meant to be consumed by a program,
+/// e.g. `flox activate` prints a script to be sourced instead of spawning a subshell.
+/// stderr is still passed on so that diagnostics reach the user, see [pass_stderr].
+/// `envs` are set in addition to the default environment.
+pub async fn capture_in_flox(
+    flox: &Flox,
+    args: &[impl AsRef<std::ffi::OsStr> + Debug],
+    envs: &[(&str, &str)],
+) -> Result<String> {
+    let stdout = capture_bytes_in_flox(flox, args, envs).await?;
+    String::from_utf8(stdout).context("flox (sh) produced output that is not UTF-8")
+}
+
+/// Like [capture_in_flox], but for binary output such as archives
+pub async fn capture_bytes_in_flox(
+    flox: &Flox,
+    args: &[impl AsRef<std::ffi::OsStr> + Debug],
+    envs: &[(&str, &str)],
+) -> Result<Vec<u8>> {
+    debug!("Capturing output of flox with arguments: {:?}", args);
+
+    sync_bash_metrics_consent(&flox.data_dir, &flox.cache_dir).await?;
+
+    let stderr = if logger::plain_stderr() {
+        Stdio::piped()
+    } else {
+        Stdio::inherit()
+    };
+    let mut child = Command::new(FLOX_SH)
+        .args(args)
+        .envs(&default_nix_subprocess_env())
+        .envs(envs.iter().copied())
+        .stdout(Stdio::piped())
+        .stderr(stderr)
+        .spawn()
+        .with_context(|| format!("fatal: failed executing {FLOX_SH}"))?;
+
+    let mut child_stdout = child.stdout.take().expect("stdout is piped");
+    let mut stdout = Vec::new();
+    match child.stderr.take() {
+        Some(child_stderr) => {
+            tokio::try_join!(
+                child_stdout.read_to_end(&mut stdout),
+                pass_stderr(child_stderr)
+            )?;
+        },
+        None => {
+            child_stdout.read_to_end(&mut stdout).await?;
+        },
+    }
+
+    let status = child
+        .wait()
+        .await
+        .with_context(|| format!("fatal: failed executing {FLOX_SH}"))?;
+
+    debug!("flox exited with {status}");
+
+    if !status.success() {
+        let code = status.code().unwrap_or(1) as u8;
+        Err(FloxShellErrorCode(ExitCode::from(code)))?
+    }
+
+    Ok(stdout)
+}
+
+/// Like [capture_in_flox], but also return the exit code and what flox (sh) wrote to stderr
+///
+/// stderr is always captured and passed on as plain text while it is written,
+/// only use this for commands that do not prompt.
+pub async fn capture_in_flox_with_stderr(
+    flox: &Flox,
+    args: &[impl AsRef<std::ffi::OsStr> + Debug],
+) -> Result<(u8, String, String)> {
+    debug!("Capturing output of flox with arguments: {:?}", args);
+
+    sync_bash_metrics_consent(&flox.data_dir, &flox.cache_dir).await?;
+
+    let mut child = Command::new(FLOX_SH)
+        .args(args)
+        .envs(&default_nix_subprocess_env())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .with_context(|| format!("fatal: failed executing {FLOX_SH}"))?;
+
+    let mut child_stdout = child.stdout.take().expect("stdout is piped");
+    let child_stderr = child.stderr.take().expect("stderr is piped");
+    let mut stdout = Vec::new();
+    let (_, stderr) = tokio::try_join!(
+        child_stdout.read_to_end(&mut stdout),
+        pass_stderr(child_stderr)
+    )?;
+
+    let status = child
+        .wait()
+        .await
+        .with_context(|| format!("fatal: failed executing {FLOX_SH}"))?;
+
+    debug!("flox exited with {status}");
+
+    Ok((
+        status.code().unwrap_or(1) as u8,
+        String::from_utf8(stdout).context("flox (sh) produced output that is not UTF-8")?,
+        String::from_utf8_lossy(&stderr).into_owned(),
+    ))
+}
+
+/// Pass the stderr of flox (sh) on while it is written and return what it wrote
+///
+/// Lines are passed on as plain text, with `--quiet` only warnings and errors.
+/// Only used if [logger::plain_stderr], flox (sh) inherits a terminal otherwise.
+async fn pass_stderr(child_stderr: ChildStderr) -> std::io::Result<Vec<u8>> {
+    let mut stderr = tokio::io::stderr();
+    let mut captured = Vec::new();
+
+    let mut lines = BufReader::new(child_stderr).split(b'\n');
+    while let Some(line) = lines.next_segment().await? {
+        let text = String::from_utf8_lossy(&line);
+        let plain = logger::plain_line(&text);
+        if !is_quiet() || logger::is_diagnostic(&plain) {
+            stderr.write_all(plain.as_bytes()).await?;
+            stderr.write_all(b"\n").await?;
+        }
+        captured.extend_from_slice(&line);
+        captured.push(b'\n');
+    }
+    Ok(captured)
+}
+
 #[allow(clippy::bool_to_int_with_if)]
 async fn sync_bash_metrics_consent(data_dir: &Path, cache_dir: &Path) -> Result<()> {
     let mut metrics_lock = LockFile::open(&cache_dir.join(METRICS_LOCK_FILE_NAME))?;
@@ -223,6 +367,8 @@ pub async fn run_in_flox(
         .await
         .context("fatal: failed executing {FLOX_SH}")?;
 
+    debug!("flox exited with {status}");
+
     let code = status.code().unwrap_or_else(|| {
         status
             .signal()
@@ -232,6 +378,52 @@ pub async fn run_in_flox(
     Ok(code)
 }
 
+/// Like [run_in_flox], but also return what flox (sh) wrote to stderr
+///
+/// stderr is only captured if it is not a terminal (see [logger::plain_stderr]),
+/// so that flox (sh) keeps its prompts and colors in interactive use.
+/// Nothing is returned for a terminal, stderr is passed on while it is written otherwise.
+pub async fn run_in_flox_with_stderr(
+    flox: &Flox,
+    args: &[impl AsRef<std::ffi::OsStr> + Debug],
+) -> Result<(u8, String)> {
+    debug!("Running in flox with arguments: {:?}", args);
+
+    sync_bash_metrics_consent(&flox.data_dir, &flox.cache_dir).await?;
+
+    let stderr = if logger::plain_stderr() {
+        Stdio::piped()
+    } else {
+        Stdio::inherit()
+    };
+    let mut child = Command::new(FLOX_SH)
+        .args(args)
+        .envs(&default_nix_subprocess_env())
+        .stderr(stderr)
+        .spawn()
+        .with_context(|| format!("fatal: failed executing {FLOX_SH}"))?;
+
+    let captured = match child.stderr.take() {
+        Some(child_stderr) => pass_stderr(child_stderr).await?,
+        None => Vec::new(),
+    };
+
+    let status = child
+        .wait()
+        .await
+        .with_context(|| format!("fatal: failed executing {FLOX_SH}"))?;
+
+    debug!("flox exited with {status}");
+
+    let code = status.code().unwrap_or_else(|| {
+        status
+            .signal()
+            .expect("Process terminated by unknown means")
+    }) as u8;
+
+    Ok((code, String::from_utf8_lossy(&captured).into_owned()))
+}
+
 /// Resets the `$USER`/`HOME` variables to match `euid`
 ///
 /// Files written by `sudo flox ...` / `su`,
@@ -0,0 +1,260 @@
+//! Registry of running activations
+//!
+//! Interactive activations started by flox register the PID of the activating
+//! flox process in `<cache dir>/activations/<owner>/<name>/`,
+//! activations sourced with `eval "$(flox activate)"` the PID of the sourcing shell.
+//! Each entry records the start time of its process,
+//! so a new process reusing the PID is not mistaken for the activation.
+//! Entries of processes that are no longer running are ignored and removed,
+//! so a crashed shell does not keep an environment marked as active.
+
+use std::io;
+use std::path::{Path, PathBuf};
+
+use anyhow::{Context, Result};
+use log::debug;
+use nix::errno::Errno;
+use nix::sys::signal::kill;
+use nix::unistd::Pid;
+
+const ACTIVATIONS_DIR: &str = "activations";
+
+/// The activations of a single environment
+pub struct Activations {
+    dir: PathBuf,
+}
+
+impl Activations {
+    /// Activations of `environment`, referred to as `[<owner>/]<name>`
+    pub fn new(cache_dir: &Path, environment: &str) -> Self {
+        let (owner, name) = environment
+            .split_once('/')
+            .unwrap_or(("local", environment));
+        Activations {
+            dir: cache_dir.join(ACTIVATIONS_DIR).join(owner).join(name),
+        }
+    }
+
+    /// The environments that have activation state, referred to as `<owner>/<name>`
+    pub fn environments(cache_dir: &Path) -> Result<Vec<String>> {
+        let dir = cache_dir.join(ACTIVATIONS_DIR);
+        let owners = match std::fs::read_dir(&dir) {
+            Ok(owners) => owners,
+            Err(err) if err.kind() == io::ErrorKind::NotFound => return Ok(Vec::new()),
+            Err(err) => {
+                return Err(err).with_context(|| format!("Could not read {}", dir.display()))
+            },
+        };
+
+        let mut environments = Vec::new();
+        for owner in owners {
+            let owner = owner?;
+            for name in std::fs::read_dir(owner.path())? {
+                environments.push(format!(
+                    "{}/{}",
+                    owner.file_name().to_string_lossy(),
+                    name?.file_name().to_string_lossy()
+                ));
+            }
+        }
+        environments.sort();
+
+        Ok(environments)
+    }
+
+    /// Register the current process as an activation of the environment
+    ///
+    /// The registration is removed when the returned guard is dropped.
+    pub fn register(&self) -> Result<Registration> {
+        let entry = self.register_process(std::process::id() as i32)?;
+        Ok(Registration { entry })
+    }
+
+    /// Register the shell `pid` that sources the activation of the environment
+    ///
+    /// flox exits before the shell, the registration is removed
+    /// once the shell is no longer running.
+    pub fn register_sourced(&self, pid: i32) -> Result<()> {
+        self.register_process(pid)?;
+        Ok(())
+    }
+
+    /// Write the entry of process `pid` with its start time
+    fn register_process(&self, pid: i32) -> Result<PathBuf> {
+        std::fs::create_dir_all(&self.dir)
+            .with_context(|| format!("Could not create {}", self.dir.display()))?;
+
+        let entry = self.dir.join(pid.to_string());
+        let started = start_time(pid).map(|started| started.to_string());
+        std::fs::write(&entry, started.unwrap_or_default())
+            .with_context(|| format!("Could not register activation in {}", entry.display()))?;
+
+        Ok(entry)
+    }
+
+    /// PIDs of the running processes activating the environment
+    ///
+    /// Entries of processes that are no longer running are removed.
+    pub fn running(&self) -> Result<Vec<i32>> {
+        let entries = match std::fs::read_dir(&self.dir) {
+            Ok(entries) => entries,
+            Err(err) if err.kind() == io::ErrorKind::NotFound => return Ok(Vec::new()),
+            Err(err) => {
+                return Err(err).with_context(|| format!("Could not read {}", self.dir.display()))
+            },
+        };
+
+        let mut pids = Vec::new();
+        for entry in entries {
+            let entry = entry?;
+            let name = entry.file_name();
+            let pid = match name.to_str().and_then(|name| name.parse().ok()) {
+                Some(pid) => pid,
+                None => continue,
+            };
+
+            // entries without a start time only compare the PID
+            let started = std::fs::read_to_string(entry.path())
+                .ok()
+                .and_then(|started| started.trim().parse().ok());
+            if is_running(pid, started) {
+                pids.push(pid);
+            } else {
+                debug!("Removing stale activation of process {pid}");
+                let _ = std::fs::remove_file(entry.path());
+            }
+        }
+        pids.sort_unstable();
+
+        Ok(pids)
+    }
+
+    /// Remove all state of the environment's activations
+    pub fn clear(&self) -> Result<()> {
+        match std::fs::remove_dir_all(&self.dir) {
+            Err(err) if err.kind() != io::ErrorKind::NotFound => {
+                Err(err).with_context(|| format!("Could not remove {}", self.dir.display()))
+            },
+            _ => Ok(()),
+        }
+    }
+}
+
+/// Whether a process with `pid` exists and, if known, was started at `started`
+///
+/// `EPERM` means the process exists but belongs to another user.
+fn is_running(pid: i32, started: Option<u64>) -> bool {
+    if matches!(kill(Pid::from_raw(pid), None), Err(Errno::ESRCH)) {
+        return false;
+    }
+    match (started, start_time(pid)) {
+        (Some(started), Some(current)) => started == current,
+        _ => true,
+    }
+}
+
+/// Start time of process `pid` in clock ticks since boot, from `/proc/<pid>/stat`
+///
+/// `None` where `/proc` is not available, e.g. on macOS.
+fn start_time(pid: i32) -> Option<u64> {
+    let stat = std::fs::read_to_string(format!("/proc/{pid}/stat")).ok()?;
+    parse_start_time(&stat)
+}
+
+/// The `starttime` field of the contents of `/proc/<pid>/stat`, see proc(5)
+///
+/// The command name in the second field may contain spaces and parentheses,
+/// the fields following it are separated by spaces.
+fn parse_start_time(stat: &str) -> Option<u64> {
+    let (_, fields) = stat.rsplit_once(')')?;
+    // `starttime` is the 22nd field, the 20th after the command name
+    fields.split_whitespace().nth(19)?.parse().ok()
+}
+
+/// An activation registered by [Activations::register]
+pub struct Registration {
+    entry: PathBuf,
+}
+
+impl Drop for Registration {
+    fn drop(&mut self) {
+        let _ = std::fs::remove_file(&self.entry);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn start_time_of_process() {
+        let stat = "4242 (my (odd) shell) S 1 4242 4242 0 -1 4194560 1020 0 0 0 \
+                    1 0 0 0 20 0 1 0 987654 8744960 1024 18446744073709551615";
+        assert_eq!(parse_start_time(stat), Some(987654));
+        assert_eq!(parse_start_time("4242 (sh) S 1"), None);
+        assert_eq!(parse_start_time(""), None);
+    }
+
+    #[test]
+    fn register_activations() {
+        let cache_dir = tempfile::tempdir().unwrap();
+        let activations = Activations::new(cache_dir.path(), "owner/env");
+        assert!(activations.running().unwrap().is_empty());
+
+        let registration = activations.register().unwrap();
+        let pid = std::process::id() as i32;
+        assert_eq!(activations.running().unwrap(), vec![pid]);
+        assert_eq!(Activations::environments(cache_dir.path()).unwrap(), vec![
+            "owner/env"
+        ]);
+        assert!(Activations::new(cache_dir.path(), "env")
+            .running()
+            .unwrap()
+            .is_empty());
+
+        drop(registration);
+        assert!(activations.running().unwrap().is_empty());
+    }
+
+    #[test]
+    fn register_sourced_activations() {
+        let cache_dir = tempfile::tempdir().unwrap();
+        let activations = Activations::new(cache_dir.path(), "env");
+
+        let parent = nix::unistd::getppid().as_raw();
+        activations.register_sourced(parent).unwrap();
+        assert_eq!(activations.running().unwrap(), vec![parent]);
+
+        activations.clear().unwrap();
+        assert!(activations.running().unwrap().is_empty());
+    }
+
+    #[test]
+    fn remove_stale_activations() {
+        let cache_dir = tempfile::tempdir().unwrap();
+        let activations = Activations::new(cache_dir.path(), "env");
+        let dir = cache_dir
+            .path()
+            .join(ACTIVATIONS_DIR)
+            .join("local")
+            .join("env");
+        std::fs::create_dir_all(&dir).unwrap();
+
+        let pid = std::process::id() as i32;
+        // no process has the largest PID
+        std::fs::write(dir.join(i32::MAX.to_string()), "").unwrap();
+        std::fs::write(dir.join("not-a-pid"), "").unwrap();
+        if let Some(started) = start_time(pid) {
+            // the PID was reused by the current process
+            std::fs::write(dir.join(pid.to_string()), (started + 1).to_string()).unwrap();
+            assert!(activations.running().unwrap().is_empty());
+            assert!(!dir.join(pid.to_string()).exists());
+        }
+        assert!(activations.running().unwrap().is_empty());
+        assert!(!dir.join(i32::MAX.to_string()).exists());
+
+        // entries written before start times were recorded
+        std::fs::write(dir.join(pid.to_string()), "").unwrap();
+        assert_eq!(activations.running().unwrap(), vec![pid]);
+    }
+}
@@ -0,0 +1,330 @@
+//! Exit codes of flox
+//!
+//! Scripts branch on the exit code of flox to tell failures apart,
+//! the codes are part of flox's interface and stable within a major version.
+//! See `flox(1)` for the documented contract.
+
+use std::fmt::{Debug, Display};
+use std::process::ExitCode;
+
+use flox_rust_sdk::models::root::environment::{GenerationError, GetEnvironmentError};
+use flox_rust_sdk::models::root::floxmeta::GetFloxmetaError;
+use flox_rust_sdk::providers::git::GitCommandProvider;
+
+/// The exit code of a failed flox command
+///
+/// [FloxExitCode::UpgradesAvailable] is the exception, it reports a result rather than a failure.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum FloxExitCode {
+    /// Any failure without a more specific exit code
+    Failure = 1,
+    /// Invalid arguments or a combination of options that can not be used together
+    Usage = 2,
+    /// An environment, generation or package does not exist
+    NotFound = 3,
+    /// A channel, remote or substituter can not be reached
+    Network = 4,
+    /// Packages or channels can not be resolved or locked,
+    /// or a change conflicts with the environment or its remote
+    Resolution = 5,
+    /// `flox upgrade --dry-run --exit-code` found packages to upgrade
+    UpgradesAvailable = 100,
+}
+
+impl From<FloxExitCode> for u8 {
+    fn from(code: FloxExitCode) -> Self {
+        code as u8
+    }
+}
+
+impl From<FloxExitCode> for ExitCode {
+    fn from(code: FloxExitCode) -> Self {
+        ExitCode::from(u8::from(code))
+    }
+}
+
+/// An error that exits flox with a specific [FloxExitCode]
+///
+/// Displays as the wrapped error, use [WithExitCode::exit_code] to create one
+/// or [bail_with!](crate::bail_with) to return one.
+pub struct ExitCodeError {
+    pub code: FloxExitCode,
+    error: anyhow::Error,
+}
+
+impl ExitCodeError {
+    pub fn new(code: FloxExitCode, error: impl Into<anyhow::Error>) -> Self {
+        ExitCodeError {
+            code,
+            error: error.into(),
+        }
+    }
+}
+
+impl Debug for ExitCodeError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        Debug::fmt(&self.error, f)
+    }
+}
+
+impl Display for ExitCodeError {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        Display::fmt(&self.error, f)
+    }
+}
+
+impl std::error::Error for ExitCodeError {
+    fn source(&self) -> Option<&(dyn std::error::Error + 'static)> {
+        Some(&*self.error)
+    }
+}
+
+/// Attach a [FloxExitCode] to the error of a [Result]
+pub trait WithExitCode<T> {
+    fn exit_code(self, code: FloxExitCode) -> Result<T, ExitCodeError>;
+}
+
+impl<T, E: Into<anyhow::Error>> WithExitCode<T> for Result<T, E> {
+    fn exit_code(self, code: FloxExitCode) -> Result<T, ExitCodeError> {
+        self.map_err(|error| ExitCodeError::new(code, error))
+    }
+}
+
+/// Return early with an error exiting flox with the given [FloxExitCode]
+///
+/// Takes the exit code followed by the arguments of [anyhow::anyhow!].
+#[macro_export]
+macro_rules! bail_with {
+    ($code:expr, $($arg:tt)*) => {
+        return Err($crate::utils::errors::ExitCodeError::new($code, anyhow::anyhow!($($arg)*)).into())
+    };
+}
+
+/// The [FloxExitCode] of an error returned by a command
+///
+/// Uses the code of the outermost [ExitCodeError] in the chain of causes,
+/// otherwise classifies the known errors of the SDK.
+pub fn exit_code(error: &anyhow::Error) -> FloxExitCode {
+    for cause in error.chain() {
+        if let Some(error) = cause.downcast_ref::<ExitCodeError>() {
+            return error.code;
+        }
+        if matches!(
+            cause.downcast_ref::<GetEnvironmentError<GitCommandProvider>>(),
+            Some(GetEnvironmentError::NotFound)
+        ) || matches!(
+            cause.downcast_ref::<GenerationError<GitCommandProvider>>(),
+            Some(GenerationError::NotFound)
+        ) || matches!(
+            cause.downcast_ref::<GetFloxmetaError<GitCommandProvider>>(),
+            Some(GetFloxmetaError::NotFound(_))
+        ) {
+            return FloxExitCode::NotFound;
+        }
+        if cause.is::<reqwest::Error>() {
+            return FloxExitCode::Network;
+        }
+    }
+    FloxExitCode::Failure
+}
+
+/// Format `error` and its causes like the `Debug` output of [anyhow::Error]
+///
+/// [ExitCodeError]s are skipped, they display as the error they wrap,
+/// which follows them in the chain of causes.
+pub fn format_error(error: &anyhow::Error) -> String {
+    let mut chain = error
+        .chain()
+        .filter(|cause| !cause.is::<ExitCodeError>())
+        .map(ToString::to_string);
+    let mut message = chain.next().unwrap_or_default();
+    let causes: Vec<String> = chain.collect();
+    match causes.as_slice() {
+        [] => {},
+        [cause] => message.push_str(&format!("\n\nCaused by:\n    {cause}")),
+        causes => {
+            message.push_str("\n\nCaused by:");
+            for (n, cause) in causes.iter().enumerate() {
+                message.push_str(&format!("\n    {n}: {cause}"));
+            }
+        },
+    }
+    message
+}
+
+/// Messages of nix and git identifying a failure, the first match applies
+const NIX_ERRORS: &[(&str, FloxExitCode)] = &[
+    ("unable to download", FloxExitCode::Network),
+    ("Could not resolve host", FloxExitCode::Network),
+    ("Couldn't resolve host", FloxExitCode::Network),
+    ("Failed to connect to", FloxExitCode::Network),
+    ("Connection timed out", FloxExitCode::Network),
+    (
+        "Could not read from remote repository",
+        FloxExitCode::Network,
+    ),
+    ("does not provide attribute", FloxExitCode::NotFound),
+    ("couldn't find remote ref", FloxExitCode::NotFound),
+    ("collision between", FloxExitCode::Resolution),
+    ("cannot write modified lock file", FloxExitCode::Resolution),
+    ("Updates were rejected", FloxExitCode::Resolution),
+    ("non-fast-forward", FloxExitCode::Resolution),
+];
+
+/// Classify the errors of nix or git in `stderr`
+///
+/// nix, git and flox (sh) exit with 1 for most failures,
+/// their messages tell them apart.
+pub fn classify_nix_errors(stderr: &str) -> Option<FloxExitCode> {
+    NIX_ERRORS
+        .iter()
+        .find(|(message, _)| stderr.contains(message))
+        .map(|(_, code)| *code)
+}
+
+#[cfg(test)]
+mod tests {
+    use anyhow::{anyhow, Context};
+
+    use super::*;
+
+    #[test]
+    fn exit_code_of_errors() {
+        let cases: Vec<(anyhow::Error, FloxExitCode)> = vec![
+            (anyhow!("failed"), FloxExitCode::Failure),
+            (
+                ExitCodeError::new(FloxExitCode::Network, anyhow!("offline")).into(),
+                FloxExitCode::Network,
+            ),
+            (
+                Err::<(), _>(ExitCodeError::new(
+                    FloxExitCode::Resolution,
+                    anyhow!("rejected"),
+                ))
+                .context("Could not push")
+                .unwrap_err(),
+                FloxExitCode::Resolution,
+            ),
+            (
+                ExitCodeError::new(
+                    FloxExitCode::Usage,
+                    ExitCodeError::new(FloxExitCode::Network, anyhow!("offline")),
+                )
+                .into(),
+                FloxExitCode::Usage,
+            ),
+            (
+                GetEnvironmentError::<GitCommandProvider>::NotFound.into(),
+                FloxExitCode::NotFound,
+            ),
+            (
+                Err::<(), _>(GenerationError::<GitCommandProvider>::NotFound)
+                    .context("Could not switch generation")
+                    .unwrap_err(),
+                FloxExitCode::NotFound,
+            ),
+            (
+                GetFloxmetaError::<GitCommandProvider>::NotFound("flox".to_string()).into(),
+                FloxExitCode::NotFound,
+            ),
+        ];
+
+        for (error, code) in cases {
+            assert_eq!(exit_code(&error), code, "exit code of {error:?}");
+        }
+    }
+
+    #[test]
+    fn exit_code_error_source() {
+        let error: anyhow::Error = ExitCodeError::new(
+            FloxExitCode::Failure,
+            GetEnvironmentError::<GitCommandProvider>::NotFound,
+        )
+        .into();
+
+        assert!(error
+            .chain()
+            .any(|cause| cause.is::<GetEnvironmentError<GitCommandProvider>>()));
+        assert_eq!(exit_code(&error), FloxExitCode::Failure);
+    }
+
+    #[test]
+    fn format_errors() {
+        let error: anyhow::Error = ExitCodeError::new(
+            FloxExitCode::Network,
+            anyhow!("unable to download").context("Could not pull"),
+        )
+        .into();
+        assert_eq!(
+            format_error(&error),
+            "Could not pull\n\nCaused by:\n    unable to download"
+        );
+
+        let error = error.context("Could not activate");
+        assert_eq!(
+            format_error(&error),
+            "Could not activate\n\nCaused by:\n    0: Could not pull\n    1: unable to download"
+        );
+        assert_eq!(format_error(&anyhow!("failed")), "failed");
+    }
+
+    #[test]
+    fn classify_errors() {
+        let cases = [
+            (
+                "error: unable to download 'https://cache.nixos.org/nar/abc.nar.xz': \
+                 Couldn't resolve host name (6)",
+                Some(FloxExitCode::Network),
+            ),
+            (
+                "fatal: unable to access 'https://github.com/flox/floxmeta/': \
+                 Could not resolve host: github.com",
+                Some(FloxExitCode::Network),
+            ),
+            (
+                "curl: (7) Failed to connect to hub.flox.dev port 443",
+                Some(FloxExitCode::Network),
+            ),
+            (
+                "ssh: connect to host github.com port 22: Connection timed out",
+                Some(FloxExitCode::Network),
+            ),
+            (
+                "fatal: Could not read from remote repository.",
+                Some(FloxExitCode::Network),
+            ),
+            (
+                "error: flake 'flake:nixpkgs-flox' does not provide attribute 'packages.x86_64-linux.helo'",
+                Some(FloxExitCode::NotFound),
+            ),
+            (
+                "fatal: couldn't find remote ref floxmain",
+                Some(FloxExitCode::NotFound),
+            ),
+            (
+                "error: collision between `/nix/store/aaa-vim/bin/vi' and `/nix/store/bbb-busybox/bin/vi'",
+                Some(FloxExitCode::Resolution),
+            ),
+            (
+                "error: cannot write modified lock file of flake 'path:/tmp/env'",
+                Some(FloxExitCode::Resolution),
+            ),
+            (
+                "! [rejected] floxmain -> floxmain (non-fast-forward)\n\
+                 error: failed to push some refs\n\
+                 hint: Updates were rejected because the tip of your current branch is behind",
+                Some(FloxExitCode::Resolution),
+            ),
+            ("error: attribute 'hello' missing", None),
+            ("", None),
+        ];
+
+        for (stderr, code) in cases {
+            assert_eq!(
+                classify_nix_errors(stderr),
+                code,
+                "classification of {stderr:?}"
+            );
+        }
+    }
+}
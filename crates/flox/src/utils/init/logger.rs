@@ -1,8 +1,10 @@
+use std::sync::atomic::{AtomicBool, Ordering};
+
 use log::{debug, error};
 use once_cell::sync::OnceCell;
 use tracing_subscriber::prelude::*;
 
-use crate::commands::Verbosity;
+use crate::commands::{LogFormat, Verbosity};
 use crate::utils::logger::{self, LogFormatter};
 use crate::utils::metrics::PosthogLayer;
 use crate::utils::TERMINAL_STDERR;
@@ -47,9 +49,29 @@ static LOGGER_HANDLE: OnceCell<(
     >,
 )> = OnceCell::new();
 
-pub fn init_logger(verbosity: Option<Verbosity>, debug: Option<bool>) {
+/// Whether flox only reports warnings and errors, see [is_quiet]
+static QUIET: AtomicBool = AtomicBool::new(false);
+
+/// Whether flox runs with `--quiet` or `flox activate --quiet`
+///
+/// Besides the log level this hides the progress output of flox (sh).
+pub fn is_quiet() -> bool {
+    QUIET.load(Ordering::Relaxed)
+}
+
+pub fn init_logger(
+    verbosity: Option<Verbosity>,
+    debug: Option<bool>,
+    log_format: Option<LogFormat>,
+) {
     let verbosity = verbosity.unwrap_or_default();
     let debug = debug.unwrap_or(false);
+    let format = log_format.unwrap_or_default();
+
+    QUIET.store(
+        matches!((debug, &verbosity), (false, Verbosity::Quiet)),
+        Ordering::Relaxed,
+    );
 
     let log_filter = match (debug, verbosity) {
         // Show only errors
@@ -83,7 +105,7 @@ pub fn init_logger(verbosity: Option<Verbosity>, debug: Option<bool>) {
 
         let fmt = tracing_subscriber::fmt::layer()
             .with_writer(LockingTerminalStderr)
-            .event_format(logger::LogFormatter { debug });
+            .event_format(logger::LogFormatter { debug, format });
 
         let (fmt_reloadable, fmt_reload_handle) = tracing_subscriber::reload::Layer::new(fmt);
 
@@ -108,7 +130,27 @@ pub fn init_logger(verbosity: Option<Verbosity>, debug: Option<bool>) {
     if let Err(err) = fmt_handle.modify(|layer| {
         *layer = tracing_subscriber::fmt::layer()
             .with_writer(LockingTerminalStderr)
-            .event_format(logger::LogFormatter { debug });
+            .event_format(logger::LogFormatter { debug, format });
+    }) {
+        error!("Updating logger filter failed: {}", err);
+    }
+}
+
+/// Hide progress output for `flox activate --quiet`
+///
+/// Unlike the general `--quiet`, which only shows errors,
+/// warnings of the activation, e.g. about overridden variables, are still shown.
+pub fn init_quiet_progress() {
+    QUIET.store(true, Ordering::Relaxed);
+
+    let filter_handle = match LOGGER_HANDLE.get() {
+        Some((filter_handle, _)) => filter_handle,
+        None => return,
+    };
+    if let Err(err) = filter_handle.modify(|layer| {
+        *layer = tracing_subscriber::filter::EnvFilter::try_from_default_env()
+            .or_else(|_| tracing_subscriber::filter::EnvFilter::try_new("off,flox=warn"))
+            .unwrap();
     }) {
         error!("Updating logger filter failed: {}", err);
     }
@@ -21,6 +21,37 @@ mod channels;
 
 pub use channels::init_channels;
 
+/// Pass the network settings of flox to nix through `NIX_CONFIG`
+///
+/// Affects all nix invocations, including those of flox (sh).
+/// nix only retries transient errors, such as connection resets or
+/// 502, 503 and 504 responses, and never client errors.
+/// The settings are appended to a `NIX_CONFIG` set by the user.
+pub fn init_nix_network_config(connect_timeout: Option<u32>, max_retries: Option<u32>) {
+    let mut settings = Vec::new();
+    if let Some(connect_timeout) = connect_timeout {
+        settings.push(format!("connect-timeout = {connect_timeout}"));
+    }
+    if let Some(max_retries) = max_retries {
+        // nix counts the first attempt as well
+        settings.push(format!("download-attempts = {}", max_retries + 1));
+    }
+    if settings.is_empty() {
+        return;
+    }
+
+    let mut nix_config = env::var("NIX_CONFIG").unwrap_or_default();
+    for setting in settings {
+        if !nix_config.is_empty() {
+            nix_config.push('\n');
+        }
+        nix_config.push_str(&setting);
+    }
+
+    debug!("Setting NIX_CONFIG: {nix_config:?}");
+    env::set_var("NIX_CONFIG", nix_config);
+}
+
 pub fn init_access_tokens(
     config_tokens: &HashMap<String, String>,
 ) -> Result<Vec<(String, String)>> {
@@ -2,8 +2,15 @@ use std::borrow::Cow;
 use std::fmt::{self, Write};
 
 use crossterm::style::{Attribute, ContentStyle, Stylize};
+use once_cell::sync::Lazy;
+use regex::Regex;
+use serde_json::json;
+use time::format_description::well_known::Iso8601;
+use time::OffsetDateTime;
 
+use crate::commands::LogFormat;
 use crate::utils::colors;
+use crate::utils::init::is_quiet;
 
 #[derive(Default, Debug)]
 struct LogFields {
@@ -49,6 +56,7 @@ impl<'a> tracing::field::Visit for LoggerVisitor<'a> {
 
 pub struct LogFormatter {
     pub debug: bool,
+    pub format: LogFormat,
 }
 
 struct IndentWrapper<'a, 'b> {
@@ -98,6 +106,16 @@ where
             None => return Ok(()),
         };
 
+        // One unstyled object per line, `subsystem` is the target of the log,
+        // e.g. `flox::commands::environment` or `posix` for executed commands
+        if self.format == LogFormat::Json {
+            let timestamp = OffsetDateTime::now_utc()
+                .format(&Iso8601::DEFAULT)
+                .map_err(|_| fmt::Error)?;
+            let line = json_line(&timestamp, level, fields.target.as_deref(), &message);
+            return writeln!(f, "{line}");
+        }
+
         let is_posix = fields.target.iter().any(|x| x == "posix");
         let is_flox = fields
             .target
@@ -194,3 +212,75 @@ where
         Ok(())
     }
 }
+
+/// The object logged for `message` with `--log-format json`
+fn json_line(
+    timestamp: &str,
+    level: &tracing::Level,
+    target: Option<&str>,
+    message: &str,
+) -> serde_json::Value {
+    json!({
+        "timestamp": timestamp,
+        "level": level.to_string().to_lowercase(),
+        "subsystem": target,
+        "message": message,
+    })
+}
+
+/// Escape sequences styling the output of a terminal or moving its cursor
+static ANSI_ESCAPE: Lazy<Regex> =
+    Lazy::new(|| Regex::new(r"\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b[()][0-9A-Za-z]|\x1b[=>]").unwrap());
+
+/// Whether the stderr of subprocesses should be reduced to plain text
+///
+/// Spinners and styling of flox (sh) and nix are only useful on a terminal
+/// and are dropped if stderr is redirected, `NO_COLOR` is set or flox runs with `--quiet`.
+pub fn plain_stderr() -> bool {
+    is_quiet() || supports_color::on(supports_color::Stream::Stderr).is_none()
+}
+
+/// The plain text of a line written by a subprocess
+///
+/// Removes escape sequences and keeps only the last frame
+/// of a line that a spinner redraws with carriage returns.
+pub fn plain_line(line: &str) -> Cow<str> {
+    let line = line.trim_end_matches('\r');
+    let line = line.rsplit('\r').next().unwrap_or(line);
+    ANSI_ESCAPE.replace_all(line, "")
+}
+
+/// Whether `--quiet` shows a plain line written by a subprocess
+pub fn is_diagnostic(line: &str) -> bool {
+    let line = line.to_lowercase();
+    line.contains("error") || line.contains("warning")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn json_log_line() {
+        let line = json_line(
+            "2023-05-01T12:00:00.000000000Z",
+            &tracing::Level::WARN,
+            Some("flox::commands::environment"),
+            "Entrypoint 'hello' is not provided by the environment",
+        );
+        assert_eq!(
+            line,
+            json!({
+                "timestamp": "2023-05-01T12:00:00.000000000Z",
+                "level": "warn",
+                "subsystem": "flox::commands::environment",
+                "message": "Entrypoint 'hello' is not provided by the environment",
+            })
+        );
+        // one object per line
+        assert!(!line.to_string().contains('\n'));
+
+        let line = json_line("", &tracing::Level::DEBUG, None, "");
+        assert_eq!(line["subsystem"], serde_json::Value::Null);
+    }
+}
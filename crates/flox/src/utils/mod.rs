@@ -15,13 +15,17 @@ use itertools::Itertools;
 use log::{debug, error, warn};
 use once_cell::sync::Lazy;
 
+pub mod activations;
 pub mod colors;
 mod completion;
 pub mod dialog;
+pub mod errors;
 pub mod init;
 pub mod installables;
 pub mod logger;
 pub mod metrics;
+pub mod retry;
+pub mod shell;
 
 use regex::Regex;
 use tokio::sync::Mutex;
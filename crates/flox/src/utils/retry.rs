@@ -0,0 +1,112 @@
+//! Retries of network operations
+//!
+//! nix retries its own downloads, see `download-attempts` in nix.conf(5),
+//! git does not retry fetches and pushes of environments at all.
+//! Both are configured by `max_retries`.
+
+use std::future::Future;
+use std::time::Duration;
+
+/// Retries if `max_retries` is not configured,
+/// the same number of attempts as nix makes by default
+pub const DEFAULT_RETRIES: u32 = 4;
+
+/// Time to wait before the first retry, doubled for every further retry
+pub const RETRY_DELAY: Duration = Duration::from_secs(1);
+
+/// Run `operation` until `should_retry` rejects its result,
+/// at most `max_retries` times more than once
+///
+/// Waits `delay` before the first retry and twice as long before every following one.
+/// Returns the last result and the number of attempts made.
+pub async fn retry<R, Fut>(
+    max_retries: u32,
+    delay: Duration,
+    mut operation: impl FnMut() -> Fut,
+    should_retry: impl Fn(&R) -> bool,
+) -> (R, u32)
+where
+    Fut: Future<Output = R>,
+{
+    let mut attempts = 1;
+    let mut delay = delay;
+    loop {
+        let result = operation().await;
+        if attempts > max_retries || !should_retry(&result) {
+            return (result, attempts);
+        }
+
+        log::debug!("Attempt {attempts} failed, retrying in {delay:?}");
+        tokio::time::sleep(delay).await;
+        attempts += 1;
+        delay *= 2;
+    }
+}
+
+/// `after <attempts> attempts`, for error messages
+pub fn after_attempts(attempts: u32) -> String {
+    match attempts {
+        1 => "after 1 attempt".to_string(),
+        attempts => format!("after {attempts} attempts"),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::cell::Cell;
+
+    use super::*;
+
+    async fn attempts_until(succeeds_at: u32, max_retries: u32) -> (Result<u32, u32>, u32) {
+        let attempt = Cell::new(0);
+        retry(
+            max_retries,
+            Duration::ZERO,
+            || async {
+                attempt.set(attempt.get() + 1);
+                if attempt.get() >= succeeds_at {
+                    Ok(attempt.get())
+                } else {
+                    Err(attempt.get())
+                }
+            },
+            Result::is_err,
+        )
+        .await
+    }
+
+    #[tokio::test]
+    async fn retry_until_success() {
+        assert_eq!(attempts_until(1, 3).await, (Ok(1), 1));
+        assert_eq!(attempts_until(3, 3).await, (Ok(3), 3));
+        assert_eq!(attempts_until(4, 3).await, (Ok(4), 4));
+    }
+
+    #[tokio::test]
+    async fn retry_at_most_max_retries() {
+        assert_eq!(attempts_until(10, 3).await, (Err(4), 4));
+        assert_eq!(attempts_until(10, 0).await, (Err(1), 1));
+    }
+
+    #[tokio::test]
+    async fn retry_only_accepted_results() {
+        let attempt = Cell::new(0);
+        let result = retry(
+            3,
+            Duration::ZERO,
+            || async {
+                attempt.set(attempt.get() + 1);
+                Err::<(), _>("rejected")
+            },
+            |result| result != &Err("rejected"),
+        )
+        .await;
+        assert_eq!(result, (Err("rejected"), 1));
+    }
+
+    #[test]
+    fn attempts_in_messages() {
+        assert_eq!(after_attempts(1), "after 1 attempt");
+        assert_eq!(after_attempts(5), "after 5 attempts");
+    }
+}
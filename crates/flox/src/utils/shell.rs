@@ -0,0 +1,378 @@
+use std::collections::BTreeMap;
+use std::env;
+use std::fmt::Display;
+use std::path::{Path, PathBuf};
+use std::process::{ExitStatus, Stdio};
+use std::str::FromStr;
+
+use anyhow::{bail, Context, Result};
+use log::debug;
+use tokio::process::Command;
+
+/// Shells for which flox knows how to launch an interactive activation
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ShellKind {
+    Bash,
+    Zsh,
+    Fish,
+}
+
+impl ShellKind {
+    /// Statement exporting `name` set to `value`
+    pub fn export(&self, name: &str, value: &str) -> String {
+        let value = shell_escape::escape(value.into());
+        match self {
+            ShellKind::Bash | ShellKind::Zsh => format!("export {name}={value};"),
+            ShellKind::Fish => format!("set -gx {name} {value};"),
+        }
+    }
+
+    /// Statement prepending `dir` to the `PATH`-like variable `name`
+    pub fn prepend_path(&self, name: &str, dir: &Path) -> String {
+        let dir = shell_escape::escape(dir.to_string_lossy());
+        match self {
+            ShellKind::Bash | ShellKind::Zsh => {
+                format!("export {name}={dir}\"${{{name}:+:${name}}}\";")
+            },
+            ShellKind::Fish => format!("set -gx {name} {dir} ${name};"),
+        }
+    }
+
+    /// Statement sourcing `path` if it exists
+    pub fn source_if_exists(&self, path: &Path) -> String {
+        let path = shell_escape::escape(path.to_string_lossy());
+        match self {
+            ShellKind::Bash | ShellKind::Zsh => format!("[ -f {path} ] && . {path};"),
+            ShellKind::Fish => format!("test -f {path}; and source {path};"),
+        }
+    }
+
+    /// Statements sourcing `path` and removing it right away
+    pub fn source_and_remove(&self, path: &Path) -> String {
+        let path = shell_escape::escape(path.to_string_lossy());
+        match self {
+            ShellKind::Bash | ShellKind::Zsh => format!(". {path}; rm -f {path};"),
+            ShellKind::Fish => format!("source {path}; rm -f {path};"),
+        }
+    }
+
+    /// Statements sourcing and removing `path` before each prompt, if it exists
+    pub fn reload_before_prompt(&self, path: &Path) -> String {
+        let source = self.source_if_exists(path);
+        let path = shell_escape::escape(path.to_string_lossy());
+        match self {
+            ShellKind::Bash => format!(
+                "__flox_reload() {{ {source} rm -f {path}; }};\n\
+                 PROMPT_COMMAND=\"__flox_reload${{PROMPT_COMMAND:+;$PROMPT_COMMAND}}\";"
+            ),
+            ShellKind::Zsh => format!(
+                "__flox_reload() {{ {source} rm -f {path}; }};\n\
+                 precmd_functions=(__flox_reload $precmd_functions);"
+            ),
+            ShellKind::Fish => format!(
+                "function __flox_reload --on-event fish_prompt; {source} rm -f {path}; end;"
+            ),
+        }
+    }
+}
+
+impl FromStr for ShellKind {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "bash" => Ok(ShellKind::Bash),
+            "zsh" => Ok(ShellKind::Zsh),
+            "fish" => Ok(ShellKind::Fish),
+            _ => bail!("Unsupported shell: {s}, expected one of bash, zsh, fish"),
+        }
+    }
+}
+
+impl Display for ShellKind {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let name = match self {
+            ShellKind::Bash => "bash",
+            ShellKind::Zsh => "zsh",
+            ShellKind::Fish => "fish",
+        };
+        write!(f, "{name}")
+    }
+}
+
+/// The interactive shell of the user
+#[derive(Debug, Clone)]
+pub struct Shell {
+    pub kind: ShellKind,
+    pub exe: PathBuf,
+}
+
+impl Shell {
+    /// Detect the user's shell from `$SHELL`
+    pub fn detect() -> Result<Self> {
+        let shell = env::var("SHELL").context("Could not detect shell: `$SHELL` is not set")?;
+        Self::from_path(shell)
+    }
+
+    pub fn from_path(exe: impl Into<PathBuf>) -> Result<Self> {
+        let exe = exe.into();
+        let kind = match exe.file_name().and_then(|name| name.to_str()) {
+            Some(name) => name.parse()?,
+            None => bail!("Unsupported shell: {}", exe.display()),
+        };
+        Ok(Shell { kind, exe })
+    }
+
+    /// Launch an interactive shell that sources `activation_script`
+    ///
+    /// If `source_profile` is false, none of the user's own rc/profile files are sourced,
+    /// otherwise they are sourced before the activation script.
+    ///
+    /// `state_dir` is used to store the files the shell is pointed at
+    /// and must outlive the shell.
+    pub async fn spawn(
+        &self,
+        state_dir: &Path,
+        activation_script: &str,
+        source_profile: bool,
+    ) -> Result<ExitStatus> {
+        let mut command = self
+            .command(state_dir, activation_script, source_profile)
+            .await?;
+
+        let status = command
+            .spawn()
+            .with_context(|| format!("Failed to start {}", self.exe.display()))?
+            .wait()
+            .await
+            .with_context(|| format!("{} failed to run", self.exe.display()))?;
+
+        Ok(status)
+    }
+
+    /// The command launching the interactive shell of [Shell::spawn]
+    pub async fn command(
+        &self,
+        state_dir: &Path,
+        activation_script: &str,
+        source_profile: bool,
+    ) -> Result<Command> {
+        let home = dirs::home_dir().context("Could not find home directory")?;
+        let mut command = Command::new(&self.exe);
+
+        match self.kind {
+            // `--norc` would also skip the activation script,
+            // `--rcfile` replaces `~/.bashrc` with the script instead
+            ShellKind::Bash => {
+                let mut rcfile = String::new();
+                if source_profile {
+                    rcfile.push_str(&self.kind.source_if_exists(&home.join(".bashrc")));
+                    rcfile.push('\n');
+                }
+                rcfile.push_str(activation_script);
+
+                let script_path = state_dir.join("activate");
+                tokio::fs::write(&script_path, rcfile)
+                    .await
+                    .context("Could not write activation script")?;
+
+                command
+                    .arg("--noprofile")
+                    .arg("--rcfile")
+                    .arg(&script_path)
+                    .arg("-i");
+            },
+            // zsh reads its startup files from `$ZDOTDIR`,
+            // point it to a directory only containing the activation script
+            ShellKind::Zsh => {
+                let zdotdir = state_dir.join("zdotdir");
+                tokio::fs::create_dir_all(&zdotdir)
+                    .await
+                    .context("Could not create ZDOTDIR")?;
+
+                // restore the user's `$ZDOTDIR` before anything else runs
+                let user_zdotdir = env::var_os("ZDOTDIR").map(PathBuf::from);
+                let mut zshrc = match user_zdotdir {
+                    Some(ref dir) => self.kind.export("ZDOTDIR", &dir.to_string_lossy()),
+                    None => "unset ZDOTDIR;".to_string(),
+                };
+                zshrc.push('\n');
+                if source_profile {
+                    let user_zdotdir = user_zdotdir.unwrap_or(home);
+                    for file in [".zshenv", ".zshrc"] {
+                        zshrc.push_str(&self.kind.source_if_exists(&user_zdotdir.join(file)));
+                        zshrc.push('\n');
+                    }
+                }
+                zshrc.push_str(activation_script);
+                zshrc.push('\n');
+
+                tokio::fs::write(zdotdir.join(".zshrc"), zshrc)
+                    .await
+                    .context("Could not write zshrc")?;
+
+                command.env("ZDOTDIR", &zdotdir).arg("-i");
+            },
+            ShellKind::Fish => {
+                let script_path = state_dir.join("activate.fish");
+                tokio::fs::write(&script_path, activation_script)
+                    .await
+                    .context("Could not write activation script")?;
+
+                if !source_profile {
+                    command.arg("--no-config");
+                }
+                command
+                    .arg("--init-command")
+                    .arg(format!(
+                        "source {}",
+                        shell_escape::escape(script_path.to_string_lossy())
+                    ))
+                    .arg("--interactive");
+            },
+        }
+
+        debug!("Launching shell: {command:?}");
+
+        Ok(command)
+    }
+}
+
+/// The shell running activation scripts that are not sourced by an interactive shell
+const ACTIVATION_SHELL: &str = "bash";
+
+/// Run `command` with `args` after sourcing `activation_script` in bash
+///
+/// Activation scripts are written for [ShellKind::Bash], the profiles and hooks
+/// of environments may use bash syntax that a POSIX `sh` such as dash rejects.
+/// The command runs in `dir` if given, the script is sourced in the current directory.
+/// `args` are passed to the command verbatim.
+/// `state_dir` is used to store the script and must outlive the command.
+pub async fn run_with_script(
+    state_dir: &Path,
+    activation_script: &str,
+    dir: Option<&Path>,
+    command: &str,
+    args: &[String],
+) -> Result<ExitStatus> {
+    let script_path = state_dir.join("activate");
+    tokio::fs::write(&script_path, activation_script)
+        .await
+        .context("Could not write activation script")?;
+
+    let mut command_line = Command::new(ACTIVATION_SHELL);
+    command_line
+        .arg("-c")
+        .arg(". \"$0\" && cd \"$1\" && shift && exec \"$@\"")
+        .arg(&script_path)
+        .arg(dir.unwrap_or_else(|| Path::new(".")))
+        .arg(command)
+        .args(args);
+
+    debug!("Running command in activation: {command_line:?}");
+
+    let status = command_line
+        .spawn()
+        .with_context(|| format!("Failed to run {command}"))?
+        .wait()
+        .await
+        .with_context(|| format!("{command} failed to run"))?;
+
+    Ok(status)
+}
+
+/// The environment variables set after sourcing `activation_script` in bash
+///
+/// Like [run_with_script], the script is sourced by bash rather than a POSIX `sh`.
+/// Output of the script is redirected to stderr.
+/// `state_dir` is used to store the script.
+pub async fn activated_environment(
+    state_dir: &Path,
+    activation_script: &str,
+) -> Result<BTreeMap<String, String>> {
+    let script_path = state_dir.join("activate");
+    tokio::fs::write(&script_path, activation_script)
+        .await
+        .context("Could not write activation script")?;
+
+    let output = Command::new(ACTIVATION_SHELL)
+        .arg("-c")
+        .arg(". \"$0\" >&2 && exec env -0")
+        .arg(&script_path)
+        .stdin(Stdio::null())
+        .stderr(Stdio::inherit())
+        .output()
+        .await
+        .context("Failed to run activation script")?;
+
+    if !output.status.success() {
+        bail!("Activation script failed");
+    }
+
+    let variables = output
+        .stdout
+        .split(|byte| *byte == 0)
+        .filter_map(|entry| {
+            let entry = String::from_utf8_lossy(entry);
+            let (name, value) = entry.split_once('=')?;
+            Some((name.to_string(), value.to_string()))
+        })
+        .collect();
+
+    Ok(variables)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn run_command_with_arguments_verbatim() {
+        let state_dir = tempfile::tempdir().unwrap();
+        let output = state_dir.path().join("arguments");
+
+        // bash syntax is accepted by activation scripts
+        let script = "if [[ -n \"$BASH_VERSION\" ]]; then export ACTIVATED=1; fi;";
+        let status = run_with_script(
+            state_dir.path(),
+            script,
+            Some(state_dir.path()),
+            "sh",
+            &[
+                "-c",
+                "printf '%s\\n' \"$ACTIVATED\" \"$@\" > arguments; exit 3",
+                "tool",
+                "a b",
+                "c",
+                "$HOME",
+            ]
+            .map(String::from),
+        )
+        .await
+        .unwrap();
+
+        assert_eq!(status.code(), Some(3));
+        assert_eq!(
+            std::fs::read_to_string(output).unwrap(),
+            "1\na b\nc\n$HOME\n"
+        );
+    }
+
+    #[tokio::test]
+    async fn environment_of_activation() {
+        let state_dir = tempfile::tempdir().unwrap();
+
+        let script = "declare -a dirs=(a b); export FLOX_TEST_DIRS=\"${dirs[*]}\"; echo noise";
+        let variables = activated_environment(state_dir.path(), script)
+            .await
+            .unwrap();
+        assert_eq!(
+            variables.get("FLOX_TEST_DIRS").map(String::as_str),
+            Some("a b")
+        );
+
+        assert!(activated_environment(state_dir.path(), "false")
+            .await
+            .is_err());
+    }
+}